@@ -0,0 +1,27 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"eagain.net/go/securityblanket/internal/alert"
+	"eagain.net/go/securityblanket/internal/database"
+	"eagain.net/go/securityblanket/internal/honeywell5800/hw58tamper"
+)
+
+// acknowledgeTamper records that someone has seen a tamper event.
+func acknowledgeTamper(ctx context.Context, db *database.DB, conf *config) error {
+	if err := hw58tamper.Acknowledge(ctx, db, conf.AcknowledgeTamper, conf.AcknowledgedBy, time.Now()); err != nil {
+		return fmt.Errorf("tamper %d: %w", conf.AcknowledgeTamper, err)
+	}
+	return nil
+}
+
+// acknowledgeAlert records that someone has seen an alert.
+func acknowledgeAlert(ctx context.Context, db *database.DB, conf *config) error {
+	if err := alert.Acknowledge(ctx, db, conf.AcknowledgeAlert, conf.AcknowledgedBy, conf.Note, time.Now()); err != nil {
+		return fmt.Errorf("alert %d: %w", conf.AcknowledgeAlert, err)
+	}
+	return nil
+}
@@ -0,0 +1,19 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"eagain.net/go/securityblanket/internal/archive"
+	"eagain.net/go/securityblanket/internal/database"
+)
+
+// importArchive loads an archive, for looking into old events.
+func importArchive(ctx context.Context, db *database.DB, conf *config) error {
+	n, err := archive.Import(ctx, db, conf.ImportArchive)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("imported %d rows\n", n)
+	return nil
+}
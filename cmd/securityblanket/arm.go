@@ -0,0 +1,28 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"eagain.net/go/securityblanket/internal/arming"
+	"eagain.net/go/securityblanket/internal/database"
+)
+
+// arm changes the arming mode.
+func arm(ctx context.Context, db *database.DB, conf *config) error {
+	mode, err := arming.ModeString(conf.Arm)
+	if err != nil {
+		return fmt.Errorf("bad arming mode: %q", conf.Arm)
+	}
+	change := &arming.Change{
+		Time:      time.Now(),
+		Mode:      mode,
+		ChangedBy: conf.ArmedBy,
+		Via:       "cli",
+	}
+	if err := arming.Set(ctx, db, change); err != nil {
+		return fmt.Errorf("arming: %w", err)
+	}
+	return nil
+}
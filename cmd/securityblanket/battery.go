@@ -0,0 +1,46 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"eagain.net/go/securityblanket/internal/database"
+	"eagain.net/go/securityblanket/internal/honeywell5800"
+	"eagain.net/go/securityblanket/internal/honeywell5800/hw58battery"
+)
+
+// batteriesDue prints the sensors that will probably need a new
+// battery within the requested number of weeks.
+func batteriesDue(ctx context.Context, db *database.DB, conf *config) error {
+	now := time.Now()
+	within := time.Duration(conf.BatteriesDue) * 7 * 24 * time.Hour
+	dues, err := hw58battery.Forecast(ctx, db, now, within)
+	if err != nil {
+		return fmt.Errorf("battery forecast: %w", err)
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(w, "SENSOR\tMODEL\tDESCRIPTION\tINSTALLED\tDUE\n")
+	for _, d := range dues {
+		due := d.Expected.Format("2006-01-02")
+		if d.Low {
+			due = "low since " + due
+		}
+		fmt.Fprintf(w, "%v\t%s\t%s\t%s\t%s\n",
+			d.Sensor, d.Model, d.Description,
+			d.Installed.Format("2006-01-02"), due,
+		)
+	}
+	return w.Flush()
+}
+
+// batteryReplaced records a battery replaced by hand.
+func batteryReplaced(ctx context.Context, db *database.DB, conf *config) error {
+	sensor := honeywell5800.Sensor(conf.BatteryReplaced)
+	if err := hw58battery.Replace(ctx, db, sensor, time.Now(), conf.BatteryNote); err != nil {
+		return fmt.Errorf("battery replacement: %w", err)
+	}
+	return nil
+}
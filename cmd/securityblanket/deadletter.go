@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"eagain.net/go/securityblanket/internal/catchup"
+	"eagain.net/go/securityblanket/internal/database"
+)
+
+// deadLetters prints the rows that consumers have failed to process.
+func deadLetters(ctx context.Context, db *database.DB) error {
+	list, err := catchup.DeadLetters(ctx, db)
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(w, "ID\tCONSUMER\tSOURCE\tATTEMPTS\tLAST FAILED\tSTATE\tERROR\n")
+	for _, d := range list {
+		state := "failing"
+		switch {
+		case d.Retry:
+			state = "retry"
+		case !d.Skipped.IsZero():
+			state = "skipped"
+		}
+		fmt.Fprintf(w, "%d\t%s\t%d\t%d\t%s\t%s\t%s\n",
+			d.ID, d.Consumer, d.Source, d.Attempts,
+			d.LastFailed.Local().Format(time.RFC3339), state, d.Error,
+		)
+	}
+	return w.Flush()
+}
+
+// retryDeadLetter asks for a skipped row to be processed again.
+func retryDeadLetter(ctx context.Context, db *database.DB, conf *config) error {
+	if err := catchup.Retry(ctx, db, conf.RetryDeadLetter); err != nil {
+		return fmt.Errorf("dead letter %d: %w", conf.RetryDeadLetter, err)
+	}
+	return nil
+}
+
+// discardDeadLetter forgets about a row that failed to process.
+func discardDeadLetter(ctx context.Context, db *database.DB, conf *config) error {
+	if err := catchup.Discard(ctx, db, conf.DiscardDeadLetter); err != nil {
+		return fmt.Errorf("dead letter %d: %w", conf.DiscardDeadLetter, err)
+	}
+	return nil
+}
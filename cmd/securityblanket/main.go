@@ -5,15 +5,37 @@ import (
 	"flag"
 	"fmt"
 	"log"
+	"net/http"
+	"net/url"
 	"os"
+	"time"
 
 	"crawshaw.io/sqlite"
+	"eagain.net/go/securityblanket/internal/alert"
+	"eagain.net/go/securityblanket/internal/arming"
 	"eagain.net/go/securityblanket/internal/database"
+	"eagain.net/go/securityblanket/internal/downtime"
+	"eagain.net/go/securityblanket/internal/escalate"
+	"eagain.net/go/securityblanket/internal/homeassistant"
+	"eagain.net/go/securityblanket/internal/honeywell5800/hw58battery"
+	"eagain.net/go/securityblanket/internal/honeywell5800/hw58demod"
+	"eagain.net/go/securityblanket/internal/honeywell5800/hw58metrics"
 	"eagain.net/go/securityblanket/internal/honeywell5800/hw58receive"
+	"eagain.net/go/securityblanket/internal/honeywell5800/hw58signal"
+	"eagain.net/go/securityblanket/internal/honeywell5800/hw58supervise"
+	"eagain.net/go/securityblanket/internal/honeywell5800/hw58tamper"
 	"eagain.net/go/securityblanket/internal/honeywell5800/hw58trip"
+	"eagain.net/go/securityblanket/internal/metrics"
+	"eagain.net/go/securityblanket/internal/notify"
+	"eagain.net/go/securityblanket/internal/output"
+	"eagain.net/go/securityblanket/internal/pipeline"
+	"eagain.net/go/securityblanket/internal/retention"
+	"eagain.net/go/securityblanket/internal/rfjam"
 	"eagain.net/go/securityblanket/internal/rtl433receive"
 	"eagain.net/go/securityblanket/internal/rtl433sql"
 	"eagain.net/go/securityblanket/internal/runner"
+	"eagain.net/go/securityblanket/internal/siteconf"
+	"eagain.net/go/securityblanket/internal/webpush"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
 	"golang.org/x/sync/errgroup"
@@ -39,8 +61,100 @@ func newZap() (*zap.Logger, error) {
 }
 
 type config struct {
-	DBPath    string
-	SDRDevice string
+	DBPath        string
+	ConfigPath    string
+	SDRDevice     string
+	Source        string
+	FailureBudget int
+
+	Replay           string
+	ReplayRealTime   bool
+	ReplayTimestamps bool
+
+	BatteriesDue    int
+	BatteryReplaced uint
+	BatteryNote     string
+
+	AcknowledgeTamper int64
+	AcknowledgedBy    string
+
+	Arm     string
+	ArmedBy string
+
+	AcknowledgeAlert int64
+	Note             string
+
+	DeadLetters       bool
+	RetryDeadLetter   int64
+	DiscardDeadLetter int64
+
+	Vacuum        bool
+	ImportArchive string
+
+	Pipeline    bool
+	Rewind      string
+	RewindTo    int64
+	RewindSince string
+	RewindClear bool
+
+	Listen string
+}
+
+// siteConfig returns the configuration file, or a single receiver as
+// described by command line flags.
+func siteConfig(conf *config) (*siteconf.Config, error) {
+	if conf.ConfigPath != "" {
+		return siteconf.Load(conf.ConfigPath)
+	}
+	r := siteconf.Receiver{
+		Label:     "default",
+		Source:    conf.Source,
+		Device:    conf.SDRDevice,
+		Frequency: 344975000,
+	}
+	c := &siteconf.Config{
+		Receivers: []siteconf.Receiver{r},
+	}
+	return c, nil
+}
+
+// receive runs the rtl_433 input for one receiver until it fails or
+// ctx is canceled.
+func receive(ctx context.Context, log *zap.Logger, conf *config, receiver *siteconf.Receiver, store *rtl433sql.SQLStore) error {
+	opts := []rtl433receive.Option{
+		rtl433receive.Restarts(store),
+		rtl433receive.FailureBudget(conf.FailureBudget),
+	}
+	if receiver.Source == "" {
+		return rtl433receive.Supervise(ctx, log, receiver.Radio(), store, opts...)
+	}
+	u, err := url.Parse(receiver.Source)
+	if err != nil {
+		return fmt.Errorf("bad rtl_433 source: %w", err)
+	}
+	switch u.Scheme {
+	case "syslog":
+		return rtl433receive.ReceiveSyslog(ctx, log, u.Host, store)
+	case "mqtt":
+		return rtl433receive.ReceiveMQTT(ctx, log, receiver.Source, store, opts...)
+	case "http", "https":
+		return rtl433receive.ReceiveHTTP(ctx, log, receiver.Source, store, opts...)
+	case "rtl_tcp":
+		return rtl433receive.ReceiveRTLTCP(ctx, log, u.Host, receiver.Radio(), store, opts...)
+	case "file":
+		format, err := hw58demod.FormatFromName(u.Path)
+		if err != nil {
+			return err
+		}
+		f, err := os.Open(u.Path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		return rtl433receive.ReceiveIQ(ctx, log, f, format, receiver.SampleRate, store)
+	default:
+		return fmt.Errorf("bad rtl_433 source: unsupported scheme: %q", u.Scheme)
+	}
 }
 
 func run(conf *config) error {
@@ -48,6 +162,11 @@ func run(conf *config) error {
 	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
 
+	site, err := siteConfig(conf)
+	if err != nil {
+		return fmt.Errorf("error loading configuration: %w", err)
+	}
+
 	log, err := newZap()
 	if err != nil {
 		return fmt.Errorf("error configuring logging: %w", err)
@@ -86,32 +205,226 @@ func run(conf *config) error {
 	}
 	defer db.Close()
 
+	if conf.Replay != "" {
+		return replay(ctx, log, db, conf)
+	}
+	if conf.BatteriesDue > 0 {
+		return batteriesDue(ctx, db, conf)
+	}
+	if conf.BatteryReplaced != 0 {
+		return batteryReplaced(ctx, db, conf)
+	}
+	if conf.AcknowledgeTamper != 0 {
+		return acknowledgeTamper(ctx, db, conf)
+	}
+	if conf.Arm != "" {
+		return arm(ctx, db, conf)
+	}
+	if conf.AcknowledgeAlert != 0 {
+		return acknowledgeAlert(ctx, db, conf)
+	}
+	if conf.DeadLetters {
+		return deadLetters(ctx, db)
+	}
+	if conf.RetryDeadLetter != 0 {
+		return retryDeadLetter(ctx, db, conf)
+	}
+	if conf.DiscardDeadLetter != 0 {
+		return discardDeadLetter(ctx, db, conf)
+	}
+	if conf.Vacuum {
+		return retention.EnableIncrementalVacuum(ctx, db)
+	}
+	if conf.ImportArchive != "" {
+		return importArchive(ctx, db, conf)
+	}
+	if conf.Pipeline {
+		return printPipeline(ctx, db)
+	}
+	if conf.Rewind != "" {
+		return rewind(ctx, db, conf)
+	}
+
 	g, ctx := errgroup.WithContext(ctx)
 
+	// Runners are created downstream first, so everyone has subscribed
+	// before anything upstream of them runs.
+	pipe := pipeline.NewRegistry()
+
+	// supervision does not count the time the daemon was not running
+	started := time.Now()
+	downtimeRecorder := downtime.NewRecorder(ctx, db, started)
+	downtimeRunnerLog := log.Named("downtime.runner")
+	downtimeRunner := runner.New(ctx, downtimeRecorder.Run, downtimeRunnerLog, runner.Name("downtime"))
+	g.Go(downtimeRunner.Loop)
+	g.Go(func() error { return downtimeRunner.Tick(time.Minute) })
+
+	if conf.Listen != "" {
+		mux := http.NewServeMux()
+		var webpushOpts []webpush.HandlerOption
+		if site.Subscriptions != nil {
+			webpushOpts = site.Subscriptions.Options()
+		}
+		mux.Handle("/webpush/", http.StripPrefix("/webpush", webpush.Handler(db, log.Named("webpush"), webpushOpts...)))
+		metrics.Default.Collect(hw58metrics.New(db).Collect)
+		mux.Handle("/metrics", metrics.Handler(metrics.Default, log.Named("metrics")))
+		httpLog := log.Named("http")
+		g.Go(func() error { return serveHTTP(ctx, httpLog, conf.Listen, mux) })
+	}
+
+	notifyLog := log.Named("notify")
+	notifyDeliverer := notify.New(ctx, db, notifyLog, site.Channels(db, notifyLog))
+	notifyRunnerLog := log.Named("notify.runner")
+	notifyRunner := runner.New(ctx, notifyDeliverer.Run, notifyRunnerLog, runner.Name("notify"))
+	pipe.Subscribe(notifyRunner.Wakeup, "notify_outbox")
+	g.Go(notifyRunner.Loop)
+	// retries and rate limits look at the clock
+	g.Go(func() error { return notifyRunner.Tick(time.Second) })
+
+	escalateLog := log.Named("escalate")
+	escalator := escalate.New(ctx, db, escalateLog,
+		site.EscalationPolicies(),
+		site.EscalationRecipients(),
+		escalate.Rotations(site.EscalationRotations()...),
+		escalate.Wakeup(pipe.Wakeup("escalate")),
+	)
+	escalateRunnerLog := log.Named("escalate.runner")
+	escalateRunner := runner.New(ctx, escalator.Run, escalateRunnerLog, runner.Name("escalate"))
+	pipe.Register(escalateRunner.Wakeup, "escalate")
+	g.Go(escalateRunner.Loop)
+	// escalation steps become due as time passes
+	g.Go(func() error { return escalateRunner.Tick(time.Second) })
+
+	if site.HomeAssistant != nil {
+		hassLog := log.Named("homeassistant")
+		hass := homeassistant.New(ctx, db, hassLog, site.HomeAssistant.Config())
+		defer hass.Close()
+		hassRunnerLog := log.Named("homeassistant.runner")
+		hassRunner := runner.New(ctx, hass.Run, hassRunnerLog, runner.Name("homeassistant"))
+		pipe.Subscribe(hassRunner.Wakeup, "honeywell5800_updates", "alerts")
+		g.Go(hassRunner.Loop)
+		// reconnects, commands and arming changes by other processes
+		g.Go(func() error { return hassRunner.Tick(time.Second) })
+	}
+
+	alertLog := log.Named("alert")
+	alertEngine := alert.New(ctx, db, alertLog,
+		alert.Channels(site.BroadcastChannels()...),
+		alert.Wakeup(pipe.Wakeup("alert.trip", "alert.tamper", "alert.supervision", "alert.jamming")),
+	)
+	alertRunnerLog := log.Named("alert.runner")
+	alertRunner := runner.New(ctx, alertEngine.Run, alertRunnerLog, runner.Name("alert"))
+	pipe.Register(alertRunner.Wakeup, "alert.trip", "alert.tamper", "alert.supervision", "alert.jamming")
+	// low batteries are alerted on without catchup
+	pipe.Subscribe(alertRunner.Wakeup, "honeywell5800_batteries")
+	g.Go(alertRunner.Loop)
+	// trip alerts settle by looking at the clock
+	g.Go(func() error { return alertRunner.Tick(time.Minute) })
+
+	outputLog := log.Named("output")
+	outputController := output.New(ctx, db, outputLog, site.OutputDevices())
+	outputRunnerLog := log.Named("output.runner")
+	outputRunner := runner.New(ctx, outputController.Run, outputRunnerLog, runner.Name("output"))
+	pipe.Register(outputRunner.Wakeup, "output", "output.escalate")
+	g.Go(outputRunner.Loop)
+	// patterns play out, and disarming stops them, as time passes
+	g.Go(func() error { return outputRunner.Tick(100 * time.Millisecond) })
+
+	armingLog := log.Named("arming")
+	armingClassifier := arming.New(ctx, db, armingLog,
+		arming.Wakeup(pipe.Wakeup("arming.classify")),
+	)
+	armingRunnerLog := log.Named("arming.runner")
+	armingRunner := runner.New(ctx, armingClassifier.Run, armingRunnerLog, runner.Name("arming"))
+	pipe.Register(armingRunner.Wakeup, "arming.classify")
+	g.Go(armingRunner.Loop)
+	// entry delays run out by looking at the clock
+	g.Go(func() error { return armingRunner.Tick(time.Second) })
+
 	hw58TripLog := log.Named("honeywell5800.trip")
-	hw58Trip := hw58trip.New(ctx, db, hw58TripLog)
+	hw58Trip := hw58trip.New(ctx, db, hw58TripLog,
+		hw58trip.Wakeup(pipe.Wakeup("honeywell5800.trip")),
+	)
 	hw58TripRunnerLog := log.Named("honeywell5800.trip.runner")
-	hw58TripRunner := runner.New(ctx, hw58Trip.Run, hw58TripRunnerLog)
+	hw58TripRunner := runner.New(ctx, hw58Trip.Run, hw58TripRunnerLog, runner.Name("honeywell5800.trip"))
+	pipe.Register(hw58TripRunner.Wakeup, "honeywell5800.trip")
 	g.Go(hw58TripRunner.Loop)
 
+	hw58SignalLog := log.Named("honeywell5800.signal")
+	hw58Signal := hw58signal.New(ctx, db, hw58SignalLog)
+	hw58SignalRunnerLog := log.Named("honeywell5800.signal.runner")
+	hw58SignalRunner := runner.New(ctx, hw58Signal.Run, hw58SignalRunnerLog, runner.Name("honeywell5800.signal"))
+	pipe.Register(hw58SignalRunner.Wakeup, "honeywell5800.signal")
+	g.Go(hw58SignalRunner.Loop)
+
+	hw58SuperviseLog := log.Named("honeywell5800.supervise")
+	hw58Supervise := hw58supervise.New(ctx, db, hw58SuperviseLog,
+		hw58supervise.Wakeup(pipe.Wakeup("honeywell5800.supervise")),
+		hw58supervise.Started(started),
+	)
+	hw58SuperviseRunnerLog := log.Named("honeywell5800.supervise.runner")
+	hw58SuperviseRunner := runner.New(ctx, hw58Supervise.Run, hw58SuperviseRunnerLog, runner.Name("honeywell5800.supervise"))
+	pipe.Register(hw58SuperviseRunner.Wakeup, "honeywell5800.supervise")
+	g.Go(hw58SuperviseRunner.Loop)
+	// losses are only noticed by looking at the clock
+	g.Go(func() error { return hw58SuperviseRunner.Tick(time.Minute) })
+
+	hw58BatteryLog := log.Named("honeywell5800.battery")
+	hw58Battery := hw58battery.New(ctx, db, hw58BatteryLog,
+		hw58battery.Wakeup(pipe.Wakeup("honeywell5800.battery")),
+	)
+	hw58BatteryRunnerLog := log.Named("honeywell5800.battery.runner")
+	hw58BatteryRunner := runner.New(ctx, hw58Battery.Run, hw58BatteryRunnerLog, runner.Name("honeywell5800.battery"))
+	pipe.Register(hw58BatteryRunner.Wakeup, "honeywell5800.battery")
+	g.Go(hw58BatteryRunner.Loop)
+
+	hw58TamperLog := log.Named("honeywell5800.tamper")
+	hw58Tamper := hw58tamper.New(ctx, db, hw58TamperLog,
+		hw58tamper.Wakeup(pipe.Wakeup("honeywell5800.tamper")),
+	)
+	hw58TamperRunnerLog := log.Named("honeywell5800.tamper.runner")
+	hw58TamperRunner := runner.New(ctx, hw58Tamper.Run, hw58TamperRunnerLog, runner.Name("honeywell5800.tamper"))
+	pipe.Register(hw58TamperRunner.Wakeup, "honeywell5800.tamper")
+	g.Go(hw58TamperRunner.Loop)
+
 	hw58RecvLog := log.Named("honeywell5800.receive")
-	hw58Recv := hw58receive.New(ctx, db, hw58RecvLog, hw58TripRunner.Wakeup)
+	hw58Recv := hw58receive.New(ctx, db, hw58RecvLog, pipe.Wakeup("honeywell5800.receive"))
 	hw58RecvRunnerLog := log.Named("honeywell5800.receive.runner")
-	hw58RecvRunner := runner.New(ctx, hw58Recv.Run, hw58RecvRunnerLog)
+	hw58RecvRunner := runner.New(ctx, hw58Recv.Run, hw58RecvRunnerLog, runner.Name("honeywell5800.receive"))
+	pipe.Register(hw58RecvRunner.Wakeup, "honeywell5800.receive")
 	g.Go(hw58RecvRunner.Loop)
 
-	rtl433store := rtl433sql.New(db, 345,
-		rtl433sql.Wakeup(hw58RecvRunner.Wakeup),
-	)
-	g.Go(func() error {
-		return rtl433receive.Receive(
-			ctx,
-			log.Named("rtl433.receive"),
-			conf.SDRDevice,
-			344975000,
-			rtl433store,
+	rfjamLog := log.Named("rfjam")
+	rfjamOpts := append(site.Jamming.Options(), rfjam.Wakeup(pipe.Wakeup("rfjam.noise")), rfjam.Started(started))
+	rfjamDetector := rfjam.New(ctx, db, rfjamLog, rfjamOpts...)
+	rfjamRunnerLog := log.Named("rfjam.runner")
+	rfjamRunner := runner.New(ctx, rfjamDetector.Run, rfjamRunnerLog, runner.Name("rfjam"))
+	pipe.Register(rfjamRunner.Wakeup, "rfjam.noise")
+	g.Go(rfjamRunner.Loop)
+	// silence is only noticed by looking at the clock
+	g.Go(func() error { return rfjamRunner.Tick(time.Minute) })
+
+	if policies := site.RetentionPolicies(); len(policies) > 0 {
+		retentionLog := log.Named("retention")
+		pruner := retention.New(ctx, db, retentionLog, policies)
+		retentionRunnerLog := log.Named("retention.runner")
+		retentionRunner := runner.New(ctx, pruner.Run, retentionRunnerLog, runner.Name("retention"))
+		g.Go(retentionRunner.Loop)
+		g.Go(func() error { return retentionRunner.Tick(time.Hour) })
+	}
+
+	rawWakeup := pipe.Added("rtl433_raw")
+	for i := range site.Receivers {
+		receiver := &site.Receivers[i]
+		store := rtl433sql.New(db, receiver.FreqMHz(),
+			rtl433sql.Receiver(receiver.Label),
+			rtl433sql.Wakeup(rawWakeup),
 		)
-	})
+		recvLog := log.Named("rtl433.receive").With(zap.String("receiver", receiver.Label))
+		g.Go(func() error {
+			return receive(ctx, recvLog, conf, receiver, store)
+		})
+	}
 
 	return g.Wait()
 }
@@ -129,9 +442,87 @@ func usage() {
 
 func main() {
 	conf := &config{}
+	flag.StringVar(&conf.ConfigPath, "config", "",
+		"Read receiver configuration from JSON `FILE`. Overrides -sdr-device and -rtl433-source.",
+	)
 	flag.StringVar(&conf.SDRDevice, "sdr-device", "",
 		"SDR device to listen to. USB device index or colon and serial number.",
 	)
+	flag.StringVar(&conf.Source, "rtl433-source", "",
+		"Receive from a networked rtl_433 instead of running it locally: syslog://[HOST]:PORT, mqtt://[USER:PASS@]HOST[:PORT][/TOPIC] or http://HOST:PORT/events. Decode raw IQ samples without rtl_433 from rtl_tcp://HOST:PORT or file:///PATH.cu8.",
+	)
+	flag.IntVar(&conf.FailureBudget, "rtl433-failure-budget", 10,
+		"Give up after rtl_433 fails this many times in a row. 0 means retry forever.",
+	)
+	flag.StringVar(&conf.Replay, "replay", "",
+		"Process recorded rtl_433 JSON output from `FILE` instead of a radio, and exit. Use - for stdin.",
+	)
+	flag.BoolVar(&conf.ReplayRealTime, "replay-realtime", false,
+		"Pace replay according to recorded timestamps.",
+	)
+	flag.BoolVar(&conf.ReplayTimestamps, "replay-timestamps", false,
+		"Use recorded timestamps for replayed messages, instead of current time.",
+	)
+	flag.IntVar(&conf.BatteriesDue, "batteries-due", 0,
+		"List sensors that will probably need a new battery within `WEEKS`, and exit.",
+	)
+	flag.UintVar(&conf.BatteryReplaced, "battery-replaced", 0,
+		"Record that the battery of `SENSOR` was replaced by hand, and exit.",
+	)
+	flag.StringVar(&conf.BatteryNote, "battery-note", "",
+		"Note to store with -battery-replaced.",
+	)
+	flag.Int64Var(&conf.AcknowledgeTamper, "acknowledge-tamper", 0,
+		"Acknowledge the tamper event with `ID`, and exit. Requires -acknowledged-by.",
+	)
+	flag.StringVar(&conf.AcknowledgedBy, "acknowledged-by", "",
+		"`NAME` of the person acknowledging.",
+	)
+	flag.StringVar(&conf.Arm, "arm", "",
+		"Change the arming mode to `MODE`: disarmed, home, away or night, and exit. Requires -armed-by.",
+	)
+	flag.StringVar(&conf.ArmedBy, "armed-by", "",
+		"`NAME` of the person changing the arming mode.",
+	)
+	flag.Int64Var(&conf.AcknowledgeAlert, "acknowledge-alert", 0,
+		"Acknowledge the alert with `ID`, and exit. Requires -acknowledged-by.",
+	)
+	flag.StringVar(&conf.Note, "note", "",
+		"Note to store with -acknowledge-alert.",
+	)
+	flag.BoolVar(&conf.DeadLetters, "dead-letters", false,
+		"List input that failed to process, and exit.",
+	)
+	flag.Int64Var(&conf.RetryDeadLetter, "retry-dead-letter", 0,
+		"Process the skipped input of dead letter `ID` again when the daemon next gets to it, and exit.",
+	)
+	flag.Int64Var(&conf.DiscardDeadLetter, "discard-dead-letter", 0,
+		"Forget about dead letter `ID`, and exit.",
+	)
+	flag.BoolVar(&conf.Vacuum, "vacuum", false,
+		"Compact the database and switch it to incremental vacuum, so space freed by retention is returned to the filesystem, and exit. Stop the daemon first.",
+	)
+	flag.StringVar(&conf.ImportArchive, "import-archive", "",
+		"Load rows archived by retention in `DIR` into the database, and exit. Use a new database, not the one the daemon uses.",
+	)
+	flag.BoolVar(&conf.Pipeline, "pipeline", false,
+		"List the consumers of the processing pipeline, which consumers each one feeds, and how far behind they are, and exit.",
+	)
+	flag.StringVar(&conf.Rewind, "rewind", "",
+		"Make the `CONSUMER`, such as honeywell5800.trip, and everything downstream of it process their input again, and exit. Requires -rewind-to or -rewind-since. Stop the daemon first.",
+	)
+	flag.Int64Var(&conf.RewindTo, "rewind-to", -1,
+		"Process input after `ID` again, with -rewind.",
+	)
+	flag.StringVar(&conf.RewindSince, "rewind-since", "",
+		"Process input from `TIME` on again, with -rewind. RFC 3339, like 2020-02-12T12:00:00-07:00.",
+	)
+	flag.BoolVar(&conf.RewindClear, "rewind-clear", false,
+		"With -rewind, delete what was derived from the input being processed again, such as trips.",
+	)
+	flag.StringVar(&conf.Listen, "listen", "",
+		"Serve HTTP on `ADDR`, for Web Push subscriptions and Prometheus metrics. Changing subscriptions needs the bearer token from the site configuration; /metrics and /webpush/key are served to anyone, so only listen on a trusted network.",
+	)
 	flag.Usage = usage
 	flag.Parse()
 
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"eagain.net/go/securityblanket/internal/database"
+	"eagain.net/go/securityblanket/internal/pipeline"
+)
+
+// printPipeline prints the consumers, what they read and feed, and how
+// far behind they are.
+func printPipeline(ctx context.Context, db *database.DB) error {
+	graph, err := pipeline.Graph(ctx, db)
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(w, "CONSUMER\tSOURCE\tLAST\tMAX\tLAG\tFEEDS\n")
+	for _, s := range graph {
+		feeds := strings.Join(s.Readers, ",")
+		if feeds == "" {
+			feeds = "-"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%d\t%d\t%d\t%s\n",
+			s.Name, s.Source, s.Last, s.Max, s.Lag(), feeds,
+		)
+	}
+	return w.Flush()
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"eagain.net/go/securityblanket/internal/alert"
+	"eagain.net/go/securityblanket/internal/arming"
+	"eagain.net/go/securityblanket/internal/database"
+	"eagain.net/go/securityblanket/internal/honeywell5800/hw58battery"
+	"eagain.net/go/securityblanket/internal/honeywell5800/hw58receive"
+	"eagain.net/go/securityblanket/internal/honeywell5800/hw58signal"
+	"eagain.net/go/securityblanket/internal/honeywell5800/hw58tamper"
+	"eagain.net/go/securityblanket/internal/honeywell5800/hw58trip"
+	"eagain.net/go/securityblanket/internal/rtl433receive"
+	"eagain.net/go/securityblanket/internal/rtl433sql"
+	"go.uber.org/zap"
+)
+
+// processingStore runs the rest of the pipeline synchronously after
+// every message, for real-time replays.
+type processingStore struct {
+	*rtl433sql.SQLStore
+	process func() error
+}
+
+func (p processingStore) Store(ctx context.Context, data []byte) error {
+	if err := p.SQLStore.Store(ctx, data); err != nil {
+		return err
+	}
+	return p.process()
+}
+
+func (p processingStore) StoreTime(ctx context.Context, t time.Time, data []byte) error {
+	if err := p.SQLStore.StoreTime(ctx, t, data); err != nil {
+		return err
+	}
+	return p.process()
+}
+
+// replay feeds recorded rtl_433 output through the pipeline, and
+// returns once everything has been processed.
+func replay(ctx context.Context, log *zap.Logger, db *database.DB, conf *config) error {
+	var input io.Reader = os.Stdin
+	if conf.Replay != "-" {
+		f, err := os.Open(conf.Replay)
+		if err != nil {
+			return fmt.Errorf("replay: %w", err)
+		}
+		defer f.Close()
+		input = f
+	}
+
+	nop := func() {}
+	hw58Trip := hw58trip.New(ctx, db, log.Named("honeywell5800.trip"))
+	armingClassifier := arming.New(ctx, db, log.Named("arming"))
+	// replayed alerts are not queued for notification
+	alertEngine := alert.New(ctx, db, log.Named("alert"))
+	hw58Signal := hw58signal.New(ctx, db, log.Named("honeywell5800.signal"))
+	hw58Battery := hw58battery.New(ctx, db, log.Named("honeywell5800.battery"))
+	hw58Tamper := hw58tamper.New(ctx, db, log.Named("honeywell5800.tamper"))
+	hw58Recv := hw58receive.New(ctx, db, log.Named("honeywell5800.receive"), nop)
+	process := func() error {
+		if err := hw58Recv.Run(); err != nil {
+			return err
+		}
+		if err := hw58Signal.Run(); err != nil {
+			return err
+		}
+		if err := hw58Battery.Run(); err != nil {
+			return err
+		}
+		if err := hw58Tamper.Run(); err != nil {
+			return err
+		}
+		if err := hw58Trip.Run(); err != nil {
+			return err
+		}
+		if err := armingClassifier.Run(); err != nil {
+			return err
+		}
+		return alertEngine.Run()
+	}
+
+	var store rtl433receive.TimeStore = rtl433sql.New(db, 345, rtl433sql.Receiver("replay"))
+	var opts []rtl433receive.ReplayOption
+	if conf.ReplayTimestamps {
+		opts = append(opts, rtl433receive.Timestamps(time.Local))
+	}
+	if conf.ReplayRealTime {
+		opts = append(opts, rtl433receive.RealTime())
+		store = processingStore{
+			SQLStore: store.(*rtl433sql.SQLStore),
+			process:  process,
+		}
+	}
+	if err := rtl433receive.Replay(ctx, log.Named("rtl433.replay"), input, store, opts...); err != nil {
+		return err
+	}
+	return process()
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"eagain.net/go/securityblanket/internal/database"
+	"eagain.net/go/securityblanket/internal/pipeline"
+)
+
+// rewind makes a consumer, and everyone downstream of it, process
+// their input again from a chosen point.
+func rewind(ctx context.Context, db *database.DB, conf *config) error {
+	last := conf.RewindTo
+	switch {
+	case conf.RewindSince != "" && last >= 0:
+		return errors.New("use only one of -rewind-to and -rewind-since")
+	case conf.RewindSince != "":
+		t, err := time.Parse(time.RFC3339, conf.RewindSince)
+		if err != nil {
+			return fmt.Errorf("bad -rewind-since: %w", err)
+		}
+		// times are stored in local time, and compared as text
+		last, err = pipeline.Seek(ctx, db, conf.Rewind, t.Local())
+		if err != nil {
+			return err
+		}
+	case last < 0:
+		return errors.New("-rewind requires -rewind-to or -rewind-since")
+	}
+
+	rewound, err := pipeline.Rewind(ctx, db, conf.Rewind, last, conf.RewindClear)
+	if err != nil {
+		return err
+	}
+	if len(rewound) == 0 {
+		fmt.Printf("%s has not processed anything after %d\n", conf.Rewind, last)
+		return nil
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(w, "CONSUMER\tFROM\tTO\tCLEARED\n")
+	for _, r := range rewound {
+		fmt.Fprintf(w, "%s\t%d\t%d\t%d\n", r.Name, r.From, r.To, r.Cleared)
+	}
+	return w.Flush()
+}
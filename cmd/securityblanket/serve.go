@@ -0,0 +1,34 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// serveHTTP serves handler on addr until ctx is canceled.
+func serveHTTP(ctx context.Context, log *zap.Logger, addr string, handler http.Handler) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	srv := &http.Server{
+		Handler:           handler,
+		ReadHeaderTimeout: 10 * time.Second,
+		ErrorLog:          zap.NewStdLog(log),
+	}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_ = srv.Shutdown(shutdownCtx)
+	}()
+	log.Info("listening", zap.Stringer("addr", l.Addr()))
+	if err := srv.Serve(l); err != http.ErrServerClosed {
+		return err
+	}
+	return ctx.Err()
+}
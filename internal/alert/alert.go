@@ -0,0 +1,541 @@
+// Package alert turns security events into alerts with a lifecycle.
+//
+// Alerts are raised from trips classified as alarms, tampers,
+// supervision losses, low batteries and jamming. An alert is notified
+// once someone has been told about it, acknowledged by a person, and
+// resolved when the condition behind it clears. A condition repeating
+// while its alert is open is counted in the existing alert, instead of
+// raising a new one.
+//
+// Jamming defeats every sensor at once, so it raises an alarm about
+// the whole site, open for as long as any jamming condition is.
+//
+// Raising and resolving an alert queues a notification for each
+// channel in the notify_outbox table, in the same savepoint; package
+// notify delivers them.
+//
+// Alert times come from the source tables and not the clock, so
+// emptying the alerts table and rewinding the catchup consumers
+// rebuilds the same alerts. Events processed again after a
+// pipeline.Rewind are an exception: people have already been told
+// about them, so they raise nothing.
+package alert
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"crawshaw.io/sqlite"
+	"crawshaw.io/sqlite/sqlitex"
+	"eagain.net/go/securityblanket/internal/catchup"
+	"eagain.net/go/securityblanket/internal/database"
+	"eagain.net/go/securityblanket/internal/honeywell5800"
+	"eagain.net/go/securityblanket/internal/pipeline"
+	"go.uber.org/zap"
+)
+
+// ErrNotFound is returned when acknowledging an alert that does not
+// exist or has already been acknowledged.
+var ErrNotFound = errors.New("no such unacknowledged alert")
+
+const (
+	sourceTrip        = "trip"
+	sourceTamper      = "tamper"
+	sourceSupervision = "supervision"
+	sourceBattery     = "battery"
+	sourceJamming     = "jamming"
+
+	severityAlarm   = "alarm"
+	severityWarning = "warning"
+	severityInfo    = "info"
+
+	eventRaised   = "raised"
+	eventResolved = "resolved"
+)
+
+type config struct {
+	settle   time.Duration
+	channels []string
+	clock    func() time.Time
+	wakeup   func()
+}
+
+type Option option
+
+type option func(*config)
+
+// Settle sets how long a tripped loop must stay normal before its
+// alert is resolved. Trips within that time count toward the same
+// alert.
+func Settle(d time.Duration) Option {
+	fn := func(conf *config) {
+		conf.settle = d
+	}
+	return fn
+}
+
+// Channels sets the notification channels alerts are queued for.
+func Channels(names ...string) Option {
+	fn := func(conf *config) {
+		conf.channels = names
+	}
+	return fn
+}
+
+// Clock overrides the source of time used for resolving trip alerts.
+func Clock(clock func() time.Time) Option {
+	fn := func(conf *config) {
+		conf.clock = clock
+	}
+	return fn
+}
+
+// Wakeup is called whenever alerts are raised or resolved.
+func Wakeup(wakeup func()) Option {
+	fn := func(conf *config) {
+		conf.wakeup = wakeup
+	}
+	return fn
+}
+
+type Engine struct {
+	ctx         context.Context
+	db          *database.DB
+	trips       *catchup.Catchup
+	tampers     *catchup.Catchup
+	supervision *catchup.Catchup
+	jamming     *catchup.Catchup
+	log         *zap.Logger
+	config      config
+}
+
+func New(ctx context.Context, db *database.DB, log *zap.Logger, opts ...Option) *Engine {
+	e := &Engine{
+		ctx: ctx,
+		db:  db,
+		trips: catchup.New(&catchup.Config{
+			DB:      db,
+			Log:     log.Named("catchup.trip"),
+			Name:    "alert.trip",
+			MaxSQL:  fetch_arming_trips_max.Content,
+			NextSQL: fetch_arming_trips.Content,
+		}),
+		tampers: catchup.New(&catchup.Config{
+			DB:      db,
+			Log:     log.Named("catchup.tamper"),
+			Name:    "alert.tamper",
+			MaxSQL:  fetch_honeywell5800_tampers_max.Content,
+			NextSQL: fetch_honeywell5800_tampers.Content,
+		}),
+		supervision: catchup.New(&catchup.Config{
+			DB:      db,
+			Log:     log.Named("catchup.supervision"),
+			Name:    "alert.supervision",
+			MaxSQL:  fetch_honeywell5800_supervision_losses_max.Content,
+			NextSQL: fetch_honeywell5800_supervision_losses.Content,
+		}),
+		jamming: catchup.New(&catchup.Config{
+			DB:      db,
+			Log:     log.Named("catchup.jamming"),
+			Name:    "alert.jamming",
+			MaxSQL:  fetch_rfjam_conditions_max.Content,
+			NextSQL: fetch_rfjam_conditions.Content,
+		}),
+		log: log,
+		config: config{
+			settle: 5 * time.Minute,
+			clock:  time.Now,
+			wakeup: func() {},
+		},
+	}
+	for _, opt := range opts {
+		opt(&e.config)
+	}
+	return e
+}
+
+// Run raises alerts for new events, and then resolves alerts whose
+// condition has cleared.
+func (e *Engine) Run() error {
+	if err := e.trips.Run(e.ctx, e.trip); err != nil {
+		return err
+	}
+	if err := e.tampers.Run(e.ctx, e.tamper); err != nil {
+		return err
+	}
+	if err := e.supervision.Run(e.ctx, e.lost); err != nil {
+		return err
+	}
+	if err := e.jamming.Run(e.ctx, e.jam); err != nil {
+		return err
+	}
+	if err := e.reconcile(); err != nil {
+		return fmt.Errorf("alert reconcile: %w", err)
+	}
+	return nil
+}
+
+type event struct {
+	source string
+	// zero for alerts about the whole site
+	sensor   honeywell5800.Sensor
+	loop     uint8
+	severity string
+	summary  string
+	time     time.Time
+}
+
+// bindSensor sets the sensor of ev as a SQL query bind parameter, or
+// NULL for alerts about the whole site.
+func (ev *event) bindSensor(stmt *sqlite.Stmt, param string) {
+	if ev.sensor == 0 {
+		stmt.SetNull(param)
+		return
+	}
+	ev.sensor.ToSQL(stmt, param)
+}
+
+func (e *Engine) raise(conn *sqlite.Conn, ev *event) error {
+	var stmt *sqlite.Stmt
+	if ev.sensor == 0 {
+		stmt = upsert_alert_site.Prep(conn)
+	} else {
+		stmt = upsert_alert.Prep(conn)
+		ev.sensor.ToSQL(stmt, "@sensor")
+		stmt.SetInt64("@loop", int64(ev.loop))
+	}
+	defer stmt.Finalize()
+	stmt.SetText("@source", ev.source)
+	stmt.SetText("@severity", ev.severity)
+	stmt.SetText("@summary", ev.summary)
+	database.BindTime(stmt, "@time", ev.time)
+	if _, err := stmt.Step(); err != nil {
+		return fmt.Errorf("raise alert: %s %v: %w", ev.source, ev.sensor, err)
+	}
+
+	open := fetch_alert_open.Prep(conn)
+	defer open.Finalize()
+	open.SetText("@source", ev.source)
+	ev.bindSensor(open, "@sensor")
+	open.SetInt64("@loop", int64(ev.loop))
+	if err := database.Row(open); err != nil {
+		return fmt.Errorf("error fetching raised alert: %s %v: %w", ev.source, ev.sensor, err)
+	}
+	id := open.GetInt64("id")
+	count := open.GetInt64("count")
+	if err := database.NoMoreRows(open); err != nil {
+		return err
+	}
+	if count == 1 {
+		// repeats are counted, not notified
+		if err := e.enqueue(conn, id, eventRaised, ev.time); err != nil {
+			return err
+		}
+	}
+	e.log.Info("raised",
+		zap.String("source", ev.source),
+		zap.Stringer("sensor", ev.sensor),
+		zap.Uint8("loop", ev.loop),
+		zap.String("severity", ev.severity),
+		zap.String("summary", ev.summary),
+	)
+	e.config.wakeup()
+	return nil
+}
+
+// replayed reports whether ev is from before the named consumer was
+// rewound, and was alerted about the first time around.
+func (e *Engine) replayed(conn *sqlite.Conn, name string, ev *event) (bool, error) {
+	replayed, err := pipeline.Replayed(conn, name, ev.time)
+	if err != nil {
+		return false, err
+	}
+	if replayed {
+		e.log.Info("replayed",
+			zap.String("source", ev.source),
+			zap.Stringer("sensor", ev.sensor),
+			zap.Uint8("loop", ev.loop),
+			zap.Time("time", ev.time),
+		)
+	}
+	return replayed, nil
+}
+
+// enqueue queues notifications about the alert for every channel.
+func (e *Engine) enqueue(conn *sqlite.Conn, id int64, event string, t time.Time) error {
+	if len(e.config.channels) == 0 {
+		return nil
+	}
+	stmt := insert_notify_outbox.Prep(conn)
+	defer stmt.Finalize()
+	for _, channel := range e.config.channels {
+		stmt.SetInt64("@alert", id)
+		stmt.SetText("@channel", channel)
+		stmt.SetText("@event", event)
+		database.BindTime(stmt, "@created", t)
+		if _, err := stmt.Step(); err != nil {
+			return fmt.Errorf("queue notification: alert %d %s: %w", id, channel, err)
+		}
+		if err := stmt.Reset(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (e *Engine) trip(conn *sqlite.Conn, stmt *sqlite.Stmt) error {
+	if stmt.GetText("action") != "alarm" {
+		return nil
+	}
+	loop, err := database.GetUint8(stmt, "loop")
+	if err != nil {
+		return fmt.Errorf("bad loop in database: %w", err)
+	}
+	t, err := database.GetTime(stmt, "time")
+	if err != nil {
+		return fmt.Errorf("bad trip time: %w", err)
+	}
+	ev := &event{
+		source:   sourceTrip,
+		sensor:   honeywell5800.SensorFromSQL(stmt, "sensor"),
+		loop:     loop,
+		severity: severityAlarm,
+		summary:  stmt.GetText("description") + ": " + stmt.GetText("label"),
+		time:     t,
+	}
+	if replayed, err := e.replayed(conn, "alert.trip", ev); err != nil || replayed {
+		return err
+	}
+	return e.raise(conn, ev)
+}
+
+func (e *Engine) tamper(conn *sqlite.Conn, stmt *sqlite.Stmt) error {
+	loop, err := database.GetUint8(stmt, "loop")
+	if err != nil {
+		return fmt.Errorf("bad loop in database: %w", err)
+	}
+	t, err := database.GetTime(stmt, "time")
+	if err != nil {
+		return fmt.Errorf("bad tamper time: %w", err)
+	}
+	ev := &event{
+		source:   sourceTamper,
+		sensor:   honeywell5800.SensorFromSQL(stmt, "sensor"),
+		loop:     loop,
+		severity: severityAlarm,
+		summary:  stmt.GetText("description") + ": tamper",
+		time:     t,
+	}
+	if stmt.GetInt64("disabled") != 0 {
+		ev.severity = severityWarning
+		ev.summary += " (disabled loop)"
+	}
+	if replayed, err := e.replayed(conn, "alert.tamper", ev); err != nil || replayed {
+		return err
+	}
+	return e.raise(conn, ev)
+}
+
+func (e *Engine) lost(conn *sqlite.Conn, stmt *sqlite.Stmt) error {
+	t, err := database.GetTime(stmt, "time")
+	if err != nil {
+		return fmt.Errorf("bad supervision loss time: %w", err)
+	}
+	ev := &event{
+		source:   sourceSupervision,
+		sensor:   honeywell5800.SensorFromSQL(stmt, "sensor"),
+		severity: severityWarning,
+		summary:  stmt.GetText("description") + ": not heard from",
+		time:     t,
+	}
+	if replayed, err := e.replayed(conn, "alert.supervision", ev); err != nil || replayed {
+		return err
+	}
+	return e.raise(conn, ev)
+}
+
+func (e *Engine) jam(conn *sqlite.Conn, stmt *sqlite.Stmt) error {
+	if stmt.GetInt64("active") == 0 {
+		// resolved by reconcile once nothing is active
+		return nil
+	}
+	t, err := database.GetTime(stmt, "time")
+	if err != nil {
+		return fmt.Errorf("bad jamming time: %w", err)
+	}
+	var summary string
+	switch kind := stmt.GetText("kind"); kind {
+	case "noise":
+		summary = fmt.Sprintf("jamming: noise %.1f dB over the normal %.1f dB on receiver %s",
+			stmt.GetFloat("noise")-stmt.GetFloat("baseline"),
+			stmt.GetFloat("baseline"),
+			stmt.GetText("receiver"),
+		)
+	case "silence":
+		summary = fmt.Sprintf("jamming: %d of %d sensors silent",
+			stmt.GetInt64("silentSensors"),
+			stmt.GetInt64("sensors"),
+		)
+	default:
+		return fmt.Errorf("unknown jamming kind: %q", kind)
+	}
+	ev := &event{
+		source:   sourceJamming,
+		severity: severityAlarm,
+		summary:  summary,
+		time:     t,
+	}
+	if replayed, err := e.replayed(conn, "alert.jamming", ev); err != nil || replayed {
+		return err
+	}
+	return e.raise(conn, ev)
+}
+
+// reconcile raises alerts for low batteries, which are state and not
+// events, and resolves alerts whose condition has cleared.
+func (e *Engine) reconcile() (err error) {
+	conn := e.db.Get(e.ctx)
+	if conn == nil {
+		return context.Canceled
+	}
+	defer e.db.Put(conn)
+	defer sqlitex.Save(conn)(&err)
+
+	var batteries []*event
+	{
+		stmt := fetch_honeywell5800_batteries_low.Prep(conn)
+		defer stmt.Finalize()
+		for {
+			hasRow, err := stmt.Step()
+			if err != nil {
+				return fmt.Errorf("error fetching low batteries: %w", err)
+			}
+			if !hasRow {
+				break
+			}
+			t, err := database.GetTime(stmt, "time")
+			if err != nil {
+				return fmt.Errorf("bad battery time: %w", err)
+			}
+			batteries = append(batteries, &event{
+				source:   sourceBattery,
+				sensor:   honeywell5800.SensorFromSQL(stmt, "sensor"),
+				severity: severityInfo,
+				summary:  stmt.GetText("description") + ": low battery",
+				time:     t,
+			})
+		}
+	}
+	for _, ev := range batteries {
+		if err := e.raise(conn, ev); err != nil {
+			return err
+		}
+	}
+
+	now := e.config.clock()
+	for _, c := range []struct {
+		stmt   *sqlite.Stmt
+		settle time.Duration
+	}{
+		{fetch_alerts_open_trip.Prep(conn), e.config.settle},
+		{fetch_alerts_open_tamper.Prep(conn), 0},
+		{fetch_alerts_open_supervision.Prep(conn), 0},
+		{fetch_alerts_open_battery.Prep(conn), 0},
+		{fetch_alerts_open_jamming.Prep(conn), 0},
+	} {
+		defer c.stmt.Finalize()
+		if err := e.resolve(conn, c.stmt, now, c.settle); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// resolve resolves the alerts listed by stmt, that have been clear
+// for at least settle.
+func (e *Engine) resolve(conn *sqlite.Conn, stmt *sqlite.Stmt, now time.Time, settle time.Duration) error {
+	type resolution struct {
+		id      int64
+		cleared time.Time
+	}
+	var resolutions []resolution
+	for {
+		hasRow, err := stmt.Step()
+		if err != nil {
+			return fmt.Errorf("error fetching open alerts: %w", err)
+		}
+		if !hasRow {
+			break
+		}
+		cleared, err := database.GetTime(stmt, "clearedTime")
+		if err != nil {
+			return err
+		}
+		if cleared.IsZero() {
+			// still ongoing
+			continue
+		}
+		if now.Before(cleared.Add(settle)) {
+			continue
+		}
+		resolutions = append(resolutions, resolution{
+			id:      stmt.GetInt64("id"),
+			cleared: cleared,
+		})
+	}
+
+	up := update_alert_resolved.Prep(conn)
+	defer up.Finalize()
+	for _, r := range resolutions {
+		up.SetInt64("@id", r.id)
+		database.BindTime(up, "@resolved", r.cleared)
+		if _, err := up.Step(); err != nil {
+			return fmt.Errorf("resolve alert: %d: %w", r.id, err)
+		}
+		if err := up.Reset(); err != nil {
+			return err
+		}
+		if err := e.enqueue(conn, r.id, eventResolved, r.cleared); err != nil {
+			return err
+		}
+		e.log.Info("resolved", zap.Int64("alert", r.id))
+	}
+	if len(resolutions) > 0 {
+		e.config.wakeup()
+	}
+	return nil
+}
+
+// Acknowledge records that who has seen the alert with the given id,
+// with an optional note.
+func Acknowledge(ctx context.Context, db *database.DB, id int64, who string, note string, ts time.Time) (err error) {
+	if who == "" {
+		return errors.New("alert acknowledgement needs a name")
+	}
+	conn := db.Get(ctx)
+	if conn == nil {
+		return context.Canceled
+	}
+	defer db.Put(conn)
+	defer sqlitex.Save(conn)(&err)
+
+	stmt := update_alert_acknowledged.Prep(conn)
+	defer stmt.Finalize()
+	stmt.SetInt64("@id", id)
+	database.BindTime(stmt, "@acknowledged", ts)
+	stmt.SetText("@acknowledgedBy", who)
+	stmt.SetText("@note", note)
+	if _, err := stmt.Step(); err != nil {
+		return fmt.Errorf("acknowledge alert: %w", err)
+	}
+	switch affected := conn.Changes(); affected {
+	case 0:
+		return ErrNotFound
+	case 1:
+		return nil
+	default:
+		return fmt.Errorf("internal error: acknowledging alert caused multiple changes: %d", affected)
+	}
+}
@@ -0,0 +1,489 @@
+package alert_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"crawshaw.io/sqlite/sqlitex"
+	"eagain.net/go/securityblanket/internal/alert"
+	"eagain.net/go/securityblanket/internal/database"
+	"github.com/google/go-cmp/cmp"
+	"go.uber.org/zap/zaptest"
+)
+
+func execScript(t testing.TB, db *database.DB, sql string) {
+	conn := db.Get(nil)
+	defer db.Put(conn)
+
+	if err := sqlitex.ExecScript(conn, sql); err != nil {
+		t.Fatalf("database error: %v", err)
+	}
+}
+
+var start = time.Date(2020, 2, 3, 4, 5, 6, 0, time.UTC)
+
+func at(d time.Duration) string {
+	return start.Add(d).Format(time.RFC3339Nano)
+}
+
+func update(t testing.TB, db *database.DB, id int, d time.Duration, sensor int) {
+	execScript(t, db, fmt.Sprintf(`
+INSERT INTO honeywell5800_updates(id, time, channel, sensor, event)
+VALUES (%d, '%s', 8, %d, 0);
+`, id, at(d), sensor))
+}
+
+// trip adds a classified trip of loop 1, tripped by update id.
+func trip(t testing.TB, db *database.DB, id int, sensor int, action string) {
+	execScript(t, db, fmt.Sprintf(`
+INSERT INTO honeywell5800_trips(id, sensor, loop, trippedBy)
+VALUES (%[1]d, %[2]d, 1, %[1]d);
+
+INSERT INTO arming_trips(trip, mode, action)
+VALUES (%[1]d, 'away', '%[3]s');
+`, id, sensor, action))
+}
+
+type row struct {
+	Source       string
+	Sensor       int64
+	Loop         int64
+	Severity     string
+	Summary      string
+	Raised       string
+	LastSeen     string
+	Count        int64
+	Acknowledged string
+	Note         string
+	Resolved     string
+}
+
+func alerts(t testing.TB, db *database.DB) []row {
+	conn := db.Get(nil)
+	defer db.Put(conn)
+	stmt := conn.Prep(`
+SELECT source, sensor, loop, severity, summary, raised, lastSeen, count,
+	acknowledged, note, resolved
+FROM alerts
+ORDER BY id
+`)
+	defer stmt.Finalize()
+	var got []row
+	for {
+		hasRow, err := stmt.Step()
+		if err != nil {
+			t.Fatalf("database error: %v", err)
+		}
+		if !hasRow {
+			break
+		}
+		got = append(got, row{
+			Source:       stmt.GetText("source"),
+			Sensor:       stmt.GetInt64("sensor"),
+			Loop:         stmt.GetInt64("loop"),
+			Severity:     stmt.GetText("severity"),
+			Summary:      stmt.GetText("summary"),
+			Raised:       stmt.GetText("raised"),
+			LastSeen:     stmt.GetText("lastSeen"),
+			Count:        stmt.GetInt64("count"),
+			Acknowledged: stmt.GetText("acknowledged"),
+			Note:         stmt.GetText("note"),
+			Resolved:     stmt.GetText("resolved"),
+		})
+	}
+	return got
+}
+
+func alertID(t testing.TB, db *database.DB, source string) int64 {
+	conn := db.Get(nil)
+	defer db.Put(conn)
+	stmt := conn.Prep(`
+SELECT id FROM alerts WHERE source=@source
+`)
+	defer stmt.Finalize()
+	stmt.SetText("@source", source)
+	id, err := sqlitex.ResultInt64(stmt)
+	if err != nil {
+		t.Fatalf("database error: %v", err)
+	}
+	return id
+}
+
+func TestLifecycle(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	db := database.Scratch()
+	defer db.Close()
+
+	log := zaptest.NewLogger(t)
+	now := start
+	wakeups := 0
+	engine := alert.New(ctx, db, log,
+		alert.Clock(func() time.Time { return now }),
+		alert.Wakeup(func() { wakeups++ }),
+	)
+	run := func() {
+		t.Helper()
+		if err := engine.Run(); err != nil {
+			t.Fatalf("run: %v", err)
+		}
+	}
+
+	execScript(t, db, `
+INSERT INTO honeywell5800_sensors(id, model, description) VALUES
+	(1, '5800MINI', 'front door'),
+	(2, '5800PIR-RES', 'hallway'),
+	(3, '5808W3', 'kitchen');
+`)
+
+	// the door opens twice, the hallway motion is not an alarm
+	update(t, db, 1, 0, 1)
+	trip(t, db, 1, 1, "alarm")
+	update(t, db, 2, time.Minute, 1)
+	execScript(t, db, `UPDATE honeywell5800_trips SET clearedBy=2 WHERE id=1;`)
+	update(t, db, 3, 2*time.Minute, 1)
+	trip(t, db, 3, 1, "alarm")
+	update(t, db, 4, 2*time.Minute, 2)
+	trip(t, db, 4, 2, "ignored")
+	update(t, db, 5, 3*time.Minute, 1)
+	execScript(t, db, `UPDATE honeywell5800_trips SET clearedBy=5 WHERE id=3;`)
+
+	// the smoke detector is opened, and goes missing
+	update(t, db, 6, 4*time.Minute, 3)
+	execScript(t, db, fmt.Sprintf(`
+INSERT INTO honeywell5800_tampers(sensor, loop, disabled, openedBy)
+VALUES (3, 4, false, 6);
+
+INSERT INTO honeywell5800_supervision_losses(sensor, lastSeen, lost)
+VALUES (3, 6, '%s');
+
+INSERT INTO honeywell5800_batteries(sensor, low, firstSeenLow)
+VALUES (3, true, '%s');
+`, at(5*time.Hour), at(3*time.Hour)))
+
+	now = start.Add(5 * time.Hour)
+	run()
+	doorAlert := row{
+		Source:   "trip",
+		Sensor:   1,
+		Loop:     1,
+		Severity: "alarm",
+		Summary:  "front door: door or window open",
+		Raised:   at(0),
+		LastSeen: at(2 * time.Minute),
+		Count:    2,
+		Resolved: at(3 * time.Minute),
+	}
+	want := []row{
+		doorAlert,
+		{
+			Source:   "tamper",
+			Sensor:   3,
+			Loop:     4,
+			Severity: "alarm",
+			Summary:  "kitchen: tamper",
+			Raised:   at(4 * time.Minute),
+			LastSeen: at(4 * time.Minute),
+			Count:    1,
+		},
+		{
+			Source:   "supervision",
+			Sensor:   3,
+			Severity: "warning",
+			Summary:  "kitchen: not heard from",
+			Raised:   at(5 * time.Hour),
+			LastSeen: at(5 * time.Hour),
+			Count:    1,
+		},
+		{
+			Source:   "battery",
+			Sensor:   3,
+			Severity: "info",
+			Summary:  "kitchen: low battery",
+			Raised:   at(3 * time.Hour),
+			LastSeen: at(3 * time.Hour),
+			Count:    1,
+		},
+	}
+	if diff := cmp.Diff(want, alerts(t, db)); diff != "" {
+		t.Errorf("wrong alerts (-want +got):\n%s", diff)
+	}
+	// 4 raised, 2 trips in one, and the door resolved
+	if g, e := wakeups, 6; g != e {
+		t.Errorf("wrong number of wakeups: %v != %v", g, e)
+	}
+
+	tamperID := alertID(t, db, "tamper")
+	if err := alert.Acknowledge(ctx, db, tamperID, "alex", "replaced the cover", start.Add(6*time.Hour)); err != nil {
+		t.Fatalf("acknowledge: %v", err)
+	}
+	if err := alert.Acknowledge(ctx, db, tamperID, "sam", "", start.Add(7*time.Hour)); !errors.Is(err, alert.ErrNotFound) {
+		t.Errorf("wrong error for second acknowledgement: %v", err)
+	}
+
+	// everything clears
+	update(t, db, 7, 8*time.Hour, 3)
+	execScript(t, db, fmt.Sprintf(`
+UPDATE honeywell5800_tampers SET closedBy=7;
+UPDATE honeywell5800_supervision_losses SET restoredBy=7;
+UPDATE honeywell5800_batteries SET low=false, cleared='%s';
+`, at(8*time.Hour)))
+	now = start.Add(8 * time.Hour)
+	run()
+	want[1].Acknowledged = at(6 * time.Hour)
+	want[1].Note = "replaced the cover"
+	for i := 1; i < len(want); i++ {
+		want[i].Resolved = at(8 * time.Hour)
+	}
+	if diff := cmp.Diff(want, alerts(t, db)); diff != "" {
+		t.Errorf("wrong alerts (-want +got):\n%s", diff)
+	}
+
+	// the door opens again, a new alert
+	update(t, db, 8, 9*time.Hour, 1)
+	trip(t, db, 8, 1, "alarm")
+	run()
+	got := alerts(t, db)
+	if g, e := len(got), 5; g != e {
+		t.Fatalf("wrong number of alerts: %d != %d", g, e)
+	}
+	if g, e := got[4].Raised, at(9*time.Hour); g != e {
+		t.Errorf("wrong raise time: %v != %v", g, e)
+	}
+	if g, e := got[4].Resolved, ""; g != e {
+		t.Errorf("new alert is resolved: %v", g)
+	}
+}
+
+func TestSettle(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	db := database.Scratch()
+	defer db.Close()
+
+	log := zaptest.NewLogger(t)
+	now := start
+	engine := alert.New(ctx, db, log,
+		alert.Clock(func() time.Time { return now }),
+		alert.Settle(time.Hour),
+	)
+	execScript(t, db, `
+INSERT INTO honeywell5800_sensors(id, model, description)
+VALUES (1, '5800MINI', 'front door');
+`)
+	update(t, db, 1, 0, 1)
+	trip(t, db, 1, 1, "alarm")
+	update(t, db, 2, time.Minute, 1)
+	execScript(t, db, `UPDATE honeywell5800_trips SET clearedBy=2 WHERE id=1;`)
+
+	now = start.Add(30 * time.Minute)
+	if err := engine.Run(); err != nil {
+		t.Fatalf("run: %v", err)
+	}
+	if g, e := alerts(t, db)[0].Resolved, ""; g != e {
+		t.Errorf("resolved too early: %v", g)
+	}
+	now = start.Add(61 * time.Minute)
+	if err := engine.Run(); err != nil {
+		t.Fatalf("run: %v", err)
+	}
+	if g, e := alerts(t, db)[0].Resolved, at(time.Minute); g != e {
+		t.Errorf("wrong resolve time: %q != %q", g, e)
+	}
+}
+
+func TestOutbox(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	db := database.Scratch()
+	defer db.Close()
+
+	log := zaptest.NewLogger(t)
+	now := start.Add(time.Hour)
+	engine := alert.New(ctx, db, log,
+		alert.Clock(func() time.Time { return now }),
+		alert.Channels("email", "hook"),
+	)
+	execScript(t, db, `
+INSERT INTO honeywell5800_sensors(id, model, description)
+VALUES (1, '5800MINI', 'front door');
+`)
+	// two trips make one alert, notified once
+	update(t, db, 1, 0, 1)
+	trip(t, db, 1, 1, "alarm")
+	update(t, db, 2, time.Minute, 1)
+	execScript(t, db, `UPDATE honeywell5800_trips SET clearedBy=2 WHERE id=1;`)
+	update(t, db, 3, 2*time.Minute, 1)
+	trip(t, db, 3, 1, "alarm")
+	update(t, db, 4, 3*time.Minute, 1)
+	execScript(t, db, `UPDATE honeywell5800_trips SET clearedBy=4 WHERE id=3;`)
+	if err := engine.Run(); err != nil {
+		t.Fatalf("run: %v", err)
+	}
+
+	type queued struct {
+		Alert   int64
+		Channel string
+		Event   string
+		Created string
+	}
+	conn := db.Get(nil)
+	defer db.Put(conn)
+	stmt := conn.Prep(`
+SELECT alert, channel, event, created
+FROM notify_outbox
+ORDER BY id
+`)
+	defer stmt.Finalize()
+	var got []queued
+	for {
+		hasRow, err := stmt.Step()
+		if err != nil {
+			t.Fatalf("database error: %v", err)
+		}
+		if !hasRow {
+			break
+		}
+		got = append(got, queued{
+			Alert:   stmt.GetInt64("alert"),
+			Channel: stmt.GetText("channel"),
+			Event:   stmt.GetText("event"),
+			Created: stmt.GetText("created"),
+		})
+	}
+	id := alertID(t, db, "trip")
+	want := []queued{
+		{id, "email", "raised", at(0)},
+		{id, "hook", "raised", at(0)},
+		{id, "email", "resolved", at(3 * time.Minute)},
+		{id, "hook", "resolved", at(3 * time.Minute)},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("wrong outbox: -want +got\n%s", diff)
+	}
+}
+
+func TestRebuild(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	db := database.Scratch()
+	defer db.Close()
+
+	log := zaptest.NewLogger(t)
+	now := start.Add(time.Hour)
+	clock := alert.Clock(func() time.Time { return now })
+	execScript(t, db, `
+INSERT INTO honeywell5800_sensors(id, model, description)
+VALUES (1, '5800MINI', 'front door');
+`)
+	update(t, db, 1, 0, 1)
+	trip(t, db, 1, 1, "alarm")
+	update(t, db, 2, time.Minute, 1)
+	execScript(t, db, `UPDATE honeywell5800_trips SET clearedBy=2 WHERE id=1;`)
+	update(t, db, 3, 2*time.Minute, 1)
+	trip(t, db, 3, 1, "alarm")
+
+	if err := alert.New(ctx, db, log, clock).Run(); err != nil {
+		t.Fatalf("run: %v", err)
+	}
+	want := alerts(t, db)
+
+	execScript(t, db, `
+DELETE FROM alerts;
+DELETE FROM catchup WHERE name LIKE 'alert.%';
+`)
+	if err := alert.New(ctx, db, log, clock).Run(); err != nil {
+		t.Fatalf("run: %v", err)
+	}
+	if diff := cmp.Diff(want, alerts(t, db)); diff != "" {
+		t.Errorf("rebuilt alerts differ (-want +got):\n%s", diff)
+	}
+}
+
+// jamming adds a change to a jamming condition.
+func jamming(t testing.TB, db *database.DB, d time.Duration, kind, receiver string, active bool) {
+	execScript(t, db, fmt.Sprintf(`
+INSERT INTO rfjam_conditions(time, kind, receiver, active, noise, baseline, silentSensors, sensors)
+VALUES ('%s', '%s', '%s', %t,
+	CASE '%[2]s' WHEN 'noise' THEN -62.5 END,
+	CASE '%[2]s' WHEN 'noise' THEN -80 END,
+	CASE '%[2]s' WHEN 'silence' THEN 4 END,
+	CASE '%[2]s' WHEN 'silence' THEN 6 END);
+`, at(d), kind, receiver, active))
+}
+
+func TestJamming(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	db := database.Scratch()
+	defer db.Close()
+
+	log := zaptest.NewLogger(t)
+	engine := alert.New(ctx, db, log, alert.Channels("hook"))
+	run := func() {
+		t.Helper()
+		if err := engine.Run(); err != nil {
+			t.Fatalf("run: %v", err)
+		}
+	}
+
+	// one alarm for the site, however many conditions are active
+	jamming(t, db, 0, "noise", "attic", true)
+	jamming(t, db, time.Minute, "silence", "", true)
+	run()
+	want := []row{{
+		Source:   "jamming",
+		Severity: "alarm",
+		Summary:  "jamming: noise 17.5 dB over the normal -80.0 dB on receiver attic",
+		Raised:   at(0),
+		LastSeen: at(time.Minute),
+		Count:    2,
+	}}
+	if diff := cmp.Diff(want, alerts(t, db)); diff != "" {
+		t.Fatalf("wrong alerts while jammed: -want +got\n%s", diff)
+	}
+
+	// open until the last condition clears
+	jamming(t, db, 2*time.Minute, "noise", "attic", false)
+	run()
+	if diff := cmp.Diff(want, alerts(t, db)); diff != "" {
+		t.Fatalf("resolved while still silent: -want +got\n%s", diff)
+	}
+	jamming(t, db, 3*time.Minute, "silence", "", false)
+	run()
+	want[0].Resolved = at(3 * time.Minute)
+	if diff := cmp.Diff(want, alerts(t, db)); diff != "" {
+		t.Fatalf("wrong alerts after jamming: -want +got\n%s", diff)
+	}
+
+	// jamming again is a new alert
+	jamming(t, db, 4*time.Minute, "silence", "", true)
+	run()
+	want = append(want, row{
+		Source:   "jamming",
+		Severity: "alarm",
+		Summary:  "jamming: 4 of 6 sensors silent",
+		Raised:   at(4 * time.Minute),
+		LastSeen: at(4 * time.Minute),
+		Count:    1,
+	})
+	if diff := cmp.Diff(want, alerts(t, db)); diff != "" {
+		t.Fatalf("wrong alerts after jamming again: -want +got\n%s", diff)
+	}
+
+	conn := db.Get(nil)
+	defer db.Put(conn)
+	stmt := conn.Prep(`SELECT count(*) FROM notify_outbox`)
+	defer stmt.Finalize()
+	queued, err := sqlitex.ResultInt64(stmt)
+	if err != nil {
+		t.Fatalf("database error: %v", err)
+	}
+	// raised, resolved, raised
+	if g, e := queued, int64(3); g != e {
+		t.Errorf("wrong number of notifications: %d != %d", g, e)
+	}
+}
@@ -0,0 +1,8 @@
+SELECT
+	id,
+	count
+FROM alerts
+WHERE source=@source
+	AND sensor IS @sensor
+	AND loop=@loop
+	AND resolved IS NULL
@@ -0,0 +1,11 @@
+-- Open battery alerts whose battery is no longer low, and since when.
+SELECT
+	alerts.id AS id,
+	honeywell5800_batteries.cleared AS clearedTime
+FROM alerts
+JOIN honeywell5800_batteries
+ON (honeywell5800_batteries.sensor=alerts.sensor)
+WHERE alerts.source='battery'
+	AND alerts.resolved IS NULL
+	AND NOT honeywell5800_batteries.low
+ORDER BY alerts.id
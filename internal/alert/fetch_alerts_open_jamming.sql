@@ -0,0 +1,14 @@
+-- Open jamming alerts once no jamming condition is active, and when
+-- the last one cleared.
+SELECT
+	alerts.id AS id,
+	(
+		SELECT max(time)
+		FROM rfjam_conditions
+		WHERE NOT active
+	) AS clearedTime
+FROM alerts
+WHERE alerts.source='jamming'
+	AND alerts.resolved IS NULL
+	AND NOT EXISTS (SELECT 1 FROM rfjam_active)
+ORDER BY alerts.id
@@ -0,0 +1,17 @@
+-- Open supervision alerts whose sensor has been heard from again, and
+-- when.
+SELECT
+	alerts.id AS id,
+	restored.time AS clearedTime
+FROM alerts
+JOIN honeywell5800_supervision_losses AS latest
+ON (latest.id=(
+	SELECT max(id)
+	FROM honeywell5800_supervision_losses
+	WHERE sensor=alerts.sensor
+))
+JOIN honeywell5800_updates AS restored
+ON (restored.id=latest.restoredBy)
+WHERE alerts.source='supervision'
+	AND alerts.resolved IS NULL
+ORDER BY alerts.id
@@ -0,0 +1,17 @@
+-- Open tamper alerts whose tamper has closed, and when.
+SELECT
+	alerts.id AS id,
+	closed.time AS clearedTime
+FROM alerts
+JOIN honeywell5800_tampers AS latest
+ON (latest.id=(
+	SELECT max(id)
+	FROM honeywell5800_tampers
+	WHERE sensor=alerts.sensor
+		AND loop=alerts.loop
+))
+JOIN honeywell5800_updates AS closed
+ON (closed.id=latest.closedBy)
+WHERE alerts.source='tamper'
+	AND alerts.resolved IS NULL
+ORDER BY alerts.id
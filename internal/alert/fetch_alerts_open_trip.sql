@@ -0,0 +1,18 @@
+-- Open trip alerts, and when the loop last returned to normal. NULL
+-- clearedTime means still tripped.
+SELECT
+	alerts.id AS id,
+	cleared.time AS clearedTime
+FROM alerts
+JOIN honeywell5800_trips AS latest
+ON (latest.id=(
+	SELECT max(id)
+	FROM honeywell5800_trips
+	WHERE sensor=alerts.sensor
+		AND loop=alerts.loop
+))
+LEFT JOIN honeywell5800_updates AS cleared
+ON (cleared.id=latest.clearedBy)
+WHERE alerts.source='trip'
+	AND alerts.resolved IS NULL
+ORDER BY alerts.id
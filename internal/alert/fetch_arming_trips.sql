@@ -0,0 +1,33 @@
+SELECT
+	arming_trips.id AS id,
+	arming_trips.action AS action,
+	honeywell5800_trips.sensor AS sensor,
+	honeywell5800_trips.loop AS loop,
+	honeywell5800_updates.time AS time,
+	honeywell5800_sensors.description AS description,
+	coalesce(
+		honeywell5800_site_loops.siteLabel,
+		honeywell5800_model_loops.factoryLabel,
+		honeywell5800_site_loops.kind,
+		honeywell5800_model_loops.kind,
+		'loop ' || honeywell5800_trips.loop
+	) AS label
+FROM arming_trips
+JOIN honeywell5800_trips
+ON (honeywell5800_trips.id=arming_trips.trip)
+JOIN honeywell5800_updates
+ON (honeywell5800_updates.id=honeywell5800_trips.trippedBy)
+JOIN honeywell5800_sensors
+ON (honeywell5800_sensors.id=honeywell5800_trips.sensor)
+LEFT JOIN honeywell5800_model_loops
+ON (honeywell5800_model_loops.model=honeywell5800_sensors.model
+	AND honeywell5800_model_loops.loop=honeywell5800_trips.loop
+)
+LEFT JOIN honeywell5800_site_loops
+ON (honeywell5800_site_loops.sensor=honeywell5800_trips.sensor
+	AND honeywell5800_site_loops.loop=honeywell5800_trips.loop
+)
+WHERE arming_trips.id>@last
+	AND arming_trips.id<=@max
+ORDER BY arming_trips.id ASC
+LIMIT 100
@@ -0,0 +1,17 @@
+-- Low batteries without an open alert.
+SELECT
+	honeywell5800_batteries.sensor AS sensor,
+	honeywell5800_batteries.firstSeenLow AS time,
+	honeywell5800_sensors.description AS description
+FROM honeywell5800_batteries
+JOIN honeywell5800_sensors
+ON (honeywell5800_sensors.id=honeywell5800_batteries.sensor)
+WHERE honeywell5800_batteries.low
+	AND NOT EXISTS (
+		SELECT 1
+		FROM alerts
+		WHERE source='battery'
+			AND sensor=honeywell5800_batteries.sensor
+			AND resolved IS NULL
+	)
+ORDER BY honeywell5800_batteries.sensor
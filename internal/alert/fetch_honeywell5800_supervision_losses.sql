@@ -0,0 +1,12 @@
+SELECT
+	honeywell5800_supervision_losses.id AS id,
+	honeywell5800_supervision_losses.sensor AS sensor,
+	honeywell5800_supervision_losses.lost AS time,
+	honeywell5800_sensors.description AS description
+FROM honeywell5800_supervision_losses
+JOIN honeywell5800_sensors
+ON (honeywell5800_sensors.id=honeywell5800_supervision_losses.sensor)
+WHERE honeywell5800_supervision_losses.id>@last
+	AND honeywell5800_supervision_losses.id<=@max
+ORDER BY honeywell5800_supervision_losses.id ASC
+LIMIT 100
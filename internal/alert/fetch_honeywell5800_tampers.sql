@@ -0,0 +1,16 @@
+SELECT
+	honeywell5800_tampers.id AS id,
+	honeywell5800_tampers.sensor AS sensor,
+	honeywell5800_tampers.loop AS loop,
+	honeywell5800_tampers.disabled AS disabled,
+	honeywell5800_updates.time AS time,
+	honeywell5800_sensors.description AS description
+FROM honeywell5800_tampers
+JOIN honeywell5800_updates
+ON (honeywell5800_updates.id=honeywell5800_tampers.openedBy)
+JOIN honeywell5800_sensors
+ON (honeywell5800_sensors.id=honeywell5800_tampers.sensor)
+WHERE honeywell5800_tampers.id>@last
+	AND honeywell5800_tampers.id<=@max
+ORDER BY honeywell5800_tampers.id ASC
+LIMIT 100
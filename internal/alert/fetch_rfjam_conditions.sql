@@ -0,0 +1,15 @@
+SELECT
+	id,
+	time,
+	kind,
+	receiver,
+	active,
+	noise,
+	baseline,
+	silentSensors,
+	sensors
+FROM rfjam_conditions
+WHERE id>@last
+	AND id<=@max
+ORDER BY id ASC
+LIMIT 100
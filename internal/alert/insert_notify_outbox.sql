@@ -0,0 +1,2 @@
+INSERT INTO notify_outbox(alert, channel, event, created, nextAttempt)
+	VALUES (@alert, @channel, @event, @created, @created)
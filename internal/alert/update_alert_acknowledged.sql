@@ -0,0 +1,6 @@
+UPDATE alerts
+	SET acknowledged=@acknowledged,
+		acknowledgedBy=@acknowledgedBy,
+		note=@note
+	WHERE id=@id
+		AND acknowledged IS NULL
@@ -0,0 +1,4 @@
+UPDATE alerts
+	SET resolved=@resolved
+	WHERE id=@id
+		AND resolved IS NULL
@@ -0,0 +1,5 @@
+INSERT INTO alerts(source, sensor, loop, severity, summary, raised, lastSeen)
+	VALUES (@source, @sensor, @loop, @severity, @summary, @time, @time)
+	ON CONFLICT(source, sensor, loop) WHERE resolved IS NULL DO UPDATE SET
+		count=count+1,
+		lastSeen=excluded.lastSeen
@@ -0,0 +1,5 @@
+INSERT INTO alerts(source, sensor, loop, severity, summary, raised, lastSeen)
+	VALUES (@source, NULL, 0, @severity, @summary, @time, @time)
+	ON CONFLICT(source) WHERE resolved IS NULL AND sensor IS NULL DO UPDATE SET
+		count=count+1,
+		lastSeen=excluded.lastSeen
@@ -0,0 +1,417 @@
+// Package archive keeps rows deleted by retention policies in
+// compressed files, and loads them back for looking into old events.
+//
+// Rows are stored as newline-delimited JSON objects, one file per
+// table and month, compressed with gzip: TABLE/YYYY-MM.ndjson.gz. Every
+// batch is appended to the file as a gzip member of its own.
+// manifest.json lists the files, with how many rows and which ids and
+// times they hold. Tables without an id column, such as
+// honeywell5800_receptions, have no ids in the manifest.
+//
+// A batch that is archived but then fails to be deleted is archived
+// again later, so the same row can appear more than once. Import
+// ignores the duplicates.
+package archive
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"crawshaw.io/sqlite"
+	"crawshaw.io/sqlite/sqlitex"
+	"eagain.net/go/securityblanket/internal/database"
+	"eagain.net/go/securityblanket/internal/retention"
+)
+
+const manifestName = "manifest.json"
+
+// Manifest lists the files of an archive.
+type Manifest struct {
+	Files []*File `json:"files"`
+}
+
+// File is one month of rows of a table.
+type File struct {
+	Table string `json:"table"`
+	// Month is in YYYY-MM form, from the time of the rows.
+	Month string `json:"month"`
+	// Path is relative to the archive directory, with forward
+	// slashes.
+	Path      string `json:"path"`
+	Rows      int64  `json:"rows"`
+	FirstID   int64  `json:"firstID"`
+	LastID    int64  `json:"lastID"`
+	FirstTime string `json:"firstTime"`
+	LastTime  string `json:"lastTime"`
+}
+
+func (m *Manifest) file(table, month string) *File {
+	for _, f := range m.Files {
+		if f.Table == table && f.Month == month {
+			return f
+		}
+	}
+	f := &File{
+		Table: table,
+		Month: month,
+		Path:  path.Join(table, month+".ndjson.gz"),
+	}
+	m.Files = append(m.Files, f)
+	sort.Slice(m.Files, func(i, j int) bool {
+		if m.Files[i].Table != m.Files[j].Table {
+			return m.Files[i].Table < m.Files[j].Table
+		}
+		return m.Files[i].Month < m.Files[j].Month
+	})
+	return f
+}
+
+// ReadManifest reads the manifest of the archive in dir. A missing
+// manifest is an empty archive.
+func ReadManifest(dir string) (*Manifest, error) {
+	var m Manifest
+	buf, err := ioutil.ReadFile(filepath.Join(dir, manifestName))
+	if os.IsNotExist(err) {
+		return &m, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(buf, &m); err != nil {
+		return nil, fmt.Errorf("bad archive manifest: %w", err)
+	}
+	return &m, nil
+}
+
+func writeManifest(dir string, m *Manifest) error {
+	buf, err := json.MarshalIndent(m, "", "\t")
+	if err != nil {
+		return err
+	}
+	buf = append(buf, '\n')
+	tmp := filepath.Join(dir, manifestName+".tmp")
+	if err := writeFileSync(tmp, buf); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(dir, manifestName))
+}
+
+func writeFileSync(name string, data []byte) error {
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := f.Write(data); err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// Archiver writes rows to the archive in a directory.
+type Archiver struct {
+	dir string
+	mu  sync.Mutex
+}
+
+func New(dir string) *Archiver {
+	a := &Archiver{
+		dir: dir,
+	}
+	return a
+}
+
+// month is a batch of rows going to one file.
+type month struct {
+	lines bytes.Buffer
+	rows  int64
+	ids   [2]int64
+	times [2]string
+}
+
+// Archive writes rows of table to the archive. It fits the
+// retention.Policy Archive field.
+func (a *Archiver) Archive(table string, rows *sqlite.Stmt) error {
+	months := make(map[string]*month)
+	for {
+		hasRow, err := rows.Step()
+		if err != nil {
+			return err
+		}
+		if !hasRow {
+			break
+		}
+		row, err := rowJSON(rows)
+		if err != nil {
+			return fmt.Errorf("%s: %w", table, err)
+		}
+		var id int64
+		if rows.ColumnIndex("id") >= 0 {
+			id = rows.GetInt64("id")
+		}
+		t := rows.GetText("time")
+		if len(t) < len("2006-01") {
+			return fmt.Errorf("%s: bad time: %d: %q", table, id, t)
+		}
+		key := t[:len("2006-01")]
+		m, ok := months[key]
+		if !ok {
+			m = &month{
+				ids:   [2]int64{id, id},
+				times: [2]string{t, t},
+			}
+			months[key] = m
+		}
+		m.lines.Write(row)
+		m.lines.WriteByte('\n')
+		m.rows++
+		m.ids[1] = id
+		if t < m.times[0] {
+			m.times[0] = t
+		}
+		if t > m.times[1] {
+			m.times[1] = t
+		}
+	}
+	if len(months) == 0 {
+		return nil
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	manifest, err := ReadManifest(a.dir)
+	if err != nil {
+		return err
+	}
+	keys := make([]string, 0, len(months))
+	for key := range months {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		m := months[key]
+		f := manifest.file(table, key)
+		if err := a.appendFile(f.Path, m.lines.Bytes()); err != nil {
+			return err
+		}
+		if f.Rows == 0 || m.ids[0] < f.FirstID {
+			f.FirstID = m.ids[0]
+		}
+		if m.ids[1] > f.LastID {
+			f.LastID = m.ids[1]
+		}
+		if f.Rows == 0 || m.times[0] < f.FirstTime {
+			f.FirstTime = m.times[0]
+		}
+		if m.times[1] > f.LastTime {
+			f.LastTime = m.times[1]
+		}
+		f.Rows += m.rows
+	}
+	return writeManifest(a.dir, manifest)
+}
+
+// appendFile adds a gzip member holding lines to the file.
+func (a *Archiver) appendFile(rel string, lines []byte) error {
+	name := filepath.Join(a.dir, filepath.FromSlash(rel))
+	if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	zw := gzip.NewWriter(f)
+	if _, err := zw.Write(lines); err != nil {
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// rowJSON returns the current row as a JSON object.
+func rowJSON(stmt *sqlite.Stmt) ([]byte, error) {
+	row := make(map[string]interface{}, stmt.ColumnCount())
+	for i := 0; i < stmt.ColumnCount(); i++ {
+		name := stmt.ColumnName(i)
+		switch typ := stmt.ColumnType(i); typ {
+		case sqlite.SQLITE_INTEGER:
+			row[name] = stmt.ColumnInt64(i)
+		case sqlite.SQLITE_FLOAT:
+			row[name] = stmt.ColumnFloat(i)
+		case sqlite.SQLITE_TEXT:
+			row[name] = stmt.ColumnText(i)
+		case sqlite.SQLITE_NULL:
+			row[name] = nil
+		default:
+			return nil, fmt.Errorf("column %s: unsupported type: %v", name, typ)
+		}
+	}
+	return json.Marshal(row)
+}
+
+// Import loads the archive in dir into db, and returns how many rows
+// were added. Rows already in db are left alone.
+//
+// Foreign keys are not enforced during the import, as an archive does
+// not hold the sensors and such its rows refer to. Import into a
+// separate database, not the one the daemon uses.
+func Import(ctx context.Context, db *database.DB, dir string) (int64, error) {
+	manifest, err := ReadManifest(dir)
+	if err != nil {
+		return 0, err
+	}
+	known := make(map[string]bool)
+	for _, t := range retention.ArchivedTables() {
+		known[t] = true
+	}
+
+	conn := db.Get(ctx)
+	if conn == nil {
+		return 0, context.Canceled
+	}
+	defer db.Put(conn)
+	if err := sqlitex.ExecTransient(conn, "PRAGMA foreign_keys=0;", nil); err != nil {
+		return 0, err
+	}
+	defer func() {
+		_ = sqlitex.ExecTransient(conn, "PRAGMA foreign_keys=1;", nil)
+	}()
+
+	var total int64
+	for _, f := range manifest.Files {
+		if !known[f.Table] {
+			return total, fmt.Errorf("archive: unknown table: %q", f.Table)
+		}
+		n, err := importFile(conn, f.Table, filepath.Join(dir, filepath.FromSlash(f.Path)))
+		if err != nil {
+			return total, fmt.Errorf("archive: %s: %w", f.Path, err)
+		}
+		total += n
+	}
+	return total, nil
+}
+
+func columns(conn *sqlite.Conn, table string) (map[string]bool, error) {
+	cols := make(map[string]bool)
+	err := sqlitex.ExecTransient(conn, fmt.Sprintf("PRAGMA table_info(%q);", table), func(stmt *sqlite.Stmt) error {
+		cols[stmt.GetText("name")] = true
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return cols, nil
+}
+
+func importFile(conn *sqlite.Conn, table, name string) (n int64, err error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		return 0, err
+	}
+	defer zr.Close()
+
+	cols, err := columns(conn, table)
+	if err != nil {
+		return 0, err
+	}
+
+	defer sqlitex.Save(conn)(&err)
+	dec := json.NewDecoder(zr)
+	dec.UseNumber()
+	for {
+		var row map[string]interface{}
+		if err := dec.Decode(&row); err != nil {
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			return 0, err
+		}
+		added, err := insertRow(conn, table, cols, row)
+		if err != nil {
+			return 0, err
+		}
+		if added {
+			n++
+		}
+	}
+	return n, nil
+}
+
+func insertRow(conn *sqlite.Conn, table string, cols map[string]bool, row map[string]interface{}) (bool, error) {
+	names := make([]string, 0, len(row))
+	for name := range row {
+		if !cols[name] {
+			return false, fmt.Errorf("unknown column: %q", name)
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	quoted := make([]string, len(names))
+	params := make([]string, len(names))
+	for i, name := range names {
+		quoted[i] = fmt.Sprintf("%q", name)
+		params[i] = fmt.Sprintf("?%d", i+1)
+	}
+	query := fmt.Sprintf("INSERT OR IGNORE INTO %q(%s) VALUES (%s);",
+		table, strings.Join(quoted, ", "), strings.Join(params, ", "),
+	)
+	stmt := conn.Prep(query)
+	if err := stmt.Reset(); err != nil {
+		return false, err
+	}
+	if err := stmt.ClearBindings(); err != nil {
+		return false, err
+	}
+	for i, name := range names {
+		param := i + 1
+		switch v := row[name].(type) {
+		case nil:
+			stmt.BindNull(param)
+		case string:
+			stmt.BindText(param, v)
+		case json.Number:
+			if n, err := v.Int64(); err == nil {
+				stmt.BindInt64(param, n)
+				continue
+			}
+			x, err := v.Float64()
+			if err != nil {
+				return false, fmt.Errorf("column %s: %w", name, err)
+			}
+			stmt.BindFloat(param, x)
+		default:
+			return false, fmt.Errorf("column %s: unsupported value: %T", name, v)
+		}
+	}
+	if _, err := stmt.Step(); err != nil {
+		return false, err
+	}
+	return conn.Changes() > 0, nil
+}
@@ -0,0 +1,251 @@
+package archive_test
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"crawshaw.io/sqlite/sqlitex"
+	"eagain.net/go/securityblanket/internal/archive"
+	"eagain.net/go/securityblanket/internal/database"
+	"eagain.net/go/securityblanket/internal/retention"
+	"github.com/google/go-cmp/cmp"
+	"go.uber.org/zap/zaptest"
+)
+
+func execScript(t testing.TB, db *database.DB, sql string) {
+	conn := db.Get(nil)
+	defer db.Put(conn)
+
+	if err := sqlitex.ExecScript(conn, sql); err != nil {
+		t.Fatalf("database error: %v", err)
+	}
+}
+
+func tempDir(t testing.TB) string {
+	dir, err := ioutil.TempDir("", "securityblanket-archive-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+var start = time.Date(2020, 1, 30, 4, 5, 6, 0, time.UTC)
+
+type raw struct {
+	ID    int64
+	Time  string
+	Model string
+	RSSI  float64
+	Data  string
+}
+
+func rawRows(t testing.TB, db *database.DB) []raw {
+	conn := db.Get(nil)
+	defer db.Put(conn)
+	stmt := conn.Prep(`SELECT id, time, model, coalesce(rssi, 0) AS rssi, data FROM rtl433_raw ORDER BY id`)
+	defer stmt.Finalize()
+	var rows []raw
+	for {
+		hasRow, err := stmt.Step()
+		if err != nil {
+			t.Fatalf("database error: %v", err)
+		}
+		if !hasRow {
+			break
+		}
+		rows = append(rows, raw{
+			ID:    stmt.GetInt64("id"),
+			Time:  stmt.GetText("time"),
+			Model: stmt.GetText("model"),
+			RSSI:  stmt.GetFloat("rssi"),
+			Data:  stmt.GetText("data"),
+		})
+	}
+	return rows
+}
+
+func TestArchiveImport(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	db := database.Scratch()
+	defer db.Close()
+	var sql strings.Builder
+	ts := start
+	for i := 0; i < 6; i++ {
+		fmt.Fprintf(&sql, `
+INSERT INTO rtl433_raw(time, freqMHz, model, rssi, data)
+VALUES ('%s', 345, 'Honeywell-Security', %g, '{"id": %d}');
+`, ts.Format(time.RFC3339Nano), -10.5-float64(i), i)
+		ts = ts.Add(24 * time.Hour)
+	}
+	sql.WriteString(`
+INSERT INTO catchup(name, last) VALUES ('honeywell5800.receive', 6), ('rfjam.noise', 6);
+`)
+	execScript(t, db, sql.String())
+	orig := rawRows(t, db)
+
+	policy, err := retention.For("rtl433_raw", 24*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	policy.Archive = archive.New(dir).Archive
+	now := start.Add(100 * 24 * time.Hour)
+	p := retention.New(context.Background(), db, zaptest.NewLogger(t),
+		[]*retention.Policy{policy},
+		retention.Clock(func() time.Time { return now }),
+		retention.BatchSize(4),
+	)
+	if err := p.Run(); err != nil {
+		t.Fatalf("prune: %v", err)
+	}
+	if got := rawRows(t, db); len(got) != 0 {
+		t.Fatalf("rows left: %v", got)
+	}
+
+	manifest, err := archive.ReadManifest(dir)
+	if err != nil {
+		t.Fatalf("read manifest: %v", err)
+	}
+	want := []*archive.File{
+		{
+			Table:     "rtl433_raw",
+			Month:     "2020-01",
+			Path:      "rtl433_raw/2020-01.ndjson.gz",
+			Rows:      2,
+			FirstID:   1,
+			LastID:    2,
+			FirstTime: "2020-01-30T04:05:06Z",
+			LastTime:  "2020-01-31T04:05:06Z",
+		},
+		{
+			Table:     "rtl433_raw",
+			Month:     "2020-02",
+			Path:      "rtl433_raw/2020-02.ndjson.gz",
+			Rows:      4,
+			FirstID:   3,
+			LastID:    6,
+			FirstTime: "2020-02-01T04:05:06Z",
+			LastTime:  "2020-02-04T04:05:06Z",
+		},
+	}
+	if diff := cmp.Diff(want, manifest.Files); diff != "" {
+		t.Errorf("wrong manifest: -want +got\n%s", diff)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "rtl433_raw", "2020-02.ndjson.gz")); err != nil {
+		t.Errorf("archive file: %v", err)
+	}
+
+	scratch := database.Scratch()
+	defer scratch.Close()
+	n, err := archive.Import(context.Background(), scratch, dir)
+	if err != nil {
+		t.Fatalf("import: %v", err)
+	}
+	if n != 6 {
+		t.Errorf("wrong number of rows imported: %d", n)
+	}
+	if diff := cmp.Diff(orig, rawRows(t, scratch)); diff != "" {
+		t.Errorf("wrong rows imported: -want +got\n%s", diff)
+	}
+
+	// importing again changes nothing
+	n, err = archive.Import(context.Background(), scratch, dir)
+	if err != nil {
+		t.Fatalf("import again: %v", err)
+	}
+	if n != 0 {
+		t.Errorf("rows imported twice: %d", n)
+	}
+}
+
+func TestImportUpdates(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	db := database.Scratch()
+	defer db.Close()
+	execScript(t, db, `
+INSERT INTO honeywell5800_sensors(id) VALUES (1);
+INSERT INTO honeywell5800_updates(id, time, channel, sensor, event)
+VALUES
+	(1, '2020-01-01T00:00:00Z', 8, 1, 0),
+	(2, '2020-01-01T01:00:00Z', 8, 1, 128),
+	(3, '2020-01-01T02:00:00Z', 8, 1, 0);
+INSERT INTO honeywell5800_receptions(sensorUpdate, receiver, raw, time, rssi)
+VALUES
+	(1, 'attic', 1, '2020-01-01T00:00:00Z', -12.5),
+	(2, 'attic', 2, '2020-01-01T01:00:00Z', -11.5),
+	(2, 'garage', 3, '2020-01-01T01:00:00Z', NULL),
+	(3, 'attic', 4, '2020-01-01T02:00:00Z', -13.5);
+INSERT INTO catchup(name, last)
+VALUES
+	('honeywell5800.battery', 3),
+	('honeywell5800.signal', 3),
+	('honeywell5800.supervise', 3),
+	('honeywell5800.tamper', 3),
+	('honeywell5800.trip', 3);
+`)
+	policy, err := retention.For("honeywell5800_updates", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	policy.Archive = archive.New(dir).Archive
+	p := retention.New(context.Background(), db, zaptest.NewLogger(t), []*retention.Policy{policy})
+	if err := p.Run(); err != nil {
+		t.Fatalf("prune: %v", err)
+	}
+
+	// the sensor is not in the archive
+	scratch := database.Scratch()
+	defer scratch.Close()
+	n, err := archive.Import(context.Background(), scratch, dir)
+	if err != nil {
+		t.Fatalf("import: %v", err)
+	}
+	// two updates, and their three receptions
+	if n != 5 {
+		t.Errorf("wrong number of rows imported: %d", n)
+	}
+	conn := scratch.Get(nil)
+	defer scratch.Put(conn)
+	stmt := conn.Prep(`SELECT group_concat(event) AS events FROM honeywell5800_updates ORDER BY id`)
+	defer stmt.Finalize()
+	events, err := sqlitex.ResultText(stmt)
+	if err != nil {
+		t.Fatalf("database error: %v", err)
+	}
+	if g, e := events, "0,128"; g != e {
+		t.Errorf("wrong events: %q != %q", g, e)
+	}
+	recv := conn.Prep(`
+SELECT group_concat(sensorUpdate || ':' || receiver || ':' || coalesce(rssi, ''), ' ') AS receptions
+FROM (SELECT * FROM honeywell5800_receptions ORDER BY sensorUpdate, receiver)
+`)
+	defer recv.Finalize()
+	receptions, err := sqlitex.ResultText(recv)
+	if err != nil {
+		t.Fatalf("database error: %v", err)
+	}
+	if g, e := receptions, "1:attic:-12.5 2:attic:-11.5 2:garage:"; g != e {
+		t.Errorf("wrong receptions: %q != %q", g, e)
+	}
+
+	manifest, err := archive.ReadManifest(dir)
+	if err != nil {
+		t.Fatalf("read manifest: %v", err)
+	}
+	var tables []string
+	for _, f := range manifest.Files {
+		tables = append(tables, f.Table)
+	}
+	if diff := cmp.Diff([]string{"honeywell5800_receptions", "honeywell5800_updates"}, tables); diff != "" {
+		t.Errorf("wrong tables in manifest: -want +got\n%s", diff)
+	}
+}
@@ -0,0 +1,161 @@
+// Package arming keeps track of the arming mode of the site, and
+// classifies trips according to it.
+//
+// The mode changes only along allowed transitions, and every change
+// records who made it and how. Each trip is classified as an alarm, a
+// chime or ignored, according to the mode at the time of the trip and
+// the rules in the arming_kind_rules and arming_loop_rules tables.
+package arming
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"crawshaw.io/sqlite"
+	"crawshaw.io/sqlite/sqlitex"
+	"eagain.net/go/securityblanket/internal/database"
+)
+
+// transitions lists the modes each mode can change to. Going from
+// away to night means coming home first.
+var transitions = map[Mode][]Mode{
+	Disarmed: {Home, Away, Night},
+	Home:     {Disarmed, Away, Night},
+	Away:     {Disarmed, Home},
+	Night:    {Disarmed, Home},
+}
+
+// CanChange reports whether the mode can change from one mode to
+// another.
+func CanChange(from, to Mode) bool {
+	for _, m := range transitions[from] {
+		if m == to {
+			return true
+		}
+	}
+	return false
+}
+
+// Change is a change of arming mode.
+type Change struct {
+	Time time.Time
+	Mode Mode
+	// ChangedBy is who made the change.
+	ChangedBy string
+	// Via is what was used to make the change.
+	Via string
+}
+
+// ErrTransition is returned for changes not allowed by the state
+// machine.
+var ErrTransition = errors.New("arming mode transition not allowed")
+
+// changes iterates through mode changes, latest first, until fn
+// returns false.
+func changes(conn *sqlite.Conn, fn func(*Change) bool) error {
+	stmt := fetch_arming_changes.Prep(conn)
+	defer stmt.Finalize()
+	for {
+		hasRow, err := stmt.Step()
+		if err != nil {
+			return fmt.Errorf("error fetching arming changes: %w", err)
+		}
+		if !hasRow {
+			return nil
+		}
+		c := &Change{
+			ChangedBy: stmt.GetText("changedBy"),
+			Via:       stmt.GetText("via"),
+		}
+		if c.Time, err = database.GetTime(stmt, "time"); err != nil {
+			return err
+		}
+		if c.Mode, err = ModeFromSQL(stmt, "mode"); err != nil {
+			return err
+		}
+		if !fn(c) {
+			return stmt.Reset()
+		}
+	}
+}
+
+// changeAt returns the mode change in effect at time t.
+func changeAt(conn *sqlite.Conn, t time.Time) (*Change, error) {
+	at := &Change{Mode: Disarmed}
+	fn := func(c *Change) bool {
+		if c.Time.After(t) {
+			return true
+		}
+		at = c
+		return false
+	}
+	if err := changes(conn, fn); err != nil {
+		return nil, err
+	}
+	return at, nil
+}
+
+func current(conn *sqlite.Conn) (*Change, error) {
+	var cur *Change
+	fn := func(c *Change) bool {
+		cur = c
+		return false
+	}
+	if err := changes(conn, fn); err != nil {
+		return nil, err
+	}
+	if cur == nil {
+		// never armed
+		cur = &Change{Mode: Disarmed}
+	}
+	return cur, nil
+}
+
+// Current returns the latest mode change. A site that has never been
+// armed is disarmed, with zero time and nobody having changed it.
+func Current(ctx context.Context, db *database.DB) (*Change, error) {
+	conn := db.Get(ctx)
+	if conn == nil {
+		return nil, context.Canceled
+	}
+	defer db.Put(conn)
+	return current(conn)
+}
+
+// Set changes the arming mode. Changes must be made in chronological
+// order, and follow the allowed transitions.
+func Set(ctx context.Context, db *database.DB, change *Change) (err error) {
+	if change.ChangedBy == "" {
+		return errors.New("arming change needs a name")
+	}
+	conn := db.Get(ctx)
+	if conn == nil {
+		return context.Canceled
+	}
+	defer db.Put(conn)
+	defer sqlitex.Save(conn)(&err)
+
+	cur, err := current(conn)
+	if err != nil {
+		return err
+	}
+	if !CanChange(cur.Mode, change.Mode) {
+		return fmt.Errorf("%w: %v to %v", ErrTransition, cur.Mode, change.Mode)
+	}
+	if change.Time.Before(cur.Time) {
+		return fmt.Errorf("arming change is older than current mode: %v < %v", change.Time, cur.Time)
+	}
+
+	stmt := insert_arming_change.Prep(conn)
+	defer stmt.Finalize()
+	database.BindTime(stmt, "@time", change.Time)
+	stmt.SetText("@mode", change.Mode.String())
+	stmt.SetText("@changedBy", change.ChangedBy)
+	stmt.SetText("@via", change.Via)
+	if _, err := stmt.Step(); err != nil {
+		return fmt.Errorf("add arming change: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,322 @@
+package arming_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"crawshaw.io/sqlite/sqlitex"
+	"eagain.net/go/securityblanket/internal/arming"
+	"eagain.net/go/securityblanket/internal/database"
+	"github.com/google/go-cmp/cmp"
+	"go.uber.org/zap/zaptest"
+)
+
+func execScript(t testing.TB, db *database.DB, sql string) {
+	conn := db.Get(nil)
+	defer db.Put(conn)
+
+	if err := sqlitex.ExecScript(conn, sql); err != nil {
+		t.Fatalf("database error: %v", err)
+	}
+}
+
+var start = time.Date(2020, 2, 3, 4, 5, 6, 0, time.UTC)
+
+func TestModeKnownFromDB(t *testing.T) {
+	db := database.Scratch()
+	defer db.Close()
+	conn := db.Get(nil)
+	defer db.Put(conn)
+	stmt := conn.Prep(`
+SELECT id AS mode FROM arming_modes
+`)
+	defer stmt.Finalize()
+	n := 0
+	for {
+		hasRow, err := stmt.Step()
+		if err != nil {
+			t.Fatalf("database error: %v", err)
+		}
+		if !hasRow {
+			break
+		}
+		n++
+		m, err := arming.ModeFromSQL(stmt, "mode")
+		if err != nil {
+			t.Errorf("did not recognize mode: %q", stmt.GetText("mode"))
+		}
+		if g, e := m.String(), stmt.GetText("mode"); g != e {
+			t.Errorf("mode did not roundtrip: %q != %q", g, e)
+		}
+	}
+	if g, e := n, len(arming.ModeValues()); g != e {
+		t.Errorf("wrong number of modes in database: %d != %d", g, e)
+	}
+}
+
+func TestSet(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	db := database.Scratch()
+	defer db.Close()
+
+	cur, err := arming.Current(ctx, db)
+	if err != nil {
+		t.Fatalf("current: %v", err)
+	}
+	if diff := cmp.Diff(&arming.Change{Mode: arming.Disarmed}, cur); diff != "" {
+		t.Errorf("wrong initial mode (-want +got):\n%s", diff)
+	}
+
+	away := &arming.Change{Time: start, Mode: arming.Away, ChangedBy: "alex", Via: "cli"}
+	if err := arming.Set(ctx, db, away); err != nil {
+		t.Fatalf("set: %v", err)
+	}
+	cur, err = arming.Current(ctx, db)
+	if err != nil {
+		t.Fatalf("current: %v", err)
+	}
+	if diff := cmp.Diff(away, cur); diff != "" {
+		t.Errorf("wrong mode (-want +got):\n%s", diff)
+	}
+
+	// away to night is not allowed
+	night := &arming.Change{Time: start.Add(time.Hour), Mode: arming.Night, ChangedBy: "alex"}
+	if err := arming.Set(ctx, db, night); !errors.Is(err, arming.ErrTransition) {
+		t.Errorf("wrong error for bad transition: %v", err)
+	}
+	// neither is staying in the same mode
+	again := &arming.Change{Time: start.Add(time.Hour), Mode: arming.Away, ChangedBy: "alex"}
+	if err := arming.Set(ctx, db, again); !errors.Is(err, arming.ErrTransition) {
+		t.Errorf("wrong error for same mode: %v", err)
+	}
+	past := &arming.Change{Time: start.Add(-time.Hour), Mode: arming.Disarmed, ChangedBy: "alex"}
+	if err := arming.Set(ctx, db, past); err == nil {
+		t.Error("expected error for change in the past")
+	}
+	anonymous := &arming.Change{Time: start.Add(time.Hour), Mode: arming.Disarmed}
+	if err := arming.Set(ctx, db, anonymous); err == nil {
+		t.Error("expected error for anonymous change")
+	}
+
+	cur, err = arming.Current(ctx, db)
+	if err != nil {
+		t.Fatalf("current: %v", err)
+	}
+	if diff := cmp.Diff(away, cur); diff != "" {
+		t.Errorf("wrong mode (-want +got):\n%s", diff)
+	}
+}
+
+type classified struct {
+	Trip   int64
+	Mode   string
+	Action string
+}
+
+func classifications(t testing.TB, db *database.DB) []classified {
+	conn := db.Get(nil)
+	defer db.Put(conn)
+	stmt := conn.Prep(`
+SELECT trip, mode, action
+FROM arming_trips
+ORDER BY trip
+`)
+	defer stmt.Finalize()
+	var got []classified
+	for {
+		hasRow, err := stmt.Step()
+		if err != nil {
+			t.Fatalf("database error: %v", err)
+		}
+		if !hasRow {
+			break
+		}
+		got = append(got, classified{
+			Trip:   stmt.GetInt64("trip"),
+			Mode:   stmt.GetText("mode"),
+			Action: stmt.GetText("action"),
+		})
+	}
+	return got
+}
+
+func TestClassify(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	db := database.Scratch()
+	defer db.Close()
+
+	log := zaptest.NewLogger(t)
+	wakeups := 0
+	classifier := arming.New(ctx, db, log,
+		arming.Wakeup(func() { wakeups++ }),
+	)
+
+	execScript(t, db, `
+INSERT INTO honeywell5800_sensors(id, model, description) VALUES
+	(1, '5800MINI', 'front door'),
+	(2, '5800PIR-RES', 'hallway'),
+	(3, '5808W3', 'kitchen'),
+	(4, '5800PIR-RES', 'garage');
+
+-- the garage has no business seeing motion at night
+INSERT INTO arming_loop_rules(mode, sensor, loop, action)
+VALUES ('night', 4, 1, 'alarm');
+`)
+	set := func(d time.Duration, mode arming.Mode) {
+		t.Helper()
+		c := &arming.Change{Time: start.Add(d), Mode: mode, ChangedBy: "alex"}
+		if err := arming.Set(ctx, db, c); err != nil {
+			t.Fatalf("set: %v", err)
+		}
+	}
+	trip := func(id int, d time.Duration, sensor int) {
+		t.Helper()
+		execScript(t, db, fmt.Sprintf(`
+INSERT INTO honeywell5800_updates(id, time, channel, sensor, event)
+VALUES (%[1]d, '%[2]s', 8, %[3]d, 128);
+
+INSERT INTO honeywell5800_trips(id, sensor, loop, trippedBy)
+VALUES (%[1]d, %[3]d, 1, %[1]d);
+`, id, start.Add(d).Format(time.RFC3339Nano), sensor))
+	}
+
+	// disarmed
+	trip(1, 0, 1)
+	trip(2, 0, 2)
+	trip(3, 0, 3)
+	set(time.Hour, arming.Home)
+	trip(4, time.Hour, 1)
+	trip(5, time.Hour, 2)
+	set(2*time.Hour, arming.Night)
+	trip(6, 2*time.Hour, 2)
+	trip(7, 2*time.Hour, 4)
+	// classified by the mode at the time of the trip, not when
+	// processed
+	set(3*time.Hour, arming.Disarmed)
+
+	if err := classifier.Run(); err != nil {
+		t.Fatalf("run: %v", err)
+	}
+	want := []classified{
+		{Trip: 1, Mode: "disarmed", Action: "chime"},
+		{Trip: 2, Mode: "disarmed", Action: "ignored"},
+		{Trip: 3, Mode: "disarmed", Action: "alarm"},
+		{Trip: 4, Mode: "home", Action: "alarm"},
+		{Trip: 5, Mode: "home", Action: "ignored"},
+		{Trip: 6, Mode: "night", Action: "ignored"},
+		{Trip: 7, Mode: "night", Action: "alarm"},
+	}
+	if diff := cmp.Diff(want, classifications(t, db)); diff != "" {
+		t.Errorf("wrong classifications (-want +got):\n%s", diff)
+	}
+	if g, e := wakeups, 4; g != e {
+		t.Errorf("wrong number of wakeups: %v != %v", g, e)
+	}
+}
+
+func TestEntryExitDelay(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	db := database.Scratch()
+	defer db.Close()
+
+	log := zaptest.NewLogger(t)
+	now := start
+	wakeups := 0
+	opts := []arming.Option{
+		arming.Clock(func() time.Time { return now }),
+		arming.Wakeup(func() { wakeups++ }),
+	}
+	classifier := arming.New(ctx, db, log, opts...)
+	run := func() {
+		t.Helper()
+		if err := classifier.Run(); err != nil {
+			t.Fatalf("run: %v", err)
+		}
+	}
+
+	execScript(t, db, `
+INSERT INTO honeywell5800_sensors(id, model, description) VALUES
+	(1, '5800MINI', 'front door'),
+	(2, '5800PIR-RES', 'hallway'),
+	(3, '5800MINI', 'back door');
+
+INSERT INTO honeywell5800_site_loops(sensor, loop, entryExit)
+VALUES (1, 1, true);
+`)
+	set := func(d time.Duration, mode arming.Mode) {
+		t.Helper()
+		c := &arming.Change{Time: start.Add(d), Mode: mode, ChangedBy: "alex"}
+		if err := arming.Set(ctx, db, c); err != nil {
+			t.Fatalf("set: %v", err)
+		}
+	}
+	trip := func(id int, d time.Duration, sensor int) {
+		t.Helper()
+		execScript(t, db, fmt.Sprintf(`
+INSERT INTO honeywell5800_updates(id, time, channel, sensor, event)
+VALUES (%[1]d, '%[2]s', 8, %[3]d, 128);
+
+INSERT INTO honeywell5800_trips(id, sensor, loop, trippedBy)
+VALUES (%[1]d, %[3]d, 1, %[1]d);
+`, id, start.Add(d).Format(time.RFC3339Nano), sensor))
+	}
+
+	// leaving
+	set(0, arming.Away)
+	trip(1, 30*time.Second, 2)
+	trip(2, 40*time.Second, 1)
+	trip(3, 50*time.Second, 3)
+	now = start.Add(time.Minute)
+	run()
+	want := []classified{
+		{Trip: 1, Mode: "away", Action: "ignored"},
+		{Trip: 2, Mode: "away", Action: "ignored"},
+		{Trip: 3, Mode: "away", Action: "alarm"},
+	}
+	if diff := cmp.Diff(want, classifications(t, db)); diff != "" {
+		t.Errorf("wrong classifications (-want +got):\n%s", diff)
+	}
+
+	// coming back and disarming in time
+	trip(4, time.Hour, 1)
+	trip(5, time.Hour+10*time.Second, 2)
+	now = start.Add(time.Hour + 20*time.Second)
+	run()
+	if diff := cmp.Diff(want, classifications(t, db)); diff != "" {
+		t.Errorf("wrong classifications (-want +got):\n%s", diff)
+	}
+	set(time.Hour+25*time.Second, arming.Disarmed)
+	now = start.Add(time.Hour + 40*time.Second)
+	run()
+	want = append(want,
+		classified{Trip: 4, Mode: "away", Action: "ignored"},
+		classified{Trip: 5, Mode: "away", Action: "ignored"},
+	)
+	if diff := cmp.Diff(want, classifications(t, db)); diff != "" {
+		t.Errorf("wrong classifications (-want +got):\n%s", diff)
+	}
+
+	// an intruder, with a restart in the middle of the countdown
+	set(2*time.Hour, arming.Away)
+	trip(6, 3*time.Hour, 1)
+	now = start.Add(3*time.Hour + 10*time.Second)
+	run()
+	classifier = arming.New(ctx, db, log, opts...)
+	now = start.Add(3*time.Hour + 30*time.Second)
+	run()
+	want = append(want,
+		classified{Trip: 6, Mode: "away", Action: "alarm"},
+	)
+	if diff := cmp.Diff(want, classifications(t, db)); diff != "" {
+		t.Errorf("wrong classifications (-want +got):\n%s", diff)
+	}
+	if g, e := wakeups, 2; g != e {
+		t.Errorf("wrong number of wakeups: %v != %v", g, e)
+	}
+}
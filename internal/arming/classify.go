@@ -0,0 +1,340 @@
+package arming
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"crawshaw.io/sqlite"
+	"crawshaw.io/sqlite/sqlitex"
+	"eagain.net/go/securityblanket/internal/catchup"
+	"eagain.net/go/securityblanket/internal/database"
+	"eagain.net/go/securityblanket/internal/honeywell5800"
+	"go.uber.org/zap"
+)
+
+type config struct {
+	clock  func() time.Time
+	wakeup func()
+}
+
+type Option option
+
+type option func(*config)
+
+// Clock overrides the source of time used for entry delays.
+func Clock(clock func() time.Time) Option {
+	fn := func(conf *config) {
+		conf.clock = clock
+	}
+	return fn
+}
+
+// Wakeup is called whenever a trip is classified as something other
+// than ignored.
+func Wakeup(wakeup func()) Option {
+	fn := func(conf *config) {
+		conf.wakeup = wakeup
+	}
+	return fn
+}
+
+// Classifier classifies Honeywell 5800 trips according to the arming
+// mode at the time of the trip.
+//
+// Trips waiting for an entry delay are only classified once the delay
+// is over, so Run needs to be called periodically even when nothing
+// trips.
+type Classifier struct {
+	ctx     context.Context
+	db      *database.DB
+	catchup *catchup.Catchup
+	log     *zap.Logger
+	config  config
+}
+
+func New(ctx context.Context, db *database.DB, log *zap.Logger, opts ...Option) *Classifier {
+	c := &Classifier{
+		ctx: ctx,
+		db:  db,
+		catchup: catchup.New(&catchup.Config{
+			DB:      db,
+			Log:     log.Named("catchup"),
+			Name:    "arming.classify",
+			MaxSQL:  fetch_honeywell5800_trips_max.Content,
+			NextSQL: fetch_honeywell5800_trips.Content,
+		}),
+		log: log,
+		config: config{
+			clock:  time.Now,
+			wakeup: func() {},
+		},
+	}
+	for _, opt := range opts {
+		opt(&c.config)
+	}
+	return c
+}
+
+// Run classifies new trips, and then finishes entry delays that are
+// over.
+func (c *Classifier) Run() error {
+	if err := c.catchup.Run(c.ctx, c.run); err != nil {
+		return err
+	}
+	if err := c.resolve(); err != nil {
+		return fmt.Errorf("entry delays: %w", err)
+	}
+	return nil
+}
+
+func seconds(stmt *sqlite.Stmt, param string) (time.Duration, error) {
+	f, ok, err := database.GetNullFloat(stmt, param)
+	if err != nil || !ok {
+		return 0, err
+	}
+	return time.Duration(f * float64(time.Second)), nil
+}
+
+// latestEntryDelay returns the deadline of the entry delay counting
+// down at time t, or zero time.
+func latestEntryDelay(conn *sqlite.Conn, t time.Time) (time.Time, error) {
+	stmt := fetch_arming_entry_delay_latest.Prep(conn)
+	defer stmt.Finalize()
+	hasRow, err := stmt.Step()
+	if err != nil {
+		return time.Time{}, fmt.Errorf("error fetching entry delays: %w", err)
+	}
+	if !hasRow {
+		return time.Time{}, nil
+	}
+	started, err := database.GetTime(stmt, "started")
+	if err != nil {
+		return time.Time{}, err
+	}
+	deadline, err := database.GetTime(stmt, "deadline")
+	if err != nil {
+		return time.Time{}, err
+	}
+	if err := database.NoMoreRows(stmt); err != nil {
+		return time.Time{}, err
+	}
+	if t.Before(started) || !t.Before(deadline) {
+		return time.Time{}, nil
+	}
+	return deadline, nil
+}
+
+func (c *Classifier) run(conn *sqlite.Conn, stmt *sqlite.Stmt) error {
+	tripID := stmt.GetInt64("id")
+	sensor := honeywell5800.SensorFromSQL(stmt, "sensor")
+	loop, err := database.GetUint8(stmt, "loop")
+	if err != nil {
+		return fmt.Errorf("bad loop in database: trip %d: %w", tripID, err)
+	}
+	t, err := database.GetTime(stmt, "time")
+	if err != nil {
+		return fmt.Errorf("bad trip time: %d: %w", tripID, err)
+	}
+
+	change, err := changeAt(conn, t)
+	if err != nil {
+		return err
+	}
+	mode := change.Mode
+
+	actionStmt := fetch_arming_action.Prep(conn)
+	defer actionStmt.Finalize()
+	actionStmt.SetText("@mode", mode.String())
+	sensor.ToSQL(actionStmt, "@sensor")
+	actionStmt.SetInt64("@loop", int64(loop))
+	if err := database.Row(actionStmt); err != nil {
+		return fmt.Errorf("error fetching arming rules: trip %d: %w", tripID, err)
+	}
+	kind := actionStmt.GetText("kind")
+	entryExit := actionStmt.GetInt64("entryExit") != 0
+	action, err := ActionFromSQL(actionStmt, "action")
+	if err != nil {
+		return err
+	}
+	exitDelay, err := seconds(actionStmt, "exitDelay")
+	if err != nil {
+		return err
+	}
+	entryDelay, err := seconds(actionStmt, "entryDelay")
+	if err != nil {
+		return err
+	}
+	if err := database.NoMoreRows(actionStmt); err != nil {
+		return err
+	}
+
+	log := c.log.With(
+		zap.Int64("trip", tripID),
+		zap.Stringer("sensor", sensor),
+		zap.Uint8("loop", loop),
+		zap.String("kind", kind),
+		zap.Stringer("mode", mode),
+	)
+
+	if action == Alarm {
+		// people walk past motion detectors on their way to the
+		// door or the keypad
+		isPath := entryExit || kind == honeywell5800.MotionDetector.String()
+		var deadline time.Time
+		switch {
+		case isPath && t.Before(change.Time.Add(exitDelay)):
+			log.Info("exit.delay")
+			action = Ignored
+		case entryExit && entryDelay > 0:
+			deadline = t.Add(entryDelay)
+		case isPath:
+			// follow an entry delay already counting down
+			if deadline, err = latestEntryDelay(conn, t); err != nil {
+				return err
+			}
+		}
+		if !deadline.IsZero() {
+			ins := insert_arming_entry_delay.Prep(conn)
+			defer ins.Finalize()
+			ins.SetInt64("@trip", tripID)
+			ins.SetText("@mode", mode.String())
+			database.BindTime(ins, "@started", t)
+			database.BindTime(ins, "@deadline", deadline)
+			if _, err := ins.Step(); err != nil {
+				return fmt.Errorf("add entry delay: %d: %w", tripID, err)
+			}
+			log.Info("entry.delay", zap.Time("deadline", deadline))
+			return nil
+		}
+	}
+
+	if err := classify(conn, tripID, mode, action); err != nil {
+		return err
+	}
+	if action == Ignored {
+		log.Debug("classified", zap.Stringer("action", action))
+		return nil
+	}
+	log.Info("classified", zap.Stringer("action", action))
+	c.config.wakeup()
+	return nil
+}
+
+func classify(conn *sqlite.Conn, tripID int64, mode Mode, action Action) error {
+	ins := insert_arming_trip.Prep(conn)
+	defer ins.Finalize()
+	ins.SetInt64("@trip", tripID)
+	ins.SetText("@mode", mode.String())
+	ins.SetText("@action", action.String())
+	if _, err := ins.Step(); err != nil {
+		return fmt.Errorf("add trip classification: %d: %w", tripID, err)
+	}
+	return nil
+}
+
+// disarmedBetween reports whether the system was disarmed during the
+// time range.
+func disarmedBetween(conn *sqlite.Conn, start, end time.Time) (bool, error) {
+	var disarmed bool
+	fn := func(c *Change) bool {
+		if c.Time.Before(start) {
+			return false
+		}
+		if c.Mode == Disarmed && !c.Time.After(end) {
+			disarmed = true
+			return false
+		}
+		return true
+	}
+	if err := changes(conn, fn); err != nil {
+		return false, err
+	}
+	return disarmed, nil
+}
+
+func (c *Classifier) resolve() (err error) {
+	conn := c.db.Get(c.ctx)
+	if conn == nil {
+		return context.Canceled
+	}
+	defer c.db.Put(conn)
+	defer sqlitex.Save(conn)(&err)
+
+	now := c.config.clock()
+
+	type outcome struct {
+		trip   int64
+		mode   Mode
+		action Action
+	}
+	var outcomes []outcome
+	stmt := fetch_arming_entry_delays_pending.Prep(conn)
+	defer stmt.Finalize()
+	for {
+		hasRow, err := stmt.Step()
+		if err != nil {
+			return fmt.Errorf("error fetching entry delays: %w", err)
+		}
+		if !hasRow {
+			break
+		}
+		o := outcome{trip: stmt.GetInt64("trip")}
+		if o.mode, err = ModeFromSQL(stmt, "mode"); err != nil {
+			return err
+		}
+		started, err := database.GetTime(stmt, "started")
+		if err != nil {
+			return err
+		}
+		deadline, err := database.GetTime(stmt, "deadline")
+		if err != nil {
+			return err
+		}
+		disarmed, err := disarmedBetween(conn, started, deadline)
+		if err != nil {
+			return err
+		}
+		switch {
+		case disarmed:
+			o.action = Ignored
+		case !now.Before(deadline):
+			o.action = Alarm
+		default:
+			// still counting down
+			continue
+		}
+		outcomes = append(outcomes, o)
+	}
+
+	up := update_arming_entry_delay_outcome.Prep(conn)
+	defer up.Finalize()
+	alarms := 0
+	for _, o := range outcomes {
+		up.SetInt64("@trip", o.trip)
+		up.SetText("@outcome", o.action.String())
+		if _, err := up.Step(); err != nil {
+			return fmt.Errorf("finish entry delay: %d: %w", o.trip, err)
+		}
+		if err := up.Reset(); err != nil {
+			return err
+		}
+		if err := classify(conn, o.trip, o.mode, o.action); err != nil {
+			return err
+		}
+		if o.action == Ignored {
+			c.log.Info("entry.canceled", zap.Int64("trip", o.trip))
+			continue
+		}
+		c.log.Info("classified",
+			zap.Int64("trip", o.trip),
+			zap.Stringer("mode", o.mode),
+			zap.Stringer("action", o.action),
+		)
+		alarms++
+	}
+	if alarms > 0 {
+		c.config.wakeup()
+	}
+	return nil
+}
@@ -0,0 +1,32 @@
+-- most specific rule wins
+SELECT
+	coalesce(honeywell5800_site_loops.kind, honeywell5800_model_loops.kind) AS kind,
+	coalesce(honeywell5800_site_loops.entryExit, false) AS entryExit,
+	arming_modes.exitDelay AS exitDelay,
+	arming_modes.entryDelay AS entryDelay,
+	coalesce(
+		arming_loop_rules.action,
+		arming_kind_rules.action,
+		arming_modes.defaultAction
+	) AS action
+	FROM arming_modes
+	LEFT JOIN honeywell5800_sensors
+	ON (honeywell5800_sensors.id=@sensor)
+	LEFT JOIN honeywell5800_model_loops
+	ON (honeywell5800_model_loops.model=honeywell5800_sensors.model
+		AND honeywell5800_model_loops.loop=@loop
+	)
+	LEFT JOIN honeywell5800_site_loops
+	ON (honeywell5800_site_loops.sensor=@sensor
+		AND honeywell5800_site_loops.loop=@loop
+	)
+	LEFT JOIN arming_kind_rules
+	ON (arming_kind_rules.mode=arming_modes.id
+		AND arming_kind_rules.kind=coalesce(honeywell5800_site_loops.kind, honeywell5800_model_loops.kind)
+	)
+	LEFT JOIN arming_loop_rules
+	ON (arming_loop_rules.mode=arming_modes.id
+		AND arming_loop_rules.sensor=@sensor
+		AND arming_loop_rules.loop=@loop
+	)
+	WHERE arming_modes.id=@mode
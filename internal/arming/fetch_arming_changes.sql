@@ -0,0 +1,7 @@
+SELECT
+	time,
+	mode,
+	changedBy,
+	via
+FROM arming_changes
+ORDER BY id DESC
@@ -0,0 +1,6 @@
+SELECT
+	started,
+	deadline
+FROM arming_entry_delays
+ORDER BY trip DESC
+LIMIT 1
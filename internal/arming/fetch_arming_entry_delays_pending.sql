@@ -0,0 +1,8 @@
+SELECT
+	trip,
+	mode,
+	started,
+	deadline
+FROM arming_entry_delays
+WHERE outcome IS NULL
+ORDER BY trip
@@ -0,0 +1,12 @@
+SELECT
+	honeywell5800_trips.id AS id,
+	honeywell5800_trips.sensor AS sensor,
+	honeywell5800_trips.loop AS loop,
+	honeywell5800_updates.time AS time
+FROM honeywell5800_trips
+JOIN honeywell5800_updates
+ON (honeywell5800_updates.id=honeywell5800_trips.trippedBy)
+WHERE honeywell5800_trips.id>@last
+	AND honeywell5800_trips.id<=@max
+ORDER BY honeywell5800_trips.id ASC
+LIMIT 100
@@ -0,0 +1,2 @@
+INSERT INTO arming_changes(time, mode, changedBy, via)
+	VALUES (@time, @mode, @changedBy, @via)
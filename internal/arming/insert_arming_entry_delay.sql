@@ -0,0 +1,2 @@
+INSERT INTO arming_entry_delays(trip, mode, started, deadline)
+	VALUES (@trip, @mode, @started, @deadline)
@@ -0,0 +1,2 @@
+INSERT INTO arming_trips(trip, mode, action)
+	VALUES (@trip, @mode, @action)
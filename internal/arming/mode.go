@@ -0,0 +1,57 @@
+package arming
+
+import (
+	"fmt"
+
+	"crawshaw.io/sqlite"
+)
+
+//go:generate go run github.com/alvaroloes/enumer -type=Mode -output=mode.gen.go -linecomment
+//go:generate go run github.com/alvaroloes/enumer -type=Action -output=action.gen.go -linecomment
+
+// Mode is an arming mode.
+type Mode int
+
+const (
+	_        Mode = iota
+	Disarmed      // disarmed
+	Home          // home
+	Away          // away
+	Night         // night
+)
+
+func ModeFromSQL(stmt *sqlite.Stmt, param string) (Mode, error) {
+	col := stmt.ColumnIndex(param)
+	if col < 0 {
+		return 0, fmt.Errorf("no such column in sql row: %q", param)
+	}
+	s := stmt.ColumnText(col)
+	m, err := ModeString(s)
+	if err != nil {
+		return Mode(0), fmt.Errorf("bad arming mode in database: column %s=%q", param, s)
+	}
+	return m, nil
+}
+
+// Action is what a trip means in an arming mode.
+type Action int
+
+const (
+	_       Action = iota
+	Ignored        // ignored
+	Chime          // chime
+	Alarm          // alarm
+)
+
+func ActionFromSQL(stmt *sqlite.Stmt, param string) (Action, error) {
+	col := stmt.ColumnIndex(param)
+	if col < 0 {
+		return 0, fmt.Errorf("no such column in sql row: %q", param)
+	}
+	s := stmt.ColumnText(col)
+	a, err := ActionString(s)
+	if err != nil {
+		return Action(0), fmt.Errorf("bad arming action in database: column %s=%q", param, s)
+	}
+	return a, nil
+}
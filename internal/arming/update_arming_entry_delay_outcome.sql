@@ -0,0 +1,4 @@
+UPDATE arming_entry_delays
+	SET outcome=@outcome
+	WHERE trip=@trip
+		AND outcome IS NULL
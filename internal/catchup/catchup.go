@@ -11,8 +11,11 @@
 // 2. Rows CAN be updated, but consumers will NOT be notified; hence
 // only columns not directly used by consumers are good candidates.
 //
-// Source table MUST NOT be inserted into concurrently (this can cause
-// ids to show up out of order).
+// Ids MUST become visible in increasing order. Concurrent inserts are
+// fine when every insert into the source table is a single autocommit
+// INSERT of one row, as SQLite then assigns ids in commit order. An
+// insert inside a longer transaction can commit after a row with a
+// larger id has already been processed, and its row is never seen.
 //
 // Source tables that see any deletes (including pruning of oldest
 // entries) MUST use AUTOINCREMENT.
@@ -21,19 +24,61 @@
 // protected by the same SQLite savepoint (which roughly means they
 // must be in the same database, and changed through the same database
 // connection).
+//
+// A row the consumer fails to process is tried again after a backoff,
+// up to MaxAttempts times. After that it is skipped, so one bad row
+// cannot stop the consumer for good, and left in the
+// catchup_dead_letters table. Skipped rows can be retried by hand with
+// Retry, or forgotten with Discard. A retried row is processed out of
+// order, after the rows that came after it.
+//
+// Only errors about the row itself count against it. SQLite errors,
+// such as a full disk or a busy database, and I/O errors would fail
+// every row alike; they fail the run instead, without skipping
+// anything. Constraint violations are the exception: they come from
+// what the row contains.
+//
+// A consumer can be moved back with Rewind, to process rows again.
 package catchup
 
 import (
 	"context"
 	"errors"
 	"fmt"
+	"io"
+	"net"
+	"os"
+	"syscall"
+	"time"
 
 	"crawshaw.io/sqlite"
 	"crawshaw.io/sqlite/sqlitex"
 	"eagain.net/go/securityblanket/internal/database"
+	"eagain.net/go/securityblanket/internal/metrics"
 	"go.uber.org/zap"
 )
 
+var lagGauge = metrics.Default.Gauge(
+	"securityblanket_catchup_lag",
+	"Maximum id in the source table minus the last processed id, as of the latest run.",
+	"consumer",
+)
+
+var skippedCounter = metrics.Default.Counter(
+	"securityblanket_catchup_skipped_total",
+	"Source rows skipped after failing too many times.",
+	"consumer",
+)
+
+// DefaultMaxAttempts is how many times a row is tried before it is
+// skipped, unless Config.MaxAttempts says otherwise.
+const DefaultMaxAttempts = 3
+
+// DefaultBackoff is how long to wait before trying a failed row again
+// the first time, unless Config.Backoff says otherwise. The wait
+// doubles with every attempt.
+const DefaultBackoff = time.Second
+
 type Config struct {
 	DB   *database.DB
 	Log  *zap.Logger
@@ -45,15 +90,31 @@ type Config struct {
 	// The result must have column named id, and should use bind
 	// parameters @last and @max to limit the rows.
 	NextSQL string
+	// MaxAttempts is how many times a row is tried before it is
+	// skipped. Zero means DefaultMaxAttempts.
+	MaxAttempts int
+	// Backoff is how long to wait before trying a failed row again
+	// the first time. Zero means DefaultBackoff.
+	Backoff time.Duration
 }
 
 type Catchup struct {
-	conf Config
+	conf    Config
+	lag     *metrics.Gauge
+	skipped *metrics.Counter
 }
 
 func New(conf *Config) *Catchup {
 	c := &Catchup{
-		conf: *conf,
+		conf:    *conf,
+		lag:     lagGauge.With(conf.Name),
+		skipped: skippedCounter.With(conf.Name),
+	}
+	if c.conf.MaxAttempts == 0 {
+		c.conf.MaxAttempts = DefaultMaxAttempts
+	}
+	if c.conf.Backoff == 0 {
+		c.conf.Backoff = DefaultBackoff
 	}
 	return c
 }
@@ -105,32 +166,105 @@ func (c *Catchup) save(conn *sqlite.Conn, last int64) error {
 	return nil
 }
 
+// funcError is an error returned by the user function, as opposed to
+// one from catchup itself.
+type funcError struct {
+	err error
+}
+
+func (e *funcError) Error() string {
+	return "error from user function: " + e.err.Error()
+}
+
+func (e *funcError) Unwrap() error {
+	return e.err
+}
+
 func (c *Catchup) runRow(conn *sqlite.Conn, fn Func, stmt *sqlite.Stmt, id int64) (err error) {
 	defer sqlitex.Save(conn)(&err)
 	if err := fn(conn, stmt); err != nil {
-		return fmt.Errorf("error from user function: %w", err)
+		return &funcError{err: err}
 	}
 	if err := c.save(conn, id); err != nil {
 		return fmt.Errorf("saving last processed id: %w", err)
 	}
+	if err := c.resolve(conn, id); err != nil {
+		return err
+	}
 	return nil
 }
 
-func (c *Catchup) run(ctx context.Context, fn Func) (progress bool, err error) {
+// isLocked reports whether err is an SQLite deadlock, which is
+// resolved by trying again.
+func isLocked(err error) (sqlite.Error, bool) {
+	var sqerr sqlite.Error
+	if errors.As(err, &sqerr) && sqerr.Code == sqlite.SQLITE_LOCKED {
+		return sqerr, true
+	}
+	return sqerr, false
+}
+
+// rowFailed reports whether err is the fault of the row being
+// processed, and thus a candidate for the dead letter queue. Database
+// and I/O errors are not, even when the user function returns them,
+// except for constraint violations.
+func rowFailed(ctx context.Context, err error) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+	var ferr *funcError
+	if !errors.As(err, &ferr) {
+		return false
+	}
+	var sqerr sqlite.Error
+	if errors.As(err, &sqerr) {
+		// extended result codes keep the primary one in the low byte
+		return sqerr.Code&0xff == sqlite.SQLITE_CONSTRAINT
+	}
+	return !isIOError(err)
+}
+
+// isIOError reports whether err comes from the filesystem, the network
+// or the operating system.
+func isIOError(err error) bool {
+	var pathErr *os.PathError
+	var netErr net.Error
+	var errno syscall.Errno
+	switch {
+	case errors.As(err, &pathErr),
+		errors.As(err, &netErr),
+		errors.As(err, &errno),
+		errors.Is(err, io.ErrUnexpectedEOF),
+		errors.Is(err, context.DeadlineExceeded):
+		return true
+	}
+	return false
+}
+
+// run processes rows until it runs out, or a row fails. After a
+// failure, it returns how long to wait before starting over.
+func (c *Catchup) run(ctx context.Context, fn Func) (progress bool, wait time.Duration, err error) {
 	conn := c.conf.DB.Get(ctx)
 	if conn == nil {
-		return false, context.Canceled
+		return false, 0, context.Canceled
 	}
 	defer c.conf.DB.Put(conn)
 
 	max, err := fetchMax(conn, c.conf.MaxSQL)
 	if err != nil {
-		return false, fmt.Errorf("fetching max id: %w", err)
+		return false, 0, fmt.Errorf("fetching max id: %w", err)
 	}
 
 	last, err := c.load(conn)
 	if err != nil {
-		return false, fmt.Errorf("fetching last processed id: %w", err)
+		return false, 0, fmt.Errorf("fetching last processed id: %w", err)
+	}
+	c.lag.Set(float64(max - last))
+	defer func() {
+		c.lag.Set(float64(max - last))
+	}()
+	if err := c.retry(ctx, conn, fn); err != nil {
+		return false, 0, err
 	}
 	madeProgress := false
 	stmt := conn.Prep(c.conf.NextSQL)
@@ -140,19 +274,28 @@ func (c *Catchup) run(ctx context.Context, fn Func) (progress bool, err error) {
 	for {
 		hasRow, err := stmt.Step()
 		if err != nil {
-			return madeProgress, err
+			return madeProgress, 0, err
 		}
 		if !hasRow {
 			break
 		}
 		id := stmt.GetInt64("id")
 		if err := c.runRow(conn, fn, stmt, id); err != nil {
-			return madeProgress, err
+			if !rowFailed(ctx, err) {
+				return madeProgress, 0, err
+			}
+			wait, err := c.fail(conn, id, err, time.Now())
+			if err != nil {
+				return madeProgress, 0, err
+			}
+			// Start over, to try the row again or to move past it.
+			// Rolling back the row can restart stmt.
+			return true, wait, nil
 		}
 		last = id
 		madeProgress = true
 	}
-	return madeProgress, nil
+	return madeProgress, 0, nil
 }
 
 // Func is a function that does the actual work. The current source
@@ -165,10 +308,9 @@ type Func func(conn *sqlite.Conn, stmt *sqlite.Stmt) error
 
 func (c *Catchup) Run(ctx context.Context, fn Func) (err error) {
 	for {
-		progress, err := c.run(ctx, fn)
+		progress, wait, err := c.run(ctx, fn)
 		if err != nil {
-			var sqerr sqlite.Error
-			if errors.As(err, &sqerr) && sqerr.Code == sqlite.SQLITE_LOCKED {
+			if sqerr, ok := isLocked(err); ok {
 				c.conf.Log.Debug("retry.sqlite_deadlock",
 					zap.Stringer("code", sqerr.Code),
 					zap.String("msg", sqerr.Msg),
@@ -182,6 +324,16 @@ func (c *Catchup) Run(ctx context.Context, fn Func) (err error) {
 		if !progress {
 			break
 		}
+		if wait > 0 {
+			// the database connection is not held while waiting
+			timer := time.NewTimer(wait)
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return fmt.Errorf("catchup %v: %w", c.conf.Name, ctx.Err())
+			case <-timer.C:
+			}
+		}
 	}
 	return nil
 }
@@ -3,7 +3,9 @@ package catchup_test
 import (
 	"context"
 	"errors"
+	"fmt"
 	"testing"
+	"time"
 
 	"crawshaw.io/sqlite"
 	"crawshaw.io/sqlite/sqlitex"
@@ -28,6 +30,11 @@ CREATE TABLE test_source (
 }
 
 func makeCatchup(tb testing.TB, db *database.DB) *catchup.Catchup {
+	tb.Helper()
+	return makeCatchupBackoff(tb, db, time.Millisecond)
+}
+
+func makeCatchupBackoff(tb testing.TB, db *database.DB, backoff time.Duration) *catchup.Catchup {
 	tb.Helper()
 	createTable(tb, db)
 	c := catchup.New(&catchup.Config{
@@ -40,6 +47,7 @@ SELECT id, x FROM test_source
 WHERE id>@last AND id<=@max
 ORDER BY id ASC
 `,
+		Backoff: backoff,
 	})
 	return c
 }
@@ -88,3 +96,335 @@ INSERT INTO test_source (x) VALUES (10), (11);
 		t.Errorf("wrong results: -want +got\n%s", diff)
 	}
 }
+
+func listDeadLetters(t testing.TB, db *database.DB) []*catchup.DeadLetter {
+	t.Helper()
+	list, err := catchup.DeadLetters(context.Background(), db)
+	if err != nil {
+		t.Fatalf("dead letters: %v", err)
+	}
+	return list
+}
+
+func TestDeadLetter(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	db := database.Scratch()
+	var seen []int64
+	broken := true
+	fn := func(conn *sqlite.Conn, stmt *sqlite.Stmt) error {
+		x := stmt.GetInt64("x")
+		seen = append(seen, x)
+		if x == 11 && broken {
+			return errors.New("bad row")
+		}
+		return nil
+	}
+	c := makeCatchup(t, db)
+	execScript(t, db, `
+INSERT INTO test_source (x) VALUES (10), (11), (12);
+`)
+	if err := c.Run(ctx, fn); err != nil {
+		t.Fatalf("catchup run: %v", err)
+	}
+	want := []int64{10, 11, 11, 11, 12}
+	if diff := cmp.Diff(want, seen); diff != "" {
+		t.Errorf("wrong results: -want +got\n%s", diff)
+	}
+
+	list := listDeadLetters(t, db)
+	if len(list) != 1 {
+		t.Fatalf("wrong number of dead letters: %d", len(list))
+	}
+	d := list[0]
+	if d.Consumer != "xyzzy" || d.Source != 2 || d.Attempts != catchup.DefaultMaxAttempts {
+		t.Errorf("wrong dead letter: %+v", d)
+	}
+	if d.Error != "error from user function: bad row" {
+		t.Errorf("wrong error: %q", d.Error)
+	}
+	if d.Skipped.IsZero() || d.Retry {
+		t.Errorf("dead letter not skipped: %+v", d)
+	}
+
+	// nothing to do until asked
+	seen = nil
+	if err := c.Run(ctx, fn); err != nil {
+		t.Fatalf("catchup run: %v", err)
+	}
+	if len(seen) != 0 {
+		t.Errorf("unexpected calls: %v", seen)
+	}
+
+	// retrying a broken row keeps it skipped
+	if err := catchup.Retry(ctx, db, d.ID); err != nil {
+		t.Fatalf("retry: %v", err)
+	}
+	if err := c.Run(ctx, fn); err != nil {
+		t.Fatalf("catchup run: %v", err)
+	}
+	list = listDeadLetters(t, db)
+	if len(list) != 1 || list[0].Attempts != catchup.DefaultMaxAttempts+1 || list[0].Retry {
+		t.Errorf("wrong dead letters after failed retry: %+v", list)
+	}
+
+	broken = false
+	seen = nil
+	if err := catchup.Retry(ctx, db, d.ID); err != nil {
+		t.Fatalf("retry: %v", err)
+	}
+	execScript(t, db, `
+INSERT INTO test_source (x) VALUES (13);
+`)
+	if err := c.Run(ctx, fn); err != nil {
+		t.Fatalf("catchup run: %v", err)
+	}
+	want = []int64{11, 13}
+	if diff := cmp.Diff(want, seen); diff != "" {
+		t.Errorf("wrong results after retry: -want +got\n%s", diff)
+	}
+	if list := listDeadLetters(t, db); len(list) != 0 {
+		t.Errorf("dead letters left after retry: %+v", list)
+	}
+	if err := catchup.Retry(ctx, db, d.ID); !errors.Is(err, catchup.ErrNotFound) {
+		t.Errorf("retry of resolved dead letter: %v", err)
+	}
+}
+
+func TestDeadLetterTransient(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	db := database.Scratch()
+	var seen []int64
+	fails := 1
+	fn := func(conn *sqlite.Conn, stmt *sqlite.Stmt) error {
+		x := stmt.GetInt64("x")
+		seen = append(seen, x)
+		if x == 10 && fails > 0 {
+			fails--
+			return errors.New("try again")
+		}
+		return nil
+	}
+	c := makeCatchup(t, db)
+	execScript(t, db, `
+INSERT INTO test_source (x) VALUES (10), (11);
+`)
+	if err := c.Run(ctx, fn); err != nil {
+		t.Fatalf("catchup run: %v", err)
+	}
+	want := []int64{10, 10, 11}
+	if diff := cmp.Diff(want, seen); diff != "" {
+		t.Errorf("wrong results: -want +got\n%s", diff)
+	}
+	if list := listDeadLetters(t, db); len(list) != 0 {
+		t.Errorf("dead letters left: %+v", list)
+	}
+}
+
+func TestDeadLetterBackoff(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	db := database.Scratch()
+	var seen []time.Time
+	fn := func(conn *sqlite.Conn, stmt *sqlite.Stmt) error {
+		seen = append(seen, time.Now())
+		return errors.New("bad row")
+	}
+	c := makeCatchupBackoff(t, db, 20*time.Millisecond)
+	execScript(t, db, `
+INSERT INTO test_source (x) VALUES (10);
+`)
+	if err := c.Run(ctx, fn); err != nil {
+		t.Fatalf("catchup run: %v", err)
+	}
+	if g, e := len(seen), catchup.DefaultMaxAttempts; g != e {
+		t.Fatalf("wrong number of attempts: %d != %d", g, e)
+	}
+	for i, min := range []time.Duration{20 * time.Millisecond, 40 * time.Millisecond} {
+		if d := seen[i+1].Sub(seen[i]); d < min {
+			t.Errorf("attempt %d too soon: %v < %v", i+2, d, min)
+		}
+	}
+}
+
+func TestDatabaseErrorNotDeadLetter(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	db := database.Scratch()
+	calls := 0
+	fn := func(conn *sqlite.Conn, stmt *sqlite.Stmt) error {
+		calls++
+		return fmt.Errorf("cannot insert: %w", sqlite.Error{Code: sqlite.SQLITE_FULL})
+	}
+	c := makeCatchup(t, db)
+	execScript(t, db, `
+INSERT INTO test_source (x) VALUES (10);
+`)
+	err := c.Run(ctx, fn)
+	var sqerr sqlite.Error
+	if !errors.As(err, &sqerr) || sqerr.Code != sqlite.SQLITE_FULL {
+		t.Errorf("catchup run: %v", err)
+	}
+	if calls != 1 {
+		t.Errorf("wrong number of calls: %d", calls)
+	}
+	if list := listDeadLetters(t, db); len(list) != 0 {
+		t.Errorf("dead letters left: %+v", list)
+	}
+}
+
+func TestConstraintDeadLetter(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	db := database.Scratch()
+	c := makeCatchup(t, db)
+	execScript(t, db, `
+CREATE TABLE test_sink (
+	x INTEGER NOT NULL
+		CONSTRAINT 'not eleven' CHECK (x!=11)
+);
+INSERT INTO test_source (x) VALUES (10), (11), (12);
+`)
+	fn := func(conn *sqlite.Conn, stmt *sqlite.Stmt) error {
+		return sqlitex.Exec(conn, `INSERT INTO test_sink(x) VALUES (?)`, nil, stmt.GetInt64("x"))
+	}
+	if err := c.Run(ctx, fn); err != nil {
+		t.Fatalf("catchup run: %v", err)
+	}
+
+	list := listDeadLetters(t, db)
+	if len(list) != 1 {
+		t.Fatalf("wrong number of dead letters: %d", len(list))
+	}
+	if d := list[0]; d.Source != 2 || d.Attempts != catchup.DefaultMaxAttempts {
+		t.Errorf("wrong dead letter: %+v", d)
+	}
+
+	conn := db.Get(nil)
+	defer db.Put(conn)
+	var got []int64
+	collect := func(stmt *sqlite.Stmt) error {
+		got = append(got, stmt.GetInt64("x"))
+		return nil
+	}
+	if err := sqlitex.Exec(conn, `SELECT x FROM test_sink ORDER BY x`, collect); err != nil {
+		t.Fatalf("database error: %v", err)
+	}
+	if diff := cmp.Diff([]int64{10, 12}, got); diff != "" {
+		t.Errorf("wrong results: -want +got\n%s", diff)
+	}
+}
+
+func TestDeadLetterDiscard(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	db := database.Scratch()
+	fn := func(conn *sqlite.Conn, stmt *sqlite.Stmt) error {
+		return errors.New("bad row")
+	}
+	c := makeCatchup(t, db)
+	execScript(t, db, `
+INSERT INTO test_source (x) VALUES (10);
+`)
+	if err := c.Run(ctx, fn); err != nil {
+		t.Fatalf("catchup run: %v", err)
+	}
+	list := listDeadLetters(t, db)
+	if len(list) != 1 {
+		t.Fatalf("wrong number of dead letters: %d", len(list))
+	}
+	if err := catchup.Discard(ctx, db, list[0].ID); err != nil {
+		t.Fatalf("discard: %v", err)
+	}
+	if list := listDeadLetters(t, db); len(list) != 0 {
+		t.Errorf("dead letters left: %+v", list)
+	}
+	if err := catchup.Discard(ctx, db, list[0].ID); !errors.Is(err, catchup.ErrNotFound) {
+		t.Errorf("discard again: %v", err)
+	}
+}
+
+func TestCanceledNotDeadLetter(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	db := database.Scratch()
+	fn := func(conn *sqlite.Conn, stmt *sqlite.Stmt) error {
+		cancel()
+		return context.Canceled
+	}
+	c := makeCatchup(t, db)
+	execScript(t, db, `
+INSERT INTO test_source (x) VALUES (10);
+`)
+	if err := c.Run(ctx, fn); !errors.Is(err, context.Canceled) {
+		t.Errorf("catchup run: %v", err)
+	}
+	if list := listDeadLetters(t, db); len(list) != 0 {
+		t.Errorf("dead letters left: %+v", list)
+	}
+}
+
+func rewind(t testing.TB, db *database.DB, last int64) int64 {
+	t.Helper()
+	conn := db.Get(nil)
+	defer db.Put(conn)
+	prev, err := catchup.Rewind(conn, "xyzzy", last)
+	if err != nil {
+		t.Fatalf("rewind: %v", err)
+	}
+	return prev
+}
+
+func TestRewind(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	db := database.Scratch()
+	var seen []int64
+	broken := true
+	fn := func(conn *sqlite.Conn, stmt *sqlite.Stmt) error {
+		x := stmt.GetInt64("x")
+		if x == 12 && broken {
+			return errors.New("bad row")
+		}
+		seen = append(seen, x)
+		return nil
+	}
+	c := makeCatchup(t, db)
+
+	// nothing to rewind yet
+	if prev := rewind(t, db, 0); prev != 0 {
+		t.Errorf("rewound a consumer that has not run: %d", prev)
+	}
+
+	execScript(t, db, `
+INSERT INTO test_source (x) VALUES (10), (11), (12), (13);
+`)
+	if err := c.Run(ctx, fn); err != nil {
+		t.Fatalf("catchup run: %v", err)
+	}
+	if len(listDeadLetters(t, db)) != 1 {
+		t.Fatal("expected a dead letter")
+	}
+
+	// rewinding forward does nothing
+	if prev := rewind(t, db, 10); prev != 4 {
+		t.Errorf("wrong previous last: %d", prev)
+	}
+	if prev := rewind(t, db, 1); prev != 4 {
+		t.Errorf("wrong previous last: %d", prev)
+	}
+	if list := listDeadLetters(t, db); len(list) != 0 {
+		t.Errorf("dead letters left after rewind: %+v", list)
+	}
+
+	seen = nil
+	broken = false
+	if err := c.Run(ctx, fn); err != nil {
+		t.Fatalf("catchup run: %v", err)
+	}
+	want := []int64{11, 12, 13}
+	if diff := cmp.Diff(want, seen); diff != "" {
+		t.Errorf("wrong results: -want +got\n%s", diff)
+	}
+}
@@ -0,0 +1,245 @@
+package catchup
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"crawshaw.io/sqlite"
+	"crawshaw.io/sqlite/sqlitex"
+	"eagain.net/go/securityblanket/internal/database"
+	"go.uber.org/zap"
+)
+
+// ErrNotFound is returned when there is no such dead letter.
+var ErrNotFound = errors.New("no such dead letter")
+
+// resolve forgets earlier failures of a row, now that it has been
+// processed.
+func (c *Catchup) resolve(conn *sqlite.Conn, id int64) error {
+	stmt := delete_dead_letter_source.Prep(conn)
+	defer stmt.Finalize()
+	stmt.SetText("@consumer", c.conf.Name)
+	stmt.SetInt64("@source", id)
+	if _, err := stmt.Step(); err != nil {
+		return fmt.Errorf("removing dead letter: %w", err)
+	}
+	return nil
+}
+
+// fail records a failure to process a row. Once the row has failed
+// MaxAttempts times, it is skipped. A row that was skipped earlier
+// stays skipped. It returns how long to wait before trying the row
+// again, or zero if it is not tried again.
+func (c *Catchup) fail(conn *sqlite.Conn, id int64, fnErr error, now time.Time) (wait time.Duration, err error) {
+	defer sqlitex.Save(conn)(&err)
+
+	{
+		stmt := upsert_dead_letter.Prep(conn)
+		defer stmt.Finalize()
+		stmt.SetText("@consumer", c.conf.Name)
+		stmt.SetInt64("@source", id)
+		stmt.SetText("@error", fnErr.Error())
+		database.BindTime(stmt, "@failed", now)
+		if _, err := stmt.Step(); err != nil {
+			return 0, fmt.Errorf("recording dead letter: %w", err)
+		}
+	}
+
+	stmt := fetch_dead_letter_source.Prep(conn)
+	defer stmt.Finalize()
+	stmt.SetText("@consumer", c.conf.Name)
+	stmt.SetInt64("@source", id)
+	if err := database.Row(stmt); err != nil {
+		return 0, fmt.Errorf("fetching dead letter: %w", err)
+	}
+	attempts := stmt.GetInt64("attempts")
+	alreadySkipped := stmt.ColumnType(stmt.ColumnIndex("skipped")) != sqlite.SQLITE_NULL
+	if err := database.NoMoreRows(stmt); err != nil {
+		return 0, err
+	}
+
+	log := c.conf.Log.With(
+		zap.Int64("id", id),
+		zap.Int64("attempts", attempts),
+		zap.Error(fnErr),
+	)
+	if alreadySkipped {
+		log.Warn("retry.failed")
+		return 0, nil
+	}
+	if attempts < int64(c.conf.MaxAttempts) {
+		log.Warn("row.failed")
+		return c.conf.Backoff << uint(attempts-1), nil
+	}
+
+	{
+		stmt := update_dead_letter_skipped.Prep(conn)
+		defer stmt.Finalize()
+		stmt.SetText("@consumer", c.conf.Name)
+		stmt.SetInt64("@source", id)
+		database.BindTime(stmt, "@skipped", now)
+		if _, err := stmt.Step(); err != nil {
+			return 0, fmt.Errorf("skipping dead letter: %w", err)
+		}
+	}
+	if err := c.save(conn, id); err != nil {
+		return 0, fmt.Errorf("saving last processed id: %w", err)
+	}
+	log.Error("row.skipped")
+	c.skipped.Inc()
+	return 0, nil
+}
+
+// retry processes the skipped rows someone asked to be retried.
+func (c *Catchup) retry(ctx context.Context, conn *sqlite.Conn, fn Func) error {
+	var ids []int64
+	{
+		stmt := fetch_dead_letters_retry.Prep(conn)
+		defer stmt.Finalize()
+		stmt.SetText("@consumer", c.conf.Name)
+		for {
+			hasRow, err := stmt.Step()
+			if err != nil {
+				return fmt.Errorf("fetching dead letters to retry: %w", err)
+			}
+			if !hasRow {
+				break
+			}
+			ids = append(ids, stmt.GetInt64("source"))
+		}
+	}
+	for _, id := range ids {
+		if err := c.retryRow(ctx, conn, fn, id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *Catchup) retryRow(ctx context.Context, conn *sqlite.Conn, fn Func, id int64) error {
+	stmt := conn.Prep(c.conf.NextSQL)
+	defer stmt.Finalize()
+	stmt.SetInt64("@last", id-1)
+	stmt.SetInt64("@max", id)
+	hasRow, err := stmt.Step()
+	if err != nil {
+		return err
+	}
+	if !hasRow || stmt.GetInt64("id") != id {
+		c.conf.Log.Warn("retry.gone", zap.Int64("id", id))
+		return c.resolve(conn, id)
+	}
+	err = c.retryFunc(conn, fn, stmt, id)
+	if err == nil {
+		c.conf.Log.Info("retry.ok", zap.Int64("id", id))
+		return nil
+	}
+	if !rowFailed(ctx, err) {
+		return err
+	}
+	// skipped already, so not tried again until asked to
+	_, err = c.fail(conn, id, err, time.Now())
+	return err
+}
+
+func (c *Catchup) retryFunc(conn *sqlite.Conn, fn Func, stmt *sqlite.Stmt, id int64) (err error) {
+	defer sqlitex.Save(conn)(&err)
+	if err := fn(conn, stmt); err != nil {
+		return &funcError{err: err}
+	}
+	return c.resolve(conn, id)
+}
+
+// DeadLetter is a source row a consumer failed to process.
+type DeadLetter struct {
+	ID       int64
+	Consumer string
+	// Source is the id of the row in the source table.
+	Source      int64
+	Attempts    int64
+	Error       string
+	FirstFailed time.Time
+	LastFailed  time.Time
+	// Skipped is when the consumer moved past the row, or zero if it
+	// is still being tried.
+	Skipped time.Time
+	// Retry is set when the row is waiting to be tried again.
+	Retry bool
+}
+
+// DeadLetters returns the rows that consumers have failed to process.
+func DeadLetters(ctx context.Context, db *database.DB) ([]*DeadLetter, error) {
+	conn := db.Get(ctx)
+	if conn == nil {
+		return nil, context.Canceled
+	}
+	defer db.Put(conn)
+
+	stmt := fetch_dead_letters.Prep(conn)
+	defer stmt.Finalize()
+	var list []*DeadLetter
+	for {
+		hasRow, err := stmt.Step()
+		if err != nil {
+			return nil, fmt.Errorf("error fetching dead letters: %w", err)
+		}
+		if !hasRow {
+			break
+		}
+		d := &DeadLetter{
+			ID:       stmt.GetInt64("id"),
+			Consumer: stmt.GetText("consumer"),
+			Source:   stmt.GetInt64("source"),
+			Attempts: stmt.GetInt64("attempts"),
+			Error:    stmt.GetText("error"),
+			Retry:    stmt.GetInt64("retry") != 0,
+		}
+		if d.FirstFailed, err = database.GetTime(stmt, "firstFailed"); err != nil {
+			return nil, err
+		}
+		if d.LastFailed, err = database.GetTime(stmt, "lastFailed"); err != nil {
+			return nil, err
+		}
+		if d.Skipped, err = database.GetTime(stmt, "skipped"); err != nil {
+			return nil, err
+		}
+		list = append(list, d)
+	}
+	return list, nil
+}
+
+// Retry asks for a skipped row to be processed again, the next time
+// its consumer runs. If that fails, the row stays skipped.
+func Retry(ctx context.Context, db *database.DB, id int64) error {
+	return changeOne(ctx, db, update_dead_letter_retry.Content, id)
+}
+
+// Discard forgets about a row a consumer failed to process.
+func Discard(ctx context.Context, db *database.DB, id int64) error {
+	return changeOne(ctx, db, delete_dead_letter.Content, id)
+}
+
+func changeOne(ctx context.Context, db *database.DB, sql string, id int64) error {
+	conn := db.Get(ctx)
+	if conn == nil {
+		return context.Canceled
+	}
+	defer db.Put(conn)
+
+	stmt := conn.Prep(sql)
+	defer stmt.Finalize()
+	stmt.SetInt64("@id", id)
+	if _, err := stmt.Step(); err != nil {
+		return fmt.Errorf("dead letter: %w", err)
+	}
+	switch affected := conn.Changes(); affected {
+	case 0:
+		return ErrNotFound
+	case 1:
+		return nil
+	default:
+		return fmt.Errorf("internal error: dead letter change caused multiple changes: %d", affected)
+	}
+}
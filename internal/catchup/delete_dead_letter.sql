@@ -0,0 +1,2 @@
+DELETE FROM catchup_dead_letters
+WHERE id=@id
@@ -0,0 +1,3 @@
+DELETE FROM catchup_dead_letters
+WHERE consumer=@consumer
+	AND source>@last
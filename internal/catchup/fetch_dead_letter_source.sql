@@ -0,0 +1,6 @@
+SELECT
+	attempts,
+	skipped
+FROM catchup_dead_letters
+WHERE consumer=@consumer
+	AND source=@source
@@ -0,0 +1,12 @@
+SELECT
+	id,
+	consumer,
+	source,
+	attempts,
+	error,
+	firstFailed,
+	lastFailed,
+	skipped,
+	retry
+FROM catchup_dead_letters
+ORDER BY consumer, source
@@ -0,0 +1,5 @@
+SELECT source
+FROM catchup_dead_letters
+WHERE consumer=@consumer
+	AND retry
+ORDER BY source
@@ -0,0 +1,61 @@
+package catchup
+
+import (
+	"fmt"
+
+	"crawshaw.io/sqlite"
+	"crawshaw.io/sqlite/sqlitex"
+)
+
+// Last returns the last id processed by the consumer named name, or 0
+// if it has not run yet.
+func Last(conn *sqlite.Conn, name string) (int64, error) {
+	stmt := load.Prep(conn)
+	defer stmt.Finalize()
+	stmt.SetText("@name", name)
+	last, err := sqlitex.ResultInt64(stmt)
+	if err != nil {
+		return 0, fmt.Errorf("fetching last processed id: %w", err)
+	}
+	return last, nil
+}
+
+// Rewind moves the consumer named name back so the rows after last are
+// processed again, and forgets its dead letters for those rows. It
+// returns the last processed id from before the rewind. A consumer
+// that is not past last, or has not run yet, is left alone.
+//
+// Rewind is meant to be done in a savepoint together with undoing
+// what the consumer did with those rows. The consumer must not be
+// running at the same time, or it may save its old position over the
+// rewind.
+func Rewind(conn *sqlite.Conn, name string, last int64) (prev int64, err error) {
+	defer sqlitex.Save(conn)(&err)
+
+	prev, err = Last(conn, name)
+	if err != nil {
+		return 0, err
+	}
+	if prev <= last {
+		return prev, nil
+	}
+
+	{
+		stmt := rewind.Prep(conn)
+		defer stmt.Finalize()
+		stmt.SetText("@name", name)
+		stmt.SetInt64("@last", last)
+		if _, err := stmt.Step(); err != nil {
+			return 0, fmt.Errorf("saving last processed id: %w", err)
+		}
+	}
+
+	stmt := delete_dead_letters_after.Prep(conn)
+	defer stmt.Finalize()
+	stmt.SetText("@consumer", name)
+	stmt.SetInt64("@last", last)
+	if _, err := stmt.Step(); err != nil {
+		return 0, fmt.Errorf("removing dead letters: %w", err)
+	}
+	return prev, nil
+}
@@ -0,0 +1,4 @@
+UPDATE catchup
+	SET last=@last
+	WHERE name=@name
+		AND last>@last
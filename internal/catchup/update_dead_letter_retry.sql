@@ -0,0 +1,4 @@
+UPDATE catchup_dead_letters
+SET retry=true
+WHERE id=@id
+	AND skipped IS NOT NULL
@@ -0,0 +1,4 @@
+UPDATE catchup_dead_letters
+SET skipped=@skipped
+WHERE consumer=@consumer
+	AND source=@source
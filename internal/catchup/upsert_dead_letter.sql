@@ -0,0 +1,8 @@
+INSERT INTO catchup_dead_letters(consumer, source, attempts, error, firstFailed, lastFailed)
+	VALUES (@consumer, @source, 1, @error, @failed, @failed)
+	ON CONFLICT(consumer, source)
+		DO UPDATE SET
+			attempts=attempts+1,
+			error=excluded.error,
+			lastFailed=excluded.lastFailed,
+			retry=false
@@ -8,6 +8,9 @@ import (
 	"crawshaw.io/sqlite"
 )
 
+// format of strftime('%Y-%m-%dT%H:%M:%f', 'now')
+const sqliteTimeLayout = "2006-01-02T15:04:05.999999999"
+
 // GetTime extracts the time from a query result column. NULL becomes
 // zero time.
 func GetTime(stmt *sqlite.Stmt, param string) (time.Time, error) {
@@ -21,6 +24,11 @@ func GetTime(stmt *sqlite.Stmt, param string) (time.Time, error) {
 	case sqlite.SQLITE_TEXT:
 		s := stmt.ColumnText(col)
 		t, err := time.Parse(time.RFC3339, s)
+		if err != nil {
+			// column defaults use SQLite strftime, which is UTC
+			// without saying so
+			t, err = time.Parse(sqliteTimeLayout, s)
+		}
 		if err != nil {
 			return time.Time{}, fmt.Errorf("bad time in database: column %s=%q", param, s)
 		}
@@ -43,3 +51,20 @@ func GetUint8(stmt *sqlite.Stmt, param string) (uint8, error) {
 	}
 	return uint8(n), nil
 }
+
+// GetNullFloat extracts a floating point number from a query result
+// column. NULL is reported by ok being false.
+func GetNullFloat(stmt *sqlite.Stmt, param string) (f float64, ok bool, err error) {
+	col := stmt.ColumnIndex(param)
+	if col < 0 {
+		return 0, false, fmt.Errorf("no such column in sql row: %q", param)
+	}
+	switch columnType := stmt.ColumnType(col); columnType {
+	case sqlite.SQLITE_NULL:
+		return 0, false, nil
+	case sqlite.SQLITE_INTEGER, sqlite.SQLITE_FLOAT:
+		return stmt.ColumnFloat(col), true, nil
+	default:
+		return 0, false, fmt.Errorf("bad number in database: column %s type %s value %q", param, columnType, stmt.ColumnText(col))
+	}
+}
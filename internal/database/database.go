@@ -80,6 +80,9 @@ func openDB(u url.URL, flags sqlite.OpenFlags) (*DB, error) {
 
 	conn := pool.Get(nil)
 	defer pool.Put(conn)
+	if err := incrementalVacuum(conn); err != nil {
+		return nil, fmt.Errorf("cannot set auto_vacuum: %v", err)
+	}
 	if err := schema.Migrate(conn); err != nil {
 		return nil, fmt.Errorf("cannot migrate sql schema: %v", err)
 	}
@@ -89,6 +92,30 @@ func openDB(u url.URL, flags sqlite.OpenFlags) (*DB, error) {
 	return db, nil
 }
 
+// incrementalVacuum makes a new database use incremental vacuum.
+// Existing databases need to be rewritten to switch; that is left for
+// the user to do, as it can take a while.
+func incrementalVacuum(conn *sqlite.Conn) error {
+	stmt := conn.Prep("SELECT count(*) FROM sqlite_master;")
+	defer stmt.Finalize()
+	tables, err := sqlitex.ResultInt64(stmt)
+	if err != nil {
+		return err
+	}
+	if tables > 0 {
+		return nil
+	}
+	if err := sqlitex.ExecTransient(conn, "PRAGMA auto_vacuum=INCREMENTAL;", nil); err != nil {
+		return err
+	}
+	// Switching to WAL has already written the database header, so
+	// even an empty database needs to be rewritten.
+	if err := sqlitex.ExecTransient(conn, "VACUUM;", nil); err != nil {
+		return err
+	}
+	return nil
+}
+
 func Open(dbPath string) (*DB, error) {
 	u := makeURL(dbPath)
 	return openDB(u, 0)
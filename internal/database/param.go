@@ -15,3 +15,13 @@ func BindTime(stmt *sqlite.Stmt, param string, t time.Time) {
 	}
 	stmt.SetText(param, t.Format(time.RFC3339Nano))
 }
+
+// BindNullFloat sets the number as a SQL query bind parameter, or
+// NULL if ok is false.
+func BindNullFloat(stmt *sqlite.Stmt, param string, f float64, ok bool) {
+	if !ok {
+		stmt.SetNull(param)
+		return
+	}
+	stmt.SetFloat(param, f)
+}
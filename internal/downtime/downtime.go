@@ -0,0 +1,212 @@
+// Package downtime tells how long nobody was listening to a sensor,
+// so it is not blamed for silence that could not have been heard.
+//
+// Nobody listens between runs of the daemon: from the last time a run
+// was known to be alive to the start of the next one. A Recorder keeps
+// the daemon_runs table up to date for that. Before the first recorded
+// run, nothing is known, and the daemon counts as down.
+//
+// A sensor is not heard either while the receivers that heard it last
+// are restarting: from an exit recorded in rtl433_restarts to the
+// receiver being started again. Overlapping outages count once.
+package downtime
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"crawshaw.io/sqlite"
+	"eagain.net/go/securityblanket/internal/database"
+)
+
+// Recorder records a run of the daemon, and when it was last alive.
+type Recorder struct {
+	ctx     context.Context
+	db      *database.DB
+	started time.Time
+	clock   func() time.Time
+	id      int64
+}
+
+// NewRecorder returns a Recorder for the run that started at started.
+// Run needs to be called periodically; the daemon counts as down
+// after the last call.
+func NewRecorder(ctx context.Context, db *database.DB, started time.Time) *Recorder {
+	r := &Recorder{
+		ctx:     ctx,
+		db:      db,
+		started: started,
+		clock:   time.Now,
+	}
+	return r
+}
+
+// Run records that the daemon is alive.
+func (r *Recorder) Run() error {
+	conn := r.db.Get(r.ctx)
+	if conn == nil {
+		return context.Canceled
+	}
+	defer r.db.Put(conn)
+
+	now := r.clock()
+	if r.id == 0 {
+		stmt := insert_daemon_run.Prep(conn)
+		defer stmt.Finalize()
+		database.BindTime(stmt, "@started", r.started)
+		database.BindTime(stmt, "@alive", now)
+		if _, err := stmt.Step(); err != nil {
+			return fmt.Errorf("record daemon run: %w", err)
+		}
+		r.id = conn.LastInsertRowID()
+		return nil
+	}
+	stmt := update_daemon_run_alive.Prep(conn)
+	defer stmt.Finalize()
+	stmt.SetInt64("@id", r.id)
+	database.BindTime(stmt, "@alive", now)
+	if _, err := stmt.Step(); err != nil {
+		return fmt.Errorf("record daemon alive: %w", err)
+	}
+	return nil
+}
+
+type interval struct {
+	from, to time.Time
+}
+
+// Between returns how long, from from to to, the sensor update was
+// heard from could not have been heard again: the daemon run started
+// at started was not yet running, or a receiver that heard update was
+// restarting.
+func Between(conn *sqlite.Conn, update int64, started, from, to time.Time) (time.Duration, error) {
+	down, err := outages(conn, update, started, from, to)
+	if err != nil {
+		return 0, err
+	}
+	var sum time.Duration
+	for _, i := range down {
+		sum += i.to.Sub(i.from)
+	}
+	return sum, nil
+}
+
+// After returns when, counting from from, the sensor update was heard
+// from could have been heard again for d. Downtime is known only up
+// to now; any time after that counts as listening.
+func After(conn *sqlite.Conn, update int64, started, from time.Time, d time.Duration, now time.Time) (time.Time, error) {
+	down, err := outages(conn, update, started, from, now)
+	if err != nil {
+		return time.Time{}, err
+	}
+	t := from
+	for _, i := range down {
+		gap := i.from.Sub(t)
+		if gap >= d {
+			break
+		}
+		d -= gap
+		t = i.to
+	}
+	return t.Add(d), nil
+}
+
+// outages returns when, from from to to, nobody was listening for the
+// sensor update was heard from. The intervals are clipped to from and
+// to, sorted, and do not overlap.
+func outages(conn *sqlite.Conn, update int64, started, from, to time.Time) ([]interval, error) {
+	var down []interval
+	add := func(stmt *sqlite.Stmt) error {
+		for {
+			hasRow, err := stmt.Step()
+			if err != nil {
+				return err
+			}
+			if !hasRow {
+				return nil
+			}
+			var i interval
+			if i.from, err = database.GetTime(stmt, "down"); err != nil {
+				return err
+			}
+			if i.to, err = database.GetTime(stmt, "up"); err != nil {
+				return err
+			}
+			down = append(down, i)
+		}
+	}
+
+	first := started
+	{
+		stmt := fetch_daemon_runs_first.Prep(conn)
+		defer stmt.Finalize()
+		database.BindTime(stmt, "@started", started)
+		if err := database.Row(stmt); err != nil {
+			return nil, fmt.Errorf("error fetching daemon runs: %w", err)
+		}
+		t, err := database.GetTime(stmt, "first")
+		if err != nil {
+			return nil, err
+		}
+		if !t.IsZero() {
+			first = t
+		}
+		if err := stmt.Reset(); err != nil {
+			return nil, err
+		}
+	}
+	down = append(down, interval{from: from, to: first})
+	{
+		stmt := fetch_daemon_gaps.Prep(conn)
+		defer stmt.Finalize()
+		database.BindTime(stmt, "@started", started)
+		database.BindTime(stmt, "@from", from)
+		if err := add(stmt); err != nil {
+			return nil, fmt.Errorf("error fetching daemon runs: %w", err)
+		}
+	}
+	{
+		stmt := fetch_receiver_outages.Prep(conn)
+		defer stmt.Finalize()
+		stmt.SetInt64("@update", update)
+		database.BindTime(stmt, "@from", from)
+		database.BindTime(stmt, "@to", to)
+		if err := add(stmt); err != nil {
+			return nil, fmt.Errorf("error fetching receiver restarts: %w", err)
+		}
+	}
+	return merge(down, from, to), nil
+}
+
+// merge clips the intervals to from and to, and merges the ones that
+// overlap.
+func merge(list []interval, from, to time.Time) []interval {
+	var clipped []interval
+	for _, i := range list {
+		if i.from.Before(from) {
+			i.from = from
+		}
+		if i.to.After(to) {
+			i.to = to
+		}
+		if i.to.After(i.from) {
+			clipped = append(clipped, i)
+		}
+	}
+	sort.Slice(clipped, func(a, b int) bool {
+		return clipped[a].from.Before(clipped[b].from)
+	})
+	var merged []interval
+	for _, i := range clipped {
+		if n := len(merged); n > 0 && !i.from.After(merged[n-1].to) {
+			if i.to.After(merged[n-1].to) {
+				merged[n-1].to = i.to
+			}
+			continue
+		}
+		merged = append(merged, i)
+	}
+	return merged
+}
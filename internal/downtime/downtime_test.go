@@ -0,0 +1,134 @@
+package downtime_test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"crawshaw.io/sqlite/sqlitex"
+	"eagain.net/go/securityblanket/internal/database"
+	"eagain.net/go/securityblanket/internal/downtime"
+)
+
+func execScript(t testing.TB, db *database.DB, sql string) {
+	conn := db.Get(nil)
+	defer db.Put(conn)
+
+	if err := sqlitex.ExecScript(conn, sql); err != nil {
+		t.Fatalf("database error: %v", err)
+	}
+}
+
+var start = time.Date(2020, 2, 3, 4, 5, 6, 0, time.UTC)
+
+func at(d time.Duration) string {
+	return start.Add(d).Format(time.RFC3339Nano)
+}
+
+func TestRecorder(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	db := database.Scratch()
+	defer db.Close()
+
+	started := time.Now()
+	recorder := downtime.NewRecorder(ctx, db, started)
+	for i := 0; i < 2; i++ {
+		if err := recorder.Run(); err != nil {
+			t.Fatalf("run: %v", err)
+		}
+	}
+
+	conn := db.Get(nil)
+	defer db.Put(conn)
+	stmt := conn.Prep(`SELECT count(*) AS runs, min(started) AS started, max(alive) AS alive FROM daemon_runs`)
+	defer stmt.Finalize()
+	if err := database.Row(stmt); err != nil {
+		t.Fatal(err)
+	}
+	if g, e := stmt.GetInt64("runs"), int64(1); g != e {
+		t.Errorf("wrong number of runs: %v != %v", g, e)
+	}
+	gotStarted, err := database.GetTime(stmt, "started")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !gotStarted.Equal(started) {
+		t.Errorf("wrong start: %v != %v", gotStarted, started)
+	}
+	alive, err := database.GetTime(stmt, "alive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if alive.Before(started) {
+		t.Errorf("alive before start: %v < %v", alive, started)
+	}
+}
+
+func TestBetween(t *testing.T) {
+	db := database.Scratch()
+	defer db.Close()
+
+	// the daemon is down from 1h to 2h and from 3h to 5h; receiver a
+	// is down from 90m to 150m, overlapping the first gap; b heard
+	// something else
+	execScript(t, db, fmt.Sprintf(`
+INSERT INTO daemon_runs(started, alive) VALUES
+	('%[1]s', '%[2]s'),
+	('%[3]s', '%[4]s');
+INSERT INTO honeywell5800_sensors(id, model, description) VALUES
+	(1, '5800MINI', 'front door');
+INSERT INTO honeywell5800_updates(id, time, channel, sensor, event)
+VALUES (1, '%[5]s', 8, 1, 4), (2, '%[5]s', 8, 1, 4);
+INSERT INTO honeywell5800_receptions(sensorUpdate, receiver, raw, time)
+VALUES (1, 'a', 1, '%[5]s'), (2, 'b', 2, '%[5]s');
+INSERT INTO rtl433_restarts(time, freqMHz, receiver, started, uptime, error, resumes) VALUES
+	('%[6]s', 345, 'a', '%[5]s', 5400, 'exit status 1', '%[7]s'),
+	('%[8]s', 345, 'b', '%[5]s', 12600, 'exit status 1', '%[9]s');
+`,
+		at(-time.Hour), at(time.Hour),
+		at(2*time.Hour), at(3*time.Hour),
+		at(0),
+		at(90*time.Minute), at(150*time.Minute),
+		at(210*time.Minute), at(24*time.Hour),
+	))
+
+	conn := db.Get(nil)
+	defer db.Put(conn)
+	started := start.Add(5 * time.Hour)
+	now := start.Add(6 * time.Hour)
+
+	down, err := downtime.Between(conn, 1, started, start, now)
+	if err != nil {
+		t.Fatalf("between: %v", err)
+	}
+	if g, e := down, 210*time.Minute; g != e {
+		t.Errorf("wrong downtime: %v != %v", g, e)
+	}
+
+	after, err := downtime.After(conn, 1, started, start, 3*time.Hour, now)
+	if err != nil {
+		t.Fatalf("after: %v", err)
+	}
+	if g, e := after, start.Add(390*time.Minute); !g.Equal(e) {
+		t.Errorf("wrong time: %v != %v", g, e)
+	}
+}
+
+func TestBetweenNoRuns(t *testing.T) {
+	db := database.Scratch()
+	defer db.Close()
+	conn := db.Get(nil)
+	defer db.Put(conn)
+
+	// nothing is known before the daemon started
+	started := start.Add(24 * time.Hour)
+	down, err := downtime.Between(conn, 1, started, start, started.Add(time.Hour))
+	if err != nil {
+		t.Fatalf("between: %v", err)
+	}
+	if g, e := down, 24*time.Hour; g != e {
+		t.Errorf("wrong downtime: %v != %v", g, e)
+	}
+}
@@ -0,0 +1,16 @@
+-- Gaps between the runs of the daemon up to the one started at
+-- @started, that end after @from.
+SELECT
+	down,
+	up
+FROM (
+	SELECT
+		alive AS down,
+		coalesce(
+			lead(started) OVER (ORDER BY started, id),
+			@started
+		) AS up
+	FROM daemon_runs
+	WHERE started<@started
+)
+WHERE up>@from
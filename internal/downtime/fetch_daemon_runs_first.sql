@@ -0,0 +1,4 @@
+-- The first run of the daemon before the one started at @started.
+SELECT min(started) AS first
+	FROM daemon_runs
+	WHERE started<@started
@@ -0,0 +1,13 @@
+-- Outages of the receivers that heard @update, from an exit until the
+-- receiver was started again, overlapping @from to @to.
+SELECT
+	time AS down,
+	resumes AS up
+FROM rtl433_restarts
+WHERE receiver IN (
+		SELECT receiver
+		FROM honeywell5800_receptions
+		WHERE sensorUpdate=@update
+	)
+	AND resumes>@from
+	AND time<@to
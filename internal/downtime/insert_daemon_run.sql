@@ -0,0 +1,2 @@
+INSERT INTO daemon_runs(started, alive)
+	VALUES (@started, @alive)
@@ -0,0 +1,3 @@
+UPDATE daemon_runs
+	SET alive=@alive
+	WHERE id=@id
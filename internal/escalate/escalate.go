@@ -0,0 +1,640 @@
+// Package escalate notifies people about alerts in steps, until
+// someone acknowledges the alert.
+//
+// An alert matching a Policy is first sent to the recipients of the
+// first step. If it is still unacknowledged when the next step is due,
+// it goes to the recipients of that step, and so on. Recipients in
+// their quiet hours are skipped, unless the alert is about a critical
+// kind of sensor loop, such as a smoke detector.
+//
+// A step can also go to whoever is on call in a Rotation at the time
+// the step is taken. Being on call overrides quiet hours.
+//
+// Notifications are queued in the notify_outbox table, to the channels
+// of each recipient. The recipients reached are told when the alert is
+// resolved.
+//
+// A step can also sound outputs, such as a siren, by adding them to
+// the alert_escalation_outputs table for the output controller. Quiet
+// hours do not apply to outputs.
+package escalate
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"crawshaw.io/sqlite"
+	"crawshaw.io/sqlite/sqlitex"
+	"eagain.net/go/securityblanket/internal/catchup"
+	"eagain.net/go/securityblanket/internal/database"
+	"eagain.net/go/securityblanket/internal/honeywell5800"
+	"go.uber.org/zap"
+)
+
+// Recipient is a person notifications are sent to.
+type Recipient struct {
+	Name string
+	// Channels are names of notification channels.
+	Channels []string
+	// Quiet is nil for no quiet hours.
+	Quiet *QuietHours
+}
+
+// QuietHours is a daily time range, in local time, as offsets from
+// midnight. The range wraps around midnight if Start is after End.
+type QuietHours struct {
+	Start time.Duration
+	End   time.Duration
+}
+
+// Contains reports whether t is within the quiet hours.
+func (q *QuietHours) Contains(t time.Time) bool {
+	h, m, s := t.Clock()
+	d := time.Duration(h)*time.Hour + time.Duration(m)*time.Minute + time.Duration(s)*time.Second
+	if q.Start <= q.End {
+		return d >= q.Start && d < q.End
+	}
+	return d >= q.Start || d < q.End
+}
+
+// Rotation hands the on-call duty to each of its recipients in turn,
+// for a shift at a time.
+type Rotation struct {
+	Name string
+	// Recipients are names of recipients, in order of their shifts.
+	Recipients []string
+	// Start is when the shift of the first recipient starts. The
+	// rotation repeats before and after.
+	Start time.Time
+	Shift time.Duration
+}
+
+// OnCall returns the name of the recipient on call at t.
+func (r *Rotation) OnCall(t time.Time) string {
+	d := t.Sub(r.Start)
+	n := int64(d / r.Shift)
+	if d < 0 && d%r.Shift != 0 {
+		n--
+	}
+	i := n % int64(len(r.Recipients))
+	if i < 0 {
+		i += int64(len(r.Recipients))
+	}
+	return r.Recipients[i]
+}
+
+// Step is one escalation step.
+type Step struct {
+	// After is the time since the alert was raised.
+	After time.Duration
+	// Recipients are names of recipients.
+	Recipients []string
+	// Everyone sends to all recipients.
+	Everyone bool
+	// OnCall are names of rotations, whose recipient on call is
+	// notified.
+	OnCall []string
+	// Outputs are names of outputs to sound the alarm on.
+	Outputs []string
+}
+
+// Policy decides who hears about an alert, and when.
+type Policy struct {
+	Name string
+	// Sources and Severities limit the alerts the policy applies to.
+	// Empty matches all.
+	Sources    []string
+	Severities []string
+	// Steps are in order of After.
+	Steps []Step
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+func containsRecipient(list []*Recipient, r *Recipient) bool {
+	for _, item := range list {
+		if item == r {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *Policy) matches(source, severity string) bool {
+	if len(p.Sources) > 0 && !contains(p.Sources, source) {
+		return false
+	}
+	if len(p.Severities) > 0 && !contains(p.Severities, severity) {
+		return false
+	}
+	return true
+}
+
+// DefaultCritical lists the kinds of sensor loops that override quiet
+// hours, unless the Critical option says otherwise.
+var DefaultCritical = []honeywell5800.Kind{
+	honeywell5800.HeatDetector,
+	honeywell5800.MedicalAlert,
+	honeywell5800.PanicButton,
+	honeywell5800.SmokeDetector,
+}
+
+type config struct {
+	critical  []honeywell5800.Kind
+	rotations map[string]*Rotation
+	clock     func() time.Time
+	wakeup    func()
+}
+
+type Option option
+
+type option func(*config)
+
+// Critical sets the kinds of sensor loops that override quiet hours.
+func Critical(kinds ...honeywell5800.Kind) Option {
+	fn := func(conf *config) {
+		conf.critical = kinds
+	}
+	return fn
+}
+
+// Rotations sets the on-call rotations steps can refer to.
+func Rotations(rotations ...*Rotation) Option {
+	fn := func(conf *config) {
+		conf.rotations = make(map[string]*Rotation, len(rotations))
+		for _, r := range rotations {
+			conf.rotations[r.Name] = r
+		}
+	}
+	return fn
+}
+
+// Clock overrides the source of time used for escalation steps and
+// quiet hours.
+func Clock(clock func() time.Time) Option {
+	fn := func(conf *config) {
+		conf.clock = clock
+	}
+	return fn
+}
+
+// Wakeup is called whenever notifications are queued, or outputs
+// asked to sound.
+func Wakeup(wakeup func()) Option {
+	fn := func(conf *config) {
+		conf.wakeup = wakeup
+	}
+	return fn
+}
+
+// Escalator starts escalations for new alerts, and takes the steps
+// that are due.
+//
+// Steps become due as time passes, so Run needs to be called
+// periodically even when nothing new happens.
+type Escalator struct {
+	ctx        context.Context
+	db         *database.DB
+	catchup    *catchup.Catchup
+	log        *zap.Logger
+	policies   []*Policy
+	recipients map[string]*Recipient
+	// in configuration order, for Everyone
+	everyone []*Recipient
+	config   config
+}
+
+func New(ctx context.Context, db *database.DB, log *zap.Logger, policies []*Policy, recipients []*Recipient, opts ...Option) *Escalator {
+	e := &Escalator{
+		ctx: ctx,
+		db:  db,
+		catchup: catchup.New(&catchup.Config{
+			DB:      db,
+			Log:     log.Named("catchup"),
+			Name:    "escalate",
+			MaxSQL:  fetch_alerts_max.Content,
+			NextSQL: fetch_alerts.Content,
+		}),
+		log:        log,
+		policies:   policies,
+		recipients: make(map[string]*Recipient, len(recipients)),
+		everyone:   recipients,
+		config: config{
+			critical: DefaultCritical,
+			clock:    time.Now,
+			wakeup:   func() {},
+		},
+	}
+	for _, r := range recipients {
+		e.recipients[r.Name] = r
+	}
+	for _, opt := range opts {
+		opt(&e.config)
+	}
+	return e
+}
+
+// Run starts escalating new alerts, takes the steps that are due, and
+// tells recipients about resolved alerts.
+func (e *Escalator) Run() error {
+	if err := e.catchup.Run(e.ctx, e.start); err != nil {
+		return err
+	}
+	if err := e.advance(); err != nil {
+		return fmt.Errorf("escalate: %w", err)
+	}
+	return nil
+}
+
+func (e *Escalator) policy(name string) *Policy {
+	for _, p := range e.policies {
+		if p.Name == name {
+			return p
+		}
+	}
+	return nil
+}
+
+func (e *Escalator) start(conn *sqlite.Conn, stmt *sqlite.Stmt) error {
+	id := stmt.GetInt64("id")
+	source := stmt.GetText("source")
+	severity := stmt.GetText("severity")
+	var policy *Policy
+	for _, p := range e.policies {
+		if p.matches(source, severity) {
+			policy = p
+			break
+		}
+	}
+	if policy == nil {
+		return nil
+	}
+	raised, err := database.GetTime(stmt, "raised")
+	if err != nil {
+		return fmt.Errorf("bad alert time: %d: %w", id, err)
+	}
+
+	ins := insert_alert_escalation.Prep(conn)
+	defer ins.Finalize()
+	ins.SetInt64("@alert", id)
+	ins.SetText("@policy", policy.Name)
+	database.BindTime(ins, "@due", raised.Add(policy.Steps[0].After))
+	if _, err := ins.Step(); err != nil {
+		return fmt.Errorf("add escalation: %d: %w", id, err)
+	}
+	e.log.Info("start",
+		zap.Int64("alert", id),
+		zap.String("policy", policy.Name),
+	)
+	return nil
+}
+
+type escalation struct {
+	alert        int64
+	policy       string
+	step         int
+	due          time.Time
+	raised       time.Time
+	acknowledged bool
+	resolved     bool
+	kind         string
+}
+
+func (e *Escalator) isCritical(kind string) bool {
+	for _, k := range e.config.critical {
+		if k.String() == kind {
+			return true
+		}
+	}
+	return false
+}
+
+func (e *Escalator) advance() (err error) {
+	conn := e.db.Get(e.ctx)
+	if conn == nil {
+		return context.Canceled
+	}
+	defer e.db.Put(conn)
+	defer sqlitex.Save(conn)(&err)
+
+	now := e.config.clock()
+	var pending []*escalation
+	{
+		stmt := fetch_alert_escalations_pending.Prep(conn)
+		defer stmt.Finalize()
+		for {
+			hasRow, err := stmt.Step()
+			if err != nil {
+				return fmt.Errorf("error fetching escalations: %w", err)
+			}
+			if !hasRow {
+				break
+			}
+			esc := &escalation{
+				alert:  stmt.GetInt64("alert"),
+				policy: stmt.GetText("policy"),
+				step:   int(stmt.GetInt64("step")),
+				// alerts about the whole sensor or site have no kind
+				kind: stmt.GetText("kind"),
+			}
+			if esc.due, err = database.GetTime(stmt, "due"); err != nil {
+				return err
+			}
+			if esc.raised, err = database.GetTime(stmt, "raised"); err != nil {
+				return err
+			}
+			acknowledged, err := database.GetTime(stmt, "acknowledged")
+			if err != nil {
+				return err
+			}
+			esc.acknowledged = !acknowledged.IsZero()
+			resolved, err := database.GetTime(stmt, "resolved")
+			if err != nil {
+				return err
+			}
+			esc.resolved = !resolved.IsZero()
+			pending = append(pending, esc)
+		}
+	}
+
+	queued := 0
+	for _, esc := range pending {
+		n, err := e.escalate(conn, esc, now)
+		if err != nil {
+			return err
+		}
+		queued += n
+	}
+	n, err := e.resolved(conn)
+	if err != nil {
+		return err
+	}
+	queued += n
+	if queued > 0 {
+		e.config.wakeup()
+	}
+	return nil
+}
+
+func (e *Escalator) finish(conn *sqlite.Conn, esc *escalation, now time.Time, outcome string) error {
+	stmt := update_alert_escalation_finished.Prep(conn)
+	defer stmt.Finalize()
+	stmt.SetInt64("@alert", esc.alert)
+	stmt.SetInt64("@step", int64(esc.step))
+	database.BindTime(stmt, "@finished", now)
+	stmt.SetText("@outcome", outcome)
+	if _, err := stmt.Step(); err != nil {
+		return fmt.Errorf("finish escalation: %d: %w", esc.alert, err)
+	}
+	e.log.Info("finish",
+		zap.Int64("alert", esc.alert),
+		zap.String("policy", esc.policy),
+		zap.String("outcome", outcome),
+	)
+	return nil
+}
+
+// escalate takes the steps of esc that are due, and returns the
+// number of notifications queued.
+func (e *Escalator) escalate(conn *sqlite.Conn, esc *escalation, now time.Time) (int, error) {
+	switch {
+	case esc.acknowledged:
+		return 0, e.finish(conn, esc, now, "acknowledged")
+	case esc.resolved:
+		return 0, e.finish(conn, esc, now, "resolved")
+	}
+	policy := e.policy(esc.policy)
+	if policy == nil {
+		e.log.Warn("policy.unknown",
+			zap.Int64("alert", esc.alert),
+			zap.String("policy", esc.policy),
+		)
+		return 0, e.finish(conn, esc, now, "unknown policy")
+	}
+
+	queued := 0
+	// after a restart, several steps may be due at once
+	for esc.step < len(policy.Steps) && !now.Before(esc.due) {
+		step := &policy.Steps[esc.step]
+		n, err := e.notify(conn, esc, step, now)
+		if err != nil {
+			return queued, err
+		}
+		queued += n
+		n, err = e.sound(conn, esc, step, now)
+		if err != nil {
+			return queued, err
+		}
+		queued += n
+		esc.step++
+		if esc.step < len(policy.Steps) {
+			esc.due = esc.raised.Add(policy.Steps[esc.step].After)
+		}
+	}
+	if esc.step >= len(policy.Steps) {
+		return queued, e.finish(conn, esc, now, "exhausted")
+	}
+	up := update_alert_escalation_step.Prep(conn)
+	defer up.Finalize()
+	up.SetInt64("@alert", esc.alert)
+	up.SetInt64("@step", int64(esc.step))
+	database.BindTime(up, "@due", esc.due)
+	if _, err := up.Step(); err != nil {
+		return queued, fmt.Errorf("update escalation: %d: %w", esc.alert, err)
+	}
+	return queued, nil
+}
+
+// notify takes one step, and returns the number of notifications
+// queued.
+func (e *Escalator) notify(conn *sqlite.Conn, esc *escalation, step *Step, now time.Time) (int, error) {
+	recipients := e.everyone
+	if !step.Everyone {
+		recipients = nil
+		for _, name := range step.Recipients {
+			r, ok := e.recipients[name]
+			if !ok {
+				e.log.Warn("recipient.unknown",
+					zap.Int64("alert", esc.alert),
+					zap.String("recipient", name),
+				)
+				continue
+			}
+			recipients = append(recipients, r)
+		}
+	}
+	// on call, whether or not the step otherwise reaches them
+	onCall := make(map[*Recipient]bool)
+	for _, name := range step.OnCall {
+		rot, ok := e.config.rotations[name]
+		if !ok {
+			e.log.Warn("rotation.unknown",
+				zap.Int64("alert", esc.alert),
+				zap.String("rotation", name),
+			)
+			continue
+		}
+		who := rot.OnCall(now)
+		r, ok := e.recipients[who]
+		if !ok {
+			e.log.Warn("recipient.unknown",
+				zap.Int64("alert", esc.alert),
+				zap.String("rotation", name),
+				zap.String("recipient", who),
+			)
+			continue
+		}
+		if onCall[r] {
+			continue
+		}
+		onCall[r] = true
+		if !containsRecipient(recipients, r) {
+			recipients = append(recipients, r)
+		}
+	}
+
+	notice := insert_alert_escalation_notice.Prep(conn)
+	defer notice.Finalize()
+	var channels []string
+	for _, r := range recipients {
+		quiet := r.Quiet != nil && r.Quiet.Contains(now) && !e.isCritical(esc.kind) && !onCall[r]
+		notice.SetInt64("@alert", esc.alert)
+		notice.SetInt64("@step", int64(esc.step))
+		notice.SetText("@recipient", r.Name)
+		database.BindTime(notice, "@time", now)
+		notice.SetBool("@quiet", quiet)
+		if _, err := notice.Step(); err != nil {
+			return 0, fmt.Errorf("add escalation notice: %d: %w", esc.alert, err)
+		}
+		if err := notice.Reset(); err != nil {
+			return 0, err
+		}
+		e.log.Info("step",
+			zap.Int64("alert", esc.alert),
+			zap.Int("step", esc.step),
+			zap.String("recipient", r.Name),
+			zap.Bool("quiet", quiet),
+		)
+		if quiet {
+			continue
+		}
+		for _, ch := range r.Channels {
+			if !contains(channels, ch) {
+				channels = append(channels, ch)
+			}
+		}
+	}
+	return len(channels), enqueue(conn, esc.alert, "raised", esc.raised, channels)
+}
+
+// sound asks for the outputs of one step to be sounded, and returns
+// the number of outputs.
+func (e *Escalator) sound(conn *sqlite.Conn, esc *escalation, step *Step, now time.Time) (int, error) {
+	stmt := insert_alert_escalation_output.Prep(conn)
+	defer stmt.Finalize()
+	for _, name := range step.Outputs {
+		stmt.SetInt64("@alert", esc.alert)
+		stmt.SetInt64("@step", int64(esc.step))
+		stmt.SetText("@output", name)
+		database.BindTime(stmt, "@time", now)
+		if _, err := stmt.Step(); err != nil {
+			return 0, fmt.Errorf("add escalation output: %d: %w", esc.alert, err)
+		}
+		if err := stmt.Reset(); err != nil {
+			return 0, err
+		}
+		e.log.Info("sound",
+			zap.Int64("alert", esc.alert),
+			zap.Int("step", esc.step),
+			zap.String("output", name),
+		)
+	}
+	return len(step.Outputs), nil
+}
+
+func enqueue(conn *sqlite.Conn, alert int64, event string, t time.Time, channels []string) error {
+	stmt := insert_notify_outbox.Prep(conn)
+	defer stmt.Finalize()
+	for _, ch := range channels {
+		stmt.SetInt64("@alert", alert)
+		stmt.SetText("@channel", ch)
+		stmt.SetText("@event", event)
+		database.BindTime(stmt, "@created", t)
+		if _, err := stmt.Step(); err != nil {
+			return fmt.Errorf("queue notification: alert %d %s: %w", alert, ch, err)
+		}
+		if err := stmt.Reset(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// resolved queues notifications about resolved alerts to everyone
+// who was told about them, and returns the number queued.
+func (e *Escalator) resolved(conn *sqlite.Conn) (int, error) {
+	type resolution struct {
+		resolved time.Time
+		channels []string
+	}
+	resolutions := make(map[int64]*resolution)
+	var order []int64
+	{
+		stmt := fetch_alert_escalations_resolved.Prep(conn)
+		defer stmt.Finalize()
+		for {
+			hasRow, err := stmt.Step()
+			if err != nil {
+				return 0, fmt.Errorf("error fetching resolved escalations: %w", err)
+			}
+			if !hasRow {
+				break
+			}
+			alert := stmt.GetInt64("alert")
+			res, ok := resolutions[alert]
+			if !ok {
+				res = &resolution{}
+				if res.resolved, err = database.GetTime(stmt, "resolved"); err != nil {
+					return 0, err
+				}
+				resolutions[alert] = res
+				order = append(order, alert)
+			}
+			// NULL when nobody was told
+			if r, ok := e.recipients[stmt.GetText("recipient")]; ok {
+				for _, ch := range r.Channels {
+					if !contains(res.channels, ch) {
+						res.channels = append(res.channels, ch)
+					}
+				}
+			}
+		}
+	}
+
+	up := update_alert_escalation_resolved_queued.Prep(conn)
+	defer up.Finalize()
+	queued := 0
+	for _, alert := range order {
+		res := resolutions[alert]
+		if err := enqueue(conn, alert, "resolved", res.resolved, res.channels); err != nil {
+			return queued, err
+		}
+		queued += len(res.channels)
+		up.SetInt64("@alert", alert)
+		if _, err := up.Step(); err != nil {
+			return queued, fmt.Errorf("mark escalation resolved: %d: %w", alert, err)
+		}
+		if err := up.Reset(); err != nil {
+			return queued, err
+		}
+	}
+	return queued, nil
+}
@@ -0,0 +1,418 @@
+package escalate_test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"crawshaw.io/sqlite"
+	"crawshaw.io/sqlite/sqlitex"
+	"eagain.net/go/securityblanket/internal/alert"
+	"eagain.net/go/securityblanket/internal/database"
+	"eagain.net/go/securityblanket/internal/escalate"
+	"github.com/google/go-cmp/cmp"
+	"go.uber.org/zap/zaptest"
+)
+
+func execScript(t testing.TB, db *database.DB, sql string) {
+	conn := db.Get(nil)
+	defer db.Put(conn)
+
+	if err := sqlitex.ExecScript(conn, sql); err != nil {
+		t.Fatalf("database error: %v", err)
+	}
+}
+
+// start is at noon, outside quiet hours.
+var start = time.Date(2020, 2, 3, 12, 0, 0, 0, time.UTC)
+
+func at(d time.Duration) string {
+	return start.Add(d).Format(time.RFC3339Nano)
+}
+
+// raise adds an alert with id about loop 1 of sensor, raised at
+// start+d.
+func raise(t testing.TB, db *database.DB, id int, sensor int, d time.Duration) {
+	execScript(t, db, fmt.Sprintf(`
+INSERT INTO alerts(id, source, sensor, loop, severity, summary, raised, lastSeen)
+VALUES (%[1]d, 'trip', %[2]d, 1, 'alarm', 'test', '%[3]s', '%[3]s');
+`, id, sensor, at(d)))
+}
+
+type queued struct {
+	Alert   int64
+	Channel string
+	Event   string
+}
+
+func outbox(t testing.TB, db *database.DB) []queued {
+	conn := db.Get(nil)
+	defer db.Put(conn)
+	var got []queued
+	fn := func(stmt *sqlite.Stmt) error {
+		got = append(got, queued{
+			Alert:   stmt.GetInt64("alert"),
+			Channel: stmt.GetText("channel"),
+			Event:   stmt.GetText("event"),
+		})
+		return nil
+	}
+	if err := sqlitex.Exec(conn, `SELECT alert, channel, event FROM notify_outbox ORDER BY id`, fn); err != nil {
+		t.Fatalf("database error: %v", err)
+	}
+	return got
+}
+
+var (
+	recipients = []*escalate.Recipient{
+		{
+			Name:     "alice",
+			Channels: []string{"alice-push", "alice-email"},
+			Quiet: &escalate.QuietHours{
+				Start: 22 * time.Hour,
+				End:   7 * time.Hour,
+			},
+		},
+		{Name: "bob", Channels: []string{"bob-push"}},
+		{Name: "carol", Channels: []string{"carol-push"}},
+	}
+	policies = []*escalate.Policy{
+		{
+			Name:       "break-in",
+			Sources:    []string{"trip"},
+			Severities: []string{"alarm"},
+			Steps: []escalate.Step{
+				{After: 0, Recipients: []string{"alice"}},
+				{After: 2 * time.Minute, Recipients: []string{"bob"}},
+				{After: 4 * time.Minute, Everyone: true},
+			},
+		},
+	}
+)
+
+func TestEscalate(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	db := database.Scratch()
+	defer db.Close()
+
+	log := zaptest.NewLogger(t)
+	now := start
+	wakeups := 0
+	newEscalator := func() *escalate.Escalator {
+		return escalate.New(ctx, db, log, policies, recipients,
+			escalate.Clock(func() time.Time { return now }),
+			escalate.Wakeup(func() { wakeups++ }),
+		)
+	}
+	e := newEscalator()
+	run := func() {
+		t.Helper()
+		if err := e.Run(); err != nil {
+			t.Fatalf("run: %v", err)
+		}
+	}
+
+	execScript(t, db, `
+INSERT INTO honeywell5800_sensors(id, model, description)
+VALUES (1, '5800MINI', 'front door');
+`)
+	raise(t, db, 1, 1, 0)
+	run()
+	want := []queued{
+		{1, "alice-push", "raised"},
+		{1, "alice-email", "raised"},
+	}
+	if diff := cmp.Diff(want, outbox(t, db)); diff != "" {
+		t.Fatalf("wrong outbox after first step: -want +got\n%s", diff)
+	}
+	if g, e := wakeups, 1; g != e {
+		t.Errorf("wrong number of wakeups: %d != %d", g, e)
+	}
+
+	now = start.Add(time.Minute)
+	run()
+	if diff := cmp.Diff(want, outbox(t, db)); diff != "" {
+		t.Fatalf("escalated too early: -want +got\n%s", diff)
+	}
+
+	// the timer survives a restart, and steps missed while down are
+	// all taken
+	e = newEscalator()
+	now = start.Add(5 * time.Minute)
+	run()
+	want = append(want,
+		queued{1, "bob-push", "raised"},
+		queued{1, "alice-push", "raised"},
+		queued{1, "alice-email", "raised"},
+		queued{1, "bob-push", "raised"},
+		queued{1, "carol-push", "raised"},
+	)
+	if diff := cmp.Diff(want, outbox(t, db)); diff != "" {
+		t.Fatalf("wrong outbox after escalation: -want +got\n%s", diff)
+	}
+
+	// everyone reached hears about the resolution, once
+	execScript(t, db, fmt.Sprintf(`UPDATE alerts SET resolved='%s' WHERE id=1;`, at(6*time.Minute)))
+	now = start.Add(6 * time.Minute)
+	run()
+	run()
+	want = append(want,
+		queued{1, "alice-push", "resolved"},
+		queued{1, "alice-email", "resolved"},
+		queued{1, "bob-push", "resolved"},
+		queued{1, "carol-push", "resolved"},
+	)
+	if diff := cmp.Diff(want, outbox(t, db)); diff != "" {
+		t.Fatalf("wrong outbox after resolution: -want +got\n%s", diff)
+	}
+}
+
+func TestAcknowledgeStops(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	db := database.Scratch()
+	defer db.Close()
+
+	log := zaptest.NewLogger(t)
+	now := start
+	e := escalate.New(ctx, db, log, policies, recipients,
+		escalate.Clock(func() time.Time { return now }),
+	)
+	execScript(t, db, `
+INSERT INTO honeywell5800_sensors(id, model, description)
+VALUES (1, '5800MINI', 'front door');
+`)
+	raise(t, db, 1, 1, 0)
+	if err := e.Run(); err != nil {
+		t.Fatalf("run: %v", err)
+	}
+	if err := alert.Acknowledge(ctx, db, 1, "alice", "", start.Add(time.Minute)); err != nil {
+		t.Fatalf("acknowledge: %v", err)
+	}
+	now = start.Add(10 * time.Minute)
+	if err := e.Run(); err != nil {
+		t.Fatalf("run: %v", err)
+	}
+	want := []queued{
+		{1, "alice-push", "raised"},
+		{1, "alice-email", "raised"},
+	}
+	if diff := cmp.Diff(want, outbox(t, db)); diff != "" {
+		t.Fatalf("escalated after acknowledgement: -want +got\n%s", diff)
+	}
+}
+
+type sounded struct {
+	Alert  int64
+	Step   int64
+	Output string
+	Time   string
+}
+
+func soundedOutputs(t testing.TB, db *database.DB) []sounded {
+	conn := db.Get(nil)
+	defer db.Put(conn)
+	var got []sounded
+	fn := func(stmt *sqlite.Stmt) error {
+		got = append(got, sounded{
+			Alert:  stmt.GetInt64("alert"),
+			Step:   stmt.GetInt64("step"),
+			Output: stmt.GetText("output"),
+			Time:   stmt.GetText("time"),
+		})
+		return nil
+	}
+	if err := sqlitex.Exec(conn, `SELECT alert, step, output, time FROM alert_escalation_outputs ORDER BY id`, fn); err != nil {
+		t.Fatalf("database error: %v", err)
+	}
+	return got
+}
+
+func TestSound(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	db := database.Scratch()
+	defer db.Close()
+
+	log := zaptest.NewLogger(t)
+	night := time.Date(2020, 2, 3, 23, 0, 0, 0, time.UTC)
+	now := night
+	wakeups := 0
+	policies := []*escalate.Policy{
+		{
+			Name: "siren",
+			Steps: []escalate.Step{
+				{After: 0, Recipients: []string{"alice"}},
+				{After: time.Minute, Outputs: []string{"siren", "strobe"}},
+			},
+		},
+	}
+	e := escalate.New(ctx, db, log, policies, recipients,
+		escalate.Clock(func() time.Time { return now }),
+		escalate.Wakeup(func() { wakeups++ }),
+	)
+	execScript(t, db, `
+INSERT INTO honeywell5800_sensors(id, model, description)
+VALUES (1, '5800MINI', 'front door');
+`)
+	raise(t, db, 1, 1, 11*time.Hour)
+	if err := e.Run(); err != nil {
+		t.Fatalf("run: %v", err)
+	}
+	if got := soundedOutputs(t, db); len(got) != 0 {
+		t.Fatalf("sounded too early: %v", got)
+	}
+	// quiet hours keep alice asleep, but not the siren
+	now = night.Add(time.Minute)
+	if err := e.Run(); err != nil {
+		t.Fatalf("run: %v", err)
+	}
+	want := []sounded{
+		{1, 1, "siren", now.Format(time.RFC3339Nano)},
+		{1, 1, "strobe", now.Format(time.RFC3339Nano)},
+	}
+	if diff := cmp.Diff(want, soundedOutputs(t, db)); diff != "" {
+		t.Errorf("wrong outputs: -want +got\n%s", diff)
+	}
+	if g, e := wakeups, 1; g != e {
+		t.Errorf("wrong number of wakeups: %d != %d", g, e)
+	}
+	if got := outbox(t, db); len(got) != 0 {
+		t.Errorf("notified during quiet hours: %v", got)
+	}
+}
+
+func TestQuietHours(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	db := database.Scratch()
+	defer db.Close()
+
+	log := zaptest.NewLogger(t)
+	night := time.Date(2020, 2, 3, 23, 0, 0, 0, time.UTC)
+	e := escalate.New(ctx, db, log, policies, recipients,
+		escalate.Clock(func() time.Time { return night }),
+	)
+	execScript(t, db, `
+INSERT INTO honeywell5800_sensors(id, model, description) VALUES
+	(1, '5800MINI', 'front door'),
+	(2, '5808W3', 'kitchen');
+`)
+	// the door waits for bob, the smoke detector wakes alice
+	raise(t, db, 1, 1, 11*time.Hour)
+	raise(t, db, 2, 2, 11*time.Hour)
+	if err := e.Run(); err != nil {
+		t.Fatalf("run: %v", err)
+	}
+	want := []queued{
+		{2, "alice-push", "raised"},
+		{2, "alice-email", "raised"},
+	}
+	if diff := cmp.Diff(want, outbox(t, db)); diff != "" {
+		t.Fatalf("wrong outbox: -want +got\n%s", diff)
+	}
+}
+
+func TestOnCall(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	db := database.Scratch()
+	defer db.Close()
+
+	log := zaptest.NewLogger(t)
+	night := time.Date(2020, 2, 3, 23, 0, 0, 0, time.UTC)
+	now := night
+	rotations := []*escalate.Rotation{
+		{
+			Name:       "daily",
+			Recipients: []string{"alice", "bob"},
+			Start:      time.Date(2020, 2, 3, 9, 0, 0, 0, time.UTC),
+			Shift:      24 * time.Hour,
+		},
+	}
+	policies := []*escalate.Policy{
+		{
+			Name: "on-call",
+			Steps: []escalate.Step{
+				{After: 0, Recipients: []string{"alice"}, OnCall: []string{"daily"}},
+			},
+		},
+	}
+	e := escalate.New(ctx, db, log, policies, recipients,
+		escalate.Rotations(rotations...),
+		escalate.Clock(func() time.Time { return now }),
+	)
+	execScript(t, db, `
+INSERT INTO honeywell5800_sensors(id, model, description) VALUES
+	(1, '5800MINI', 'front door'),
+	(2, '5800MINI', 'back door');
+`)
+	// alice is on call, quiet hours or not, and told once
+	raise(t, db, 1, 1, 11*time.Hour)
+	if err := e.Run(); err != nil {
+		t.Fatalf("run: %v", err)
+	}
+	// bob is on call from 09:00 the next day
+	now = night.Add(11 * time.Hour)
+	raise(t, db, 2, 2, 22*time.Hour)
+	if err := e.Run(); err != nil {
+		t.Fatalf("run: %v", err)
+	}
+	want := []queued{
+		{1, "alice-push", "raised"},
+		{1, "alice-email", "raised"},
+		{2, "alice-push", "raised"},
+		{2, "alice-email", "raised"},
+		{2, "bob-push", "raised"},
+	}
+	if diff := cmp.Diff(want, outbox(t, db)); diff != "" {
+		t.Fatalf("wrong outbox: -want +got\n%s", diff)
+	}
+}
+
+func TestRotationOnCall(t *testing.T) {
+	r := &escalate.Rotation{
+		Recipients: []string{"alice", "bob", "carol"},
+		Start:      time.Date(2020, 2, 3, 9, 0, 0, 0, time.UTC),
+		Shift:      24 * time.Hour,
+	}
+	for _, c := range []struct {
+		t    time.Time
+		want string
+	}{
+		{time.Date(2020, 2, 3, 9, 0, 0, 0, time.UTC), "alice"},
+		{time.Date(2020, 2, 4, 8, 59, 0, 0, time.UTC), "alice"},
+		{time.Date(2020, 2, 4, 9, 0, 0, 0, time.UTC), "bob"},
+		{time.Date(2020, 2, 5, 12, 0, 0, 0, time.UTC), "carol"},
+		{time.Date(2020, 2, 6, 12, 0, 0, 0, time.UTC), "alice"},
+		// before the start, the rotation runs backwards
+		{time.Date(2020, 2, 3, 8, 0, 0, 0, time.UTC), "carol"},
+		{time.Date(2020, 2, 1, 9, 0, 0, 0, time.UTC), "bob"},
+	} {
+		if g, e := r.OnCall(c.t), c.want; g != e {
+			t.Errorf("wrong recipient at %v: %q != %q", c.t, g, e)
+		}
+	}
+}
+
+func TestQuietHoursContains(t *testing.T) {
+	q := &escalate.QuietHours{Start: 22 * time.Hour, End: 7 * time.Hour}
+	for _, c := range []struct {
+		hour  int
+		quiet bool
+	}{
+		{21, false},
+		{22, true},
+		{0, true},
+		{6, true},
+		{7, false},
+		{12, false},
+	} {
+		tm := time.Date(2020, 1, 1, c.hour, 0, 0, 0, time.UTC)
+		if g, e := q.Contains(tm), c.quiet; g != e {
+			t.Errorf("wrong quiet at %d: %v != %v", c.hour, g, e)
+		}
+	}
+}
@@ -0,0 +1,26 @@
+SELECT
+	alert_escalations.alert AS alert,
+	alert_escalations.policy AS policy,
+	alert_escalations.step AS step,
+	alert_escalations.due AS due,
+	alerts.raised AS raised,
+	alerts.acknowledged AS acknowledged,
+	alerts.resolved AS resolved,
+	coalesce(
+		honeywell5800_site_loops.kind,
+		honeywell5800_model_loops.kind
+	) AS kind
+FROM alert_escalations
+JOIN alerts ON alerts.id=alert_escalations.alert
+-- alerts about the whole site have no sensor
+LEFT JOIN honeywell5800_sensors ON honeywell5800_sensors.id=alerts.sensor
+LEFT JOIN honeywell5800_model_loops
+ON (honeywell5800_model_loops.model=honeywell5800_sensors.model
+	AND honeywell5800_model_loops.loop=alerts.loop
+)
+LEFT JOIN honeywell5800_site_loops
+ON (honeywell5800_site_loops.sensor=alerts.sensor
+	AND honeywell5800_site_loops.loop=alerts.loop
+)
+WHERE alert_escalations.finished IS NULL
+ORDER BY alert_escalations.alert
@@ -0,0 +1,14 @@
+-- recipients to tell about resolved alerts
+SELECT DISTINCT
+	alert_escalations.alert AS alert,
+	alerts.resolved AS resolved,
+	alert_escalation_notices.recipient AS recipient
+FROM alert_escalations
+JOIN alerts ON alerts.id=alert_escalations.alert
+LEFT JOIN alert_escalation_notices
+ON (alert_escalation_notices.alert=alert_escalations.alert
+	AND NOT alert_escalation_notices.quiet
+)
+WHERE alerts.resolved IS NOT NULL
+	AND NOT alert_escalations.resolvedQueued
+ORDER BY alert_escalations.alert, alert_escalation_notices.recipient
@@ -0,0 +1,10 @@
+SELECT
+	id,
+	source,
+	severity,
+	raised
+FROM alerts
+WHERE id>@last
+	AND id<=@max
+ORDER BY id ASC
+LIMIT 100
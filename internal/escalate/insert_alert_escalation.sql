@@ -0,0 +1,2 @@
+INSERT INTO alert_escalations(alert, policy, due)
+	VALUES (@alert, @policy, @due)
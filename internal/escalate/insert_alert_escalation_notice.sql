@@ -0,0 +1,2 @@
+INSERT INTO alert_escalation_notices(alert, step, recipient, time, quiet)
+	VALUES (@alert, @step, @recipient, @time, @quiet)
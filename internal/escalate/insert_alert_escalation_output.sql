@@ -0,0 +1,2 @@
+INSERT INTO alert_escalation_outputs(alert, step, output, time)
+	VALUES (@alert, @step, @output, @time)
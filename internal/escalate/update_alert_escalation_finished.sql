@@ -0,0 +1,6 @@
+UPDATE alert_escalations
+	SET step=@step,
+		due=NULL,
+		finished=@finished,
+		outcome=@outcome
+	WHERE alert=@alert
@@ -0,0 +1,3 @@
+UPDATE alert_escalations
+	SET resolvedQueued=true
+	WHERE alert=@alert
@@ -0,0 +1,4 @@
+UPDATE alert_escalations
+	SET step=@step,
+		due=@due
+	WHERE alert=@alert
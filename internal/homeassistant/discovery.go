@@ -0,0 +1,308 @@
+package homeassistant
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"crawshaw.io/sqlite"
+	"eagain.net/go/securityblanket/internal/arming"
+	"eagain.net/go/securityblanket/internal/database"
+	"eagain.net/go/securityblanket/internal/honeywell5800"
+)
+
+// deviceClasses maps loop kinds to binary sensor device classes. Kinds
+// not listed get no device class.
+var deviceClasses = map[honeywell5800.Kind]string{
+	honeywell5800.Door:              "door",
+	honeywell5800.DoorWindow:        "opening",
+	honeywell5800.GlassBreak:        "sound",
+	honeywell5800.HeatDetector:      "heat",
+	honeywell5800.LowTemp:           "cold",
+	honeywell5800.MaintenanceNeeded: "problem",
+	honeywell5800.MedicalAlert:      "safety",
+	honeywell5800.MotionDetector:    "motion",
+	honeywell5800.PanicButton:       "safety",
+	honeywell5800.SmokeDetector:     "smoke",
+	honeywell5800.Tamper:            "tamper",
+	honeywell5800.TiltSwitch:        "garage_door",
+	honeywell5800.Window:            "window",
+}
+
+// panelStates maps arming modes to alarm control panel states.
+var panelStates = map[arming.Mode]string{
+	arming.Disarmed: "disarmed",
+	arming.Home:     "armed_home",
+	arming.Away:     "armed_away",
+	arming.Night:    "armed_night",
+}
+
+// panelCommands maps alarm control panel commands to arming modes.
+var panelCommands = map[string]arming.Mode{
+	"DISARM":    arming.Disarmed,
+	"ARM_HOME":  arming.Home,
+	"ARM_AWAY":  arming.Away,
+	"ARM_NIGHT": arming.Night,
+}
+
+type device struct {
+	Identifiers  []string `json:"identifiers"`
+	Name         string   `json:"name"`
+	Manufacturer string   `json:"manufacturer,omitempty"`
+	Model        string   `json:"model,omitempty"`
+}
+
+type availability struct {
+	Topic string `json:"topic"`
+}
+
+// entity is the discovery configuration of an entity.
+type entity struct {
+	Name              string         `json:"name"`
+	UniqueID          string         `json:"unique_id"`
+	DeviceClass       string         `json:"device_class,omitempty"`
+	EntityCategory    string         `json:"entity_category,omitempty"`
+	StateTopic        string         `json:"state_topic"`
+	CommandTopic      string         `json:"command_topic,omitempty"`
+	SupportedFeatures []string       `json:"supported_features,omitempty"`
+	Availability      []availability `json:"availability"`
+	AvailabilityMode  string         `json:"availability_mode,omitempty"`
+	Device            device         `json:"device"`
+}
+
+// message is a retained message to publish.
+type message struct {
+	topic   string
+	payload string
+}
+
+func onOff(b bool) string {
+	if b {
+		return "ON"
+	}
+	return "OFF"
+}
+
+func (p *Publisher) statusTopic() string {
+	return p.conf.Topic + "/status"
+}
+
+func (p *Publisher) commandTopic() string {
+	return p.conf.Topic + "/arming/set"
+}
+
+func (p *Publisher) sensorTopic(sensor honeywell5800.Sensor) string {
+	return fmt.Sprintf("%s/honeywell5800/%d", p.conf.Topic, sensor)
+}
+
+func (p *Publisher) configTopic(component, objectID string) string {
+	return fmt.Sprintf("%s/%s/%s/%s/config", p.conf.DiscoveryPrefix, component, p.conf.Topic, objectID)
+}
+
+func (p *Publisher) discovery(topic string, e *entity) (message, error) {
+	buf, err := json.Marshal(e)
+	if err != nil {
+		return message{}, fmt.Errorf("cannot marshal discovery config: %w", err)
+	}
+	return message{topic: topic, payload: string(buf)}, nil
+}
+
+type sensorInfo struct {
+	device    device
+	available string
+}
+
+// snapshot returns the discovery configuration and state of every
+// entity, as retained messages.
+func (p *Publisher) snapshot(conn *sqlite.Conn, now time.Time) ([]message, error) {
+	var msgs []message
+	sensors := make(map[honeywell5800.Sensor]*sensorInfo)
+
+	{
+		stmt := fetch_honeywell5800_sensors.Prep(conn)
+		defer stmt.Finalize()
+		for {
+			hasRow, err := stmt.Step()
+			if err != nil {
+				return nil, fmt.Errorf("error fetching sensors: %w", err)
+			}
+			if !hasRow {
+				break
+			}
+			sensor := honeywell5800.SensorFromSQL(stmt, "sensor")
+			name := stmt.GetText("description")
+			if name == "" {
+				name = sensor.String()
+			}
+			info := &sensorInfo{
+				device: device{
+					Identifiers:  []string{fmt.Sprintf("%s_honeywell5800_%d", p.conf.Topic, sensor)},
+					Name:         name,
+					Manufacturer: "Honeywell",
+					Model:        stmt.GetText("model"),
+				},
+				available: "online",
+			}
+			if stmt.GetInt64("lost") != 0 {
+				info.available = "offline"
+			}
+			sensors[sensor] = info
+
+			topic := p.sensorTopic(sensor)
+			objectID := fmt.Sprintf("honeywell5800_%d_battery", sensor)
+			cfg, err := p.discovery(p.configTopic("binary_sensor", objectID), &entity{
+				Name:           name + " battery",
+				UniqueID:       p.conf.Topic + "_" + objectID,
+				DeviceClass:    "battery",
+				EntityCategory: "diagnostic",
+				StateTopic:     topic + "/battery",
+				Availability:   []availability{{Topic: p.statusTopic()}},
+				Device:         info.device,
+			})
+			if err != nil {
+				return nil, err
+			}
+			msgs = append(msgs,
+				cfg,
+				message{topic: topic + "/battery", payload: onOff(stmt.GetInt64("batteryLow") != 0)},
+				message{topic: topic + "/availability", payload: info.available},
+			)
+		}
+	}
+
+	{
+		stmt := fetch_honeywell5800_loops.Prep(conn)
+		defer stmt.Finalize()
+		for {
+			hasRow, err := stmt.Step()
+			if err != nil {
+				return nil, fmt.Errorf("error fetching sensor loops: %w", err)
+			}
+			if !hasRow {
+				break
+			}
+			sensor := honeywell5800.SensorFromSQL(stmt, "sensor")
+			info, ok := sensors[sensor]
+			if !ok {
+				// added between the queries
+				continue
+			}
+			loop, err := database.GetUint8(stmt, "loop")
+			if err != nil {
+				return nil, fmt.Errorf("bad loop in database: sensor %v: %w", sensor, err)
+			}
+			kind, err := honeywell5800.KindFromSQL(stmt, "kind")
+			if err != nil {
+				return nil, fmt.Errorf("bad kind in database: sensor %v loop %d: %w", sensor, loop, err)
+			}
+			label := stmt.GetText("label")
+			if label == "" {
+				label = kind.String()
+			}
+			normallyOpen := stmt.GetInt64("normallyOpen") != 0
+			// a sensor never heard from is in its normal state
+			tripped := false
+			if stmt.ColumnType(stmt.ColumnIndex("event")) != sqlite.SQLITE_NULL {
+				event := honeywell5800.EventFromSQL(stmt, "event")
+				tripped = event.Loop(loop) != normallyOpen
+			}
+
+			topic := fmt.Sprintf("%s/loop%d", p.sensorTopic(sensor), loop)
+			objectID := fmt.Sprintf("honeywell5800_%d_loop%d", sensor, loop)
+			cfg, err := p.discovery(p.configTopic("binary_sensor", objectID), &entity{
+				Name:        info.device.Name + " " + label,
+				UniqueID:    p.conf.Topic + "_" + objectID,
+				DeviceClass: deviceClasses[kind],
+				StateTopic:  topic,
+				Availability: []availability{
+					{Topic: p.statusTopic()},
+					{Topic: p.sensorTopic(sensor) + "/availability"},
+				},
+				AvailabilityMode: "all",
+				Device:           info.device,
+			})
+			if err != nil {
+				return nil, err
+			}
+			msgs = append(msgs, cfg, message{topic: topic, payload: onOff(tripped)})
+		}
+	}
+
+	state, err := p.panelState(conn, now)
+	if err != nil {
+		return nil, err
+	}
+	stateTopic := p.conf.Topic + "/arming/state"
+	cfg, err := p.discovery(p.configTopic("alarm_control_panel", "arming"), &entity{
+		Name:              "Security system",
+		UniqueID:          p.conf.Topic + "_arming",
+		StateTopic:        stateTopic,
+		CommandTopic:      p.commandTopic(),
+		SupportedFeatures: []string{"arm_home", "arm_away", "arm_night"},
+		Availability:      []availability{{Topic: p.statusTopic()}},
+		Device: device{
+			Identifiers: []string{p.conf.Topic},
+			Name:        p.conf.Topic,
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	msgs = append(msgs, cfg, message{topic: stateTopic, payload: state})
+	return msgs, nil
+}
+
+// panelState returns the state of the alarm control panel.
+func (p *Publisher) panelState(conn *sqlite.Conn, now time.Time) (string, error) {
+	mode := arming.Disarmed
+	var since time.Time
+	var exitDelay time.Duration
+	{
+		stmt := fetch_arming_change_latest.Prep(conn)
+		defer stmt.Finalize()
+		hasRow, err := stmt.Step()
+		if err != nil {
+			return "", fmt.Errorf("error fetching arming mode: %w", err)
+		}
+		if hasRow {
+			if mode, err = arming.ModeFromSQL(stmt, "mode"); err != nil {
+				return "", err
+			}
+			if since, err = database.GetTime(stmt, "time"); err != nil {
+				return "", err
+			}
+			seconds, ok, err := database.GetNullFloat(stmt, "exitDelay")
+			if err != nil {
+				return "", err
+			}
+			if ok {
+				exitDelay = time.Duration(seconds * float64(time.Second))
+			}
+			if err := database.NoMoreRows(stmt); err != nil {
+				return "", err
+			}
+		}
+	}
+
+	stmt := fetch_arming_alarms.Prep(conn)
+	defer stmt.Finalize()
+	database.BindTime(stmt, "@since", since)
+	if err := database.Row(stmt); err != nil {
+		return "", fmt.Errorf("error fetching alarms: %w", err)
+	}
+	triggered := stmt.GetInt64("triggered") != 0
+	pending := stmt.GetInt64("pending") != 0
+	if err := database.NoMoreRows(stmt); err != nil {
+		return "", err
+	}
+
+	switch {
+	case triggered:
+		return "triggered", nil
+	case pending:
+		return "pending", nil
+	case mode != arming.Disarmed && now.Before(since.Add(exitDelay)):
+		return "arming", nil
+	}
+	return panelStates[mode], nil
+}
@@ -0,0 +1,17 @@
+-- Whether an alarm has gone off since the arming mode last changed,
+-- and has not been dealt with, and whether an entry delay is counting
+-- down.
+SELECT
+	EXISTS (
+		SELECT 1
+		FROM alerts_open
+		WHERE source='trip'
+			AND severity='alarm'
+			AND acknowledged IS NULL
+			AND (@since IS NULL OR raised>=@since)
+	) AS triggered,
+	EXISTS (
+		SELECT 1
+		FROM arming_entry_delays
+		WHERE outcome IS NULL
+	) AS pending
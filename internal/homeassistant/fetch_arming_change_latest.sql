@@ -0,0 +1,8 @@
+SELECT arming_changes.time AS time,
+	arming_changes.mode AS mode,
+	arming_modes.exitDelay AS exitDelay
+	FROM arming_changes
+	JOIN arming_modes
+	ON (arming_modes.id=arming_changes.mode)
+	ORDER BY arming_changes.id DESC
+	LIMIT 1
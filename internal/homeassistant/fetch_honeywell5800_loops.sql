@@ -0,0 +1,30 @@
+WITH allLoops (loop) AS (
+	VALUES (1), (2), (3), (4)
+)
+SELECT honeywell5800_sensors.id AS sensor,
+	allLoops.loop AS loop,
+	coalesce(honeywell5800_site_loops.kind, honeywell5800_model_loops.kind) AS kind,
+	coalesce(siteLabel, factoryLabel, '') AS label,
+	coalesce(siteNormallyOpen, factoryNormallyOpen, false) AS normallyOpen,
+	latest.event AS event
+	FROM honeywell5800_sensors
+	JOIN honeywell5800_models
+	ON (honeywell5800_sensors.model=honeywell5800_models.id)
+	JOIN allLoops
+	LEFT JOIN honeywell5800_model_loops
+	USING (model, loop)
+	LEFT JOIN honeywell5800_site_loops
+	ON (honeywell5800_site_loops.sensor=honeywell5800_sensors.id
+		AND honeywell5800_site_loops.loop=allLoops.loop
+	)
+	LEFT JOIN honeywell5800_updates AS latest
+	ON (latest.id=(
+		SELECT max(id)
+		FROM honeywell5800_updates
+		WHERE sensor=honeywell5800_sensors.id
+	))
+	WHERE NOT coalesce(honeywell5800_site_loops.disabled, false)
+		AND (NOT honeywell5800_model_loops.typicallyUnused
+			OR honeywell5800_site_loops.loop IS NOT NULL)
+		AND coalesce(honeywell5800_site_loops.kind, honeywell5800_model_loops.kind) IS NOT NULL
+	ORDER BY honeywell5800_sensors.id, loop ASC
@@ -0,0 +1,14 @@
+SELECT honeywell5800_sensors.id AS sensor,
+	honeywell5800_sensors.description AS description,
+	coalesce(honeywell5800_sensors.model, '') AS model,
+	coalesce(honeywell5800_batteries.low, false) AS batteryLow,
+	EXISTS (
+		SELECT 1
+		FROM honeywell5800_supervision_losses
+		WHERE sensor=honeywell5800_sensors.id
+			AND restoredBy IS NULL
+	) AS lost
+	FROM honeywell5800_sensors
+	LEFT JOIN honeywell5800_batteries
+	ON (honeywell5800_batteries.sensor=honeywell5800_sensors.id)
+	ORDER BY honeywell5800_sensors.id
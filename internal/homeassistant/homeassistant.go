@@ -0,0 +1,286 @@
+// Package homeassistant publishes sensors and the arming mode to Home
+// Assistant, using MQTT discovery.
+//
+// Every enabled Honeywell 5800 loop is a binary_sensor, with its
+// device class derived from the kind of the loop, and the battery of
+// every sensor is another. Sensors lost to supervision are marked
+// unavailable. The arming mode is an alarm_control_panel.
+//
+// All messages are retained, so Home Assistant sees the current state
+// when it restarts. Publishing works on snapshots of the database:
+// every Run compares the current state to what has been published,
+// and publishes the difference. After connecting, the whole state is
+// published again.
+package homeassistant
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"eagain.net/go/securityblanket/internal/arming"
+	"eagain.net/go/securityblanket/internal/database"
+	"eagain.net/go/securityblanket/internal/mqtt"
+	"go.uber.org/zap"
+)
+
+// Config describes the MQTT broker Home Assistant uses.
+type Config struct {
+	// Addr is the broker address, in host:port form.
+	Addr string
+	MQTT mqtt.Config
+	// DiscoveryPrefix is where Home Assistant looks for discovery
+	// messages. Empty means "homeassistant".
+	DiscoveryPrefix string
+	// Topic prefixes the state topics, and identifies this system in
+	// Home Assistant. Empty means "securityblanket".
+	Topic string
+	// Commands allows Home Assistant to change the arming mode. There
+	// is no authentication beyond what the broker does.
+	Commands bool
+}
+
+const (
+	minRedial = time.Second
+	maxRedial = time.Minute
+)
+
+type config struct {
+	clock func() time.Time
+}
+
+type Option option
+
+type option func(*config)
+
+// Clock overrides the source of time, used for exit delays and arming
+// changes.
+func Clock(clock func() time.Time) Option {
+	fn := func(conf *config) {
+		conf.clock = clock
+	}
+	return fn
+}
+
+// Publisher keeps Home Assistant up to date. Run needs to be called
+// whenever the state may have changed, and periodically to reconnect
+// and to process commands.
+type Publisher struct {
+	ctx    context.Context
+	db     *database.DB
+	log    *zap.Logger
+	conf   Config
+	config config
+
+	client *mqtt.Client
+	// when to try connecting again, and how long to wait after that
+	nextDial time.Time
+	redial   time.Duration
+	// payloads published since connecting, by topic
+	published map[string]string
+	commands  chan string
+}
+
+func New(ctx context.Context, db *database.DB, log *zap.Logger, conf *Config, opts ...Option) *Publisher {
+	p := &Publisher{
+		ctx:  ctx,
+		db:   db,
+		log:  log,
+		conf: *conf,
+		config: config{
+			clock: time.Now,
+		},
+		redial:   minRedial,
+		commands: make(chan string, 10),
+	}
+	if p.conf.DiscoveryPrefix == "" {
+		p.conf.DiscoveryPrefix = "homeassistant"
+	}
+	if p.conf.Topic == "" {
+		p.conf.Topic = "securityblanket"
+	}
+	for _, opt := range opts {
+		opt(&p.config)
+	}
+	return p
+}
+
+func (p *Publisher) connected() bool {
+	if p.client == nil {
+		return false
+	}
+	select {
+	case <-p.client.Done():
+		p.log.Warn("disconnected", zap.Error(p.client.Err()))
+		p.client = nil
+		return false
+	default:
+		return true
+	}
+}
+
+// connect dials the broker, unless it is too soon since the last
+// failure. Failures are logged rather than returned; the broker being
+// away must not stop the daemon.
+func (p *Publisher) connect() bool {
+	now := p.config.clock()
+	if now.Before(p.nextDial) {
+		return false
+	}
+	c := p.conf.MQTT
+	c.Will = &mqtt.Message{
+		Topic:   p.statusTopic(),
+		Payload: []byte("offline"),
+		Retain:  true,
+	}
+	if p.conf.Commands {
+		c.Handler = p.command
+	}
+	client, err := mqtt.Dial(p.ctx, p.conf.Addr, &c)
+	if err == nil && p.conf.Commands {
+		if err = client.Subscribe(p.ctx, p.commandTopic()); err != nil {
+			_ = client.Close()
+		}
+	}
+	if err != nil {
+		p.log.Warn("connect.failed", zap.Duration("retry", p.redial), zap.Error(err))
+		p.nextDial = now.Add(p.redial)
+		p.redial *= 2
+		if p.redial > maxRedial {
+			p.redial = maxRedial
+		}
+		return false
+	}
+	p.log.Info("connected", zap.String("server", p.conf.Addr))
+	p.client = client
+	p.redial = minRedial
+	p.published = make(map[string]string)
+	return true
+}
+
+// command is called by the MQTT client for every message on the
+// command topic. Commands are applied on the next Run.
+func (p *Publisher) command(msg *mqtt.Message) {
+	select {
+	case p.commands <- string(msg.Payload):
+	default:
+		p.log.Warn("command.dropped", zap.ByteString("payload", msg.Payload))
+	}
+}
+
+func (p *Publisher) runCommands() error {
+	for {
+		var cmd string
+		select {
+		case cmd = <-p.commands:
+		default:
+			return nil
+		}
+		mode, ok := panelCommands[cmd]
+		if !ok {
+			p.log.Warn("command.unknown", zap.String("command", cmd))
+			continue
+		}
+		change := &arming.Change{
+			Time:      p.config.clock(),
+			Mode:      mode,
+			ChangedBy: "homeassistant",
+			Via:       "mqtt",
+		}
+		err := arming.Set(p.ctx, p.db, change)
+		if errors.Is(err, arming.ErrTransition) {
+			p.log.Warn("command.rejected", zap.String("command", cmd), zap.Error(err))
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		p.log.Info("command", zap.String("command", cmd), zap.Stringer("mode", mode))
+	}
+}
+
+func (p *Publisher) publish(topic, payload string) error {
+	msg := &mqtt.Message{
+		Topic:   topic,
+		Payload: []byte(payload),
+		Retain:  true,
+	}
+	if err := p.client.Publish(msg); err != nil {
+		return err
+	}
+	p.published[topic] = payload
+	return nil
+}
+
+// Run connects if needed, applies commands received, and publishes
+// what has changed.
+func (p *Publisher) Run() error {
+	if err := p.runCommands(); err != nil {
+		return err
+	}
+	if !p.connected() && !p.connect() {
+		return nil
+	}
+
+	conn := p.db.Get(p.ctx)
+	if conn == nil {
+		return context.Canceled
+	}
+	msgs, err := p.snapshot(conn, p.config.clock())
+	p.db.Put(conn)
+	if err != nil {
+		return err
+	}
+
+	if err := p.update(msgs); err != nil {
+		p.log.Warn("publish.failed", zap.Error(err))
+		_ = p.client.Close()
+		p.client = nil
+	}
+	return nil
+}
+
+func (p *Publisher) update(msgs []message) error {
+	if _, ok := p.published[p.statusTopic()]; !ok {
+		if err := p.publish(p.statusTopic(), "online"); err != nil {
+			return err
+		}
+	}
+	current := make(map[string]struct{}, len(msgs))
+	for _, m := range msgs {
+		current[m.topic] = struct{}{}
+		if prev, ok := p.published[m.topic]; ok && prev == m.payload {
+			continue
+		}
+		if err := p.publish(m.topic, m.payload); err != nil {
+			return err
+		}
+	}
+	// remove what is gone, such as disabled loops
+	for topic := range p.published {
+		if topic == p.statusTopic() {
+			continue
+		}
+		if _, ok := current[topic]; ok {
+			continue
+		}
+		if err := p.publish(topic, ""); err != nil {
+			return err
+		}
+		delete(p.published, topic)
+	}
+	return nil
+}
+
+// Close marks the system offline in Home Assistant, and disconnects.
+func (p *Publisher) Close() error {
+	if !p.connected() {
+		return nil
+	}
+	err := p.publish(p.statusTopic(), "offline")
+	if err2 := p.client.Close(); err == nil {
+		err = err2
+	}
+	p.client = nil
+	return err
+}
@@ -0,0 +1,255 @@
+package homeassistant_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	"crawshaw.io/sqlite/sqlitex"
+	"eagain.net/go/securityblanket/internal/arming"
+	"eagain.net/go/securityblanket/internal/database"
+	"eagain.net/go/securityblanket/internal/homeassistant"
+	"eagain.net/go/securityblanket/internal/mqtt"
+	"eagain.net/go/securityblanket/internal/mqtt/mqtttest"
+	"github.com/google/go-cmp/cmp"
+	"go.uber.org/zap/zaptest"
+)
+
+func execScript(t testing.TB, db *database.DB, sql string) {
+	conn := db.Get(nil)
+	defer db.Put(conn)
+
+	if err := sqlitex.ExecScript(conn, sql); err != nil {
+		t.Fatalf("database error: %v", err)
+	}
+}
+
+var start = time.Date(2020, 2, 3, 4, 5, 6, 0, time.UTC)
+
+func at(d time.Duration) string {
+	return start.Add(d).Format(time.RFC3339Nano)
+}
+
+// waitRetained waits for the broker to have retained payload on topic.
+func waitRetained(t testing.TB, broker *mqtttest.Broker, topic, payload string) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		msg := broker.Retained(topic)
+		if msg != nil && string(msg.Payload) == payload {
+			return
+		}
+		if time.Now().After(deadline) {
+			got := "<none>"
+			if msg != nil {
+				got = string(msg.Payload)
+			}
+			t.Fatalf("wrong retained message on %s: %q != %q", topic, got, payload)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+type discovery struct {
+	Name             string `json:"name"`
+	UniqueID         string `json:"unique_id"`
+	DeviceClass      string `json:"device_class"`
+	StateTopic       string `json:"state_topic"`
+	AvailabilityMode string `json:"availability_mode"`
+}
+
+func TestPublish(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	db := database.Scratch()
+	defer db.Close()
+	broker := mqtttest.NewBroker()
+	defer broker.Close()
+
+	execScript(t, db, fmt.Sprintf(`
+INSERT INTO honeywell5800_sensors(id, model, description) VALUES
+	(1, '5800MINI', 'front door'),
+	(2, '5808W3', 'kitchen');
+
+INSERT INTO honeywell5800_updates(id, time, channel, sensor, event) VALUES
+	(1, '%[1]s', 8, 1, 0),
+	(2, '%[1]s', 8, 2, 8);
+
+INSERT INTO honeywell5800_batteries(sensor, low)
+VALUES (2, true);
+
+INSERT INTO honeywell5800_supervision_losses(sensor, lastSeen, lost)
+VALUES (2, 2, '%[1]s');
+`, at(0)))
+
+	now := start
+	p := homeassistant.New(ctx, db, zaptest.NewLogger(t),
+		&homeassistant.Config{
+			Addr: broker.Addr,
+			MQTT: mqtt.Config{ClientID: "test"},
+		},
+		homeassistant.Clock(func() time.Time { return now }),
+	)
+	defer p.Close()
+	run := func() {
+		t.Helper()
+		if err := p.Run(); err != nil {
+			t.Fatalf("run: %v", err)
+		}
+	}
+
+	run()
+	waitRetained(t, broker, "securityblanket/status", "online")
+	waitRetained(t, broker, "securityblanket/arming/state", "disarmed")
+	waitRetained(t, broker, "securityblanket/honeywell5800/1/loop1", "OFF")
+	waitRetained(t, broker, "securityblanket/honeywell5800/1/loop4", "OFF")
+	waitRetained(t, broker, "securityblanket/honeywell5800/1/battery", "OFF")
+	waitRetained(t, broker, "securityblanket/honeywell5800/1/availability", "online")
+	waitRetained(t, broker, "securityblanket/honeywell5800/2/battery", "ON")
+	waitRetained(t, broker, "securityblanket/honeywell5800/2/availability", "offline")
+
+	for topic, want := range map[string]discovery{
+		"homeassistant/binary_sensor/securityblanket/honeywell5800_1_loop1/config": {
+			Name:             "front door door or window open",
+			UniqueID:         "securityblanket_honeywell5800_1_loop1",
+			DeviceClass:      "opening",
+			StateTopic:       "securityblanket/honeywell5800/1/loop1",
+			AvailabilityMode: "all",
+		},
+		"homeassistant/binary_sensor/securityblanket/honeywell5800_1_loop4/config": {
+			Name:             "front door tamper",
+			UniqueID:         "securityblanket_honeywell5800_1_loop4",
+			DeviceClass:      "tamper",
+			StateTopic:       "securityblanket/honeywell5800/1/loop4",
+			AvailabilityMode: "all",
+		},
+		"homeassistant/binary_sensor/securityblanket/honeywell5800_2_loop1/config": {
+			Name:             "kitchen smoke detector",
+			UniqueID:         "securityblanket_honeywell5800_2_loop1",
+			DeviceClass:      "smoke",
+			StateTopic:       "securityblanket/honeywell5800/2/loop1",
+			AvailabilityMode: "all",
+		},
+		"homeassistant/binary_sensor/securityblanket/honeywell5800_2_battery/config": {
+			Name:        "kitchen battery",
+			UniqueID:    "securityblanket_honeywell5800_2_battery",
+			DeviceClass: "battery",
+			StateTopic:  "securityblanket/honeywell5800/2/battery",
+		},
+		"homeassistant/alarm_control_panel/securityblanket/arming/config": {
+			Name:       "Security system",
+			UniqueID:   "securityblanket_arming",
+			StateTopic: "securityblanket/arming/state",
+		},
+	} {
+		msg := broker.Retained(topic)
+		if msg == nil {
+			t.Errorf("no discovery config: %s", topic)
+			continue
+		}
+		var got discovery
+		if err := json.Unmarshal(msg.Payload, &got); err != nil {
+			t.Errorf("bad discovery config: %s: %v", topic, err)
+			continue
+		}
+		if diff := cmp.Diff(want, got); diff != "" {
+			t.Errorf("wrong discovery config: %s: -want +got\n%s", topic, diff)
+		}
+	}
+
+	// only changes are published
+	count := len(broker.Published())
+	run()
+	if g, e := len(broker.Published()), count; g != e {
+		t.Errorf("republished unchanged state: %d != %d", g, e)
+	}
+
+	execScript(t, db, fmt.Sprintf(`
+INSERT INTO honeywell5800_updates(id, time, channel, sensor, event)
+VALUES (3, '%[1]s', 8, 1, 128);
+
+INSERT INTO arming_changes(time, mode, changedBy)
+VALUES ('%[1]s', 'away', 'test');
+`, at(time.Minute)))
+	now = start.Add(time.Minute)
+	run()
+	waitRetained(t, broker, "securityblanket/honeywell5800/1/loop1", "ON")
+	waitRetained(t, broker, "securityblanket/arming/state", "arming")
+
+	// exit delay is over
+	now = start.Add(3 * time.Minute)
+	run()
+	waitRetained(t, broker, "securityblanket/arming/state", "armed_away")
+
+	// losing the connection marks the system offline, and
+	// reconnecting publishes everything again
+	broker.DisconnectAll()
+	waitRetained(t, broker, "securityblanket/status", "offline")
+	execScript(t, db, `DELETE FROM honeywell5800_supervision_losses;`)
+	deadline := time.Now().Add(5 * time.Second)
+	for len(broker.Connects()) < 2 {
+		if time.Now().After(deadline) {
+			t.Fatal("never reconnected")
+		}
+		// redial waits for the clock
+		now = now.Add(time.Minute)
+		run()
+		time.Sleep(10 * time.Millisecond)
+	}
+	waitRetained(t, broker, "securityblanket/status", "online")
+	waitRetained(t, broker, "securityblanket/honeywell5800/2/availability", "online")
+
+	if err := p.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+	waitRetained(t, broker, "securityblanket/status", "offline")
+}
+
+func TestCommands(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	db := database.Scratch()
+	defer db.Close()
+	broker := mqtttest.NewBroker()
+	defer broker.Close()
+
+	p := homeassistant.New(ctx, db, zaptest.NewLogger(t),
+		&homeassistant.Config{
+			Addr:     broker.Addr,
+			MQTT:     mqtt.Config{ClientID: "test"},
+			Topic:    "house",
+			Commands: true,
+		},
+		homeassistant.Clock(func() time.Time { return start }),
+	)
+	defer p.Close()
+	if err := p.Run(); err != nil {
+		t.Fatalf("run: %v", err)
+	}
+	broker.WaitSubscribers(1)
+	broker.Publish(&mqtt.Message{Topic: "house/arming/set", Payload: []byte("ARM_HOME")})
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if err := p.Run(); err != nil {
+			t.Fatalf("run: %v", err)
+		}
+		cur, err := arming.Current(ctx, db)
+		if err != nil {
+			t.Fatalf("arming: %v", err)
+		}
+		if cur.Mode == arming.Home {
+			if g, e := cur.ChangedBy, "homeassistant"; g != e {
+				t.Errorf("wrong changedBy: %q != %q", g, e)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("command never applied")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	waitRetained(t, broker, "house/arming/state", "armed_home")
+}
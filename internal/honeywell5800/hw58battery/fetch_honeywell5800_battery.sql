@@ -0,0 +1,9 @@
+SELECT
+	low,
+	pending,
+	pendingSince,
+	firstSeenLow,
+	lastSeenLow,
+	cleared
+FROM honeywell5800_batteries
+WHERE sensor=@sensor
@@ -0,0 +1,6 @@
+SELECT
+	sensor,
+	time,
+	lowSince
+FROM honeywell5800_battery_replacements
+ORDER BY sensor, id
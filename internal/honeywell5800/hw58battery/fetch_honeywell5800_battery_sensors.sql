@@ -0,0 +1,11 @@
+SELECT
+	honeywell5800_sensors.id AS sensor,
+	honeywell5800_sensors.created AS created,
+	honeywell5800_sensors.model AS model,
+	honeywell5800_sensors.description AS description,
+	coalesce(honeywell5800_batteries.low, false) AS low,
+	honeywell5800_batteries.firstSeenLow AS firstSeenLow
+FROM honeywell5800_sensors
+LEFT JOIN honeywell5800_batteries
+ON (honeywell5800_batteries.sensor=honeywell5800_sensors.id)
+ORDER BY honeywell5800_sensors.id
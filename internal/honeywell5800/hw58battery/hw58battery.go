@@ -0,0 +1,397 @@
+// Package hw58battery tracks the battery state of Honeywell 5800
+// sensors, and keeps a history of battery replacements.
+//
+// Every update carries a low battery bit. A sensor only counts as low
+// after several reports in a row say so, and as normal again after
+// several reports in a row say that; a single flaky report changes
+// nothing. A low battery turning normal again is recorded as a
+// replacement.
+package hw58battery
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"crawshaw.io/sqlite"
+	"crawshaw.io/sqlite/sqlitex"
+	"eagain.net/go/securityblanket/internal/catchup"
+	"eagain.net/go/securityblanket/internal/database"
+	"eagain.net/go/securityblanket/internal/honeywell5800"
+	"go.uber.org/zap"
+)
+
+type config struct {
+	lowReports   int
+	clearReports int
+	wakeup       func()
+}
+
+type Option option
+
+type option func(*config)
+
+// LowReports sets how many low battery reports in a row it takes to
+// consider the battery low.
+func LowReports(n int) Option {
+	fn := func(conf *config) {
+		conf.lowReports = n
+	}
+	return fn
+}
+
+// ClearReports sets how many normal battery reports in a row it
+// takes to consider a low battery replaced.
+func ClearReports(n int) Option {
+	fn := func(conf *config) {
+		conf.clearReports = n
+	}
+	return fn
+}
+
+// Wakeup is called whenever a battery goes low or is replaced.
+func Wakeup(wakeup func()) Option {
+	fn := func(conf *config) {
+		conf.wakeup = wakeup
+	}
+	return fn
+}
+
+type Tracker struct {
+	ctx     context.Context
+	catchup *catchup.Catchup
+	log     *zap.Logger
+	config  config
+}
+
+func New(ctx context.Context, db *database.DB, log *zap.Logger, opts ...Option) *Tracker {
+	t := &Tracker{
+		ctx: ctx,
+		catchup: catchup.New(&catchup.Config{
+			DB:      db,
+			Log:     log.Named("catchup"),
+			Name:    "honeywell5800.battery",
+			MaxSQL:  fetch_honeywell5800_updates_max.Content,
+			NextSQL: fetch_honeywell5800_updates.Content,
+		}),
+		log: log,
+		config: config{
+			lowReports:   2,
+			clearReports: 2,
+			wakeup:       func() {},
+		},
+	}
+	for _, opt := range opts {
+		opt(&t.config)
+	}
+	return t
+}
+
+func (t *Tracker) Run() error {
+	return t.catchup.Run(t.ctx, t.run)
+}
+
+type state struct {
+	low          bool
+	pending      int
+	pendingSince time.Time
+	firstSeenLow time.Time
+	lastSeenLow  time.Time
+	cleared      time.Time
+}
+
+func loadState(conn *sqlite.Conn, sensor honeywell5800.Sensor) (*state, error) {
+	stmt := fetch_honeywell5800_battery.Prep(conn)
+	defer stmt.Finalize()
+	sensor.ToSQL(stmt, "@sensor")
+	hasRow, err := stmt.Step()
+	if err != nil {
+		return nil, err
+	}
+	if !hasRow {
+		return &state{}, nil
+	}
+	st := &state{
+		low:     stmt.GetInt64("low") != 0,
+		pending: int(stmt.GetInt64("pending")),
+	}
+	for _, col := range []struct {
+		name string
+		t    *time.Time
+	}{
+		{"pendingSince", &st.pendingSince},
+		{"firstSeenLow", &st.firstSeenLow},
+		{"lastSeenLow", &st.lastSeenLow},
+		{"cleared", &st.cleared},
+	} {
+		if *col.t, err = database.GetTime(stmt, col.name); err != nil {
+			return nil, err
+		}
+	}
+	if err := database.NoMoreRows(stmt); err != nil {
+		return nil, err
+	}
+	return st, nil
+}
+
+func saveState(conn *sqlite.Conn, sensor honeywell5800.Sensor, st *state) error {
+	stmt := upsert_honeywell5800_battery.Prep(conn)
+	defer stmt.Finalize()
+	sensor.ToSQL(stmt, "@sensor")
+	stmt.SetBool("@low", st.low)
+	stmt.SetInt64("@pending", int64(st.pending))
+	database.BindTime(stmt, "@pendingSince", st.pendingSince)
+	database.BindTime(stmt, "@firstSeenLow", st.firstSeenLow)
+	database.BindTime(stmt, "@lastSeenLow", st.lastSeenLow)
+	database.BindTime(stmt, "@cleared", st.cleared)
+	if _, err := stmt.Step(); err != nil {
+		return err
+	}
+	return nil
+}
+
+func addReplacement(conn *sqlite.Conn, sensor honeywell5800.Sensor, ts time.Time, lowSince time.Time, automatic bool, note string) error {
+	stmt := insert_honeywell5800_battery_replacement.Prep(conn)
+	defer stmt.Finalize()
+	sensor.ToSQL(stmt, "@sensor")
+	database.BindTime(stmt, "@time", ts)
+	database.BindTime(stmt, "@lowSince", lowSince)
+	stmt.SetBool("@automatic", automatic)
+	stmt.SetText("@note", note)
+	if _, err := stmt.Step(); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (t *Tracker) run(conn *sqlite.Conn, stmt *sqlite.Stmt) error {
+	sensor := honeywell5800.SensorFromSQL(stmt, "sensor")
+	event := honeywell5800.EventFromSQL(stmt, "event")
+	ts, err := database.GetTime(stmt, "time")
+	if err != nil {
+		return fmt.Errorf("bad update time: %w", err)
+	}
+
+	st, err := loadState(conn, sensor)
+	if err != nil {
+		return fmt.Errorf("error fetching battery state: %v: %w", sensor, err)
+	}
+
+	reportLow := event.IsBatteryLow()
+	if reportLow {
+		st.lastSeenLow = ts
+	}
+	if reportLow == st.low {
+		st.pending = 0
+		st.pendingSince = time.Time{}
+		if err := saveState(conn, sensor, st); err != nil {
+			return fmt.Errorf("error saving battery state: %v: %w", sensor, err)
+		}
+		return nil
+	}
+
+	if st.pending == 0 {
+		st.pendingSince = ts
+	}
+	st.pending++
+	need := t.config.lowReports
+	if st.low {
+		need = t.config.clearReports
+	}
+	if st.pending < need {
+		if err := saveState(conn, sensor, st); err != nil {
+			return fmt.Errorf("error saving battery state: %v: %w", sensor, err)
+		}
+		return nil
+	}
+
+	since := st.pendingSince
+	st.low = reportLow
+	st.pending = 0
+	st.pendingSince = time.Time{}
+	if st.low {
+		st.firstSeenLow = since
+		st.cleared = time.Time{}
+		t.log.Warn("low",
+			zap.Stringer("sensor", sensor),
+			zap.Time("since", since),
+		)
+	} else {
+		st.cleared = since
+		if err := addReplacement(conn, sensor, since, st.firstSeenLow, true, ""); err != nil {
+			return fmt.Errorf("error recording battery replacement: %v: %w", sensor, err)
+		}
+		t.log.Info("replaced",
+			zap.Stringer("sensor", sensor),
+			zap.Time("lowSince", st.firstSeenLow),
+		)
+	}
+	if err := saveState(conn, sensor, st); err != nil {
+		return fmt.Errorf("error saving battery state: %v: %w", sensor, err)
+	}
+	t.config.wakeup()
+	return nil
+}
+
+// Replace records a battery replacement done by hand, for example
+// preventively before the battery went low. A low battery is
+// considered normal again right away.
+func Replace(ctx context.Context, db *database.DB, sensor honeywell5800.Sensor, ts time.Time, note string) (err error) {
+	conn := db.Get(ctx)
+	if conn == nil {
+		return context.Canceled
+	}
+	defer db.Put(conn)
+	defer sqlitex.Save(conn)(&err)
+
+	st, err := loadState(conn, sensor)
+	if err != nil {
+		return fmt.Errorf("error fetching battery state: %v: %w", sensor, err)
+	}
+	var lowSince time.Time
+	if st.low {
+		lowSince = st.firstSeenLow
+		st.low = false
+		st.cleared = ts
+	}
+	st.pending = 0
+	st.pendingSince = time.Time{}
+	if err := addReplacement(conn, sensor, ts, lowSince, false, note); err != nil {
+		return fmt.Errorf("error recording battery replacement: %v: %w", sensor, err)
+	}
+	if err := saveState(conn, sensor, st); err != nil {
+		return fmt.Errorf("error saving battery state: %v: %w", sensor, err)
+	}
+	return nil
+}
+
+// DefaultLife is the assumed battery life when there is no history to
+// go by.
+const DefaultLife = 4 * 365 * 24 * time.Hour
+
+// Due is a sensor that probably needs a new battery soon.
+type Due struct {
+	Sensor      honeywell5800.Sensor
+	Model       string
+	Description string
+	// Low is true if the battery is already reported low.
+	Low bool
+	// Installed is when the current battery was put in, as far as is
+	// known.
+	Installed time.Time
+	// Expected is when the battery is expected to go low, or when it
+	// did.
+	Expected time.Time
+}
+
+func median(d []time.Duration) time.Duration {
+	s := append([]time.Duration(nil), d...)
+	sort.Slice(s, func(i, j int) bool { return s[i] < s[j] })
+	n := len(s)
+	if n%2 == 1 {
+		return s[n/2]
+	}
+	return (s[n/2-1] + s[n/2]) / 2
+}
+
+// Forecast lists sensors whose battery is low, or is expected to go
+// low before now+within.
+//
+// Battery life is estimated from earlier batteries that went low:
+// first from the same sensor, then from other sensors of the same
+// model, and if neither is known, DefaultLife is used.
+func Forecast(ctx context.Context, db *database.DB, now time.Time, within time.Duration) ([]Due, error) {
+	conn := db.Get(ctx)
+	if conn == nil {
+		return nil, context.Canceled
+	}
+	defer db.Put(conn)
+
+	type replacement struct {
+		time     time.Time
+		lowSince time.Time
+	}
+	replacements := make(map[honeywell5800.Sensor][]replacement)
+	{
+		stmt := fetch_honeywell5800_battery_replacements.Prep(conn)
+		defer stmt.Finalize()
+		for {
+			hasRow, err := stmt.Step()
+			if err != nil {
+				return nil, fmt.Errorf("error fetching battery replacements: %w", err)
+			}
+			if !hasRow {
+				break
+			}
+			sensor := honeywell5800.SensorFromSQL(stmt, "sensor")
+			var r replacement
+			if r.time, err = database.GetTime(stmt, "time"); err != nil {
+				return nil, err
+			}
+			if r.lowSince, err = database.GetTime(stmt, "lowSince"); err != nil {
+				return nil, err
+			}
+			replacements[sensor] = append(replacements[sensor], r)
+		}
+	}
+
+	var dues []Due
+	sensorLife := make(map[honeywell5800.Sensor][]time.Duration)
+	modelLife := make(map[string][]time.Duration)
+	stmt := fetch_honeywell5800_battery_sensors.Prep(conn)
+	defer stmt.Finalize()
+	for {
+		hasRow, err := stmt.Step()
+		if err != nil {
+			return nil, fmt.Errorf("error fetching sensors: %w", err)
+		}
+		if !hasRow {
+			break
+		}
+		d := Due{
+			Sensor:      honeywell5800.SensorFromSQL(stmt, "sensor"),
+			Model:       stmt.GetText("model"),
+			Description: stmt.GetText("description"),
+			Low:         stmt.GetInt64("low") != 0,
+		}
+		created, err := database.GetTime(stmt, "created")
+		if err != nil {
+			return nil, err
+		}
+		if d.Low {
+			if d.Expected, err = database.GetTime(stmt, "firstSeenLow"); err != nil {
+				return nil, err
+			}
+		}
+		d.Installed = created
+		for _, r := range replacements[d.Sensor] {
+			if !r.lowSince.IsZero() && r.lowSince.After(d.Installed) {
+				life := r.lowSince.Sub(d.Installed)
+				sensorLife[d.Sensor] = append(sensorLife[d.Sensor], life)
+				modelLife[d.Model] = append(modelLife[d.Model], life)
+			}
+			d.Installed = r.time
+		}
+		dues = append(dues, d)
+	}
+
+	var result []Due
+	for _, d := range dues {
+		if !d.Low {
+			life := DefaultLife
+			switch {
+			case len(sensorLife[d.Sensor]) > 0:
+				life = median(sensorLife[d.Sensor])
+			case len(modelLife[d.Model]) > 0:
+				life = median(modelLife[d.Model])
+			}
+			d.Expected = d.Installed.Add(life)
+			if !d.Expected.Before(now.Add(within)) {
+				continue
+			}
+		}
+		result = append(result, d)
+	}
+	return result, nil
+}
@@ -0,0 +1,303 @@
+package hw58battery_test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"crawshaw.io/sqlite/sqlitex"
+	"eagain.net/go/securityblanket/internal/database"
+	"eagain.net/go/securityblanket/internal/honeywell5800"
+	"eagain.net/go/securityblanket/internal/honeywell5800/hw58battery"
+	"github.com/google/go-cmp/cmp"
+	"go.uber.org/zap/zaptest"
+)
+
+func execScript(t testing.TB, db *database.DB, sql string) {
+	conn := db.Get(nil)
+	defer db.Put(conn)
+
+	if err := sqlitex.ExecScript(conn, sql); err != nil {
+		t.Fatalf("database error: %v", err)
+	}
+}
+
+var start = time.Date(2020, 2, 3, 4, 5, 6, 0, time.UTC)
+
+func report(t testing.TB, db *database.DB, sensor int, ts time.Time, low bool) {
+	event := 4
+	if low {
+		event |= 8
+	}
+	execScript(t, db, fmt.Sprintf(`
+INSERT INTO honeywell5800_updates(time, channel, sensor, event)
+VALUES ('%s', 8, %d, %d);
+`, ts.Format(time.RFC3339Nano), sensor, event))
+}
+
+type battery struct {
+	Sensor       int64
+	Low          bool
+	FirstSeenLow string
+	LastSeenLow  string
+	Cleared      string
+}
+
+func batteries(t testing.TB, db *database.DB) []battery {
+	conn := db.Get(nil)
+	defer db.Put(conn)
+	stmt := conn.Prep(`
+SELECT sensor, low, firstSeenLow, lastSeenLow, cleared
+FROM honeywell5800_batteries
+ORDER BY sensor
+`)
+	defer stmt.Finalize()
+	var got []battery
+	for {
+		hasRow, err := stmt.Step()
+		if err != nil {
+			t.Fatalf("database error: %v", err)
+		}
+		if !hasRow {
+			break
+		}
+		got = append(got, battery{
+			Sensor:       stmt.GetInt64("sensor"),
+			Low:          stmt.GetInt64("low") != 0,
+			FirstSeenLow: stmt.GetText("firstSeenLow"),
+			LastSeenLow:  stmt.GetText("lastSeenLow"),
+			Cleared:      stmt.GetText("cleared"),
+		})
+	}
+	return got
+}
+
+type replacement struct {
+	Sensor    int64
+	Time      string
+	LowSince  string
+	Automatic bool
+	Note      string
+}
+
+func replacements(t testing.TB, db *database.DB) []replacement {
+	conn := db.Get(nil)
+	defer db.Put(conn)
+	stmt := conn.Prep(`
+SELECT sensor, time, lowSince, automatic, note
+FROM honeywell5800_battery_replacements
+ORDER BY id
+`)
+	defer stmt.Finalize()
+	var got []replacement
+	for {
+		hasRow, err := stmt.Step()
+		if err != nil {
+			t.Fatalf("database error: %v", err)
+		}
+		if !hasRow {
+			break
+		}
+		got = append(got, replacement{
+			Sensor:    stmt.GetInt64("sensor"),
+			Time:      stmt.GetText("time"),
+			LowSince:  stmt.GetText("lowSince"),
+			Automatic: stmt.GetInt64("automatic") != 0,
+			Note:      stmt.GetText("note"),
+		})
+	}
+	return got
+}
+
+func at(d time.Duration) string {
+	return start.Add(d).Format(time.RFC3339Nano)
+}
+
+func TestTrack(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	db := database.Scratch()
+	defer db.Close()
+
+	log := zaptest.NewLogger(t)
+	wakeups := 0
+	tracker := hw58battery.New(ctx, db, log,
+		hw58battery.Wakeup(func() { wakeups++ }),
+	)
+	run := func() {
+		t.Helper()
+		if err := tracker.Run(); err != nil {
+			t.Fatalf("run: %v", err)
+		}
+	}
+
+	execScript(t, db, `
+INSERT INTO honeywell5800_sensors(id, model, description) VALUES
+	(1, '5800MINI', 'front door');
+`)
+
+	// a single flaky report is ignored
+	report(t, db, 1, start, false)
+	report(t, db, 1, start.Add(1*time.Hour), true)
+	report(t, db, 1, start.Add(2*time.Hour), false)
+	run()
+	want := []battery{
+		{Sensor: 1, LastSeenLow: at(1 * time.Hour)},
+	}
+	if diff := cmp.Diff(want, batteries(t, db)); diff != "" {
+		t.Errorf("wrong batteries (-want +got):\n%s", diff)
+	}
+	if g, e := wakeups, 0; g != e {
+		t.Errorf("wrong number of wakeups: %v != %v", g, e)
+	}
+
+	// low since the first of the reports in a row
+	report(t, db, 1, start.Add(3*time.Hour), true)
+	report(t, db, 1, start.Add(4*time.Hour), true)
+	// a single clean report does not clear it
+	report(t, db, 1, start.Add(5*time.Hour), false)
+	report(t, db, 1, start.Add(6*time.Hour), true)
+	run()
+	want = []battery{
+		{Sensor: 1, Low: true, FirstSeenLow: at(3 * time.Hour), LastSeenLow: at(6 * time.Hour)},
+	}
+	if diff := cmp.Diff(want, batteries(t, db)); diff != "" {
+		t.Errorf("wrong batteries (-want +got):\n%s", diff)
+	}
+	if diff := cmp.Diff([]replacement(nil), replacements(t, db)); diff != "" {
+		t.Errorf("wrong replacements (-want +got):\n%s", diff)
+	}
+
+	// replaced
+	report(t, db, 1, start.Add(48*time.Hour), false)
+	report(t, db, 1, start.Add(49*time.Hour), false)
+	run()
+	want = []battery{
+		{Sensor: 1, FirstSeenLow: at(3 * time.Hour), LastSeenLow: at(6 * time.Hour), Cleared: at(48 * time.Hour)},
+	}
+	if diff := cmp.Diff(want, batteries(t, db)); diff != "" {
+		t.Errorf("wrong batteries (-want +got):\n%s", diff)
+	}
+	wantReplacements := []replacement{
+		{Sensor: 1, Time: at(48 * time.Hour), LowSince: at(3 * time.Hour), Automatic: true},
+	}
+	if diff := cmp.Diff(wantReplacements, replacements(t, db)); diff != "" {
+		t.Errorf("wrong replacements (-want +got):\n%s", diff)
+	}
+	if g, e := wakeups, 2; g != e {
+		t.Errorf("wrong number of wakeups: %v != %v", g, e)
+	}
+}
+
+func TestReplace(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	db := database.Scratch()
+	defer db.Close()
+
+	log := zaptest.NewLogger(t)
+	tracker := hw58battery.New(ctx, db, log)
+
+	execScript(t, db, `
+INSERT INTO honeywell5800_sensors(id, model, description) VALUES
+	(1, '5800MINI', 'front door'),
+	(2, '5800MINI', 'back door');
+`)
+	report(t, db, 1, start, true)
+	report(t, db, 1, start.Add(time.Hour), true)
+	if err := tracker.Run(); err != nil {
+		t.Fatalf("run: %v", err)
+	}
+
+	if err := hw58battery.Replace(ctx, db, 1, start.Add(2*time.Hour), "CR123A"); err != nil {
+		t.Fatalf("replace: %v", err)
+	}
+	// preventive replacement
+	if err := hw58battery.Replace(ctx, db, 2, start.Add(3*time.Hour), ""); err != nil {
+		t.Fatalf("replace: %v", err)
+	}
+
+	want := []battery{
+		{Sensor: 1, FirstSeenLow: at(0), LastSeenLow: at(time.Hour), Cleared: at(2 * time.Hour)},
+		{Sensor: 2},
+	}
+	if diff := cmp.Diff(want, batteries(t, db)); diff != "" {
+		t.Errorf("wrong batteries (-want +got):\n%s", diff)
+	}
+	wantReplacements := []replacement{
+		{Sensor: 1, Time: at(2 * time.Hour), LowSince: at(0), Note: "CR123A"},
+		{Sensor: 2, Time: at(3 * time.Hour)},
+	}
+	if diff := cmp.Diff(wantReplacements, replacements(t, db)); diff != "" {
+		t.Errorf("wrong replacements (-want +got):\n%s", diff)
+	}
+}
+
+func TestForecast(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	db := database.Scratch()
+	defer db.Close()
+
+	const day = 24 * time.Hour
+	execScript(t, db, fmt.Sprintf(`
+INSERT INTO honeywell5800_sensors(id, created, model, description) VALUES
+	(1, '%[1]s', '5800MINI', 'front door'),
+	(2, '%[2]s', '5800MINI', 'back door'),
+	(3, '%[1]s', '5816', 'window'),
+	(4, '%[1]s', '5816', 'garage');
+
+-- sensor 1 lasted a year on its first battery
+INSERT INTO honeywell5800_battery_replacements(sensor, time, lowSince, automatic)
+VALUES (1, '%[4]s', '%[3]s', true);
+
+INSERT INTO honeywell5800_batteries(sensor, low, firstSeenLow)
+VALUES (4, true, '%[5]s');
+`,
+		at(0), at(200*day), at(365*day), at(366*day), at(390*day),
+	))
+
+	now := start.Add(400 * day)
+	got, err := hw58battery.Forecast(ctx, db, now, 26*7*day)
+	if err != nil {
+		t.Fatalf("forecast: %v", err)
+	}
+	want := []hw58battery.Due{
+		{
+			Sensor:      honeywell5800.Sensor(2),
+			Model:       "5800MINI",
+			Description: "back door",
+			Installed:   start.Add(200 * day),
+			Expected:    start.Add(565 * day),
+		},
+		{
+			Sensor:      honeywell5800.Sensor(4),
+			Model:       "5816",
+			Description: "garage",
+			Low:         true,
+			Installed:   start,
+			Expected:    start.Add(390 * day),
+		},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("wrong forecast (-want +got):\n%s", diff)
+	}
+
+	got, err = hw58battery.Forecast(ctx, db, now, 52*7*day)
+	if err != nil {
+		t.Fatalf("forecast: %v", err)
+	}
+	want = append([]hw58battery.Due{
+		{
+			Sensor:      honeywell5800.Sensor(1),
+			Model:       "5800MINI",
+			Description: "front door",
+			Installed:   start.Add(366 * day),
+			Expected:    start.Add(731 * day),
+		},
+	}, want...)
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("wrong forecast (-want +got):\n%s", diff)
+	}
+}
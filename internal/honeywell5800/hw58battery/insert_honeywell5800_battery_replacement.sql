@@ -0,0 +1,2 @@
+INSERT INTO honeywell5800_battery_replacements(sensor, time, lowSince, automatic, note)
+	VALUES (@sensor, @time, @lowSince, @automatic, @note)
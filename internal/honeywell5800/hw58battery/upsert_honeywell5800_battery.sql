@@ -0,0 +1,25 @@
+INSERT INTO honeywell5800_batteries(
+	sensor,
+	low,
+	pending,
+	pendingSince,
+	firstSeenLow,
+	lastSeenLow,
+	cleared
+)
+	VALUES (
+		@sensor,
+		@low,
+		@pending,
+		@pendingSince,
+		@firstSeenLow,
+		@lastSeenLow,
+		@cleared
+	)
+	ON CONFLICT(sensor) DO UPDATE SET
+		low=excluded.low,
+		pending=excluded.pending,
+		pendingSince=excluded.pendingSince,
+		firstSeenLow=excluded.firstSeenLow,
+		lastSeenLow=excluded.lastSeenLow,
+		cleared=excluded.cleared
@@ -0,0 +1,142 @@
+package hw58demod
+
+import (
+	"errors"
+
+	"eagain.net/go/securityblanket/internal/honeywell5800"
+)
+
+// Frame layout, after Manchester decoding:
+//
+//	preamble  16 bits  0xFFFE
+//	channel    4 bits
+//	sensor    20 bits
+//	event      8 bits
+//	crc       16 bits  over channel, sensor and event
+//
+// rtl_433 slices the pulses as Manchester with a rising edge in the
+// middle of a bit as zero, and then inverts the bits: a one is silence
+// followed by carrier. The frame thus starts with carrier in the
+// middle of the first bit of the preamble. See
+// https://github.com/merbanan/rtl_433/blob/master/src/devices/honeywell.c
+const (
+	// only the tail end of the preamble is required, the first bits
+	// may be lost while the receiver settles
+	preamble     = 0xFFE
+	preambleBits = 12
+	payloadBits  = 48
+)
+
+var (
+	errNoPreamble = errors.New("no preamble")
+	errShort      = errors.New("frame is too short")
+	errCRC        = errors.New("CRC mismatch")
+	errNoSensor   = errors.New("sensor ID is zero")
+)
+
+// crc16 is a non-reflected CRC-16 with initial value 0.
+func crc16(data []byte, poly uint16) uint16 {
+	var crc uint16
+	for _, b := range data {
+		crc ^= uint16(b) << 8
+		for i := 0; i < 8; i++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ poly
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
+
+// crcPoly returns the CRC polynomial used on channel. 2GIG sensors
+// use a different one from Honeywell.
+func crcPoly(ch honeywell5800.Channel) uint16 {
+	switch ch {
+	case 0x2, 0x4, 0xA:
+		return 0x8050
+	default:
+		return 0x8005
+	}
+}
+
+// Frame returns the frame as transmitted, before Manchester coding,
+// including preamble and CRC.
+func (m *Message) Frame() []byte {
+	b := []byte{
+		0xFF, 0xFE,
+		byte(m.Channel)<<4 | byte(m.Sensor>>16)&0x0F,
+		byte(m.Sensor >> 8),
+		byte(m.Sensor),
+		byte(m.Event),
+	}
+	crc := crc16(b[2:], crcPoly(m.Channel))
+	b = append(b, byte(crc>>8), byte(crc))
+	return b
+}
+
+// findPreamble returns the index of the first bit after the preamble,
+// or -1.
+func findPreamble(bits []byte) int {
+	var window uint16
+	const mask = 1<<preambleBits - 1
+	for i, b := range bits {
+		window = window<<1 | uint16(b)
+		if i+1 >= preambleBits && window&mask == preamble {
+			return i + 1
+		}
+	}
+	return -1
+}
+
+func packBytes(bits []byte) []byte {
+	buf := make([]byte, (len(bits)+7)/8)
+	for i, b := range bits {
+		buf[i/8] |= b << (7 - i%8)
+	}
+	return buf
+}
+
+// decodeFrame parses a frame from bits, one bit per byte.
+func decodeFrame(bits []byte) (*Message, error) {
+	start := findPreamble(bits)
+	if start < 0 {
+		return nil, errNoPreamble
+	}
+	if len(bits)-start < payloadBits {
+		return nil, errShort
+	}
+	b := packBytes(bits[start : start+payloadBits])
+	msg := &Message{
+		Channel: honeywell5800.Channel(b[0] >> 4),
+		Sensor:  honeywell5800.Sensor(uint32(b[0]&0x0F)<<16 | uint32(b[1])<<8 | uint32(b[2])),
+		Event:   honeywell5800.Event(b[3]),
+	}
+	if msg.Sensor == 0 {
+		return nil, errNoSensor
+	}
+	crc := uint16(b[4])<<8 | uint16(b[5])
+	if crc16(b[:4], crcPoly(msg.Channel)) != crc {
+		return nil, errCRC
+	}
+	return msg, nil
+}
+
+// manchester decodes half-bit levels into bits. A one is silence
+// followed by carrier, a zero the opposite. Decoding stops at the
+// first invalid symbol.
+func manchester(halves []bool) []byte {
+	var bits []byte
+	for i := 0; i+1 < len(halves); i += 2 {
+		switch {
+		case !halves[i] && halves[i+1]:
+			bits = append(bits, 1)
+		case halves[i] && !halves[i+1]:
+			bits = append(bits, 0)
+		default:
+			return bits
+		}
+	}
+	return bits
+}
@@ -0,0 +1,343 @@
+// Package hw58demod decodes Honeywell 5800 transmissions straight
+// from raw IQ samples, without rtl_433.
+//
+// The signal is on-off keyed and Manchester coded, with a half-bit
+// of about 156 µs. Demodulation finds bursts of carrier above the
+// noise floor, turns the pulse and gap lengths into half-bits,
+// Manchester decodes them, and checks the CRC of the frame.
+package hw58demod
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strings"
+
+	"eagain.net/go/securityblanket/internal/honeywell5800"
+)
+
+// Format is the encoding of IQ samples.
+type Format int
+
+const (
+	// CU8 is interleaved unsigned 8-bit I and Q, as produced by
+	// rtl_sdr and rtl_tcp.
+	CU8 Format = iota
+	// CS16 is interleaved signed 16-bit little-endian I and Q.
+	CS16
+)
+
+func (f Format) String() string {
+	switch f {
+	case CU8:
+		return "cu8"
+	case CS16:
+		return "cs16"
+	default:
+		return fmt.Sprintf("Format(%d)", int(f))
+	}
+}
+
+// FormatFromName guesses the sample format from a file name, using
+// the rtl_433 convention of naming files *.cu8 or *.cs16.
+func FormatFromName(name string) (Format, error) {
+	switch {
+	case strings.HasSuffix(name, ".cu8"):
+		return CU8, nil
+	case strings.HasSuffix(name, ".cs16"):
+		return CS16, nil
+	default:
+		return 0, fmt.Errorf("unknown IQ sample format: %q", name)
+	}
+}
+
+// Message is one decoded transmission.
+type Message struct {
+	Channel honeywell5800.Channel
+	Sensor  honeywell5800.Sensor
+	Event   honeywell5800.Event
+	// Signal level of the transmission, in dB relative to full
+	// scale.
+	RSSI  float64
+	SNR   float64
+	Noise float64
+}
+
+// RTL433JSON formats the message like rtl_433 "-M level" would, so it
+// can be processed by the same pipeline.
+func (m *Message) RTL433JSON() []byte {
+	msg := struct {
+		Model   string  `json:"model"`
+		ID      uint32  `json:"id"`
+		Channel uint8   `json:"channel"`
+		Event   uint8   `json:"event"`
+		RSSI    float64 `json:"rssi"`
+		SNR     float64 `json:"snr"`
+		Noise   float64 `json:"noise"`
+	}{
+		Model:   "Honeywell-Security",
+		ID:      uint32(m.Sensor),
+		Channel: uint8(m.Channel),
+		Event:   uint8(m.Event),
+		RSSI:    round1(m.RSSI),
+		SNR:     round1(m.SNR),
+		Noise:   round1(m.Noise),
+	}
+	data, err := json.Marshal(msg)
+	if err != nil {
+		panic(fmt.Errorf("internal error: cannot marshal message: %v", err))
+	}
+	return data
+}
+
+func round1(f float64) float64 {
+	return math.Round(f*10) / 10
+}
+
+// HalfBit is the nominal duration of half a Manchester symbol.
+const HalfBit = 156e-6
+
+const (
+	// how far above the noise floor a pulse must be
+	pulseThresholdDB = 10
+	// noise floor never goes below this, so a perfectly quiet
+	// input does not trigger on rounding errors
+	minNoise = 1e-7
+	// a gap this many half-bits long ends a burst
+	resetHalfBits = 4
+	// power is averaged over this fraction of a half-bit
+	smoothHalfBit = 8
+	// pulses and gaps shorter than this fraction of a half-bit are
+	// noise
+	glitchHalfBit = 3
+	// a burst needs at least this many half-bits to be worth
+	// decoding; preamble and payload are 2*(12+48)
+	minBurstHalfBits = 2 * (preambleBits + payloadBits)
+)
+
+type run struct {
+	on      bool
+	samples int
+}
+
+// demodulator decodes a stream of IQ samples, one sample at a time.
+type demodulator struct {
+	halfBit   float64
+	threshold float64
+	fn        func(*Message) error
+
+	// moving average of power, to smooth out noise
+	window    []float64
+	windowPos int
+	windowSum float64
+
+	noise     float64
+	haveNoise bool
+	pulse     float64
+	on        bool
+	runLen    int
+	runs      []run
+	// signal power summed over the pulses of the current burst
+	burstPower   float64
+	burstSamples int
+}
+
+func newDemodulator(sampleRate uint64, fn func(*Message) error) *demodulator {
+	halfBit := float64(sampleRate) * HalfBit
+	d := &demodulator{
+		halfBit:   halfBit,
+		threshold: math.Pow(10, pulseThresholdDB/10),
+		fn:        fn,
+		window:    make([]float64, int(math.Max(1, math.Round(halfBit/smoothHalfBit)))),
+	}
+	return d
+}
+
+// sample processes the power of one sample.
+func (d *demodulator) sample(p float64) error {
+	d.windowSum += p - d.window[d.windowPos]
+	d.window[d.windowPos] = p
+	d.windowPos = (d.windowPos + 1) % len(d.window)
+	p = math.Max(d.windowSum/float64(len(d.window)), 0)
+
+	if !d.haveNoise {
+		d.noise = math.Max(p, minNoise)
+		d.haveNoise = true
+	}
+	var on bool
+	if d.on {
+		// hysteresis: stay on until below the geometric midpoint
+		// of noise and pulse
+		on = p > math.Sqrt(d.noise*d.pulse)
+	} else {
+		on = p > d.noise*d.threshold
+	}
+
+	if on {
+		if !d.on {
+			d.pulse = p
+		}
+		d.pulse += (p - d.pulse) / 16
+		d.burstPower += p
+		d.burstSamples++
+	} else {
+		// track the noise floor slowly, only outside pulses
+		d.noise += (p - d.noise) / 1024
+		d.noise = math.Max(d.noise, minNoise)
+	}
+
+	if on != d.on && d.runLen > 0 {
+		switch {
+		case float64(d.runLen) < d.halfBit/glitchHalfBit && len(d.runs) > 0:
+			// ignore the glitch, continue the run before it
+			last := d.runs[len(d.runs)-1]
+			d.runs = d.runs[:len(d.runs)-1]
+			d.runLen += last.samples
+		case float64(d.runLen) < d.halfBit/glitchHalfBit && d.on:
+			// a lone spike of noise
+			d.runLen = 0
+		default:
+			if d.on || len(d.runs) > 0 {
+				// leading silence is not part of a burst
+				d.runs = append(d.runs, run{on: d.on, samples: d.runLen})
+			}
+			d.runLen = 0
+		}
+	}
+	d.on = on
+	d.runLen++
+
+	if !on && len(d.runs) > 0 && float64(d.runLen) > resetHalfBits*d.halfBit {
+		return d.endBurst()
+	}
+	return nil
+}
+
+func (d *demodulator) endBurst() error {
+	runs := d.runs
+	power := d.burstPower / float64(d.burstSamples)
+	d.runs = d.runs[:0]
+	d.burstPower = 0
+	d.burstSamples = 0
+
+	var halves []bool
+	for _, r := range runs {
+		n := int(math.Round(float64(r.samples) / d.halfBit))
+		if n < 1 {
+			n = 1
+		}
+		if n > 2 {
+			// not Manchester; try what we have so far, and
+			// start over
+			if err := d.decode(halves, power); err != nil {
+				return err
+			}
+			halves = halves[:0]
+			continue
+		}
+		for i := 0; i < n; i++ {
+			halves = append(halves, r.on)
+		}
+	}
+	return d.decode(halves, power)
+}
+
+func (d *demodulator) decode(halves []bool, power float64) error {
+	if len(halves) < minBurstHalfBits {
+		return nil
+	}
+	msg, err := decodeHalves(halves)
+	if err != nil {
+		// not ours, or too broken to use
+		return nil
+	}
+	msg.RSSI = 10 * math.Log10(power)
+	msg.Noise = 10 * math.Log10(d.noise)
+	msg.SNR = msg.RSSI - msg.Noise
+	return d.fn(msg)
+}
+
+// decodeHalves decodes a frame from the half-bit levels of a burst.
+// A burst starts with carrier: at the start of a frame, the silent
+// first half of the leading one is lost in the gap before it. After a
+// burst was cut short, the halves may start either way, so both are
+// tried.
+func decodeHalves(halves []bool) (*Message, error) {
+	msg, err := decodeFrame(manchester(pad(append([]bool{false}, halves...))))
+	if err == nil {
+		return msg, nil
+	}
+	return decodeFrame(manchester(pad(halves)))
+}
+
+// pad adds the final half-bit of a zero, which merges into the gap
+// after the burst.
+func pad(halves []bool) []bool {
+	if len(halves)%2 == 1 {
+		halves = append(halves, false)
+	}
+	return halves
+}
+
+// flush finishes any burst in progress, as if the input was followed
+// by silence.
+func (d *demodulator) flush() error {
+	if d.on {
+		d.runs = append(d.runs, run{on: true, samples: d.runLen})
+		d.on = false
+		d.runLen = 0
+	}
+	if len(d.runs) == 0 {
+		return nil
+	}
+	return d.endBurst()
+}
+
+var errOddSamples = errors.New("IQ samples do not divide evenly")
+
+// Demodulate reads IQ samples in format from r until EOF, and calls
+// fn for every message decoded.
+func Demodulate(r io.Reader, format Format, sampleRate uint64, fn func(*Message) error) error {
+	d := newDemodulator(sampleRate, fn)
+	br := bufio.NewReaderSize(r, 64*1024)
+	var size int
+	var decode func([]byte) float64
+	switch format {
+	case CU8:
+		size = 2
+		decode = func(b []byte) float64 {
+			i := (float64(b[0]) - 127.5) / 127.5
+			q := (float64(b[1]) - 127.5) / 127.5
+			return i*i + q*q
+		}
+	case CS16:
+		size = 4
+		decode = func(b []byte) float64 {
+			i := float64(int16(binary.LittleEndian.Uint16(b[0:]))) / 32768
+			q := float64(int16(binary.LittleEndian.Uint16(b[2:]))) / 32768
+			return i*i + q*q
+		}
+	default:
+		return fmt.Errorf("unsupported IQ sample format: %v", format)
+	}
+	buf := make([]byte, size)
+	for {
+		if _, err := io.ReadFull(br, buf); err != nil {
+			if err == io.EOF {
+				break
+			}
+			if err == io.ErrUnexpectedEOF {
+				return errOddSamples
+			}
+			return err
+		}
+		if err := d.sample(decode(buf)); err != nil {
+			return err
+		}
+	}
+	return d.flush()
+}
@@ -0,0 +1,327 @@
+package hw58demod_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"flag"
+	"io"
+	"io/ioutil"
+	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"eagain.net/go/securityblanket/internal/honeywell5800"
+	"eagain.net/go/securityblanket/internal/honeywell5800/hw58demod"
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+)
+
+var update = flag.Bool("update", false, "rewrite testdata fixtures")
+
+const sampleRate = 250000
+
+// signal synthesizes IQ samples of transmissions, with noise.
+type signal struct {
+	rng *rand.Rand
+	// carrier amplitude, relative to full scale
+	amplitude float64
+	// standard deviation of noise, relative to full scale
+	noise float64
+	// offset of the carrier from center frequency, in Hz
+	offset float64
+
+	i, q  []float64
+	phase float64
+}
+
+func newSignal(amplitude, noise float64) *signal {
+	s := &signal{
+		rng:       rand.New(rand.NewSource(42)),
+		amplitude: amplitude,
+		noise:     noise,
+		offset:    12000,
+	}
+	return s
+}
+
+func (s *signal) add(on bool, n int) {
+	step := 2 * math.Pi * s.offset / sampleRate
+	for k := 0; k < n; k++ {
+		var i, q float64
+		if on {
+			i = s.amplitude * math.Cos(s.phase)
+			q = s.amplitude * math.Sin(s.phase)
+		}
+		s.phase += step
+		s.i = append(s.i, i+s.rng.NormFloat64()*s.noise)
+		s.q = append(s.q, q+s.rng.NormFloat64()*s.noise)
+	}
+}
+
+func (s *signal) silence(seconds float64) {
+	s.add(false, int(seconds*sampleRate))
+}
+
+// transmit adds a frame, Manchester coded with a one as silence
+// followed by carrier, as rtl_433 decodes it.
+func (s *signal) transmit(frame []byte) {
+	half := int(math.Round(hw58demod.HalfBit * sampleRate))
+	for _, b := range frame {
+		for bit := 7; bit >= 0; bit-- {
+			one := b&(1<<bit) != 0
+			s.add(!one, half)
+			s.add(one, half)
+		}
+	}
+}
+
+func clamp(f, min, max float64) float64 {
+	return math.Max(min, math.Min(max, f))
+}
+
+func (s *signal) cu8() []byte {
+	buf := make([]byte, 0, 2*len(s.i))
+	for k := range s.i {
+		buf = append(buf,
+			byte(clamp(math.Round(s.i[k]*127.5+127.5), 0, 255)),
+			byte(clamp(math.Round(s.q[k]*127.5+127.5), 0, 255)),
+		)
+	}
+	return buf
+}
+
+func (s *signal) cs16() []byte {
+	buf := make([]byte, 4*len(s.i))
+	for k := range s.i {
+		binary.LittleEndian.PutUint16(buf[4*k:], uint16(int16(clamp(math.Round(s.i[k]*32768), -32768, 32767))))
+		binary.LittleEndian.PutUint16(buf[4*k+2:], uint16(int16(clamp(math.Round(s.q[k]*32768), -32768, 32767))))
+	}
+	return buf
+}
+
+func demodulate(t testing.TB, data []byte, format hw58demod.Format) []*hw58demod.Message {
+	var got []*hw58demod.Message
+	fn := func(msg *hw58demod.Message) error {
+		got = append(got, msg)
+		return nil
+	}
+	if err := hw58demod.Demodulate(bytes.NewReader(data), format, sampleRate, fn); err != nil {
+		t.Fatalf("demodulate: %v", err)
+	}
+	return got
+}
+
+// ignoreLevel compares messages without signal levels.
+var ignoreLevel = cmpopts.IgnoreFields(hw58demod.Message{}, "RSSI", "SNR", "Noise")
+
+var fixtureMessages = []*hw58demod.Message{
+	// door opens and closes, three repeats each
+	{Channel: 8, Sensor: 123456, Event: 0x80},
+	{Channel: 8, Sensor: 123456, Event: 0x80},
+	{Channel: 8, Sensor: 123456, Event: 0x80},
+	{Channel: 8, Sensor: 123456, Event: 0x00},
+	{Channel: 8, Sensor: 123456, Event: 0x00},
+	{Channel: 8, Sensor: 123456, Event: 0x00},
+	// 2GIG heartbeat, different CRC
+	{Channel: 2, Sensor: 654321, Event: 0x04},
+}
+
+// synthetic is the transmissions of fixtureMessages, as encoded by
+// signal. The fixture made from it only guards against regressions:
+// the encoder and the demodulator share their idea of the protocol, so
+// it cannot show that real transmitters are decoded. TestCapture does
+// that, given recordings off the air.
+func synthetic() *signal {
+	s := newSignal(0.5, 0.02)
+	s.silence(0.004)
+	for i, msg := range fixtureMessages {
+		s.transmit(msg.Frame())
+		s.silence(0.002)
+		if i == 2 {
+			// corrupted in flight, to be ignored
+			frame := msg.Frame()
+			frame[4] ^= 0x10
+			s.transmit(frame)
+			s.silence(0.002)
+		}
+	}
+	return s
+}
+
+func TestSyntheticFixture(t *testing.T) {
+	path := filepath.Join("testdata", "synthetic_344.975M_250k.cu8")
+	if *update {
+		if err := ioutil.WriteFile(path, synthetic().cu8(), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := demodulate(t, data, hw58demod.CU8)
+	if diff := cmp.Diff(fixtureMessages, got, ignoreLevel); diff != "" {
+		t.Errorf("wrong messages (-want +got):\n%s", diff)
+	}
+	for _, msg := range got {
+		if msg.SNR < 15 || msg.SNR > 35 {
+			t.Errorf("implausible SNR: %v", msg.SNR)
+		}
+		if msg.RSSI < -10 || msg.RSSI > 0 {
+			t.Errorf("implausible RSSI: %v", msg.RSSI)
+		}
+	}
+}
+
+// captures holds recordings of real sensors at 250 kHz, named like
+// the Honeywell ones of the rtl_433_tests repository, with the
+// messages rtl_433 decoded from each in a .json file of the same name,
+// one per line. Until some are committed, TestCapture skips.
+const captures = "testdata/captures"
+
+// expected returns the messages rtl_433 decoded from a capture.
+func expected(t testing.TB, path string) []*hw58demod.Message {
+	data, err := ioutil.ReadFile(strings.TrimSuffix(path, filepath.Ext(path)) + ".json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var want []*hw58demod.Message
+	dec := json.NewDecoder(bytes.NewReader(data))
+	for {
+		var m struct {
+			Model   string `json:"model"`
+			ID      uint32 `json:"id"`
+			Channel uint8  `json:"channel"`
+			Event   uint8  `json:"event"`
+		}
+		if err := dec.Decode(&m); err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatalf("%s: %v", path, err)
+		}
+		if m.Model != "Honeywell-Security" {
+			continue
+		}
+		want = append(want, &hw58demod.Message{
+			Channel: honeywell5800.Channel(m.Channel),
+			Sensor:  honeywell5800.Sensor(m.ID),
+			Event:   honeywell5800.Event(m.Event),
+		})
+	}
+	return want
+}
+
+func TestCapture(t *testing.T) {
+	paths, err := filepath.Glob(filepath.Join(captures, "*_250k.cu8"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(paths) == 0 {
+		t.Skipf("no recordings in %s", captures)
+	}
+	for _, path := range paths {
+		path := path
+		t.Run(filepath.Base(path), func(t *testing.T) {
+			format, err := hw58demod.FormatFromName(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			data, err := ioutil.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := demodulate(t, data, format)
+			if diff := cmp.Diff(expected(t, path), got, ignoreLevel); diff != "" {
+				t.Errorf("wrong messages (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestCS16(t *testing.T) {
+	want := []*hw58demod.Message{
+		{Channel: 8, Sensor: 1, Event: 0x84},
+	}
+	s := newSignal(0.1, 0.005)
+	s.silence(0.001)
+	s.transmit(want[0].Frame())
+	// input ends right after the burst
+	got := demodulate(t, s.cs16(), hw58demod.CS16)
+	if diff := cmp.Diff(want, got, ignoreLevel); diff != "" {
+		t.Errorf("wrong messages (-want +got):\n%s", diff)
+	}
+}
+
+func TestPolarity(t *testing.T) {
+	// carrier followed by silence is a zero; sent the other way
+	// around, the frame reads as its inverse, and has no preamble
+	msg := &hw58demod.Message{Channel: 8, Sensor: 123456, Event: 0x80}
+	frame := msg.Frame()
+	for i := range frame {
+		frame[i] ^= 0xFF
+	}
+	s := newSignal(0.5, 0.02)
+	s.silence(0.004)
+	s.transmit(frame)
+	s.silence(0.004)
+	got := demodulate(t, s.cu8(), hw58demod.CU8)
+	if len(got) != 0 {
+		t.Errorf("decoded messages with inverted polarity: %v", got)
+	}
+}
+
+func TestNoiseOnly(t *testing.T) {
+	s := newSignal(0, 0.05)
+	s.silence(0.1)
+	got := demodulate(t, s.cu8(), hw58demod.CU8)
+	if len(got) != 0 {
+		t.Errorf("decoded messages from noise: %v", got)
+	}
+}
+
+func TestFrame(t *testing.T) {
+	msg := &hw58demod.Message{
+		Channel: 8,
+		Sensor:  honeywell5800.Sensor(0x0A1B2C),
+		Event:   0x80,
+	}
+	got := msg.Frame()
+	if g, e := got[:6], []byte{0xFF, 0xFE, 0x8A, 0x1B, 0x2C, 0x80}; !bytes.Equal(g, e) {
+		t.Errorf("wrong frame: %x != %x", g, e)
+	}
+}
+
+func TestRTL433JSON(t *testing.T) {
+	msg := &hw58demod.Message{
+		Channel: 8,
+		Sensor:  123456,
+		Event:   0x80,
+		RSSI:    -6.04,
+		SNR:     24.46,
+		Noise:   -30.5,
+	}
+	if g, e := string(msg.RTL433JSON()), `{"model":"Honeywell-Security","id":123456,"channel":8,"event":128,"rssi":-6,"snr":24.5,"noise":-30.5}`; g != e {
+		t.Errorf("wrong JSON: %s != %s", g, e)
+	}
+}
+
+func TestFormatFromName(t *testing.T) {
+	if f, err := hw58demod.FormatFromName("x/g001_345M_250k.cu8"); err != nil || f != hw58demod.CU8 {
+		t.Errorf("wrong format: %v %v", f, err)
+	}
+	if f, err := hw58demod.FormatFromName("foo.cs16"); err != nil || f != hw58demod.CS16 {
+		t.Errorf("wrong format: %v %v", f, err)
+	}
+	if _, err := hw58demod.FormatFromName("foo.wav"); err == nil {
+		t.Error("expected an error")
+	}
+}
+
+func TestMain(m *testing.M) {
+	flag.Parse()
+	os.Exit(m.Run())
+}
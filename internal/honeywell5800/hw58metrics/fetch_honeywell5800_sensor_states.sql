@@ -0,0 +1,16 @@
+SELECT
+	honeywell5800_sensors.id AS sensor,
+	honeywell5800_sensors.description AS description,
+	latest.time AS lastSeen,
+	latest.event AS event,
+	coalesce(honeywell5800_batteries.low, false) AS batteryLow
+FROM honeywell5800_sensors
+LEFT JOIN honeywell5800_updates AS latest
+ON (latest.id=(
+	SELECT max(id)
+	FROM honeywell5800_updates
+	WHERE sensor=honeywell5800_sensors.id
+))
+LEFT JOIN honeywell5800_batteries
+ON (honeywell5800_batteries.sensor=honeywell5800_sensors.id)
+ORDER BY honeywell5800_sensors.id
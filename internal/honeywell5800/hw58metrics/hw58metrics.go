@@ -0,0 +1,124 @@
+// Package hw58metrics reports the current state of Honeywell 5800
+// sensors as metrics.
+package hw58metrics
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"eagain.net/go/securityblanket/internal/database"
+	"eagain.net/go/securityblanket/internal/honeywell5800"
+	"eagain.net/go/securityblanket/internal/metrics"
+)
+
+type config struct {
+	clock func() time.Time
+}
+
+type Option option
+
+type option func(*config)
+
+// Clock overrides the source of time used for last seen ages.
+func Clock(clock func() time.Time) Option {
+	fn := func(conf *config) {
+		conf.clock = clock
+	}
+	return fn
+}
+
+type Collector struct {
+	db     *database.DB
+	config config
+}
+
+func New(db *database.DB, opts ...Option) *Collector {
+	c := &Collector{
+		db: db,
+		config: config{
+			clock: time.Now,
+		},
+	}
+	for _, opt := range opts {
+		opt(&c.config)
+	}
+	return c
+}
+
+// Collect returns, for every sensor, the time since it was last heard
+// from, whether its battery is low, and whether each of its loops is
+// open as of the latest update.
+func (c *Collector) Collect(ctx context.Context) ([]*metrics.Family, error) {
+	conn := c.db.Get(ctx)
+	if conn == nil {
+		return nil, context.Canceled
+	}
+	defer c.db.Put(conn)
+
+	lastSeen := &metrics.Family{
+		Name:   "securityblanket_honeywell5800_last_seen_age_seconds",
+		Help:   "Time since the sensor was last heard from.",
+		Type:   metrics.TypeGauge,
+		Labels: []string{"sensor", "description"},
+	}
+	battery := &metrics.Family{
+		Name:   "securityblanket_honeywell5800_battery_low",
+		Help:   "Whether the sensor battery is low.",
+		Type:   metrics.TypeGauge,
+		Labels: []string{"sensor", "description"},
+	}
+	loops := &metrics.Family{
+		Name:   "securityblanket_honeywell5800_loop_open",
+		Help:   "Whether the loop was open in the latest update from the sensor.",
+		Type:   metrics.TypeGauge,
+		Labels: []string{"sensor", "description", "loop"},
+	}
+	now := c.config.clock()
+
+	stmt := fetch_honeywell5800_sensor_states.Prep(conn)
+	defer stmt.Finalize()
+	for {
+		hasRow, err := stmt.Step()
+		if err != nil {
+			return nil, fmt.Errorf("error fetching sensor states: %w", err)
+		}
+		if !hasRow {
+			break
+		}
+		sensor := honeywell5800.SensorFromSQL(stmt, "sensor").String()
+		description := stmt.GetText("description")
+		battery.Samples = append(battery.Samples, metrics.Sample{
+			Values: []string{sensor, description},
+			Value:  boolValue(stmt.GetInt64("batteryLow") != 0),
+		})
+		seen, err := database.GetTime(stmt, "lastSeen")
+		if err != nil {
+			return nil, fmt.Errorf("bad update time: %v: %w", sensor, err)
+		}
+		if seen.IsZero() {
+			// never heard from
+			continue
+		}
+		lastSeen.Samples = append(lastSeen.Samples, metrics.Sample{
+			Values: []string{sensor, description},
+			Value:  now.Sub(seen).Seconds(),
+		})
+		event := honeywell5800.EventFromSQL(stmt, "event")
+		for loop := uint8(1); loop <= 4; loop++ {
+			loops.Samples = append(loops.Samples, metrics.Sample{
+				Values: []string{sensor, description, strconv.Itoa(int(loop))},
+				Value:  boolValue(event.Loop(loop)),
+			})
+		}
+	}
+	return []*metrics.Family{lastSeen, battery, loops}, nil
+}
+
+func boolValue(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,85 @@
+package hw58metrics_test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"crawshaw.io/sqlite/sqlitex"
+	"eagain.net/go/securityblanket/internal/database"
+	"eagain.net/go/securityblanket/internal/honeywell5800/hw58metrics"
+	"eagain.net/go/securityblanket/internal/metrics"
+	"github.com/google/go-cmp/cmp"
+)
+
+func execScript(t testing.TB, db *database.DB, sql string) {
+	conn := db.Get(nil)
+	defer db.Put(conn)
+
+	if err := sqlitex.ExecScript(conn, sql); err != nil {
+		t.Fatalf("database error: %v", err)
+	}
+}
+
+var start = time.Date(2020, 2, 3, 4, 5, 6, 0, time.UTC)
+
+func at(d time.Duration) string {
+	return start.Add(d).Format(time.RFC3339Nano)
+}
+
+func TestCollect(t *testing.T) {
+	db := database.Scratch()
+	defer db.Close()
+
+	execScript(t, db, fmt.Sprintf(`
+INSERT INTO honeywell5800_sensors(id, model, description) VALUES
+	(1, '5800MINI', 'front door'),
+	(2, '5808W3', 'kitchen'),
+	(3, '5800MINI', 'never heard');
+
+INSERT INTO honeywell5800_updates(time, channel, sensor, event) VALUES
+	('%[1]s', 8, 1, 0),
+	('%[2]s', 8, 1, 128),
+	('%[1]s', 8, 2, 8);
+
+INSERT INTO honeywell5800_batteries(sensor, low)
+VALUES (2, true);
+`, at(0), at(time.Minute)))
+
+	c := hw58metrics.New(db,
+		hw58metrics.Clock(func() time.Time { return start.Add(time.Hour) }),
+	)
+	got, err := c.Collect(context.Background())
+	if err != nil {
+		t.Fatalf("collect: %v", err)
+	}
+	values := make(map[string][]metrics.Sample)
+	for _, f := range got {
+		values[f.Name] = f.Samples
+	}
+	want := map[string][]metrics.Sample{
+		"securityblanket_honeywell5800_last_seen_age_seconds": {
+			{Values: []string{"A000-0001", "front door"}, Value: 59 * 60},
+			{Values: []string{"A000-0002", "kitchen"}, Value: 60 * 60},
+		},
+		"securityblanket_honeywell5800_battery_low": {
+			{Values: []string{"A000-0001", "front door"}, Value: 0},
+			{Values: []string{"A000-0002", "kitchen"}, Value: 1},
+			{Values: []string{"A000-0003", "never heard"}, Value: 0},
+		},
+		"securityblanket_honeywell5800_loop_open": {
+			{Values: []string{"A000-0001", "front door", "1"}, Value: 1},
+			{Values: []string{"A000-0001", "front door", "2"}, Value: 0},
+			{Values: []string{"A000-0001", "front door", "3"}, Value: 0},
+			{Values: []string{"A000-0001", "front door", "4"}, Value: 0},
+			{Values: []string{"A000-0002", "kitchen", "1"}, Value: 0},
+			{Values: []string{"A000-0002", "kitchen", "2"}, Value: 0},
+			{Values: []string{"A000-0002", "kitchen", "3"}, Value: 0},
+			{Values: []string{"A000-0002", "kitchen", "4"}, Value: 0},
+		},
+	}
+	if diff := cmp.Diff(want, values); diff != "" {
+		t.Errorf("wrong metrics: -want +got\n%s", diff)
+	}
+}
@@ -0,0 +1,23 @@
+-- the update that caused insert_honeywell5800_update to deduplicate
+SELECT id
+	FROM honeywell5800_updates AS prev
+	WHERE prev.time>=@dedupTime
+	AND prev.time<=@dedupUntil
+	AND prev.channel=@channel
+	AND prev.sensor=@sensor
+	AND prev.event=@event
+	AND (
+		prev.id=(
+			SELECT max(id) FROM honeywell5800_updates
+				WHERE time>=@dedupTime
+				AND channel=@channel
+				AND sensor=@sensor
+		)
+		OR EXISTS (
+			SELECT 1 FROM honeywell5800_receptions
+				WHERE sensorUpdate=prev.id
+				AND receiver!=@receiver
+		)
+	)
+	ORDER BY id DESC
+	LIMIT 1
@@ -1,11 +1,18 @@
 SELECT
 	id,
 	time,
+	receiver,
+	rssi,
+	snr,
+	noise,
 	json_remove(data,
 		-- misinterpreted by rtl_433
 		'$.state',
 		-- redundant with event
-		'$.heartbeat'
+		'$.heartbeat',
+		-- from rtl_433 "-M level", about the receiver, not
+		-- the sensor
+		'$.mod'
 	) AS data
 FROM rtl433_raw
 WHERE model='Honeywell-Security'
@@ -14,6 +14,7 @@ import (
 	"eagain.net/go/securityblanket/internal/database"
 	"eagain.net/go/securityblanket/internal/honeywell5800"
 	"eagain.net/go/securityblanket/internal/jsonx"
+	"eagain.net/go/securityblanket/internal/metrics"
 	"go.uber.org/zap"
 )
 
@@ -21,6 +22,12 @@ var (
 	errDuplicate = errors.New("duplicate sensor update")
 )
 
+var updatesTotal = metrics.Default.Counter(
+	"securityblanket_honeywell5800_updates_total",
+	"Sensor updates received, not counting repeats.",
+	"sensor",
+)
+
 type Receiver struct {
 	ctx     context.Context
 	catchup *catchup.Catchup
@@ -50,6 +57,40 @@ type rtl433Message struct {
 	Event   honeywell5800.Event
 }
 
+// level is the signal level of a transmission. Fields are only valid
+// when ok is set.
+type level struct {
+	ok    bool
+	rssi  float64
+	snr   float64
+	noise float64
+}
+
+func levelFromSQL(stmt *sqlite.Stmt) (level, error) {
+	var l level
+	var err error
+	l.rssi, l.ok, err = database.GetNullFloat(stmt, "rssi")
+	if err != nil {
+		return level{}, err
+	}
+	if !l.ok {
+		return level{}, nil
+	}
+	if l.snr, _, err = database.GetNullFloat(stmt, "snr"); err != nil {
+		return level{}, err
+	}
+	if l.noise, _, err = database.GetNullFloat(stmt, "noise"); err != nil {
+		return level{}, err
+	}
+	return l, nil
+}
+
+func (l level) toSQL(stmt *sqlite.Stmt) {
+	database.BindNullFloat(stmt, "@rssi", l.rssi, l.ok)
+	database.BindNullFloat(stmt, "@snr", l.snr, l.ok)
+	database.BindNullFloat(stmt, "@noise", l.noise, l.ok)
+}
+
 func parseRTL433(data []byte) (*rtl433Message, error) {
 	var msg rtl433Message
 	dec := json.NewDecoder(bytes.NewReader(data))
@@ -75,39 +116,108 @@ func insertSensor(conn *sqlite.Conn, sensor honeywell5800.Sensor, created time.T
 	return nil
 }
 
-// addUpdate adds a sensor update to the database.
+// Transmissions are repeated several times, and may be heard by
+// multiple receivers. The window extends both ways, as receivers are
+// processed in turn and not in time order.
+const dedupWindow = 5 * time.Second
+
+// findDuplicate returns the id of the earlier update that a duplicate
+// update was deduplicated against.
+func findDuplicate(conn *sqlite.Conn, ts time.Time, receiver string, update *rtl433Message) (int64, error) {
+	stmt := fetch_honeywell5800_update_duplicate.Prep(conn)
+	defer stmt.Finalize()
+	database.BindTime(stmt, "@dedupTime", ts.Add(-dedupWindow))
+	database.BindTime(stmt, "@dedupUntil", ts.Add(dedupWindow))
+	stmt.SetText("@receiver", receiver)
+	update.Channel.ToSQL(stmt, "@channel")
+	update.ID.ToSQL(stmt, "@sensor")
+	update.Event.ToSQL(stmt, "@event")
+	if err := database.Row(stmt); err != nil {
+		return 0, err
+	}
+	id := stmt.GetInt64("id")
+	if err := database.NoMoreRows(stmt); err != nil {
+		return 0, err
+	}
+	return id, nil
+}
+
+// addUpdate adds a sensor update to the database, and returns its id.
 //
 // Returns errDuplicate if the update has been seen already, as is
-// very common with rapidly repeated one-way radio transmissions. Most
-// callers should quietly stop further processing.
-func addUpdate(ctx context.Context, conn *sqlite.Conn, ts time.Time, update *rtl433Message) error {
+// very common with rapidly repeated one-way radio transmissions. The
+// returned id is then that of the earlier update. Most callers should
+// quietly stop further processing.
+//
+// An update repeating the latest one is a duplicate, and so is one
+// that another receiver heard already, even if that receiver has
+// heard later updates since.
+func addUpdate(ctx context.Context, conn *sqlite.Conn, ts time.Time, receiver string, update *rtl433Message, lvl level) (int64, error) {
 	// no sqlite savepoint because any progress is useful and
 	// idempotent
 
 	if err := insertSensor(conn, update.ID, ts); err != nil {
-		return fmt.Errorf("adding sensor: %w", err)
+		return 0, fmt.Errorf("adding sensor: %w", err)
 	}
 
-	const dedupWindow = 5 * time.Second
 	stmt := insert_honeywell5800_update.Prep(conn)
 	defer stmt.Finalize()
 	database.BindTime(stmt, "@time", ts)
 	database.BindTime(stmt, "@dedupTime", ts.Add(-dedupWindow))
+	database.BindTime(stmt, "@dedupUntil", ts.Add(dedupWindow))
+	stmt.SetText("@receiver", receiver)
 	update.Channel.ToSQL(stmt, "@channel")
 	update.ID.ToSQL(stmt, "@sensor")
 	update.Event.ToSQL(stmt, "@event")
+	lvl.toSQL(stmt)
 	if _, err := stmt.Step(); err != nil {
-		return fmt.Errorf("add sensor update: %w", err)
+		return 0, fmt.Errorf("add sensor update: %w", err)
 	}
 	switch affected := conn.Changes(); affected {
 	case 0:
 		// deduplicated
-		return errDuplicate
+		id, err := findDuplicate(conn, ts, receiver, update)
+		if err != nil {
+			return 0, fmt.Errorf("finding duplicate sensor update: %w", err)
+		}
+		if err := updateLevel(conn, id, lvl); err != nil {
+			return 0, fmt.Errorf("updating signal level: %w", err)
+		}
+		return id, errDuplicate
 	case 1:
-		return nil
+		updatesTotal.With(update.ID.String()).Inc()
+		return conn.LastInsertRowID(), nil
 	default:
-		return fmt.Errorf("internal error: sensor dedup caused multiple rows: %d", affected)
+		return 0, fmt.Errorf("internal error: sensor dedup caused multiple rows: %d", affected)
+	}
+}
+
+// updateLevel improves the signal level of an update, if a duplicate
+// was heard better.
+func updateLevel(conn *sqlite.Conn, updateID int64, lvl level) error {
+	stmt := update_honeywell5800_update_level.Prep(conn)
+	defer stmt.Finalize()
+	stmt.SetInt64("@id", updateID)
+	lvl.toSQL(stmt)
+	if _, err := stmt.Step(); err != nil {
+		return err
+	}
+	return nil
+}
+
+// addReception records that a receiver heard the sensor update.
+func addReception(conn *sqlite.Conn, updateID int64, stmt *sqlite.Stmt, lvl level) error {
+	ins := insert_honeywell5800_reception.Prep(conn)
+	defer ins.Finalize()
+	ins.SetInt64("@sensorUpdate", updateID)
+	ins.SetText("@receiver", stmt.GetText("receiver"))
+	ins.SetInt64("@raw", stmt.GetInt64("id"))
+	ins.SetText("@time", stmt.GetText("time"))
+	lvl.toSQL(ins)
+	if _, err := ins.Step(); err != nil {
+		return err
 	}
+	return nil
 }
 
 func (r *Receiver) Run() error {
@@ -121,6 +231,10 @@ func (r *Receiver) run(conn *sqlite.Conn, stmt *sqlite.Stmt) error {
 	if err != nil {
 		return fmt.Errorf("parsing rtl433 update: %w", err)
 	}
+	lvl, err := levelFromSQL(stmt)
+	if err != nil {
+		return fmt.Errorf("parsing rtl433 signal level: %w", err)
+	}
 	data, _ := ioutil.ReadAll(stmt.GetReader("data"))
 
 	update, err := parseRTL433(data)
@@ -133,12 +247,17 @@ func (r *Receiver) run(conn *sqlite.Conn, stmt *sqlite.Stmt) error {
 		zap.Stringer("event", update.Event),
 		zap.String("event.parsed", fmt.Sprintf("%+v", update.Event)),
 	)
-	if err := addUpdate(r.ctx, conn, ts, update); err != nil {
-		if errors.Is(err, errDuplicate) {
-			return nil
-		}
+	updateID, err := addUpdate(r.ctx, conn, ts, stmt.GetText("receiver"), update, lvl)
+	isDuplicate := errors.Is(err, errDuplicate)
+	if err != nil && !isDuplicate {
 		return fmt.Errorf("error adding sensor update: %w", err)
 	}
+	if err := addReception(conn, updateID, stmt, lvl); err != nil {
+		return fmt.Errorf("error adding sensor update reception: %w", err)
+	}
+	if isDuplicate {
+		return nil
+	}
 
 	r.wakeup()
 	return nil
@@ -2,13 +2,17 @@ package hw58receive_test
 
 import (
 	"context"
+	"fmt"
 	"sync/atomic"
 	"testing"
 	"time"
 
+	"crawshaw.io/sqlite"
+	"crawshaw.io/sqlite/sqlitex"
 	"eagain.net/go/securityblanket/internal/database"
 	"eagain.net/go/securityblanket/internal/honeywell5800/hw58receive"
 	"eagain.net/go/securityblanket/internal/rtl433sql"
+	"github.com/google/go-cmp/cmp"
 	"go.uber.org/zap/zaptest"
 )
 
@@ -77,7 +81,7 @@ SELECT * FROM honeywell5800_updates
 	if err := database.Row(stmt); err != nil {
 		t.Fatalf("database error reading updates: %v", err)
 	}
-	if g, e := stmt.ColumnCount(), 5; g != e {
+	if g, e := stmt.ColumnCount(), 8; g != e {
 		t.Errorf("wrong number of columns: %d != %d", g, e)
 	}
 	// don't care about id
@@ -100,3 +104,149 @@ SELECT * FROM honeywell5800_updates
 		t.Errorf("wrong number of wakeups: %d != %d", g, e)
 	}
 }
+
+func TestMultipleReceivers(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	db := database.Scratch()
+	defer db.Close()
+
+	now := time.Date(2020, 2, 3, 4, 5, 6, 7, time.Local)
+	clock := func() time.Time { return now }
+	log := zaptest.NewLogger(t)
+	var wakeups uint64
+	wakeup := func() {
+		atomic.AddUint64(&wakeups, 1)
+	}
+	recv := hw58receive.New(ctx, db, log, wakeup)
+	attic := rtl433sql.New(db, 345, rtl433sql.Clock(clock), rtl433sql.Receiver("attic"))
+	garage := rtl433sql.New(db, 345, rtl433sql.Clock(clock), rtl433sql.Receiver("garage"))
+
+	if err := garage.Store(ctx, []byte(`{"model": "Honeywell-Security", "channel": 8, "id": 123456, "event": 128, "mod": "ASK", "freq": 344.9, "rssi": -20.5, "snr": 10.1, "noise": -30.6}`)); err != nil {
+		t.Fatalf("store: %v", err)
+	}
+	now = now.Add(10 * time.Millisecond)
+	if err := attic.Store(ctx, []byte(`{"model": "Honeywell-Security", "channel": 8, "id": 123456, "event": 128, "mod": "ASK", "freq": 345.0, "rssi": -12.5, "snr": 20.1, "noise": -32.6}`)); err != nil {
+		t.Fatalf("store: %v", err)
+	}
+	if err := recv.Run(); err != nil {
+		t.Fatalf("run: %v", err)
+	}
+	if g, e := count(t, db), int64(1); g != e {
+		t.Errorf("wrong number of results: %d != %d", g, e)
+	}
+	if g, e := atomic.LoadUint64(&wakeups), uint64(1); g != e {
+		t.Errorf("wrong number of wakeups: %d != %d", g, e)
+	}
+
+	conn := db.Get(nil)
+	defer db.Put(conn)
+	update := conn.Prep(`
+SELECT rssi, snr, noise FROM honeywell5800_updates
+`)
+	defer update.Finalize()
+	if err := database.Row(update); err != nil {
+		t.Fatalf("database error reading updates: %v", err)
+	}
+	if g, e := update.GetFloat("rssi"), -12.5; g != e {
+		t.Errorf("wrong update rssi: %v != %v", g, e)
+	}
+	if g, e := update.GetFloat("snr"), 20.1; g != e {
+		t.Errorf("wrong update snr: %v != %v", g, e)
+	}
+	if g, e := update.GetFloat("noise"), -32.6; g != e {
+		t.Errorf("wrong update noise: %v != %v", g, e)
+	}
+	if err := database.NoMoreRows(update); err != nil {
+		t.Fatalf("database error: %v", err)
+	}
+
+	stmt := conn.Prep(`
+SELECT receiver, rssi, snr, noise FROM honeywell5800_receptions
+ORDER BY receiver
+`)
+	defer stmt.Finalize()
+	if err := database.Row(stmt); err != nil {
+		t.Fatalf("database error reading receptions: %v", err)
+	}
+	if g, e := stmt.GetText("receiver"), "attic"; g != e {
+		t.Errorf("wrong receiver: %v != %v", g, e)
+	}
+	if g, e := stmt.GetFloat("rssi"), -12.5; g != e {
+		t.Errorf("wrong rssi: %v != %v", g, e)
+	}
+	if err := database.Row(stmt); err != nil {
+		t.Fatalf("database error reading receptions: %v", err)
+	}
+	if g, e := stmt.GetText("receiver"), "garage"; g != e {
+		t.Errorf("wrong receiver: %v != %v", g, e)
+	}
+	if g, e := stmt.GetFloat("rssi"), -20.5; g != e {
+		t.Errorf("wrong rssi: %v != %v", g, e)
+	}
+	if err := database.NoMoreRows(stmt); err != nil {
+		t.Fatalf("database error: %v", err)
+	}
+}
+
+func TestMultipleReceiversOutOfOrder(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	db := database.Scratch()
+	defer db.Close()
+
+	start := time.Date(2020, 2, 3, 4, 5, 6, 7, time.Local)
+	log := zaptest.NewLogger(t)
+	recv := hw58receive.New(ctx, db, log, func() {})
+	store := func(receiver string, d time.Duration, event int) {
+		t.Helper()
+		clock := func() time.Time { return start.Add(d) }
+		r := rtl433sql.New(db, 345, rtl433sql.Clock(clock), rtl433sql.Receiver(receiver))
+		msg := fmt.Sprintf(`{"model": "Honeywell-Security", "channel": 8, "id": 123456, "event": %d}`, event)
+		if err := r.Store(ctx, []byte(msg)); err != nil {
+			t.Fatalf("store: %v", err)
+		}
+	}
+
+	// the door opens and closes; the garage delivers its copies of
+	// both after the attic
+	store("attic", 0, 160)
+	store("attic", time.Second, 128)
+	store("garage", 10*time.Millisecond, 160)
+	store("garage", time.Second+10*time.Millisecond, 128)
+	if err := recv.Run(); err != nil {
+		t.Fatalf("run: %v", err)
+	}
+
+	conn := db.Get(nil)
+	defer db.Put(conn)
+	type update struct {
+		Event     int64
+		Receivers string
+	}
+	var got []update
+	fn := func(stmt *sqlite.Stmt) error {
+		got = append(got, update{
+			Event:     stmt.GetInt64("event"),
+			Receivers: stmt.GetText("receivers"),
+		})
+		return nil
+	}
+	const query = `
+SELECT event, group_concat(receiver) AS receivers
+FROM honeywell5800_updates
+JOIN honeywell5800_receptions ON sensorUpdate=honeywell5800_updates.id
+GROUP BY honeywell5800_updates.id
+ORDER BY honeywell5800_updates.id
+`
+	if err := sqlitex.Exec(conn, query, fn); err != nil {
+		t.Fatalf("database error: %v", err)
+	}
+	want := []update{
+		{Event: 160, Receivers: "attic,garage"},
+		{Event: 128, Receivers: "attic,garage"},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("wrong updates: -want +got\n%s", diff)
+	}
+}
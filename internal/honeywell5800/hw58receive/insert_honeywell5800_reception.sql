@@ -0,0 +1,5 @@
+INSERT INTO honeywell5800_receptions(sensorUpdate, receiver, raw, time, rssi, snr, noise)
+	VALUES (@sensorUpdate, @receiver, @raw, @time, @rssi, @snr, @noise)
+	-- the same receiver can deliver a repeated burst more than
+	-- once; remember the first one
+	ON CONFLICT(sensorUpdate, receiver) DO NOTHING
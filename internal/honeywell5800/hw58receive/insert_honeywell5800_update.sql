@@ -1,16 +1,33 @@
-INSERT INTO honeywell5800_updates(time, channel, sensor, event)
+INSERT INTO honeywell5800_updates(time, channel, sensor, event, rssi, snr, noise)
 	SELECT @time AS new_time,
 		@channel AS new_channel,
 		@sensor AS new_sensor,
-		@event AS new_event
-		-- do not insert a new record if last time sensor was
-		-- seen was within dedup time and contained the same
-		-- information
-		WHERE new_event NOT IN (
-			SELECT event FROM honeywell5800_updates
-				WHERE time>=@dedupTime
-				AND channel=new_channel
-				AND sensor=new_sensor
-				ORDER BY id DESC
-				LIMIT 1
+		@event AS new_event,
+		@rssi,
+		@snr,
+		@noise
+		-- do not insert a new record if the sensor was seen with
+		-- the same information within dedup time, either last or
+		-- by another receiver; receivers are processed in turn,
+		-- so another receiver may have heard later updates already
+		WHERE NOT EXISTS (
+			SELECT 1 FROM honeywell5800_updates AS prev
+				WHERE prev.time>=@dedupTime
+				AND prev.time<=@dedupUntil
+				AND prev.channel=new_channel
+				AND prev.sensor=new_sensor
+				AND prev.event=new_event
+				AND (
+					prev.id=(
+						SELECT max(id) FROM honeywell5800_updates
+							WHERE time>=@dedupTime
+							AND channel=new_channel
+							AND sensor=new_sensor
+					)
+					OR EXISTS (
+						SELECT 1 FROM honeywell5800_receptions
+							WHERE sensorUpdate=prev.id
+							AND receiver!=@receiver
+					)
+				)
 		)
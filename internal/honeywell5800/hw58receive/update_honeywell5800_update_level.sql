@@ -0,0 +1,11 @@
+-- Remember the best signal level any receiver heard the update with.
+--
+-- Consumers of honeywell5800_updates are not notified of this change;
+-- they need to tolerate the level improving after the fact.
+UPDATE honeywell5800_updates
+	SET rssi=@rssi,
+		snr=@snr,
+		noise=@noise
+	WHERE id=@id
+		AND @rssi IS NOT NULL
+		AND (rssi IS NULL OR rssi<@rssi)
@@ -0,0 +1,6 @@
+SELECT time, event
+	FROM honeywell5800_updates
+	WHERE sensor=@sensor
+	AND id<=@id
+	AND time>=@since
+	ORDER BY id ASC
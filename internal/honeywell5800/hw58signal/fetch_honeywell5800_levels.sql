@@ -0,0 +1,7 @@
+SELECT rssi, snr
+	FROM honeywell5800_updates
+	WHERE sensor=@sensor
+	AND id<=@id
+	AND rssi IS NOT NULL
+	ORDER BY id DESC
+	LIMIT @limit
@@ -0,0 +1,199 @@
+// Package hw58signal keeps rolling statistics about how well each
+// Honeywell 5800 sensor is heard: median signal level, and packet
+// loss estimated from missing heartbeats.
+package hw58signal
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sort"
+	"time"
+
+	"crawshaw.io/sqlite"
+	"eagain.net/go/securityblanket/internal/catchup"
+	"eagain.net/go/securityblanket/internal/database"
+	"eagain.net/go/securityblanket/internal/honeywell5800"
+	"go.uber.org/zap"
+)
+
+const (
+	// how many latest updates to use for median signal level
+	levelWindow = 100
+	// how far back to look for heartbeats
+	heartbeatWindow = 7 * 24 * time.Hour
+)
+
+type Tracker struct {
+	ctx     context.Context
+	catchup *catchup.Catchup
+	log     *zap.Logger
+}
+
+func New(ctx context.Context, db *database.DB, log *zap.Logger) *Tracker {
+	t := &Tracker{
+		ctx: ctx,
+		catchup: catchup.New(&catchup.Config{
+			DB:      db,
+			Log:     log.Named("catchup"),
+			Name:    "honeywell5800.signal",
+			MaxSQL:  fetch_honeywell5800_updates_max.Content,
+			NextSQL: fetch_honeywell5800_updates.Content,
+		}),
+		log: log,
+	}
+	return t
+}
+
+func (t *Tracker) Run() error {
+	return t.catchup.Run(t.ctx, t.run)
+}
+
+func median(values []float64) float64 {
+	s := append([]float64(nil), values...)
+	sort.Float64s(s)
+	mid := len(s) / 2
+	if len(s)%2 == 0 {
+		return (s[mid-1] + s[mid]) / 2
+	}
+	return s[mid]
+}
+
+// estimateLoss estimates the heartbeat interval from the gaps between
+// heartbeats, and from that how many heartbeats were missed. It needs
+// at least three heartbeats.
+//
+// The median gap is used as the interval, so the estimate is only
+// good while less than half of the heartbeats are lost.
+func estimateLoss(heartbeats []time.Time) (interval time.Duration, missed int, loss float64, ok bool) {
+	if len(heartbeats) < 3 {
+		return 0, 0, 0, false
+	}
+	gaps := make([]float64, 0, len(heartbeats)-1)
+	for i := 1; i < len(heartbeats); i++ {
+		gaps = append(gaps, heartbeats[i].Sub(heartbeats[i-1]).Seconds())
+	}
+	nominal := median(gaps)
+	if nominal <= 0 {
+		return 0, 0, 0, false
+	}
+	expected := 0
+	for _, gap := range gaps {
+		n := int(math.Round(gap / nominal))
+		if n < 1 {
+			n = 1
+		}
+		expected += n
+	}
+	missed = expected - len(gaps)
+	loss = float64(missed) / float64(expected)
+	interval = time.Duration(nominal * float64(time.Second))
+	return interval, missed, loss, true
+}
+
+func fetchLevels(conn *sqlite.Conn, sensor honeywell5800.Sensor, updateID int64) (rssi, snr []float64, err error) {
+	stmt := fetch_honeywell5800_levels.Prep(conn)
+	defer stmt.Finalize()
+	sensor.ToSQL(stmt, "@sensor")
+	stmt.SetInt64("@id", updateID)
+	stmt.SetInt64("@limit", levelWindow)
+	for {
+		hasRow, err := stmt.Step()
+		if err != nil {
+			return nil, nil, err
+		}
+		if !hasRow {
+			break
+		}
+		rssi = append(rssi, stmt.GetFloat("rssi"))
+		if f, ok, err := database.GetNullFloat(stmt, "snr"); err != nil {
+			return nil, nil, err
+		} else if ok {
+			snr = append(snr, f)
+		}
+	}
+	return rssi, snr, nil
+}
+
+func fetchHeartbeats(conn *sqlite.Conn, sensor honeywell5800.Sensor, updateID int64, since time.Time) ([]time.Time, error) {
+	stmt := fetch_honeywell5800_history.Prep(conn)
+	defer stmt.Finalize()
+	sensor.ToSQL(stmt, "@sensor")
+	stmt.SetInt64("@id", updateID)
+	database.BindTime(stmt, "@since", since)
+	var heartbeats []time.Time
+	for {
+		hasRow, err := stmt.Step()
+		if err != nil {
+			return nil, err
+		}
+		if !hasRow {
+			break
+		}
+		event := honeywell5800.EventFromSQL(stmt, "event")
+		if !event.IsHeartbeat() {
+			continue
+		}
+		ts, err := database.GetTime(stmt, "time")
+		if err != nil {
+			return nil, err
+		}
+		heartbeats = append(heartbeats, ts)
+	}
+	return heartbeats, nil
+}
+
+func (t *Tracker) run(conn *sqlite.Conn, stmt *sqlite.Stmt) error {
+	updateID := stmt.GetInt64("id")
+	sensor := honeywell5800.SensorFromSQL(stmt, "sensor")
+	ts, err := database.GetTime(stmt, "time")
+	if err != nil {
+		return fmt.Errorf("bad update time: %w", err)
+	}
+
+	rssi, snr, err := fetchLevels(conn, sensor, updateID)
+	if err != nil {
+		return fmt.Errorf("error fetching signal levels: %v: %w", sensor, err)
+	}
+	heartbeats, err := fetchHeartbeats(conn, sensor, updateID, ts.Add(-heartbeatWindow))
+	if err != nil {
+		return fmt.Errorf("error fetching heartbeats: %v: %w", sensor, err)
+	}
+
+	up := upsert_honeywell5800_signal_stats.Prep(conn)
+	defer up.Finalize()
+	sensor.ToSQL(up, "@sensor")
+	database.BindTime(up, "@updated", ts)
+	up.SetInt64("@samples", int64(len(rssi)))
+	var medianRSSI, medianSNR float64
+	if len(rssi) > 0 {
+		medianRSSI = median(rssi)
+	}
+	if len(snr) > 0 {
+		medianSNR = median(snr)
+	}
+	database.BindNullFloat(up, "@medianRSSI", medianRSSI, len(rssi) > 0)
+	database.BindNullFloat(up, "@medianSNR", medianSNR, len(snr) > 0)
+	up.SetInt64("@heartbeats", int64(len(heartbeats)))
+	interval, missed, loss, ok := estimateLoss(heartbeats)
+	database.BindNullFloat(up, "@heartbeatInterval", interval.Seconds(), ok)
+	if ok {
+		up.SetInt64("@missedHeartbeats", int64(missed))
+	} else {
+		up.SetNull("@missedHeartbeats")
+	}
+	database.BindNullFloat(up, "@loss", loss, ok)
+	if _, err := up.Step(); err != nil {
+		return fmt.Errorf("error saving signal stats: %v: %w", sensor, err)
+	}
+
+	t.log.Debug("stats",
+		zap.Stringer("sensor", sensor),
+		zap.Int("samples", len(rssi)),
+		zap.Float64("rssi.median", medianRSSI),
+		zap.Int("heartbeats", len(heartbeats)),
+		zap.Int("heartbeats.missed", missed),
+		zap.Float64("loss", loss),
+	)
+	return nil
+}
@@ -0,0 +1,96 @@
+package hw58signal_test
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"crawshaw.io/sqlite/sqlitex"
+	"eagain.net/go/securityblanket/internal/database"
+	"eagain.net/go/securityblanket/internal/honeywell5800/hw58signal"
+	"go.uber.org/zap/zaptest"
+)
+
+func execScript(t testing.TB, db *database.DB, sql string) {
+	conn := db.Get(nil)
+	defer db.Put(conn)
+
+	if err := sqlitex.ExecScript(conn, sql); err != nil {
+		t.Fatalf("database error: %v", err)
+	}
+}
+
+func TestStats(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	db := database.Scratch()
+	defer db.Close()
+
+	log := zaptest.NewLogger(t)
+	tracker := hw58signal.New(ctx, db, log)
+
+	// hourly heartbeats, with the ones at 3h and 4h missing
+	start := time.Date(2020, 2, 3, 4, 5, 6, 0, time.UTC)
+	var sql strings.Builder
+	sql.WriteString(`
+INSERT INTO honeywell5800_sensors(id, model, description)
+VALUES (123456,'5800MINI','front door');
+`)
+	rssi := []float64{-10, -12, -11, -20, -13}
+	for i, hour := range []int{0, 1, 2, 5, 6} {
+		ts := start.Add(time.Duration(hour) * time.Hour)
+		fmt.Fprintf(&sql, `
+INSERT INTO honeywell5800_updates(time, channel, sensor, event, rssi, snr)
+VALUES ('%s', 8, 123456, 4, %g, 20);
+`, ts.Format(time.RFC3339Nano), rssi[i])
+	}
+	// not a heartbeat, no signal level
+	fmt.Fprintf(&sql, `
+INSERT INTO honeywell5800_updates(time, channel, sensor, event)
+VALUES ('%s', 8, 123456, 128);
+`, start.Add(6*time.Hour+time.Minute).Format(time.RFC3339Nano))
+	execScript(t, db, sql.String())
+
+	if err := tracker.Run(); err != nil {
+		t.Fatalf("run: %v", err)
+	}
+
+	conn := db.Get(nil)
+	defer db.Put(conn)
+	stmt := conn.Prep(`
+SELECT * FROM honeywell5800_signal_stats
+`)
+	defer stmt.Finalize()
+	if err := database.Row(stmt); err != nil {
+		t.Fatalf("database error reading stats: %v", err)
+	}
+	if g, e := stmt.GetInt64("sensor"), int64(123456); g != e {
+		t.Errorf("wrong sensor: %v != %v", g, e)
+	}
+	if g, e := stmt.GetInt64("samples"), int64(5); g != e {
+		t.Errorf("wrong samples: %v != %v", g, e)
+	}
+	if g, e := stmt.GetFloat("medianRSSI"), -12.0; g != e {
+		t.Errorf("wrong median rssi: %v != %v", g, e)
+	}
+	if g, e := stmt.GetFloat("medianSNR"), 20.0; g != e {
+		t.Errorf("wrong median snr: %v != %v", g, e)
+	}
+	if g, e := stmt.GetInt64("heartbeats"), int64(5); g != e {
+		t.Errorf("wrong heartbeats: %v != %v", g, e)
+	}
+	if g, e := stmt.GetFloat("heartbeatInterval"), 3600.0; g != e {
+		t.Errorf("wrong heartbeat interval: %v != %v", g, e)
+	}
+	if g, e := stmt.GetInt64("missedHeartbeats"), int64(2); g != e {
+		t.Errorf("wrong missed heartbeats: %v != %v", g, e)
+	}
+	if g, e := stmt.GetFloat("loss"), 2.0/6.0; g != e {
+		t.Errorf("wrong loss: %v != %v", g, e)
+	}
+	if err := database.NoMoreRows(stmt); err != nil {
+		t.Fatalf("database error: %v", err)
+	}
+}
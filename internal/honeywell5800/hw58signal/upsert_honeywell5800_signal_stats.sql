@@ -0,0 +1,31 @@
+INSERT INTO honeywell5800_signal_stats(
+	sensor,
+	updated,
+	samples,
+	medianRSSI,
+	medianSNR,
+	heartbeats,
+	heartbeatInterval,
+	missedHeartbeats,
+	loss
+)
+	VALUES (
+		@sensor,
+		@updated,
+		@samples,
+		@medianRSSI,
+		@medianSNR,
+		@heartbeats,
+		@heartbeatInterval,
+		@missedHeartbeats,
+		@loss
+	)
+	ON CONFLICT(sensor) DO UPDATE SET
+		updated=excluded.updated,
+		samples=excluded.samples,
+		medianRSSI=excluded.medianRSSI,
+		medianSNR=excluded.medianSNR,
+		heartbeats=excluded.heartbeats,
+		heartbeatInterval=excluded.heartbeatInterval,
+		missedHeartbeats=excluded.missedHeartbeats,
+		loss=excluded.loss
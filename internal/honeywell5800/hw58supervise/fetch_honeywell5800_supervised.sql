@@ -0,0 +1,24 @@
+-- Supervised sensors that are not already lost, and when they were
+-- last heard from.
+SELECT
+	honeywell5800_sensors.id AS sensor,
+	honeywell5800_models.heartbeatInterval AS heartbeatInterval,
+	last.id AS lastSeen,
+	last.time AS lastSeenTime
+FROM honeywell5800_sensors
+JOIN honeywell5800_models
+ON (honeywell5800_models.id=honeywell5800_sensors.model)
+JOIN honeywell5800_updates AS last
+ON (last.id=(
+	SELECT max(id)
+	FROM honeywell5800_updates
+	WHERE sensor=honeywell5800_sensors.id
+))
+WHERE honeywell5800_models.heartbeatInterval IS NOT NULL
+	AND NOT EXISTS (
+		SELECT 1
+		FROM honeywell5800_supervision_losses
+		WHERE sensor=honeywell5800_sensors.id
+		AND restoredBy IS NULL
+	)
+ORDER BY honeywell5800_sensors.id
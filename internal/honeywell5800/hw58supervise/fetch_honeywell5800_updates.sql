@@ -0,0 +1,8 @@
+SELECT
+	id,
+	sensor
+FROM honeywell5800_updates
+WHERE id>@last
+	AND id<=@max
+ORDER BY id ASC
+LIMIT 100
@@ -0,0 +1,224 @@
+// Package hw58supervise watches for Honeywell 5800 sensors that stop
+// checking in.
+//
+// Supervised sensors send a heartbeat at an interval that depends on
+// the model. A sensor not heard from in a few intervals is recorded
+// as a supervision loss, which is restored by the next update from
+// the sensor.
+//
+// Nobody was listening while the daemon or the receivers that heard
+// the sensor were down, so that time is left out of the intervals; see
+// package downtime. Restarts do not start the count over, so a
+// receiver or daemon that keeps restarting still notices losses.
+//
+// Losses are noticed by looking at the clock, so Run needs to be
+// called periodically even when no updates arrive.
+package hw58supervise
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"crawshaw.io/sqlite"
+	"crawshaw.io/sqlite/sqlitex"
+	"eagain.net/go/securityblanket/internal/catchup"
+	"eagain.net/go/securityblanket/internal/database"
+	"eagain.net/go/securityblanket/internal/downtime"
+	"eagain.net/go/securityblanket/internal/honeywell5800"
+	"go.uber.org/zap"
+)
+
+type config struct {
+	missed  int
+	clock   func() time.Time
+	wakeup  func()
+	started time.Time
+}
+
+type Option option
+
+type option func(*config)
+
+// Missed sets how many heartbeats in a row a sensor may miss before
+// supervision is lost.
+func Missed(n int) Option {
+	fn := func(conf *config) {
+		conf.missed = n
+	}
+	return fn
+}
+
+// Clock overrides the source of time used for detecting losses.
+func Clock(clock func() time.Time) Option {
+	fn := func(conf *config) {
+		conf.clock = clock
+	}
+	return fn
+}
+
+// Started sets when the process started listening to the sensors.
+// The default is the time New was called.
+func Started(t time.Time) Option {
+	fn := func(conf *config) {
+		conf.started = t
+	}
+	return fn
+}
+
+// Wakeup is called whenever supervision is lost or restored.
+func Wakeup(wakeup func()) Option {
+	fn := func(conf *config) {
+		conf.wakeup = wakeup
+	}
+	return fn
+}
+
+type Supervisor struct {
+	ctx     context.Context
+	db      *database.DB
+	catchup *catchup.Catchup
+	log     *zap.Logger
+	config  config
+}
+
+func New(ctx context.Context, db *database.DB, log *zap.Logger, opts ...Option) *Supervisor {
+	s := &Supervisor{
+		ctx: ctx,
+		db:  db,
+		catchup: catchup.New(&catchup.Config{
+			DB:      db,
+			Log:     log.Named("catchup"),
+			Name:    "honeywell5800.supervise",
+			MaxSQL:  fetch_honeywell5800_updates_max.Content,
+			NextSQL: fetch_honeywell5800_updates.Content,
+		}),
+		log: log,
+		config: config{
+			missed: 2,
+			clock:  time.Now,
+			wakeup: func() {},
+		},
+	}
+	for _, opt := range opts {
+		opt(&s.config)
+	}
+	if s.config.started.IsZero() {
+		s.config.started = s.config.clock()
+	}
+	return s
+}
+
+// Run restores supervision of sensors that have been heard from, and
+// then looks for sensors that are overdue.
+func (s *Supervisor) Run() error {
+	if err := s.catchup.Run(s.ctx, s.restore); err != nil {
+		return err
+	}
+	if err := s.check(); err != nil {
+		return fmt.Errorf("supervision check: %w", err)
+	}
+	return nil
+}
+
+func (s *Supervisor) restore(conn *sqlite.Conn, stmt *sqlite.Stmt) error {
+	updateID := stmt.GetInt64("id")
+	sensor := honeywell5800.SensorFromSQL(stmt, "sensor")
+
+	up := update_honeywell5800_supervision_restored.Prep(conn)
+	defer up.Finalize()
+	sensor.ToSQL(up, "@sensor")
+	up.SetInt64("@restoredBy", updateID)
+	if _, err := up.Step(); err != nil {
+		return fmt.Errorf("restore supervision: %v: %w", sensor, err)
+	}
+	switch affected := conn.Changes(); affected {
+	case 0:
+		// was not lost
+	case 1:
+		s.log.Info("restored",
+			zap.Stringer("sensor", sensor),
+		)
+		s.config.wakeup()
+	default:
+		return fmt.Errorf("internal error: restoring supervision caused multiple changes: %d", affected)
+	}
+	return nil
+}
+
+// deadline returns when a sensor last heard at lastSeen, in update,
+// is lost, as far as is known at now. Time nobody was listening does
+// not count.
+func (s *Supervisor) deadline(conn *sqlite.Conn, update int64, lastSeen time.Time, interval time.Duration, now time.Time) (time.Time, error) {
+	return downtime.After(conn, update, s.config.started, lastSeen, time.Duration(s.config.missed+1)*interval, now)
+}
+
+func (s *Supervisor) check() (err error) {
+	conn := s.db.Get(s.ctx)
+	if conn == nil {
+		return context.Canceled
+	}
+	defer s.db.Put(conn)
+	defer sqlitex.Save(conn)(&err)
+
+	now := s.config.clock()
+
+	type loss struct {
+		sensor   honeywell5800.Sensor
+		lastSeen int64
+		lost     time.Time
+	}
+	var losses []loss
+	stmt := fetch_honeywell5800_supervised.Prep(conn)
+	defer stmt.Finalize()
+	for {
+		hasRow, err := stmt.Step()
+		if err != nil {
+			return fmt.Errorf("error fetching supervised sensors: %w", err)
+		}
+		if !hasRow {
+			break
+		}
+		sensor := honeywell5800.SensorFromSQL(stmt, "sensor")
+		lastSeenTime, err := database.GetTime(stmt, "lastSeenTime")
+		if err != nil {
+			return fmt.Errorf("bad update time: %v: %w", sensor, err)
+		}
+		lastSeen := stmt.GetInt64("lastSeen")
+		interval := time.Duration(stmt.GetFloat("heartbeatInterval") * float64(time.Second))
+		deadline, err := s.deadline(conn, lastSeen, lastSeenTime, interval, now)
+		if err != nil {
+			return fmt.Errorf("downtime: %v: %w", sensor, err)
+		}
+		if now.Before(deadline) {
+			continue
+		}
+		losses = append(losses, loss{
+			sensor:   sensor,
+			lastSeen: lastSeen,
+			lost:     deadline,
+		})
+	}
+
+	ins := insert_honeywell5800_supervision_loss.Prep(conn)
+	defer ins.Finalize()
+	for _, l := range losses {
+		l.sensor.ToSQL(ins, "@sensor")
+		ins.SetInt64("@lastSeen", l.lastSeen)
+		database.BindTime(ins, "@lost", l.lost)
+		if _, err := ins.Step(); err != nil {
+			return fmt.Errorf("record supervision loss: %v: %w", l.sensor, err)
+		}
+		if err := ins.Reset(); err != nil {
+			return err
+		}
+		s.log.Warn("lost",
+			zap.Stringer("sensor", l.sensor),
+			zap.Time("due", l.lost),
+		)
+	}
+	if len(losses) > 0 {
+		s.config.wakeup()
+	}
+	return nil
+}
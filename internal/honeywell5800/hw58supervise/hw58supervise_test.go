@@ -0,0 +1,310 @@
+package hw58supervise_test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"crawshaw.io/sqlite/sqlitex"
+	"eagain.net/go/securityblanket/internal/database"
+	"eagain.net/go/securityblanket/internal/honeywell5800/hw58supervise"
+	"github.com/google/go-cmp/cmp"
+	"go.uber.org/zap/zaptest"
+)
+
+func execScript(t testing.TB, db *database.DB, sql string) {
+	conn := db.Get(nil)
+	defer db.Put(conn)
+
+	if err := sqlitex.ExecScript(conn, sql); err != nil {
+		t.Fatalf("database error: %v", err)
+	}
+}
+
+var start = time.Date(2020, 2, 3, 4, 5, 6, 0, time.UTC)
+
+func heard(t testing.TB, db *database.DB, sensor int, ts time.Time) {
+	execScript(t, db, fmt.Sprintf(`
+INSERT INTO honeywell5800_updates(time, channel, sensor, event)
+VALUES ('%s', 8, %d, 4);
+`, ts.Format(time.RFC3339Nano), sensor))
+}
+
+type loss struct {
+	Sensor     int64
+	LastSeen   int64
+	Lost       string
+	RestoredBy int64
+}
+
+func losses(t testing.TB, db *database.DB) []loss {
+	conn := db.Get(nil)
+	defer db.Put(conn)
+	stmt := conn.Prep(`
+SELECT sensor, lastSeen, lost, restoredBy
+FROM honeywell5800_supervision_losses
+ORDER BY id
+`)
+	defer stmt.Finalize()
+	var got []loss
+	for {
+		hasRow, err := stmt.Step()
+		if err != nil {
+			t.Fatalf("database error: %v", err)
+		}
+		if !hasRow {
+			break
+		}
+		got = append(got, loss{
+			Sensor:     stmt.GetInt64("sensor"),
+			LastSeen:   stmt.GetInt64("lastSeen"),
+			Lost:       stmt.GetText("lost"),
+			RestoredBy: stmt.GetInt64("restoredBy"),
+		})
+	}
+	return got
+}
+
+func TestSupervise(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	db := database.Scratch()
+	defer db.Close()
+
+	log := zaptest.NewLogger(t)
+	now := start
+	wakeups := 0
+	supervisor := hw58supervise.New(ctx, db, log,
+		hw58supervise.Clock(func() time.Time { return now }),
+		hw58supervise.Wakeup(func() { wakeups++ }),
+	)
+	run := func() {
+		t.Helper()
+		if err := supervisor.Run(); err != nil {
+			t.Fatalf("run: %v", err)
+		}
+	}
+
+	execScript(t, db, `
+INSERT INTO honeywell5800_sensors(id, model, description) VALUES
+	(1, '5800MINI', 'front door'),
+	(2, '5816', 'back door'),
+	-- unknown model is not supervised
+	(3, NULL, 'mystery');
+`)
+	heard(t, db, 1, start)                    // id 1
+	heard(t, db, 2, start.Add(time.Hour))     // id 2
+	heard(t, db, 3, start.Add(-time.Hour*24)) // id 3
+
+	// two missed heartbeats are tolerated
+	now = start.Add(4 * time.Hour)
+	run()
+	if diff := cmp.Diff([]loss(nil), losses(t, db)); diff != "" {
+		t.Errorf("wrong losses (-want +got):\n%s", diff)
+	}
+
+	now = start.Add(5 * time.Hour)
+	run()
+	// lost only once
+	run()
+	want := []loss{
+		{Sensor: 1, LastSeen: 1, Lost: start.Add(270 * time.Minute).Format(time.RFC3339Nano)},
+	}
+	if diff := cmp.Diff(want, losses(t, db)); diff != "" {
+		t.Errorf("wrong losses (-want +got):\n%s", diff)
+	}
+
+	// sensor 1 comes back, sensor 2 goes quiet
+	heard(t, db, 1, start.Add(5*time.Hour+10*time.Minute)) // id 4
+	now = start.Add(6 * time.Hour)
+	run()
+	want = []loss{
+		{Sensor: 1, LastSeen: 1, Lost: start.Add(270 * time.Minute).Format(time.RFC3339Nano), RestoredBy: 4},
+		{Sensor: 2, LastSeen: 2, Lost: start.Add(330 * time.Minute).Format(time.RFC3339Nano)},
+	}
+	if diff := cmp.Diff(want, losses(t, db)); diff != "" {
+		t.Errorf("wrong losses (-want +got):\n%s", diff)
+	}
+	if g, e := wakeups, 3; g != e {
+		t.Errorf("wrong number of wakeups: %v != %v", g, e)
+	}
+}
+
+func TestMissed(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	db := database.Scratch()
+	defer db.Close()
+
+	log := zaptest.NewLogger(t)
+	supervisor := hw58supervise.New(ctx, db, log,
+		hw58supervise.Clock(func() time.Time { return start.Add(100 * time.Minute) }),
+		hw58supervise.Missed(0),
+		hw58supervise.Started(start),
+	)
+	execScript(t, db, `
+INSERT INTO honeywell5800_sensors(id, model, description) VALUES
+	(1, '5800MINI', 'front door');
+`)
+	heard(t, db, 1, start)
+	if err := supervisor.Run(); err != nil {
+		t.Fatalf("run: %v", err)
+	}
+	want := []loss{
+		{Sensor: 1, LastSeen: 1, Lost: start.Add(90 * time.Minute).Format(time.RFC3339Nano)},
+	}
+	if diff := cmp.Diff(want, losses(t, db)); diff != "" {
+		t.Errorf("wrong losses (-want +got):\n%s", diff)
+	}
+}
+
+func TestRestartAfterOutage(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	db := database.Scratch()
+	defer db.Close()
+
+	execScript(t, db, `
+INSERT INTO honeywell5800_sensors(id, model, description) VALUES
+	(1, '5800MINI', 'front door');
+`)
+	heard(t, db, 1, start)
+
+	// the process was down for a day
+	log := zaptest.NewLogger(t)
+	now := start.Add(24 * time.Hour)
+	supervisor := hw58supervise.New(ctx, db, log,
+		hw58supervise.Clock(func() time.Time { return now }),
+	)
+	run := func() {
+		t.Helper()
+		if err := supervisor.Run(); err != nil {
+			t.Fatalf("run: %v", err)
+		}
+	}
+	run()
+	if diff := cmp.Diff([]loss(nil), losses(t, db)); diff != "" {
+		t.Errorf("lost right after restart (-want +got):\n%s", diff)
+	}
+
+	now = start.Add(24*time.Hour + 270*time.Minute)
+	run()
+	want := []loss{
+		{Sensor: 1, LastSeen: 1, Lost: now.Format(time.RFC3339Nano)},
+	}
+	if diff := cmp.Diff(want, losses(t, db)); diff != "" {
+		t.Errorf("wrong losses (-want +got):\n%s", diff)
+	}
+}
+
+func TestReceiverRestart(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	db := database.Scratch()
+	defer db.Close()
+
+	log := zaptest.NewLogger(t)
+	now := start
+	supervisor := hw58supervise.New(ctx, db, log,
+		hw58supervise.Clock(func() time.Time { return now }),
+	)
+	run := func() {
+		t.Helper()
+		if err := supervisor.Run(); err != nil {
+			t.Fatalf("run: %v", err)
+		}
+	}
+	execScript(t, db, `
+INSERT INTO honeywell5800_sensors(id, model, description) VALUES
+	(1, '5800MINI', 'front door'),
+	(2, '5800MINI', 'back door');
+`)
+	heard(t, db, 1, start)
+	heard(t, db, 2, start)
+	// receiver a hears the front door, b the back door; a is down for
+	// 9 hours
+	stopped := start.Add(time.Hour)
+	resumed := start.Add(10 * time.Hour)
+	execScript(t, db, fmt.Sprintf(`
+INSERT INTO honeywell5800_receptions(sensorUpdate, receiver, raw, time)
+VALUES (1, 'a', 1, '%[1]s'), (2, 'b', 2, '%[1]s');
+INSERT INTO rtl433_restarts(time, freqMHz, receiver, started, uptime, error, resumes)
+VALUES ('%[2]s', 345, 'a', '%[1]s', 3600, 'rtl_tcp: connection refused', '%[3]s');
+`, start.Format(time.RFC3339Nano), stopped.Format(time.RFC3339Nano), resumed.Format(time.RFC3339Nano)))
+
+	now = resumed.Add(time.Minute)
+	run()
+	want := []loss{
+		{Sensor: 2, LastSeen: 2, Lost: start.Add(270 * time.Minute).Format(time.RFC3339Nano)},
+	}
+	if diff := cmp.Diff(want, losses(t, db)); diff != "" {
+		t.Errorf("wrong losses (-want +got):\n%s", diff)
+	}
+
+	// the hour before the outage counts
+	now = resumed.Add(210 * time.Minute)
+	run()
+	want = append(want, loss{Sensor: 1, LastSeen: 1, Lost: now.Format(time.RFC3339Nano)})
+	if diff := cmp.Diff(want, losses(t, db)); diff != "" {
+		t.Errorf("wrong losses (-want +got):\n%s", diff)
+	}
+}
+
+func TestReceiverRestartRepeatedly(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	db := database.Scratch()
+	defer db.Close()
+
+	log := zaptest.NewLogger(t)
+	now := start
+	supervisor := hw58supervise.New(ctx, db, log,
+		hw58supervise.Clock(func() time.Time { return now }),
+	)
+	run := func() {
+		t.Helper()
+		if err := supervisor.Run(); err != nil {
+			t.Fatalf("run: %v", err)
+		}
+	}
+	execScript(t, db, `
+INSERT INTO honeywell5800_sensors(id, model, description) VALUES
+	(1, '5800MINI', 'front door');
+`)
+	heard(t, db, 1, start)
+	execScript(t, db, fmt.Sprintf(`
+INSERT INTO honeywell5800_receptions(sensorUpdate, receiver, raw, time)
+VALUES (1, 'a', 1, '%s');
+`, start.Format(time.RFC3339Nano)))
+	// receiver a crashes every half an hour, and is back a minute
+	// later
+	for i := 1; i <= 20; i++ {
+		stopped := start.Add(time.Duration(i) * 30 * time.Minute)
+		execScript(t, db, fmt.Sprintf(`
+INSERT INTO rtl433_restarts(time, freqMHz, receiver, started, uptime, error, resumes)
+VALUES ('%s', 345, 'a', '%s', 1740, 'rtl_tcp: connection refused', '%s');
+`,
+			stopped.Format(time.RFC3339Nano),
+			stopped.Add(-29*time.Minute).Format(time.RFC3339Nano),
+			stopped.Add(time.Minute).Format(time.RFC3339Nano),
+		))
+	}
+
+	now = start.Add(278 * time.Minute)
+	run()
+	if diff := cmp.Diff([]loss(nil), losses(t, db)); diff != "" {
+		t.Errorf("wrong losses (-want +got):\n%s", diff)
+	}
+
+	// 270 minutes of listening, and the 9 minutes of outages in
+	// between
+	now = start.Add(6 * time.Hour)
+	run()
+	want := []loss{
+		{Sensor: 1, LastSeen: 1, Lost: start.Add(279 * time.Minute).Format(time.RFC3339Nano)},
+	}
+	if diff := cmp.Diff(want, losses(t, db)); diff != "" {
+		t.Errorf("wrong losses (-want +got):\n%s", diff)
+	}
+}
@@ -0,0 +1,2 @@
+INSERT INTO honeywell5800_supervision_losses(sensor, lastSeen, lost)
+	VALUES (@sensor, @lastSeen, @lost)
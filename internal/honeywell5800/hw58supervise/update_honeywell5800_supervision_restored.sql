@@ -0,0 +1,7 @@
+UPDATE honeywell5800_supervision_losses
+	SET restoredBy=@restoredBy
+	WHERE sensor=@sensor
+	AND restoredBy IS NULL
+	-- catching up on old updates must not restore a loss
+	-- detected later
+	AND lastSeen<@restoredBy
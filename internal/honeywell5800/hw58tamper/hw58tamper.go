@@ -0,0 +1,227 @@
+// Package hw58tamper records Honeywell 5800 tamper loops opening,
+// such as a sensor case being opened.
+//
+// Tampers are handled apart from other trips: they are security events
+// whether the system is armed or not, and are recorded even on loops
+// disabled in site configuration, flagged as such. An open tamper
+// stays unacknowledged until someone acknowledges it, even after the
+// loop closes again.
+package hw58tamper
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"crawshaw.io/sqlite"
+	"crawshaw.io/sqlite/sqlitex"
+	"eagain.net/go/securityblanket/internal/catchup"
+	"eagain.net/go/securityblanket/internal/database"
+	"eagain.net/go/securityblanket/internal/honeywell5800"
+	"go.uber.org/zap"
+)
+
+var (
+	errDuplicate = errors.New("duplicate tamper update")
+
+	// ErrNotFound is returned when acknowledging a tamper that does
+	// not exist or has already been acknowledged.
+	ErrNotFound = errors.New("no such unacknowledged tamper")
+)
+
+type config struct {
+	wakeup func()
+}
+
+type Option option
+
+type option func(*config)
+
+// Wakeup is called whenever a tamper opens or closes.
+func Wakeup(wakeup func()) Option {
+	fn := func(conf *config) {
+		conf.wakeup = wakeup
+	}
+	return fn
+}
+
+type Tamper struct {
+	ctx     context.Context
+	catchup *catchup.Catchup
+	log     *zap.Logger
+	config  config
+}
+
+func New(ctx context.Context, db *database.DB, log *zap.Logger, opts ...Option) *Tamper {
+	t := &Tamper{
+		ctx: ctx,
+		catchup: catchup.New(&catchup.Config{
+			DB:      db,
+			Log:     log.Named("catchup"),
+			Name:    "honeywell5800.tamper",
+			MaxSQL:  fetch_honeywell5800_updates_max.Content,
+			NextSQL: fetch_honeywell5800_updates.Content,
+		}),
+		log: log,
+		config: config{
+			wakeup: func() {},
+		},
+	}
+	for _, opt := range opts {
+		opt(&t.config)
+	}
+	return t
+}
+
+func (t *Tamper) Run() error {
+	return t.catchup.Run(t.ctx, t.run)
+}
+
+func (t *Tamper) run(conn *sqlite.Conn, stmt *sqlite.Stmt) error {
+	updateID := stmt.GetInt64("id")
+	sensor := honeywell5800.SensorFromSQL(stmt, "sensor")
+	event := honeywell5800.EventFromSQL(stmt, "event")
+
+	loopStmt := fetch_honeywell5800_tamper_loops.Prep(conn)
+	defer loopStmt.Finalize()
+	sensor.ToSQL(loopStmt, "@sensor")
+	for {
+		hasRow, err := loopStmt.Step()
+		if err != nil {
+			return fmt.Errorf("error fetching tamper loops: %v: %w", sensor, err)
+		}
+		if !hasRow {
+			break
+		}
+
+		model := loopStmt.GetText("model")
+		description := loopStmt.GetText("description")
+		loop, err := database.GetUint8(loopStmt, "loop")
+		if err != nil {
+			return fmt.Errorf("bad loop in database: sensor %v: %w", sensor, err)
+		}
+		label := loopStmt.GetText("label")
+		normallyOpen := loopStmt.GetInt64("normallyOpen") != 0
+		disabled := loopStmt.GetInt64("disabled") != 0
+
+		isOpen := event.Loop(loop)
+		isTamper := isOpen != normallyOpen
+
+		if isTamper {
+			err := t.open(conn, sensor, loop, disabled, updateID)
+			switch err {
+			case nil:
+				// disabled loops are still recorded, but someone
+				// decided they are not to be trusted
+				level := t.log.Warn
+				if disabled {
+					level = t.log.Info
+				}
+				level("open",
+					zap.Stringer("sensor", sensor),
+					zap.String("model", model),
+					zap.String("description", description),
+					zap.Uint8("loop", loop),
+					zap.String("label", label),
+					zap.Bool("disabled", disabled),
+				)
+				t.config.wakeup()
+			case errDuplicate:
+				// nothing
+			default:
+				return err
+			}
+			continue
+		}
+
+		err = t.close(conn, sensor, loop, updateID)
+		switch err {
+		case nil:
+			t.log.Info("closed",
+				zap.Stringer("sensor", sensor),
+				zap.String("model", model),
+				zap.String("description", description),
+				zap.Uint8("loop", loop),
+				zap.String("label", label),
+			)
+			t.config.wakeup()
+		case errDuplicate:
+			// nothing
+		default:
+			return err
+		}
+	}
+	return nil
+}
+
+func (t *Tamper) open(conn *sqlite.Conn, sensor honeywell5800.Sensor, loop uint8, disabled bool, updateID int64) error {
+	stmt := insert_honeywell5800_tamper.Prep(conn)
+	defer stmt.Finalize()
+	sensor.ToSQL(stmt, "@sensor")
+	stmt.SetInt64("@loop", int64(loop))
+	stmt.SetBool("@disabled", disabled)
+	stmt.SetInt64("@openedBy", updateID)
+	if _, err := stmt.Step(); err != nil {
+		return fmt.Errorf("add tamper: %w", err)
+	}
+	switch affected := conn.Changes(); affected {
+	case 0:
+		// already open
+		return errDuplicate
+	case 1:
+		return nil
+	default:
+		return fmt.Errorf("internal error: adding tamper caused multiple rows: %d", affected)
+	}
+}
+
+func (t *Tamper) close(conn *sqlite.Conn, sensor honeywell5800.Sensor, loop uint8, updateID int64) error {
+	stmt := update_honeywell5800_tamper_closed.Prep(conn)
+	defer stmt.Finalize()
+	sensor.ToSQL(stmt, "@sensor")
+	stmt.SetInt64("@loop", int64(loop))
+	stmt.SetInt64("@closedBy", updateID)
+	if _, err := stmt.Step(); err != nil {
+		return fmt.Errorf("close tamper: %w", err)
+	}
+	switch affected := conn.Changes(); affected {
+	case 0:
+		// was not open
+		return errDuplicate
+	case 1:
+		return nil
+	default:
+		return fmt.Errorf("internal error: closing tamper caused multiple changes: %d", affected)
+	}
+}
+
+// Acknowledge records that who has seen the tamper with the given id.
+func Acknowledge(ctx context.Context, db *database.DB, id int64, who string, ts time.Time) (err error) {
+	if who == "" {
+		return errors.New("tamper acknowledgement needs a name")
+	}
+	conn := db.Get(ctx)
+	if conn == nil {
+		return context.Canceled
+	}
+	defer db.Put(conn)
+	defer sqlitex.Save(conn)(&err)
+
+	stmt := update_honeywell5800_tamper_acknowledged.Prep(conn)
+	defer stmt.Finalize()
+	stmt.SetInt64("@id", id)
+	database.BindTime(stmt, "@acknowledged", ts)
+	stmt.SetText("@acknowledgedBy", who)
+	if _, err := stmt.Step(); err != nil {
+		return fmt.Errorf("acknowledge tamper: %w", err)
+	}
+	switch affected := conn.Changes(); affected {
+	case 0:
+		return ErrNotFound
+	case 1:
+		return nil
+	default:
+		return fmt.Errorf("internal error: acknowledging tamper caused multiple changes: %d", affected)
+	}
+}
@@ -0,0 +1,180 @@
+package hw58tamper_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"crawshaw.io/sqlite/sqlitex"
+	"eagain.net/go/securityblanket/internal/database"
+	"eagain.net/go/securityblanket/internal/honeywell5800/hw58tamper"
+	"github.com/google/go-cmp/cmp"
+	"go.uber.org/zap/zaptest"
+)
+
+func execScript(t testing.TB, db *database.DB, sql string) {
+	conn := db.Get(nil)
+	defer db.Put(conn)
+
+	if err := sqlitex.ExecScript(conn, sql); err != nil {
+		t.Fatalf("database error: %v", err)
+	}
+}
+
+var start = time.Date(2020, 2, 3, 4, 5, 6, 0, time.UTC)
+
+func update(t testing.TB, db *database.DB, sensor int, event int) {
+	execScript(t, db, fmt.Sprintf(`
+INSERT INTO honeywell5800_updates(time, channel, sensor, event)
+VALUES ('%s', 8, %d, %d);
+`, start.Format(time.RFC3339Nano), sensor, event))
+}
+
+type tamper struct {
+	Sensor         int64
+	Loop           int64
+	Disabled       bool
+	OpenedBy       int64
+	ClosedBy       int64
+	Acknowledged   string
+	AcknowledgedBy string
+}
+
+func tampers(t testing.TB, db *database.DB) []tamper {
+	conn := db.Get(nil)
+	defer db.Put(conn)
+	stmt := conn.Prep(`
+SELECT sensor, loop, disabled, openedBy, closedBy, acknowledged, acknowledgedBy
+FROM honeywell5800_tampers
+ORDER BY id
+`)
+	defer stmt.Finalize()
+	var got []tamper
+	for {
+		hasRow, err := stmt.Step()
+		if err != nil {
+			t.Fatalf("database error: %v", err)
+		}
+		if !hasRow {
+			break
+		}
+		got = append(got, tamper{
+			Sensor:         stmt.GetInt64("sensor"),
+			Loop:           stmt.GetInt64("loop"),
+			Disabled:       stmt.GetInt64("disabled") != 0,
+			OpenedBy:       stmt.GetInt64("openedBy"),
+			ClosedBy:       stmt.GetInt64("closedBy"),
+			Acknowledged:   stmt.GetText("acknowledged"),
+			AcknowledgedBy: stmt.GetText("acknowledgedBy"),
+		})
+	}
+	return got
+}
+
+const (
+	heartbeat  = 0x04
+	loop1      = 0x80
+	tamperLoop = 0x40
+)
+
+func TestTamper(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	db := database.Scratch()
+	defer db.Close()
+
+	log := zaptest.NewLogger(t)
+	wakeups := 0
+	tamp := hw58tamper.New(ctx, db, log,
+		hw58tamper.Wakeup(func() { wakeups++ }),
+	)
+	run := func() {
+		t.Helper()
+		if err := tamp.Run(); err != nil {
+			t.Fatalf("run: %v", err)
+		}
+	}
+
+	execScript(t, db, `
+INSERT INTO honeywell5800_sensors(id, model, description) VALUES
+	(1, '5800MINI', 'front door'),
+	(2, '5800MINI', 'back door');
+
+-- the back door tamper switch is broken
+INSERT INTO honeywell5800_site_loops(sensor, loop, disabled)
+VALUES (2, 4, true);
+`)
+	update(t, db, 1, heartbeat)            // id 1
+	update(t, db, 1, loop1)                // id 2, not a tamper
+	update(t, db, 1, tamperLoop)           // id 3
+	update(t, db, 1, tamperLoop|heartbeat) // id 4, still open
+	update(t, db, 2, tamperLoop)           // id 5
+	update(t, db, 1, heartbeat)            // id 6
+	run()
+
+	want := []tamper{
+		{Sensor: 1, Loop: 4, OpenedBy: 3, ClosedBy: 6},
+		{Sensor: 2, Loop: 4, Disabled: true, OpenedBy: 5},
+	}
+	if diff := cmp.Diff(want, tampers(t, db)); diff != "" {
+		t.Errorf("wrong tampers (-want +got):\n%s", diff)
+	}
+	if g, e := wakeups, 3; g != e {
+		t.Errorf("wrong number of wakeups: %v != %v", g, e)
+	}
+
+	// opens again
+	update(t, db, 1, tamperLoop) // id 7
+	run()
+	want = append(want, tamper{Sensor: 1, Loop: 4, OpenedBy: 7})
+	if diff := cmp.Diff(want, tampers(t, db)); diff != "" {
+		t.Errorf("wrong tampers (-want +got):\n%s", diff)
+	}
+}
+
+func TestAcknowledge(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	db := database.Scratch()
+	defer db.Close()
+
+	execScript(t, db, `
+INSERT INTO honeywell5800_sensors(id, model, description)
+VALUES (1, '5800MINI', 'front door');
+
+INSERT INTO honeywell5800_updates(id, time, channel, sensor, event)
+VALUES (1, '2020-02-03T04:05:06Z', 8, 1, 64);
+
+INSERT INTO honeywell5800_tampers(id, sensor, loop, disabled, openedBy)
+VALUES (10, 1, 4, false, 1);
+`)
+
+	if err := hw58tamper.Acknowledge(ctx, db, 10, "", start); err == nil {
+		t.Error("expected error for anonymous acknowledgement")
+	}
+	if err := hw58tamper.Acknowledge(ctx, db, 10, "alex", start.Add(time.Minute)); err != nil {
+		t.Fatalf("acknowledge: %v", err)
+	}
+	// only once
+	if err := hw58tamper.Acknowledge(ctx, db, 10, "sam", start.Add(time.Hour)); !errors.Is(err, hw58tamper.ErrNotFound) {
+		t.Errorf("wrong error for second acknowledgement: %v", err)
+	}
+	if err := hw58tamper.Acknowledge(ctx, db, 11, "sam", start); !errors.Is(err, hw58tamper.ErrNotFound) {
+		t.Errorf("wrong error for missing tamper: %v", err)
+	}
+
+	want := []tamper{
+		{
+			Sensor:         1,
+			Loop:           4,
+			OpenedBy:       1,
+			Acknowledged:   start.Add(time.Minute).Format(time.RFC3339Nano),
+			AcknowledgedBy: "alex",
+		},
+	}
+	if diff := cmp.Diff(want, tampers(t, db)); diff != "" {
+		t.Errorf("wrong tampers (-want +got):\n%s", diff)
+	}
+}
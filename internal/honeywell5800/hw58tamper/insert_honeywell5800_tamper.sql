@@ -0,0 +1,3 @@
+-- an already open tamper is not opened again
+INSERT OR IGNORE INTO honeywell5800_tampers(sensor, loop, disabled, openedBy)
+	VALUES (@sensor, @loop, @disabled, @openedBy)
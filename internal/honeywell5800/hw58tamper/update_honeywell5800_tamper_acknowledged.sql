@@ -0,0 +1,5 @@
+UPDATE honeywell5800_tampers
+	SET acknowledged=@acknowledged,
+		acknowledgedBy=@acknowledgedBy
+	WHERE id=@id
+		AND acknowledged IS NULL
@@ -0,0 +1,5 @@
+UPDATE honeywell5800_tampers
+	SET closedBy=@closedBy
+	WHERE sensor=@sensor
+		AND loop=@loop
+		AND closedBy IS NULL
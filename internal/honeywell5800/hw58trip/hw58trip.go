@@ -9,6 +9,7 @@ import (
 	"eagain.net/go/securityblanket/internal/catchup"
 	"eagain.net/go/securityblanket/internal/database"
 	"eagain.net/go/securityblanket/internal/honeywell5800"
+	"eagain.net/go/securityblanket/internal/metrics"
 	"go.uber.org/zap"
 )
 
@@ -16,13 +17,36 @@ var (
 	errDuplicate = errors.New("duplicate sensor update")
 )
 
+var tripsTotal = metrics.Default.Counter(
+	"securityblanket_honeywell5800_trips_total",
+	"Loops tripped, by kind of loop.",
+	"kind",
+)
+
+type config struct {
+	wakeup func()
+}
+
+type Option option
+
+type option func(*config)
+
+// Wakeup is called whenever a loop trips or returns to normal.
+func Wakeup(wakeup func()) Option {
+	fn := func(conf *config) {
+		conf.wakeup = wakeup
+	}
+	return fn
+}
+
 type Tripper struct {
 	ctx     context.Context
 	catchup *catchup.Catchup
 	log     *zap.Logger
+	config  config
 }
 
-func New(ctx context.Context, db *database.DB, log *zap.Logger) *Tripper {
+func New(ctx context.Context, db *database.DB, log *zap.Logger, opts ...Option) *Tripper {
 	t := &Tripper{
 		ctx: ctx,
 		catchup: catchup.New(&catchup.Config{
@@ -33,6 +57,12 @@ func New(ctx context.Context, db *database.DB, log *zap.Logger) *Tripper {
 			NextSQL: fetch_honeywell5800_updates.Content,
 		}),
 		log: log,
+		config: config{
+			wakeup: func() {},
+		},
+	}
+	for _, opt := range opts {
+		opt(&t.config)
 	}
 	return t
 }
@@ -70,6 +100,10 @@ func (t *Tripper) run(conn *sqlite.Conn, stmt *sqlite.Stmt) error {
 		if err != nil {
 			return fmt.Errorf("bad kind in database: sensor %v loop %d: %w", sensor, loop, err)
 		}
+		if kind == honeywell5800.Tamper {
+			// handled by hw58tamper, regardless of arming
+			continue
+		}
 		label := loopStmt.GetText("label")
 		normallyOpen := loopStmt.GetInt64("normallyOpen") != 0
 
@@ -104,8 +138,8 @@ func (t *Tripper) run(conn *sqlite.Conn, stmt *sqlite.Stmt) error {
 					zap.Stringer("kind", kind),
 					zap.String("label", label),
 				)
-				// wakeup anyone after us in the pipeline; nobody
-				// there yet
+				tripsTotal.With(kind.String()).Inc()
+				t.config.wakeup()
 			case errDuplicate:
 				// nothing
 			default:
@@ -130,8 +164,7 @@ func (t *Tripper) run(conn *sqlite.Conn, stmt *sqlite.Stmt) error {
 					zap.Stringer("kind", kind),
 					zap.String("label", label),
 				)
-				// wakeup anyone after us in the pipeline; nobody
-				// there yet
+				t.config.wakeup()
 			case errDuplicate:
 			// nothing
 			default:
@@ -159,3 +159,29 @@ SELECT * FROM honeywell5800_trips
 		t.Fatalf("database error: %v", err)
 	}
 }
+
+func TestTamperIsNotTrip(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	db := database.Scratch()
+	defer db.Close()
+
+	now := time.Date(2020, 2, 3, 4, 5, 6, 7, time.Local)
+	log := zaptest.NewLogger(t)
+	trip := hw58trip.New(ctx, db, log)
+
+	// loop 4 is the tamper loop
+	execScript(t, db, `
+INSERT INTO honeywell5800_sensors(id, model, description)
+VALUES (123456,'5853','west wing');
+
+INSERT INTO honeywell5800_updates(id, time, channel, sensor, event)
+VALUES (42, '`+now.Format(time.RFC3339)+`', 8, 123456, 64);
+`)
+	if err := trip.Run(); err != nil {
+		t.Fatalf("run: %v", err)
+	}
+	if g, e := count(t, db), int64(0); g != e {
+		t.Errorf("wrong number of results: %d != %d", g, e)
+	}
+}
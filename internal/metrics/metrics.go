@@ -0,0 +1,250 @@
+// Package metrics exports counters and gauges in the Prometheus text
+// exposition format.
+//
+// Metrics counting events in the daemon are kept in memory, and start
+// from zero on every restart, as Prometheus expects. Metrics describing
+// the current state of things are computed on every scrape, by
+// collectors that typically look at the database.
+package metrics
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const (
+	TypeCounter = "counter"
+	TypeGauge   = "gauge"
+)
+
+// Family is a set of samples sharing a name.
+type Family struct {
+	Name   string
+	Help   string
+	Type   string
+	Labels []string
+	// Samples have label values in the order of Labels.
+	Samples []Sample
+}
+
+type Sample struct {
+	Values []string
+	Value  float64
+}
+
+// Collector computes metrics at scrape time.
+type Collector func(ctx context.Context) ([]*Family, error)
+
+// Registry holds the metrics to export.
+type Registry struct {
+	mu         sync.Mutex
+	names      map[string]struct{}
+	vecs       []*vec
+	collectors []Collector
+}
+
+func NewRegistry() *Registry {
+	r := &Registry{
+		names: make(map[string]struct{}),
+	}
+	return r
+}
+
+// Default is the registry the packages of this module register their
+// metrics in.
+var Default = NewRegistry()
+
+func (r *Registry) add(v *vec) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, dup := r.names[v.name]; dup {
+		panic("metrics: duplicate name: " + v.name)
+	}
+	r.names[v.name] = struct{}{}
+	r.vecs = append(r.vecs, v)
+}
+
+// Counter adds a counter, partitioned by labels.
+func (r *Registry) Counter(name, help string, labels ...string) *CounterVec {
+	v := newVec(name, help, TypeCounter, labels)
+	r.add(v)
+	return &CounterVec{vec: v}
+}
+
+// Gauge adds a gauge, partitioned by labels.
+func (r *Registry) Gauge(name, help string, labels ...string) *GaugeVec {
+	v := newVec(name, help, TypeGauge, labels)
+	r.add(v)
+	return &GaugeVec{vec: v}
+}
+
+// Collect adds a collector, called on every scrape.
+func (r *Registry) Collect(c Collector) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.collectors = append(r.collectors, c)
+}
+
+// Gather returns all the metrics, sorted by name.
+func (r *Registry) Gather(ctx context.Context) ([]*Family, error) {
+	r.mu.Lock()
+	vecs := append([]*vec(nil), r.vecs...)
+	collectors := append([]Collector(nil), r.collectors...)
+	r.mu.Unlock()
+
+	families := make([]*Family, 0, len(vecs))
+	for _, v := range vecs {
+		families = append(families, v.family())
+	}
+	for _, c := range collectors {
+		f, err := c(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("metrics: %w", err)
+		}
+		families = append(families, f...)
+	}
+	for _, f := range families {
+		sort.Slice(f.Samples, func(i, j int) bool {
+			return lessValues(f.Samples[i].Values, f.Samples[j].Values)
+		})
+	}
+	sort.Slice(families, func(i, j int) bool {
+		return families[i].Name < families[j].Name
+	})
+	return families, nil
+}
+
+func lessValues(a, b []string) bool {
+	for i := 0; i < len(a) && i < len(b); i++ {
+		if a[i] != b[i] {
+			return a[i] < b[i]
+		}
+	}
+	return len(a) < len(b)
+}
+
+type value struct {
+	values []string
+	value  float64
+}
+
+type vec struct {
+	name   string
+	help   string
+	typ    string
+	labels []string
+
+	mu     sync.Mutex
+	values map[string]*value
+}
+
+func newVec(name, help, typ string, labels []string) *vec {
+	v := &vec{
+		name:   name,
+		help:   help,
+		typ:    typ,
+		labels: labels,
+		values: make(map[string]*value),
+	}
+	return v
+}
+
+func (v *vec) with(values []string) *value {
+	if len(values) != len(v.labels) {
+		panic(fmt.Sprintf("metrics: %s: wrong number of label values: %d != %d", v.name, len(values), len(v.labels)))
+	}
+	// label values cannot contain invalid UTF-8 in the output, so
+	// 0xff cannot be confused with a real value
+	key := strings.Join(values, "\xff")
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	val, ok := v.values[key]
+	if !ok {
+		val = &value{values: append([]string(nil), values...)}
+		v.values[key] = val
+	}
+	return val
+}
+
+func (v *vec) family() *Family {
+	f := &Family{
+		Name:   v.name,
+		Help:   v.help,
+		Type:   v.typ,
+		Labels: v.labels,
+	}
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	for _, val := range v.values {
+		f.Samples = append(f.Samples, Sample{Values: val.values, Value: val.value})
+	}
+	return f
+}
+
+func (v *vec) add(val *value, delta float64) {
+	v.mu.Lock()
+	val.value += delta
+	v.mu.Unlock()
+}
+
+func (v *vec) set(val *value, x float64) {
+	v.mu.Lock()
+	val.value = x
+	v.mu.Unlock()
+}
+
+// CounterVec is a counter partitioned by labels.
+type CounterVec struct {
+	vec *vec
+}
+
+// With returns the counter for the label values, in the order the
+// labels were given in.
+func (c *CounterVec) With(values ...string) *Counter {
+	return &Counter{vec: c.vec, value: c.vec.with(values)}
+}
+
+type Counter struct {
+	vec   *vec
+	value *value
+}
+
+func (c *Counter) Inc() {
+	c.vec.add(c.value, 1)
+}
+
+// Add increases the counter. Counters never decrease; negative delta
+// panics.
+func (c *Counter) Add(delta float64) {
+	if delta < 0 {
+		panic("metrics: counter cannot decrease: " + c.vec.name)
+	}
+	c.vec.add(c.value, delta)
+}
+
+// GaugeVec is a gauge partitioned by labels.
+type GaugeVec struct {
+	vec *vec
+}
+
+// With returns the gauge for the label values, in the order the labels
+// were given in.
+func (g *GaugeVec) With(values ...string) *Gauge {
+	return &Gauge{vec: g.vec, value: g.vec.with(values)}
+}
+
+type Gauge struct {
+	vec   *vec
+	value *value
+}
+
+func (g *Gauge) Set(x float64) {
+	g.vec.set(g.value, x)
+}
+
+func (g *Gauge) Add(delta float64) {
+	g.vec.add(g.value, delta)
+}
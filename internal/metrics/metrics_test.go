@@ -0,0 +1,90 @@
+package metrics_test
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"eagain.net/go/securityblanket/internal/metrics"
+	"github.com/google/go-cmp/cmp"
+	"go.uber.org/zap/zaptest"
+)
+
+func TestHandler(t *testing.T) {
+	r := metrics.NewRegistry()
+	received := r.Counter("test_received_total", "Messages received.", "model", "freq_mhz")
+	received.With("Honeywell-Security", "345").Inc()
+	received.With("Honeywell-Security", "345").Add(2)
+	received.With("Acurite", "433").Inc()
+	r.Gauge("test_temperature", "Temperature,\nin \\ celsius.").With().Set(-1.5)
+	r.Collect(func(ctx context.Context) ([]*metrics.Family, error) {
+		f := &metrics.Family{
+			Name:   "test_description",
+			Type:   metrics.TypeGauge,
+			Labels: []string{"description"},
+			Samples: []metrics.Sample{
+				{Values: []string{`say "hi"`}, Value: 1},
+			},
+		}
+		return []*metrics.Family{f}, nil
+	})
+
+	srv := httptest.NewServer(metrics.Handler(r, zaptest.NewLogger(t)))
+	defer srv.Close()
+	resp, err := http.Get(srv.URL)
+	if err != nil {
+		t.Fatalf("get: %v", err)
+	}
+	defer resp.Body.Close()
+	if g, e := resp.Header.Get("Content-Type"), metrics.ContentType; g != e {
+		t.Errorf("wrong content type: %q != %q", g, e)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	const want = `# TYPE test_description gauge
+test_description{description="say \"hi\""} 1
+# HELP test_received_total Messages received.
+# TYPE test_received_total counter
+test_received_total{model="Acurite",freq_mhz="433"} 1
+test_received_total{model="Honeywell-Security",freq_mhz="345"} 3
+# HELP test_temperature Temperature,\nin \\ celsius.
+# TYPE test_temperature gauge
+test_temperature -1.5
+`
+	if diff := cmp.Diff(want, string(body)); diff != "" {
+		t.Errorf("wrong metrics: -want +got\n%s", diff)
+	}
+}
+
+func TestCollectorError(t *testing.T) {
+	r := metrics.NewRegistry()
+	r.Collect(func(ctx context.Context) ([]*metrics.Family, error) {
+		return nil, errors.New("database is gone")
+	})
+	srv := httptest.NewServer(metrics.Handler(r, zaptest.NewLogger(t)))
+	defer srv.Close()
+	resp, err := http.Get(srv.URL)
+	if err != nil {
+		t.Fatalf("get: %v", err)
+	}
+	resp.Body.Close()
+	if g, e := resp.StatusCode, http.StatusInternalServerError; g != e {
+		t.Errorf("wrong status: %d != %d", g, e)
+	}
+}
+
+func TestDuplicateName(t *testing.T) {
+	r := metrics.NewRegistry()
+	r.Counter("test_total", "")
+	defer func() {
+		if recover() == nil {
+			t.Error("expected a panic")
+		}
+	}()
+	r.Gauge("test_total", "")
+}
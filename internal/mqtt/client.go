@@ -0,0 +1,279 @@
+// Package mqtt is a minimal MQTT 3.1.1 client, sufficient for
+// talking to rtl_433 and home automation systems over a local broker.
+//
+// Only QoS 0 is supported for sending and subscribing. Sessions are
+// always clean; callers are expected to resubscribe after
+// reconnecting.
+package mqtt
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+var (
+	ErrClosed = errors.New("MQTT connection closed")
+	// ErrPasswordWithoutUsername is returned for a Config with a
+	// password but no username; MQTT 3.1.1 has no way to send one.
+	ErrPasswordWithoutUsername = errors.New("MQTT password given without a username")
+)
+
+type Config struct {
+	ClientID string
+	Username string
+	Password string
+	// KeepAlive is the interval for pinging the broker. Zero uses
+	// a default of one minute.
+	KeepAlive time.Duration
+	// Will is published by the broker if the connection is lost
+	// without a clean disconnect.
+	Will *Message
+	// Handler is called for every message received on a
+	// subscription. It is called from a single goroutine, and
+	// must not block for long.
+	Handler func(msg *Message)
+}
+
+type Client struct {
+	conf Config
+	conn net.Conn
+
+	writeMu sync.Mutex
+
+	mu        sync.Mutex
+	err       error
+	nextID    uint16
+	pending   map[uint16]chan []byte
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// Dial connects to the broker at addr, in host:port form.
+func Dial(ctx context.Context, addr string, conf *Config) (*Client, error) {
+	if err := conf.check(); err != nil {
+		return nil, fmt.Errorf("mqtt: %w", err)
+	}
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("mqtt: %w", err)
+	}
+	c, err := NewClient(ctx, conn, conf)
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// check reports configuration the broker cannot be told.
+func (conf *Config) check() error {
+	if conf.Password != "" && conf.Username == "" {
+		return ErrPasswordWithoutUsername
+	}
+	return nil
+}
+
+// NewClient performs the MQTT handshake over conn.
+func NewClient(ctx context.Context, conn net.Conn, conf *Config) (*Client, error) {
+	if err := conf.check(); err != nil {
+		return nil, fmt.Errorf("mqtt connect: %w", err)
+	}
+	c := &Client{
+		conf:    *conf,
+		conn:    conn,
+		pending: make(map[uint16]chan []byte),
+		done:    make(chan struct{}),
+	}
+	if c.conf.KeepAlive <= 0 {
+		c.conf.KeepAlive = time.Minute
+	}
+	if c.conf.Handler == nil {
+		c.conf.Handler = func(*Message) {}
+	}
+
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+	connect := &Connect{
+		ClientID:  c.conf.ClientID,
+		Username:  c.conf.Username,
+		Password:  c.conf.Password,
+		KeepAlive: uint16(c.conf.KeepAlive / time.Second),
+		Will:      c.conf.Will,
+	}
+	if err := WritePacket(conn, connect.Packet()); err != nil {
+		return nil, fmt.Errorf("mqtt connect: %w", err)
+	}
+	br := bufio.NewReader(conn)
+	p, err := ReadPacket(br)
+	if err != nil {
+		return nil, fmt.Errorf("mqtt connect: %w", err)
+	}
+	if p.Type != TypeConnack || len(p.Body) != 2 {
+		return nil, fmt.Errorf("mqtt connect: unexpected packet type %d", p.Type)
+	}
+	if code := p.Body[1]; code != 0 {
+		return nil, fmt.Errorf("mqtt connect: refused with code %d", code)
+	}
+	_ = conn.SetDeadline(time.Time{})
+
+	go c.readLoop(br)
+	go c.pingLoop()
+	return c, nil
+}
+
+func (c *Client) fail(err error) {
+	c.closeOnce.Do(func() {
+		c.mu.Lock()
+		c.err = err
+		c.mu.Unlock()
+		close(c.done)
+		_ = c.conn.Close()
+	})
+}
+
+// Done is closed when the connection is lost or closed.
+func (c *Client) Done() <-chan struct{} {
+	return c.done
+}
+
+// Err returns why the connection was lost, once Done is closed.
+func (c *Client) Err() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.err
+}
+
+func (c *Client) write(p *Packet) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	select {
+	case <-c.done:
+		return c.Err()
+	default:
+	}
+	if err := WritePacket(c.conn, p); err != nil {
+		c.fail(err)
+		return err
+	}
+	return nil
+}
+
+func (c *Client) readLoop(br *bufio.Reader) {
+	for {
+		_ = c.conn.SetReadDeadline(time.Now().Add(c.conf.KeepAlive * 3 / 2))
+		p, err := ReadPacket(br)
+		if err != nil {
+			c.fail(err)
+			return
+		}
+		switch p.Type {
+		case TypePublish:
+			msg, qos, id, err := ParsePublish(p)
+			if err != nil {
+				c.fail(err)
+				return
+			}
+			if qos > 0 {
+				ack := &Packet{Type: TypePuback, Body: appendUint16(nil, id)}
+				if err := c.write(ack); err != nil {
+					return
+				}
+			}
+			c.conf.Handler(msg)
+		case TypeSuback:
+			id, codes, err := ParseSuback(p)
+			if err != nil {
+				c.fail(err)
+				return
+			}
+			c.mu.Lock()
+			ch, ok := c.pending[id]
+			delete(c.pending, id)
+			c.mu.Unlock()
+			if ok {
+				ch <- codes
+			}
+		case TypePingresp:
+			// deadline was already extended
+		default:
+			c.fail(fmt.Errorf("mqtt: unexpected packet type %d", p.Type))
+			return
+		}
+	}
+}
+
+func (c *Client) pingLoop() {
+	ticker := time.NewTicker(c.conf.KeepAlive)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-ticker.C:
+			if err := c.write(&Packet{Type: TypePingreq}); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// Subscribe subscribes to topic filters, and waits for the broker to
+// acknowledge it. It is an error if the broker refuses any of them.
+func (c *Client) Subscribe(ctx context.Context, filters ...string) error {
+	c.mu.Lock()
+	c.nextID++
+	if c.nextID == 0 {
+		c.nextID++
+	}
+	id := c.nextID
+	ch := make(chan []byte, 1)
+	c.pending[id] = ch
+	c.mu.Unlock()
+
+	body := appendUint16(nil, id)
+	for _, f := range filters {
+		body = appendString(body, f)
+		body = append(body, 0)
+	}
+	if err := c.write(&Packet{Type: TypeSubscribe, Flags: 0x02, Body: body}); err != nil {
+		return fmt.Errorf("mqtt subscribe: %w", err)
+	}
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-c.done:
+		return fmt.Errorf("mqtt subscribe: %w", c.Err())
+	case codes := <-ch:
+		if len(codes) != len(filters) {
+			return fmt.Errorf("mqtt subscribe: %d return codes for %d filters", len(codes), len(filters))
+		}
+		for i, code := range codes {
+			if code == SubackFailure {
+				return fmt.Errorf("mqtt subscribe: broker refused %q", filters[i])
+			}
+		}
+		return nil
+	}
+}
+
+// Publish sends a message, with QoS 0.
+func (c *Client) Publish(msg *Message) error {
+	if err := c.write(PublishPacket(msg)); err != nil {
+		return fmt.Errorf("mqtt publish: %w", err)
+	}
+	return nil
+}
+
+// Close disconnects cleanly. The will message is not sent.
+func (c *Client) Close() error {
+	err := c.write(&Packet{Type: TypeDisconnect})
+	c.fail(ErrClosed)
+	return err
+}
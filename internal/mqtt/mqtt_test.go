@@ -0,0 +1,160 @@
+package mqtt_test
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"eagain.net/go/securityblanket/internal/mqtt"
+	"eagain.net/go/securityblanket/internal/mqtt/mqtttest"
+)
+
+func TestMatch(t *testing.T) {
+	run := func(filter, topic string, want bool) {
+		if g := mqtt.Match(filter, topic); g != want {
+			t.Errorf("Match(%q, %q) = %v, want %v", filter, topic, g, want)
+		}
+	}
+	run("a/b", "a/b", true)
+	run("a/b", "a/c", false)
+	run("a/+", "a/b", true)
+	run("a/+", "a/b/c", false)
+	run("a/+/c", "a/b/c", true)
+	run("a/#", "a/b/c", true)
+	run("a/#", "a", true)
+	run("#", "a/b", true)
+	run("a/b/c", "a/b", false)
+	run("rtl_433/+/events", "rtl_433/pi/events", true)
+	run("rtl_433/+/events", "rtl_433/pi/devices/x", false)
+}
+
+func TestPublishSubscribe(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	broker := mqtttest.NewBroker()
+	defer broker.Close()
+
+	broker.Publish(&mqtt.Message{Topic: "a/retained", Payload: []byte("old"), Retain: true})
+
+	got := make(chan *mqtt.Message, 10)
+	sub, err := mqtt.Dial(ctx, broker.Addr, &mqtt.Config{
+		ClientID: "sub",
+		Handler: func(msg *mqtt.Message) {
+			got <- msg
+		},
+	})
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer sub.Close()
+	if err := sub.Subscribe(ctx, "a/#"); err != nil {
+		t.Fatalf("subscribe: %v", err)
+	}
+	if msg := <-got; msg.Topic != "a/retained" || string(msg.Payload) != "old" || !msg.Retain {
+		t.Errorf("wrong retained message: %+v", msg)
+	}
+
+	pub, err := mqtt.Dial(ctx, broker.Addr, &mqtt.Config{
+		ClientID: "pub",
+		Username: "user",
+		Password: "secret",
+	})
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer pub.Close()
+	if err := pub.Publish(&mqtt.Message{Topic: "b/ignored", Payload: []byte("x")}); err != nil {
+		t.Fatalf("publish: %v", err)
+	}
+	if err := pub.Publish(&mqtt.Message{Topic: "a/b", Payload: []byte("hello")}); err != nil {
+		t.Fatalf("publish: %v", err)
+	}
+	if msg := <-got; msg.Topic != "a/b" || string(msg.Payload) != "hello" {
+		t.Errorf("wrong message: %+v", msg)
+	}
+	connects := broker.Connects()
+	if g, e := connects[1].Username, "user"; g != e {
+		t.Errorf("wrong username: %q != %q", g, e)
+	}
+	if g, e := connects[1].Password, "secret"; g != e {
+		t.Errorf("wrong password: %q != %q", g, e)
+	}
+}
+
+func TestWill(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	broker := mqtttest.NewBroker()
+	defer broker.Close()
+
+	c, err := mqtt.Dial(ctx, broker.Addr, &mqtt.Config{
+		ClientID: "will",
+		Will:     &mqtt.Message{Topic: "status", Payload: []byte("offline"), Retain: true},
+	})
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	broker.DisconnectAll()
+	<-c.Done()
+	for broker.Retained("status") == nil {
+		time.Sleep(time.Millisecond)
+	}
+	if g, e := string(broker.Retained("status").Payload), "offline"; g != e {
+		t.Errorf("wrong will: %q != %q", g, e)
+	}
+}
+
+func TestPasswordWithoutUsername(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	broker := mqtttest.NewBroker()
+	defer broker.Close()
+
+	_, err := mqtt.Dial(ctx, broker.Addr, &mqtt.Config{
+		ClientID: "nobody",
+		Password: "secret",
+	})
+	if !errors.Is(err, mqtt.ErrPasswordWithoutUsername) {
+		t.Fatalf("dial: %v", err)
+	}
+	if n := len(broker.Connects()); n != 0 {
+		t.Errorf("broker got %d connects", n)
+	}
+}
+
+func TestSubscribeRefused(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	broker := mqtttest.NewBroker()
+	defer broker.Close()
+	broker.Refuse("secret/#")
+
+	c, err := mqtt.Dial(ctx, broker.Addr, &mqtt.Config{ClientID: "sub"})
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer c.Close()
+	err = c.Subscribe(ctx, "a/#", "secret/#")
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	if g, e := err.Error(), `mqtt subscribe: broker refused "secret/#"`; g != e {
+		t.Errorf("wrong error: %q != %q", g, e)
+	}
+	if err := c.Subscribe(ctx, "a/#"); err != nil {
+		t.Errorf("subscribe: %v", err)
+	}
+}
+
+func TestReadPacketTooLarge(t *testing.T) {
+	var buf bytes.Buffer
+	// PUBLISH claiming a 256MB body
+	buf.Write([]byte{mqtt.TypePublish << 4, 0xff, 0xff, 0xff, 0x7f})
+	_, err := mqtt.ReadPacket(bufio.NewReader(&buf))
+	if !errors.Is(err, mqtt.ErrTooLarge) {
+		t.Errorf("wrong error: %v", err)
+	}
+}
@@ -0,0 +1,251 @@
+// Package mqtttest provides an in-process MQTT broker for tests.
+//
+// It implements just enough of MQTT 3.1.1 for the mqtt package:
+// QoS 0, retained messages and will messages.
+package mqtttest
+
+import (
+	"bufio"
+	"net"
+	"sync"
+
+	"eagain.net/go/securityblanket/internal/mqtt"
+)
+
+type client struct {
+	conn    net.Conn
+	writeMu sync.Mutex
+	filters []string
+}
+
+func (c *client) write(p *mqtt.Packet) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	_ = mqtt.WritePacket(c.conn, p)
+}
+
+type Broker struct {
+	// Addr is the address the broker listens on, in host:port
+	// form.
+	Addr string
+
+	listener net.Listener
+	wg       sync.WaitGroup
+
+	mu          sync.Mutex
+	clients     map[*client]struct{}
+	retained    map[string]*mqtt.Message
+	published   []*mqtt.Message
+	connects    []*mqtt.Connect
+	subscribed  chan struct{}
+	subscribers int
+	refused     map[string]bool
+}
+
+// NewBroker starts a broker listening on a random port on the
+// loopback interface. Callers should Close it when done.
+func NewBroker() *Broker {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic("mqtttest: cannot listen: " + err.Error())
+	}
+	b := &Broker{
+		Addr:       l.Addr().String(),
+		listener:   l,
+		clients:    make(map[*client]struct{}),
+		retained:   make(map[string]*mqtt.Message),
+		subscribed: make(chan struct{}),
+		refused:    make(map[string]bool),
+	}
+	b.wg.Add(1)
+	go b.serve()
+	return b
+}
+
+// Close stops the broker and disconnects all clients.
+func (b *Broker) Close() {
+	_ = b.listener.Close()
+	b.DisconnectAll()
+	b.wg.Wait()
+}
+
+// DisconnectAll abruptly drops all client connections, as if the
+// network failed.
+func (b *Broker) DisconnectAll() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for c := range b.clients {
+		_ = c.conn.Close()
+	}
+}
+
+func (b *Broker) serve() {
+	defer b.wg.Done()
+	for {
+		conn, err := b.listener.Accept()
+		if err != nil {
+			return
+		}
+		b.wg.Add(1)
+		go b.handle(conn)
+	}
+}
+
+func (b *Broker) handle(conn net.Conn) {
+	defer b.wg.Done()
+	defer conn.Close()
+	br := bufio.NewReader(conn)
+	p, err := mqtt.ReadPacket(br)
+	if err != nil {
+		return
+	}
+	connect, err := mqtt.ParseConnect(p)
+	if err != nil {
+		return
+	}
+	c := &client{conn: conn}
+	b.mu.Lock()
+	b.clients[c] = struct{}{}
+	b.connects = append(b.connects, connect)
+	b.mu.Unlock()
+	c.write(&mqtt.Packet{Type: mqtt.TypeConnack, Body: []byte{0, 0}})
+
+	clean := false
+	defer func() {
+		b.mu.Lock()
+		delete(b.clients, c)
+		b.mu.Unlock()
+		if !clean && connect.Will != nil {
+			b.Publish(connect.Will)
+		}
+	}()
+
+	for {
+		p, err := mqtt.ReadPacket(br)
+		if err != nil {
+			return
+		}
+		switch p.Type {
+		case mqtt.TypePublish:
+			msg, _, _, err := mqtt.ParsePublish(p)
+			if err != nil {
+				return
+			}
+			b.Publish(msg)
+		case mqtt.TypeSubscribe:
+			id, filters, err := mqtt.ParseSubscribe(p)
+			if err != nil {
+				return
+			}
+			b.mu.Lock()
+			ack := []byte{byte(id >> 8), byte(id)}
+			var accepted []string
+			for _, f := range filters {
+				if b.refused[f] {
+					ack = append(ack, mqtt.SubackFailure)
+					continue
+				}
+				ack = append(ack, 0)
+				accepted = append(accepted, f)
+			}
+			c.filters = append(c.filters, accepted...)
+			var retained []*mqtt.Message
+			for _, msg := range b.retained {
+				for _, f := range accepted {
+					if mqtt.Match(f, msg.Topic) {
+						retained = append(retained, msg)
+						break
+					}
+				}
+			}
+			b.subscribers++
+			close(b.subscribed)
+			b.subscribed = make(chan struct{})
+			b.mu.Unlock()
+			c.write(&mqtt.Packet{Type: mqtt.TypeSuback, Body: ack})
+			for _, msg := range retained {
+				c.write(mqtt.PublishPacket(msg))
+			}
+		case mqtt.TypePingreq:
+			c.write(&mqtt.Packet{Type: mqtt.TypePingresp})
+		case mqtt.TypeDisconnect:
+			clean = true
+			return
+		default:
+			return
+		}
+	}
+}
+
+// Publish delivers msg to all matching subscribers, as if a client
+// had published it.
+func (b *Broker) Publish(msg *mqtt.Message) {
+	b.mu.Lock()
+	b.published = append(b.published, msg)
+	if msg.Retain {
+		if len(msg.Payload) == 0 {
+			delete(b.retained, msg.Topic)
+		} else {
+			b.retained[msg.Topic] = msg
+		}
+	}
+	var targets []*client
+	for c := range b.clients {
+		for _, f := range c.filters {
+			if mqtt.Match(f, msg.Topic) {
+				targets = append(targets, c)
+				break
+			}
+		}
+	}
+	b.mu.Unlock()
+	// retain flag is only set for messages sent on subscription
+	out := mqtt.PublishPacket(&mqtt.Message{Topic: msg.Topic, Payload: msg.Payload})
+	for _, c := range targets {
+		c.write(out)
+	}
+}
+
+// Refuse makes the broker refuse later subscriptions to filter, as if
+// an access control list denied them.
+func (b *Broker) Refuse(filter string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refused[filter] = true
+}
+
+// WaitSubscribers blocks until at least n subscribe requests have
+// been handled in total.
+func (b *Broker) WaitSubscribers(n int) {
+	for {
+		b.mu.Lock()
+		if b.subscribers >= n {
+			b.mu.Unlock()
+			return
+		}
+		ch := b.subscribed
+		b.mu.Unlock()
+		<-ch
+	}
+}
+
+// Retained returns the retained message for topic, or nil.
+func (b *Broker) Retained(topic string) *mqtt.Message {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.retained[topic]
+}
+
+// Published returns all messages published so far, in order.
+func (b *Broker) Published() []*mqtt.Message {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]*mqtt.Message(nil), b.published...)
+}
+
+// Connects returns the CONNECT requests received so far, in order.
+func (b *Broker) Connects() []*mqtt.Connect {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]*mqtt.Connect(nil), b.connects...)
+}
@@ -0,0 +1,389 @@
+package mqtt
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Packet types, MQTT 3.1.1 section 2.2.1.
+const (
+	TypeConnect    = 1
+	TypeConnack    = 2
+	TypePublish    = 3
+	TypePuback     = 4
+	TypeSubscribe  = 8
+	TypeSuback     = 9
+	TypePingreq    = 12
+	TypePingresp   = 13
+	TypeDisconnect = 14
+)
+
+// Connect flags, MQTT 3.1.1 section 3.1.2.3.
+const (
+	flagUsername     = 0x80
+	flagPassword     = 0x40
+	flagWillRetain   = 0x20
+	flagWill         = 0x04
+	flagCleanSession = 0x02
+)
+
+// Publish flags, MQTT 3.1.1 section 3.3.1.
+const (
+	flagRetain = 0x01
+	maskQoS    = 0x06
+	shiftQoS   = 1
+)
+
+const (
+	protocol      = "MQTT"
+	protocolLevel = 4
+)
+
+// maximum encodable remaining length
+const maxLength = 268435455
+
+// MaxPacketSize is the largest packet body ReadPacket accepts. The
+// protocol allows up to 256MB, which a misbehaving broker could make
+// us allocate.
+const MaxPacketSize = 1 << 20
+
+// SubackFailure is the SUBACK return code for a refused subscription,
+// MQTT 3.1.1 section 3.9.3.
+const SubackFailure = 0x80
+
+var (
+	ErrMalformed = errors.New("malformed MQTT packet")
+	ErrTooLarge  = errors.New("MQTT packet too large")
+)
+
+// Packet is a raw MQTT control packet.
+type Packet struct {
+	Type  uint8
+	Flags uint8
+	Body  []byte
+}
+
+// ReadPacket reads one control packet.
+func ReadPacket(r *bufio.Reader) (*Packet, error) {
+	b, err := r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	var length int
+	for shift := uint(0); ; shift += 7 {
+		if shift > 21 {
+			return nil, ErrMalformed
+		}
+		c, err := r.ReadByte()
+		if err != nil {
+			return nil, unexpectedEOF(err)
+		}
+		length |= int(c&0x7f) << shift
+		if c&0x80 == 0 {
+			break
+		}
+	}
+	if length > MaxPacketSize {
+		return nil, fmt.Errorf("%w: %d bytes", ErrTooLarge, length)
+	}
+	p := &Packet{
+		Type:  b >> 4,
+		Flags: b & 0x0f,
+		Body:  make([]byte, length),
+	}
+	if _, err := io.ReadFull(r, p.Body); err != nil {
+		return nil, unexpectedEOF(err)
+	}
+	return p, nil
+}
+
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// WritePacket writes one control packet.
+func WritePacket(w io.Writer, p *Packet) error {
+	if len(p.Body) > maxLength {
+		return fmt.Errorf("MQTT packet too large: %d", len(p.Body))
+	}
+	buf := make([]byte, 0, 5+len(p.Body))
+	buf = append(buf, p.Type<<4|p.Flags&0x0f)
+	n := len(p.Body)
+	for {
+		c := byte(n & 0x7f)
+		n >>= 7
+		if n > 0 {
+			c |= 0x80
+		}
+		buf = append(buf, c)
+		if n == 0 {
+			break
+		}
+	}
+	buf = append(buf, p.Body...)
+	_, err := w.Write(buf)
+	return err
+}
+
+func appendString(buf []byte, s string) []byte {
+	buf = appendUint16(buf, uint16(len(s)))
+	return append(buf, s...)
+}
+
+func appendUint16(buf []byte, n uint16) []byte {
+	return append(buf, byte(n>>8), byte(n))
+}
+
+// reader decodes the fields of a packet body.
+type reader struct {
+	buf []byte
+	err error
+}
+
+func (r *reader) byte() byte {
+	if r.err != nil {
+		return 0
+	}
+	if len(r.buf) < 1 {
+		r.err = ErrMalformed
+		return 0
+	}
+	b := r.buf[0]
+	r.buf = r.buf[1:]
+	return b
+}
+
+func (r *reader) uint16() uint16 {
+	if r.err != nil {
+		return 0
+	}
+	if len(r.buf) < 2 {
+		r.err = ErrMalformed
+		return 0
+	}
+	n := binary.BigEndian.Uint16(r.buf)
+	r.buf = r.buf[2:]
+	return n
+}
+
+func (r *reader) bytes() []byte {
+	n := int(r.uint16())
+	if r.err != nil {
+		return nil
+	}
+	if len(r.buf) < n {
+		r.err = ErrMalformed
+		return nil
+	}
+	b := r.buf[:n]
+	r.buf = r.buf[n:]
+	return b
+}
+
+func (r *reader) string() string {
+	return string(r.bytes())
+}
+
+func (r *reader) rest() []byte {
+	b := r.buf
+	r.buf = nil
+	return b
+}
+
+// Message is an application message.
+type Message struct {
+	Topic   string
+	Payload []byte
+	Retain  bool
+}
+
+// PublishPacket encodes msg as a QoS 0 PUBLISH packet.
+func PublishPacket(msg *Message) *Packet {
+	var flags uint8
+	if msg.Retain {
+		flags |= flagRetain
+	}
+	body := appendString(nil, msg.Topic)
+	body = append(body, msg.Payload...)
+	return &Packet{Type: TypePublish, Flags: flags, Body: body}
+}
+
+// ParsePublish decodes a PUBLISH packet. The packet identifier is
+// zero for QoS 0.
+func ParsePublish(p *Packet) (msg *Message, qos uint8, packetID uint16, err error) {
+	if p.Type != TypePublish {
+		return nil, 0, 0, ErrMalformed
+	}
+	r := reader{buf: p.Body}
+	msg = &Message{
+		Topic:  r.string(),
+		Retain: p.Flags&flagRetain != 0,
+	}
+	qos = (p.Flags & maskQoS) >> shiftQoS
+	if qos > 0 {
+		packetID = r.uint16()
+	}
+	msg.Payload = r.rest()
+	if r.err != nil {
+		return nil, 0, 0, r.err
+	}
+	return msg, qos, packetID, nil
+}
+
+// Connect is the content of a CONNECT packet.
+type Connect struct {
+	ClientID  string
+	Username  string
+	Password  string
+	KeepAlive uint16
+	Will      *Message
+}
+
+// Packet encodes c as a CONNECT packet.
+func (c *Connect) Packet() *Packet {
+	var flags uint8 = flagCleanSession
+	if c.Will != nil {
+		flags |= flagWill
+		if c.Will.Retain {
+			flags |= flagWillRetain
+		}
+	}
+	if c.Username != "" {
+		flags |= flagUsername
+	}
+	if c.Password != "" {
+		flags |= flagPassword
+	}
+	body := appendString(nil, protocol)
+	body = append(body, protocolLevel, flags)
+	body = appendUint16(body, c.KeepAlive)
+	body = appendString(body, c.ClientID)
+	if c.Will != nil {
+		body = appendString(body, c.Will.Topic)
+		body = appendString(body, string(c.Will.Payload))
+	}
+	if c.Username != "" {
+		body = appendString(body, c.Username)
+	}
+	if c.Password != "" {
+		body = appendString(body, c.Password)
+	}
+	return &Packet{Type: TypeConnect, Body: body}
+}
+
+// ParseConnect decodes a CONNECT packet.
+func ParseConnect(p *Packet) (*Connect, error) {
+	if p.Type != TypeConnect {
+		return nil, ErrMalformed
+	}
+	r := reader{buf: p.Body}
+	if proto := r.string(); r.err == nil && proto != protocol {
+		return nil, fmt.Errorf("unsupported MQTT protocol: %q", proto)
+	}
+	if lvl := r.byte(); r.err == nil && lvl != protocolLevel {
+		return nil, fmt.Errorf("unsupported MQTT protocol level: %d", lvl)
+	}
+	flags := r.byte()
+	c := &Connect{
+		KeepAlive: r.uint16(),
+		ClientID:  r.string(),
+	}
+	if flags&flagWill != 0 {
+		c.Will = &Message{
+			Topic:   r.string(),
+			Payload: r.bytes(),
+			Retain:  flags&flagWillRetain != 0,
+		}
+	}
+	if flags&flagUsername != 0 {
+		c.Username = r.string()
+	}
+	if flags&flagPassword != 0 {
+		c.Password = r.string()
+	}
+	if r.err != nil {
+		return nil, r.err
+	}
+	return c, nil
+}
+
+// ParseSubscribe decodes a SUBSCRIBE packet, ignoring requested QoS
+// levels.
+func ParseSubscribe(p *Packet) (packetID uint16, filters []string, err error) {
+	if p.Type != TypeSubscribe {
+		return 0, nil, ErrMalformed
+	}
+	r := reader{buf: p.Body}
+	packetID = r.uint16()
+	for r.err == nil && len(r.buf) > 0 {
+		filters = append(filters, r.string())
+		_ = r.byte()
+	}
+	if r.err != nil {
+		return 0, nil, r.err
+	}
+	if len(filters) == 0 {
+		return 0, nil, ErrMalformed
+	}
+	return packetID, filters, nil
+}
+
+// ParseSuback decodes a SUBACK packet. There is one return code per
+// requested filter, in order; SubackFailure means it was refused.
+func ParseSuback(p *Packet) (packetID uint16, codes []byte, err error) {
+	if p.Type != TypeSuback {
+		return 0, nil, ErrMalformed
+	}
+	r := reader{buf: p.Body}
+	packetID = r.uint16()
+	codes = r.rest()
+	if r.err != nil {
+		return 0, nil, r.err
+	}
+	if len(codes) == 0 {
+		return 0, nil, ErrMalformed
+	}
+	return packetID, codes, nil
+}
+
+// Match reports whether topic matches the subscription filter,
+// including the + and # wildcards.
+func Match(filter, topic string) bool {
+	for {
+		var f, t string
+		var fMore, tMore bool
+		f, filter, fMore = cut(filter)
+		if f == "#" {
+			return true
+		}
+		t, topic, tMore = cut(topic)
+		if f != "+" && f != t {
+			return false
+		}
+		if !fMore || !tMore {
+			if !fMore && tMore {
+				return false
+			}
+			if fMore && !tMore {
+				// "a/#" matches "a"
+				return filter == "#"
+			}
+			return true
+		}
+	}
+}
+
+func cut(s string) (before, after string, found bool) {
+	for i := 0; i < len(s); i++ {
+		if s[i] == '/' {
+			return s[:i], s[i+1:], true
+		}
+	}
+	return s, "", false
+}
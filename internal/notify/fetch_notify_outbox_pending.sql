@@ -0,0 +1,24 @@
+SELECT
+	notify_outbox.id AS id,
+	notify_outbox.alert AS alert,
+	notify_outbox.channel AS channel,
+	notify_outbox.event AS event,
+	notify_outbox.created AS created,
+	notify_outbox.attempts AS attempts,
+	notify_outbox.nextAttempt AS nextAttempt,
+	alerts.source AS source,
+	alerts.sensor AS sensor,
+	alerts.loop AS loop,
+	alerts.severity AS severity,
+	alerts.summary AS summary
+FROM notify_outbox
+JOIN alerts ON alerts.id=notify_outbox.alert
+WHERE notify_outbox.delivered IS NULL
+	AND notify_outbox.failed IS NULL
+ORDER BY
+	CASE alerts.severity
+		WHEN 'alarm' THEN 0
+		WHEN 'warning' THEN 1
+		ELSE 2
+	END,
+	notify_outbox.id
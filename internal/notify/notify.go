@@ -0,0 +1,324 @@
+// Package notify delivers alert notifications from the outbox.
+//
+// Package alert queues a row in the notify_outbox table for every
+// channel whenever an alert is raised or resolved, in the same
+// savepoint as the alert itself. A Deliverer sends them through the
+// channel's Notifier, retrying failures with exponential backoff, and
+// sending at most one notification per channel every MinInterval.
+// Alarms go first, then warnings, then the rest, so a burst of lesser
+// notifications cannot hold an alarm back behind the rate limit.
+//
+// The database connection is not held while sending, so a slow
+// notifier does not block the rest of the pipeline.
+package notify
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"crawshaw.io/sqlite"
+	"crawshaw.io/sqlite/sqlitex"
+	"eagain.net/go/securityblanket/internal/database"
+	"eagain.net/go/securityblanket/internal/honeywell5800"
+	"go.uber.org/zap"
+)
+
+// Notification is one message about an alert.
+type Notification struct {
+	// ID is the row in the notify_outbox table, the same for every
+	// attempt. Notifiers use it to remember who already has the
+	// notification. Zero means it is not from the outbox.
+	ID    int64 `json:"-"`
+	Alert int64 `json:"alert"`
+	// Event is "raised" or "resolved".
+	Event  string    `json:"event"`
+	Time   time.Time `json:"time"`
+	Source string    `json:"source"`
+	// Sensor is zero for alerts about the whole site.
+	Sensor   honeywell5800.Sensor `json:"sensor,omitempty"`
+	Loop     uint8                `json:"loop"`
+	Severity string               `json:"severity"`
+	Summary  string               `json:"summary"`
+}
+
+// Subject returns a one-line description of the notification.
+func (n *Notification) Subject() string {
+	if n.Event == "resolved" {
+		return "resolved: " + n.Summary
+	}
+	return n.Severity + ": " + n.Summary
+}
+
+// Notifier sends notifications somewhere people will see them.
+type Notifier interface {
+	Notify(ctx context.Context, n *Notification) error
+}
+
+// Channel is a named destination for notifications.
+type Channel struct {
+	Notifier Notifier
+	// MinInterval is the shortest time allowed between two
+	// notifications on the channel.
+	MinInterval time.Duration
+}
+
+// sendTimeout limits how long a single delivery attempt can take.
+const sendTimeout = 30 * time.Second
+
+type config struct {
+	clock       func() time.Time
+	minBackoff  time.Duration
+	maxBackoff  time.Duration
+	maxAttempts int
+}
+
+type Option option
+
+type option func(*config)
+
+// Clock overrides the source of time used for retries and rate
+// limiting.
+func Clock(clock func() time.Time) Option {
+	fn := func(conf *config) {
+		conf.clock = clock
+	}
+	return fn
+}
+
+// Backoff sets the delay after the first failed attempt, and the
+// longest delay it can double up to.
+func Backoff(min, max time.Duration) Option {
+	fn := func(conf *config) {
+		conf.minBackoff = min
+		conf.maxBackoff = max
+	}
+	return fn
+}
+
+// MaxAttempts sets how many times delivery is attempted before giving
+// up.
+func MaxAttempts(n int) Option {
+	fn := func(conf *config) {
+		conf.maxAttempts = n
+	}
+	return fn
+}
+
+// Deliverer sends queued notifications.
+//
+// Failed deliveries are retried later, so Run needs to be called
+// periodically even when nothing new is queued.
+type Deliverer struct {
+	ctx      context.Context
+	db       *database.DB
+	log      *zap.Logger
+	channels map[string]*Channel
+	lastSent map[string]time.Time
+	config   config
+}
+
+func New(ctx context.Context, db *database.DB, log *zap.Logger, channels map[string]*Channel, opts ...Option) *Deliverer {
+	d := &Deliverer{
+		ctx:      ctx,
+		db:       db,
+		log:      log,
+		channels: channels,
+		lastSent: make(map[string]time.Time),
+		config: config{
+			clock:       time.Now,
+			minBackoff:  10 * time.Second,
+			maxBackoff:  time.Hour,
+			maxAttempts: 10,
+		},
+	}
+	for _, opt := range opts {
+		opt(&d.config)
+	}
+	return d
+}
+
+type pending struct {
+	id           int64
+	channel      string
+	attempts     int64
+	nextAttempt  time.Time
+	notification Notification
+}
+
+func (d *Deliverer) fetch() ([]*pending, error) {
+	conn := d.db.Get(d.ctx)
+	if conn == nil {
+		return nil, context.Canceled
+	}
+	defer d.db.Put(conn)
+
+	stmt := fetch_notify_outbox_pending.Prep(conn)
+	defer stmt.Finalize()
+	var queue []*pending
+	for {
+		hasRow, err := stmt.Step()
+		if err != nil {
+			return nil, fmt.Errorf("error fetching notification outbox: %w", err)
+		}
+		if !hasRow {
+			break
+		}
+		p := &pending{
+			id:       stmt.GetInt64("id"),
+			channel:  stmt.GetText("channel"),
+			attempts: stmt.GetInt64("attempts"),
+			notification: Notification{
+				ID:       stmt.GetInt64("id"),
+				Alert:    stmt.GetInt64("alert"),
+				Event:    stmt.GetText("event"),
+				Source:   stmt.GetText("source"),
+				Severity: stmt.GetText("severity"),
+				Summary:  stmt.GetText("summary"),
+			},
+		}
+		if stmt.ColumnType(stmt.ColumnIndex("sensor")) != sqlite.SQLITE_NULL {
+			p.notification.Sensor = honeywell5800.SensorFromSQL(stmt, "sensor")
+		}
+		if p.nextAttempt, err = database.GetTime(stmt, "nextAttempt"); err != nil {
+			return nil, fmt.Errorf("bad notification time: %d: %w", p.id, err)
+		}
+		if p.notification.Time, err = database.GetTime(stmt, "created"); err != nil {
+			return nil, fmt.Errorf("bad notification time: %d: %w", p.id, err)
+		}
+		if p.notification.Loop, err = database.GetUint8(stmt, "loop"); err != nil {
+			return nil, fmt.Errorf("bad loop in database: notification %d: %w", p.id, err)
+		}
+		queue = append(queue, p)
+	}
+	return queue, nil
+}
+
+// backoff returns how long to wait after the given number of failed
+// attempts.
+func (d *Deliverer) backoff(attempts int64) time.Duration {
+	delay := d.config.minBackoff
+	for i := int64(1); i < attempts && delay < d.config.maxBackoff; i++ {
+		delay *= 2
+	}
+	if delay > d.config.maxBackoff {
+		delay = d.config.maxBackoff
+	}
+	return delay
+}
+
+// Run sends the notifications that are due.
+func (d *Deliverer) Run() error {
+	queue, err := d.fetch()
+	if err != nil {
+		return err
+	}
+	// channels that failed during this run are not tried again until
+	// the next one
+	failed := make(map[string]struct{})
+	for _, p := range queue {
+		log := d.log.With(
+			zap.Int64("notification", p.id),
+			zap.Int64("alert", p.notification.Alert),
+			zap.String("channel", p.channel),
+			zap.String("event", p.notification.Event),
+		)
+		now := d.config.clock()
+		if now.Before(p.nextAttempt) {
+			continue
+		}
+		if _, ok := failed[p.channel]; ok {
+			continue
+		}
+		ch, ok := d.channels[p.channel]
+		if !ok {
+			log.Warn("channel.unknown")
+			if err := d.attempt(p, now, fmt.Errorf("unknown channel: %q", p.channel), true); err != nil {
+				return err
+			}
+			continue
+		}
+		if last, ok := d.lastSent[p.channel]; ok && now.Before(last.Add(ch.MinInterval)) {
+			continue
+		}
+
+		ctx, cancel := context.WithTimeout(d.ctx, sendTimeout)
+		sendErr := ch.Notifier.Notify(ctx, &p.notification)
+		cancel()
+		if d.ctx.Err() != nil {
+			return d.ctx.Err()
+		}
+		d.lastSent[p.channel] = now
+		if sendErr != nil {
+			failed[p.channel] = struct{}{}
+			giveUp := p.attempts+1 >= int64(d.config.maxAttempts)
+			if giveUp {
+				log.Error("failed", zap.Int64("attempts", p.attempts+1), zap.Error(sendErr))
+			} else {
+				log.Warn("retry", zap.Int64("attempts", p.attempts+1), zap.Error(sendErr))
+			}
+			if err := d.attempt(p, now, sendErr, giveUp); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := d.delivered(p, now); err != nil {
+			return err
+		}
+		log.Info("delivered")
+	}
+	return nil
+}
+
+func (d *Deliverer) delivered(p *pending, now time.Time) (err error) {
+	conn := d.db.Get(d.ctx)
+	if conn == nil {
+		return context.Canceled
+	}
+	defer d.db.Put(conn)
+	defer sqlitex.Save(conn)(&err)
+
+	stmt := update_notify_outbox_delivered.Prep(conn)
+	defer stmt.Finalize()
+	stmt.SetInt64("@id", p.id)
+	database.BindTime(stmt, "@time", now)
+	if _, err := stmt.Step(); err != nil {
+		return fmt.Errorf("mark notification delivered: %d: %w", p.id, err)
+	}
+	if p.notification.Event != "raised" {
+		return nil
+	}
+	up := update_alert_notified.Prep(conn)
+	defer up.Finalize()
+	up.SetInt64("@id", p.notification.Alert)
+	database.BindTime(up, "@time", now)
+	if _, err := up.Step(); err != nil {
+		return fmt.Errorf("mark alert notified: %d: %w", p.notification.Alert, err)
+	}
+	return nil
+}
+
+// attempt records a failed delivery attempt.
+func (d *Deliverer) attempt(p *pending, now time.Time, sendErr error, giveUp bool) (err error) {
+	conn := d.db.Get(d.ctx)
+	if conn == nil {
+		return context.Canceled
+	}
+	defer d.db.Put(conn)
+	defer sqlitex.Save(conn)(&err)
+
+	stmt := update_notify_outbox_attempt.Prep(conn)
+	defer stmt.Finalize()
+	stmt.SetInt64("@id", p.id)
+	stmt.SetText("@error", sendErr.Error())
+	database.BindTime(stmt, "@nextAttempt", now.Add(d.backoff(p.attempts+1)))
+	var failed time.Time
+	if giveUp {
+		failed = now
+	}
+	database.BindTime(stmt, "@failed", failed)
+	if _, err := stmt.Step(); err != nil {
+		return fmt.Errorf("record notification attempt: %d: %w", p.id, err)
+	}
+	return nil
+}
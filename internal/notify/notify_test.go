@@ -0,0 +1,479 @@
+package notify_test
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"crawshaw.io/sqlite/sqlitex"
+	"eagain.net/go/securityblanket/internal/database"
+	"eagain.net/go/securityblanket/internal/notify"
+	"github.com/google/go-cmp/cmp"
+	"go.uber.org/zap/zaptest"
+)
+
+func execScript(t testing.TB, db *database.DB, sql string) {
+	conn := db.Get(nil)
+	defer db.Put(conn)
+
+	if err := sqlitex.ExecScript(conn, sql); err != nil {
+		t.Fatalf("database error: %v", err)
+	}
+}
+
+var start = time.Date(2020, 2, 3, 4, 5, 6, 0, time.UTC)
+
+func at(d time.Duration) string {
+	return start.Add(d).Format(time.RFC3339Nano)
+}
+
+// queue adds an open alarm with id, with a raised notification on
+// the given channels.
+func queue(t testing.TB, db *database.DB, id int, channels ...string) {
+	queueSeverity(t, db, id, "alarm", channels...)
+}
+
+// queueSeverity is queue for an alert of the given severity.
+func queueSeverity(t testing.TB, db *database.DB, id int, severity string, channels ...string) {
+	execScript(t, db, fmt.Sprintf(`
+INSERT INTO honeywell5800_sensors(id, model, description)
+VALUES (%[1]d, '5800MINI', 'door %[1]d');
+
+INSERT INTO alerts(id, source, sensor, loop, severity, summary, raised, lastSeen)
+VALUES (%[1]d, 'trip', %[1]d, 1, '%[3]s', 'door %[1]d: door or window open', '%[2]s', '%[2]s');
+`, id, at(0), severity))
+	for _, ch := range channels {
+		execScript(t, db, fmt.Sprintf(`
+INSERT INTO notify_outbox(alert, channel, event, created, nextAttempt)
+VALUES (%[1]d, '%[2]s', 'raised', '%[3]s', '%[3]s');
+`, id, ch, at(0)))
+	}
+}
+
+type row struct {
+	Alert     int64
+	Channel   string
+	Attempts  int64
+	LastError string
+	Delivered string
+	Failed    string
+}
+
+func outbox(t testing.TB, db *database.DB) []row {
+	conn := db.Get(nil)
+	defer db.Put(conn)
+	stmt := conn.Prep(`
+SELECT alert, channel, attempts, lastError, delivered, failed
+FROM notify_outbox
+ORDER BY id
+`)
+	defer stmt.Finalize()
+	var got []row
+	for {
+		hasRow, err := stmt.Step()
+		if err != nil {
+			t.Fatalf("database error: %v", err)
+		}
+		if !hasRow {
+			break
+		}
+		got = append(got, row{
+			Alert:     stmt.GetInt64("alert"),
+			Channel:   stmt.GetText("channel"),
+			Attempts:  stmt.GetInt64("attempts"),
+			LastError: stmt.GetText("lastError"),
+			Delivered: stmt.GetText("delivered"),
+			Failed:    stmt.GetText("failed"),
+		})
+	}
+	return got
+}
+
+func notified(t testing.TB, db *database.DB, id int) string {
+	conn := db.Get(nil)
+	defer db.Put(conn)
+	stmt := conn.Prep(`SELECT notified FROM alerts WHERE id=@id`)
+	defer stmt.Finalize()
+	stmt.SetInt64("@id", int64(id))
+	s, err := sqlitex.ResultText(stmt)
+	if err != nil {
+		t.Fatalf("database error: %v", err)
+	}
+	return s
+}
+
+type webhook struct {
+	mu       sync.Mutex
+	failures int
+	got      []notify.Notification
+}
+
+func (w *webhook) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.failures > 0 {
+		w.failures--
+		http.Error(rw, "try again", http.StatusServiceUnavailable)
+		return
+	}
+	var n notify.Notification
+	if err := json.NewDecoder(req.Body).Decode(&n); err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.got = append(w.got, n)
+}
+
+func TestWebhookRetry(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	db := database.Scratch()
+	defer db.Close()
+
+	hook := &webhook{failures: 2}
+	srv := httptest.NewServer(hook)
+	defer srv.Close()
+
+	log := zaptest.NewLogger(t)
+	now := start
+	d := notify.New(ctx, db, log,
+		map[string]*notify.Channel{
+			"hook": {Notifier: &notify.Webhook{URL: srv.URL}},
+		},
+		notify.Clock(func() time.Time { return now }),
+		notify.Backoff(10*time.Second, time.Minute),
+	)
+	run := func() {
+		t.Helper()
+		if err := d.Run(); err != nil {
+			t.Fatalf("run: %v", err)
+		}
+	}
+
+	queue(t, db, 1, "hook")
+	run()
+	run()
+	want := []row{{Alert: 1, Channel: "hook", Attempts: 1, LastError: "webhook: 503 Service Unavailable"}}
+	if diff := cmp.Diff(want, outbox(t, db)); diff != "" {
+		t.Fatalf("wrong outbox after first failure: -want +got\n%s", diff)
+	}
+
+	// second attempt after backoff fails too, and backs off longer
+	now = start.Add(10 * time.Second)
+	run()
+	now = start.Add(20 * time.Second)
+	run()
+	want[0].Attempts = 2
+	if diff := cmp.Diff(want, outbox(t, db)); diff != "" {
+		t.Fatalf("wrong outbox after second failure: -want +got\n%s", diff)
+	}
+	if g := notified(t, db, 1); g != "" {
+		t.Errorf("notified too early: %q", g)
+	}
+
+	now = start.Add(30 * time.Second)
+	run()
+	want[0].Attempts = 3
+	want[0].Delivered = at(30 * time.Second)
+	if diff := cmp.Diff(want, outbox(t, db)); diff != "" {
+		t.Fatalf("wrong outbox after delivery: -want +got\n%s", diff)
+	}
+	if g, e := notified(t, db, 1), at(30*time.Second); g != e {
+		t.Errorf("wrong notified time: %q != %q", g, e)
+	}
+	wantSent := []notify.Notification{{
+		Alert:    1,
+		Event:    "raised",
+		Time:     start,
+		Source:   "trip",
+		Sensor:   1,
+		Loop:     1,
+		Severity: "alarm",
+		Summary:  "door 1: door or window open",
+	}}
+	if diff := cmp.Diff(wantSent, hook.got); diff != "" {
+		t.Errorf("wrong notifications: -want +got\n%s", diff)
+	}
+}
+
+func TestGiveUp(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	db := database.Scratch()
+	defer db.Close()
+
+	hook := &webhook{failures: 100}
+	srv := httptest.NewServer(hook)
+	defer srv.Close()
+
+	log := zaptest.NewLogger(t)
+	now := start
+	d := notify.New(ctx, db, log,
+		map[string]*notify.Channel{
+			"hook": {Notifier: &notify.Webhook{URL: srv.URL}},
+		},
+		notify.Clock(func() time.Time { return now }),
+		notify.Backoff(time.Second, time.Second),
+		notify.MaxAttempts(3),
+	)
+	queue(t, db, 1, "hook", "gone")
+	for i := 0; i < 5; i++ {
+		now = start.Add(time.Duration(i) * time.Second)
+		if err := d.Run(); err != nil {
+			t.Fatalf("run: %v", err)
+		}
+	}
+	want := []row{
+		{Alert: 1, Channel: "hook", Attempts: 3, LastError: "webhook: 503 Service Unavailable", Failed: at(2 * time.Second)},
+		{Alert: 1, Channel: "gone", Attempts: 1, LastError: `unknown channel: "gone"`, Failed: at(0)},
+	}
+	if diff := cmp.Diff(want, outbox(t, db)); diff != "" {
+		t.Fatalf("wrong outbox: -want +got\n%s", diff)
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	db := database.Scratch()
+	defer db.Close()
+
+	hook := &webhook{}
+	srv := httptest.NewServer(hook)
+	defer srv.Close()
+
+	log := zaptest.NewLogger(t)
+	now := start
+	d := notify.New(ctx, db, log,
+		map[string]*notify.Channel{
+			"hook": {
+				Notifier:    &notify.Webhook{URL: srv.URL},
+				MinInterval: time.Minute,
+			},
+		},
+		notify.Clock(func() time.Time { return now }),
+	)
+	run := func() {
+		t.Helper()
+		if err := d.Run(); err != nil {
+			t.Fatalf("run: %v", err)
+		}
+	}
+	queue(t, db, 1, "hook")
+	queue(t, db, 2, "hook")
+	run()
+	if g, e := len(hook.got), 1; g != e {
+		t.Fatalf("wrong number of notifications: %d != %d", g, e)
+	}
+	now = start.Add(59 * time.Second)
+	run()
+	if g, e := len(hook.got), 1; g != e {
+		t.Fatalf("rate limit not applied: %d != %d", g, e)
+	}
+	now = start.Add(time.Minute)
+	run()
+	if g, e := len(hook.got), 2; g != e {
+		t.Fatalf("wrong number of notifications: %d != %d", g, e)
+	}
+	if g, e := hook.got[1].Alert, int64(2); g != e {
+		t.Errorf("wrong alert: %d != %d", g, e)
+	}
+}
+
+func TestSiteAlert(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	db := database.Scratch()
+	defer db.Close()
+
+	hook := &webhook{}
+	srv := httptest.NewServer(hook)
+	defer srv.Close()
+
+	log := zaptest.NewLogger(t)
+	d := notify.New(ctx, db, log,
+		map[string]*notify.Channel{
+			"hook": {Notifier: &notify.Webhook{URL: srv.URL}},
+		},
+		notify.Clock(func() time.Time { return start }),
+	)
+	execScript(t, db, fmt.Sprintf(`
+INSERT INTO alerts(id, source, sensor, loop, severity, summary, raised, lastSeen)
+VALUES (1, 'jamming', NULL, 0, 'alarm', 'jamming: 4 of 6 sensors silent', '%[1]s', '%[1]s');
+
+INSERT INTO notify_outbox(alert, channel, event, created, nextAttempt)
+VALUES (1, 'hook', 'raised', '%[1]s', '%[1]s');
+`, at(0)))
+	if err := d.Run(); err != nil {
+		t.Fatalf("run: %v", err)
+	}
+	want := []notify.Notification{{
+		Alert:    1,
+		Event:    "raised",
+		Time:     start,
+		Source:   "jamming",
+		Severity: "alarm",
+		Summary:  "jamming: 4 of 6 sensors silent",
+	}}
+	if diff := cmp.Diff(want, hook.got); diff != "" {
+		t.Errorf("wrong notifications: -want +got\n%s", diff)
+	}
+}
+
+func TestAlarmFirst(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	db := database.Scratch()
+	defer db.Close()
+
+	hook := &webhook{}
+	srv := httptest.NewServer(hook)
+	defer srv.Close()
+
+	log := zaptest.NewLogger(t)
+	now := start
+	d := notify.New(ctx, db, log,
+		map[string]*notify.Channel{
+			"hook": {
+				Notifier:    &notify.Webhook{URL: srv.URL},
+				MinInterval: time.Minute,
+			},
+		},
+		notify.Clock(func() time.Time { return now }),
+	)
+	queueSeverity(t, db, 1, "info", "hook")
+	queueSeverity(t, db, 2, "warning", "hook")
+	queueSeverity(t, db, 3, "warning", "hook")
+	queue(t, db, 4, "hook")
+	for i := 0; i < 4; i++ {
+		if err := d.Run(); err != nil {
+			t.Fatalf("run: %v", err)
+		}
+		now = now.Add(time.Minute)
+	}
+	var got []int64
+	for _, n := range hook.got {
+		got = append(got, n.Alert)
+	}
+	if diff := cmp.Diff([]int64{4, 2, 3, 1}, got); diff != "" {
+		t.Errorf("wrong order (-want +got):\n%s", diff)
+	}
+}
+
+// fakeSMTP accepts one mail transaction per connection, and records
+// the message data.
+type fakeSMTP struct {
+	l   net.Listener
+	mu  sync.Mutex
+	got []string
+}
+
+func (f *fakeSMTP) serve(t testing.TB) {
+	for {
+		conn, err := f.l.Accept()
+		if err != nil {
+			return
+		}
+		go f.session(t, conn)
+	}
+}
+
+func (f *fakeSMTP) session(t testing.TB, conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	reply := func(s string) {
+		fmt.Fprintf(conn, "%s\r\n", s)
+	}
+	reply("220 fake ESMTP")
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		cmd := strings.ToUpper(strings.TrimSpace(line))
+		switch {
+		case strings.HasPrefix(cmd, "EHLO"):
+			reply("250-fake")
+			reply("250 8BITMIME")
+		case strings.HasPrefix(cmd, "MAIL FROM:"),
+			strings.HasPrefix(cmd, "RCPT TO:"):
+			reply("250 ok")
+		case cmd == "DATA":
+			reply("354 go ahead")
+			var msg strings.Builder
+			for {
+				l, err := r.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if l == ".\r\n" {
+					break
+				}
+				msg.WriteString(l)
+			}
+			f.mu.Lock()
+			f.got = append(f.got, msg.String())
+			f.mu.Unlock()
+			reply("250 queued")
+		case cmd == "QUIT":
+			reply("221 bye")
+			return
+		default:
+			reply("502 unknown command")
+		}
+	}
+}
+
+func TestSMTP(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer l.Close()
+	srv := &fakeSMTP{l: l}
+	go srv.serve(t)
+
+	s := &notify.SMTP{
+		Addr: l.Addr().String(),
+		From: "alarm@example.com",
+		To:   []string{"a@example.com", "b@example.com"},
+	}
+	n := &notify.Notification{
+		Alert:    7,
+		Event:    "resolved",
+		Time:     start,
+		Source:   "tamper",
+		Sensor:   1234567,
+		Loop:     4,
+		Severity: "alarm",
+		Summary:  "kitchen: tamper",
+	}
+	if err := s.Notify(context.Background(), n); err != nil {
+		t.Fatalf("notify: %v", err)
+	}
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if g, e := len(srv.got), 1; g != e {
+		t.Fatalf("wrong number of messages: %d != %d", g, e)
+	}
+	msg := srv.got[0]
+	for _, want := range []string{
+		"From: alarm@example.com\r\n",
+		"To: a@example.com, b@example.com\r\n",
+		"Subject: resolved: kitchen: tamper\r\n",
+		"Alert:    7\r\n",
+		"Loop:     4\r\n",
+	} {
+		if !strings.Contains(msg, want) {
+			t.Errorf("message lacks %q:\n%s", want, msg)
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/smtp"
+	"strings"
+	"time"
+)
+
+// SMTP sends notifications as email. The connection is upgraded with
+// STARTTLS whenever the server offers it.
+type SMTP struct {
+	// Addr is the HOST:PORT of the mail server.
+	Addr string
+	From string
+	To   []string
+	// Auth authenticates to the server, if not nil.
+	Auth smtp.Auth
+}
+
+var _ Notifier = (*SMTP)(nil)
+
+func (s *SMTP) message(n *Notification) []byte {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "From: %s\r\n", s.From)
+	fmt.Fprintf(&buf, "To: %s\r\n", strings.Join(s.To, ", "))
+	// summaries come from the site configuration; keep them from
+	// breaking the header
+	subject := strings.NewReplacer("\r", " ", "\n", " ").Replace(n.Subject())
+	fmt.Fprintf(&buf, "Subject: %s\r\n", subject)
+	fmt.Fprintf(&buf, "Date: %s\r\n", n.Time.Format(time.RFC1123Z))
+	buf.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	buf.WriteString("\r\n")
+	fmt.Fprintf(&buf, "%s\r\n\r\n", subject)
+	fmt.Fprintf(&buf, "Alert:    %d\r\n", n.Alert)
+	fmt.Fprintf(&buf, "Event:    %s\r\n", n.Event)
+	fmt.Fprintf(&buf, "Time:     %s\r\n", n.Time.Format(time.RFC3339))
+	fmt.Fprintf(&buf, "Source:   %s\r\n", n.Source)
+	if n.Sensor != 0 {
+		fmt.Fprintf(&buf, "Sensor:   %v\r\n", n.Sensor)
+	}
+	if n.Loop != 0 {
+		fmt.Fprintf(&buf, "Loop:     %d\r\n", n.Loop)
+	}
+	fmt.Fprintf(&buf, "Severity: %s\r\n", n.Severity)
+	return buf.Bytes()
+}
+
+func (s *SMTP) Notify(ctx context.Context, n *Notification) error {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", s.Addr)
+	if err != nil {
+		return fmt.Errorf("smtp: %w", err)
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		if err := conn.SetDeadline(deadline); err != nil {
+			return fmt.Errorf("smtp: %w", err)
+		}
+	}
+	host, _, err := net.SplitHostPort(s.Addr)
+	if err != nil {
+		return fmt.Errorf("smtp: %w", err)
+	}
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		return fmt.Errorf("smtp: %w", err)
+	}
+	defer c.Close()
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		if err := c.StartTLS(&tls.Config{ServerName: host}); err != nil {
+			return fmt.Errorf("smtp: %w", err)
+		}
+	}
+	if s.Auth != nil {
+		if err := c.Auth(s.Auth); err != nil {
+			return fmt.Errorf("smtp: %w", err)
+		}
+	}
+	if err := c.Mail(s.From); err != nil {
+		return fmt.Errorf("smtp: %w", err)
+	}
+	for _, to := range s.To {
+		if err := c.Rcpt(to); err != nil {
+			return fmt.Errorf("smtp: %s: %w", to, err)
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return fmt.Errorf("smtp: %w", err)
+	}
+	if _, err := w.Write(s.message(n)); err != nil {
+		return fmt.Errorf("smtp: %w", err)
+	}
+	if err := w.Close(); err != nil {
+		return fmt.Errorf("smtp: %w", err)
+	}
+	return c.Quit()
+}
@@ -0,0 +1,4 @@
+UPDATE alerts
+	SET notified=@time
+	WHERE id=@id
+		AND notified IS NULL
@@ -0,0 +1,6 @@
+UPDATE notify_outbox
+	SET attempts=attempts+1,
+		lastError=@error,
+		nextAttempt=@nextAttempt,
+		failed=@failed
+	WHERE id=@id
@@ -0,0 +1,4 @@
+UPDATE notify_outbox
+	SET attempts=attempts+1,
+		delivered=@time
+	WHERE id=@id
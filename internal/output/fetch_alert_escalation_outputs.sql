@@ -0,0 +1,10 @@
+SELECT
+	id,
+	alert,
+	output,
+	time
+FROM alert_escalation_outputs
+WHERE id>@last
+	AND id<=@max
+ORDER BY id ASC
+LIMIT 100
@@ -0,0 +1,6 @@
+SELECT
+	time,
+	mode
+FROM arming_changes
+ORDER BY id DESC
+LIMIT 1
@@ -0,0 +1,13 @@
+SELECT
+	arming_trips.id AS id,
+	arming_trips.action AS action,
+	honeywell5800_updates.time AS time
+FROM arming_trips
+JOIN honeywell5800_trips
+ON (honeywell5800_trips.id=arming_trips.trip)
+JOIN honeywell5800_updates
+ON (honeywell5800_updates.id=honeywell5800_trips.trippedBy)
+WHERE arming_trips.id>@last
+	AND arming_trips.id<=@max
+ORDER BY arming_trips.id ASC
+LIMIT 100
@@ -0,0 +1,10 @@
+SELECT
+	id,
+	pattern,
+	started,
+	until,
+	stopped
+FROM output_activations
+WHERE output=@output
+ORDER BY id DESC
+LIMIT 1
@@ -0,0 +1,17 @@
+-- Activations that have not been stopped, and when the alert that
+-- escalated to them was acknowledged or resolved.
+SELECT
+	output_activations.id AS id,
+	output_activations.output AS output,
+	output_activations.pattern AS pattern,
+	output_activations.started AS started,
+	output_activations.until AS until,
+	alerts.acknowledged AS acknowledged,
+	alerts.resolved AS resolved
+FROM output_activations
+LEFT JOIN alert_escalation_outputs
+	ON alert_escalation_outputs.id=output_activations.escalation
+LEFT JOIN alerts
+	ON alerts.id=alert_escalation_outputs.alert
+WHERE output_activations.stopped IS NULL
+ORDER BY output_activations.id
@@ -0,0 +1,42 @@
+package output
+
+import (
+	"context"
+	"sync"
+)
+
+// GPIO drives a line of a Linux GPIO character device, such as
+// /dev/gpiochip0, typically wired to a relay or a transistor. The line
+// is requested on first use, and held until Close.
+type GPIO struct {
+	// Chip is the path of the character device.
+	Chip string
+	// Line is the offset of the line on the chip.
+	Line uint32
+	// ActiveLow inverts the output, for relay boards that switch on
+	// when the line is low.
+	ActiveLow bool
+	// Consumer labels the line in the kernel, as seen in gpioinfo.
+	// Empty means "securityblanket".
+	Consumer string
+
+	mu sync.Mutex
+	// line handle, valid when opened
+	fd     int
+	opened bool
+}
+
+var _ Driver = (*GPIO)(nil)
+
+func (g *GPIO) Set(ctx context.Context, on bool) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.set(on)
+}
+
+// Close releases the line.
+func (g *GPIO) Close() error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.close()
+}
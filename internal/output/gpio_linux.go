@@ -0,0 +1,102 @@
+package output
+
+import (
+	"fmt"
+	"syscall"
+	"unsafe"
+)
+
+// From linux/gpio.h, the version 1 character device ABI.
+const (
+	gpioHandlesMax = 64
+
+	gpioHandleRequestOutput    = 1 << 1
+	gpioHandleRequestActiveLow = 1 << 2
+
+	// _IOWR(0xB4, 0x03, struct gpiohandle_request)
+	gpioGetLineHandleIoctl = 3<<30 | uint32(unsafe.Sizeof(gpioHandleRequest{}))<<16 | 0xB4<<8 | 0x03
+	// _IOWR(0xB4, 0x09, struct gpiohandle_data)
+	gpioHandleSetLineValuesIoctl = 3<<30 | uint32(unsafe.Sizeof(gpioHandleData{}))<<16 | 0xB4<<8 | 0x09
+)
+
+type gpioHandleRequest struct {
+	LineOffsets   [gpioHandlesMax]uint32
+	Flags         uint32
+	DefaultValues [gpioHandlesMax]uint8
+	ConsumerLabel [32]byte
+	Lines         uint32
+	Fd            int32
+}
+
+type gpioHandleData struct {
+	Values [gpioHandlesMax]uint8
+}
+
+func ioctl(fd int, req uint32, arg unsafe.Pointer) error {
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), uintptr(req), uintptr(arg))
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// request asks for the line as an output, initially in state on.
+func (g *GPIO) request(on bool) error {
+	chip, err := syscall.Open(g.Chip, syscall.O_RDWR|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return fmt.Errorf("gpio: %s: %w", g.Chip, err)
+	}
+	defer syscall.Close(chip)
+
+	req := gpioHandleRequest{
+		Flags: gpioHandleRequestOutput,
+		Lines: 1,
+	}
+	req.LineOffsets[0] = g.Line
+	if g.ActiveLow {
+		req.Flags |= gpioHandleRequestActiveLow
+	}
+	if on {
+		req.DefaultValues[0] = 1
+	}
+	consumer := g.Consumer
+	if consumer == "" {
+		consumer = "securityblanket"
+	}
+	// leave room for the terminating zero
+	copy(req.ConsumerLabel[:len(req.ConsumerLabel)-1], consumer)
+	if err := ioctl(chip, gpioGetLineHandleIoctl, unsafe.Pointer(&req)); err != nil {
+		return fmt.Errorf("gpio: %s: line %d: %w", g.Chip, g.Line, err)
+	}
+	g.fd = int(req.Fd)
+	g.opened = true
+	return nil
+}
+
+func (g *GPIO) set(on bool) error {
+	if !g.opened {
+		// requesting sets the initial value
+		return g.request(on)
+	}
+	var data gpioHandleData
+	if on {
+		data.Values[0] = 1
+	}
+	if err := ioctl(g.fd, gpioHandleSetLineValuesIoctl, unsafe.Pointer(&data)); err != nil {
+		// the line may have been lost, request it again next time
+		_ = g.close()
+		return fmt.Errorf("gpio: %s: line %d: %w", g.Chip, g.Line, err)
+	}
+	return nil
+}
+
+func (g *GPIO) close() error {
+	if !g.opened {
+		return nil
+	}
+	g.opened = false
+	if err := syscall.Close(g.fd); err != nil {
+		return fmt.Errorf("gpio: %w", err)
+	}
+	return nil
+}
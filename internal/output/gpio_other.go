@@ -0,0 +1,17 @@
+// +build !linux
+
+package output
+
+import (
+	"errors"
+)
+
+var errGPIOUnsupported = errors.New("gpio: only supported on Linux")
+
+func (g *GPIO) set(on bool) error {
+	return errGPIOUnsupported
+}
+
+func (g *GPIO) close() error {
+	return nil
+}
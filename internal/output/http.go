@@ -0,0 +1,49 @@
+package output
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+)
+
+// HTTPRelay drives a relay board with a web interface, as commonly
+// built with an ESP8266 or Arduino, by requesting one URL to switch it
+// on and another to switch it off.
+type HTTPRelay struct {
+	OnURL  string
+	OffURL string
+	// Client is used for the requests. Nil means
+	// http.DefaultClient.
+	Client *http.Client
+}
+
+var _ Driver = (*HTTPRelay)(nil)
+
+func (r *HTTPRelay) Set(ctx context.Context, on bool) error {
+	u := r.OffURL
+	if on {
+		u = r.OnURL
+	}
+	req, err := http.NewRequest(http.MethodGet, u, nil)
+	if err != nil {
+		return fmt.Errorf("http relay: %w", err)
+	}
+	req = req.WithContext(ctx)
+	client := r.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("http relay: %w", err)
+	}
+	defer resp.Body.Close()
+	// drain for connection reuse; relay boards say little
+	_, _ = io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 64*1024))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("http relay: %s", resp.Status)
+	}
+	return nil
+}
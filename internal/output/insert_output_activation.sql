@@ -0,0 +1,2 @@
+INSERT INTO output_activations(output, pattern, trip, escalation, started, until)
+	VALUES (@output, @pattern, @trip, @escalation, @started, @until)
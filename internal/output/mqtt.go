@@ -0,0 +1,80 @@
+package output
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"eagain.net/go/securityblanket/internal/mqtt"
+)
+
+// MQTTRelay drives an output by publishing to its command topic, as
+// used by Tasmota, ESPHome and such. Messages are retained, so a
+// device that restarts picks up the current state.
+type MQTTRelay struct {
+	// Addr is the broker address, in host:port form.
+	Addr   string
+	Config mqtt.Config
+	Topic  string
+	On     []byte
+	Off    []byte
+
+	mu     sync.Mutex
+	client *mqtt.Client
+}
+
+var _ Driver = (*MQTTRelay)(nil)
+
+// connect returns a connected client, reconnecting if the previous
+// connection was lost.
+func (r *MQTTRelay) connect(ctx context.Context) (*mqtt.Client, error) {
+	if r.client != nil {
+		select {
+		case <-r.client.Done():
+			r.client = nil
+		default:
+			return r.client, nil
+		}
+	}
+	client, err := mqtt.Dial(ctx, r.Addr, &r.Config)
+	if err != nil {
+		return nil, err
+	}
+	r.client = client
+	return client, nil
+}
+
+func (r *MQTTRelay) Set(ctx context.Context, on bool) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	client, err := r.connect(ctx)
+	if err != nil {
+		return fmt.Errorf("mqtt relay: %w", err)
+	}
+	msg := &mqtt.Message{
+		Topic:   r.Topic,
+		Payload: r.Off,
+		Retain:  true,
+	}
+	if on {
+		msg.Payload = r.On
+	}
+	if err := client.Publish(msg); err != nil {
+		_ = client.Close()
+		r.client = nil
+		return fmt.Errorf("mqtt relay: %w", err)
+	}
+	return nil
+}
+
+// Close disconnects from the broker.
+func (r *MQTTRelay) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.client == nil {
+		return nil
+	}
+	err := r.client.Close()
+	r.client = nil
+	return err
+}
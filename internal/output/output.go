@@ -0,0 +1,635 @@
+// Package output drives sirens, strobes and chimes.
+//
+// Trips classified as alarms start the alarm pattern on outputs that
+// take it, and trips classified as chimes the chime pattern. An alarm
+// stays on until disarmed, or until the output has been on for MaxOn.
+// After an activation stops, the same pattern is not started again on
+// the output for Cooldown. An alarm replaces a chime, but not the
+// other way around.
+//
+// Escalation steps can sound outputs too, by name. They start the
+// alarm pattern on the output whether or not it takes alarms from
+// trips, and it stops the same way, or when the alert is acknowledged
+// or resolved.
+//
+// Trips and escalation steps processed again after a pipeline.Rewind
+// have already been acted on, and are left alone.
+//
+// Activations are kept in the output_activations table, and the state
+// each output was last driven to in output_states. Outputs are driven
+// concurrently. Drivers that fail are retried with exponential
+// backoff, without failing Run; a siren that cannot be reached must
+// not stop the rest of the system, or hold up the other outputs.
+package output
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"crawshaw.io/sqlite"
+	"crawshaw.io/sqlite/sqlitex"
+	"eagain.net/go/securityblanket/internal/catchup"
+	"eagain.net/go/securityblanket/internal/database"
+	"eagain.net/go/securityblanket/internal/pipeline"
+	"go.uber.org/zap"
+)
+
+// Driver switches a physical output on or off.
+type Driver interface {
+	Set(ctx context.Context, on bool) error
+}
+
+const (
+	PatternChime = "chime"
+	PatternAlarm = "alarm"
+)
+
+// chimePulses are the alternating on and off times of the chime
+// pattern, starting with on.
+var chimePulses = []time.Duration{
+	300 * time.Millisecond,
+	200 * time.Millisecond,
+	300 * time.Millisecond,
+}
+
+func chimeLength() time.Duration {
+	var total time.Duration
+	for _, d := range chimePulses {
+		total += d
+	}
+	return total
+}
+
+// isOn reports whether pattern has the output on, elapsed time after
+// it started.
+func isOn(pattern string, elapsed time.Duration) bool {
+	if pattern != PatternChime {
+		return true
+	}
+	on := true
+	for _, d := range chimePulses {
+		if elapsed < d {
+			return on
+		}
+		elapsed -= d
+		on = !on
+	}
+	return false
+}
+
+// DefaultMaxOn is the longest an alarm keeps an output on, unless
+// Output.MaxOn says otherwise.
+const DefaultMaxOn = 5 * time.Minute
+
+// Output is a siren, strobe, chime or such.
+type Output struct {
+	Name   string
+	Driver Driver
+	// Patterns lists the patterns the output is used for,
+	// PatternChime and PatternAlarm.
+	Patterns []string
+	// MaxOn limits how long an alarm keeps the output on. Zero means
+	// DefaultMaxOn.
+	MaxOn time.Duration
+	// Cooldown is the minimum time between the end of an activation
+	// and the start of another one with the same pattern.
+	Cooldown time.Duration
+}
+
+func (o *Output) takes(pattern string) bool {
+	for _, p := range o.Patterns {
+		if p == pattern {
+			return true
+		}
+	}
+	return false
+}
+
+func (o *Output) length(pattern string) time.Duration {
+	if pattern == PatternChime {
+		return chimeLength()
+	}
+	if o.MaxOn == 0 {
+		return DefaultMaxOn
+	}
+	return o.MaxOn
+}
+
+// driveTimeout limits how long a single driver call can take. The
+// chime pattern waits for the slowest output, so this is short.
+const driveTimeout = 2 * time.Second
+
+type config struct {
+	clock      func() time.Time
+	minBackoff time.Duration
+	maxBackoff time.Duration
+}
+
+type Option option
+
+type option func(*config)
+
+// Clock overrides the source of time used for driving the outputs.
+func Clock(clock func() time.Time) Option {
+	fn := func(conf *config) {
+		conf.clock = clock
+	}
+	return fn
+}
+
+// Backoff sets the delay before retrying an output after its first
+// failure, and the longest delay it can double up to.
+func Backoff(min, max time.Duration) Option {
+	fn := func(conf *config) {
+		conf.minBackoff = min
+		conf.maxBackoff = max
+	}
+	return fn
+}
+
+// failure is an output whose driver failed.
+type failure struct {
+	count int
+	// next is when to try again
+	next time.Time
+}
+
+// Controller starts activations for classified trips and escalation
+// steps, and drives the outputs accordingly.
+//
+// Patterns change the outputs as time passes, so Run needs to be
+// called frequently; the chime pattern needs a tenth of a second.
+type Controller struct {
+	ctx     context.Context
+	db      *database.DB
+	catchup *catchup.Catchup
+	// escalations reads the outputs sounded by escalation steps
+	escalations *catchup.Catchup
+	log         *zap.Logger
+	outputs     []*Output
+	// state each output was last driven to; missing is unknown
+	driven map[string]bool
+	// outputs whose driver failed last time, by name
+	failed map[string]*failure
+	config config
+}
+
+func New(ctx context.Context, db *database.DB, log *zap.Logger, outputs []*Output, opts ...Option) *Controller {
+	c := &Controller{
+		ctx: ctx,
+		db:  db,
+		catchup: catchup.New(&catchup.Config{
+			DB:      db,
+			Log:     log.Named("catchup"),
+			Name:    "output",
+			MaxSQL:  fetch_arming_trips_max.Content,
+			NextSQL: fetch_arming_trips.Content,
+		}),
+		escalations: catchup.New(&catchup.Config{
+			DB:      db,
+			Log:     log.Named("catchup"),
+			Name:    "output.escalate",
+			MaxSQL:  fetch_alert_escalation_outputs_max.Content,
+			NextSQL: fetch_alert_escalation_outputs.Content,
+		}),
+		log:     log,
+		outputs: outputs,
+		driven:  make(map[string]bool),
+		failed:  make(map[string]*failure),
+		config: config{
+			clock:      time.Now,
+			minBackoff: time.Second,
+			maxBackoff: time.Minute,
+		},
+	}
+	for _, opt := range opts {
+		opt(&c.config)
+	}
+	return c
+}
+
+// Run starts activations for new trips and escalation steps, stops
+// the ones that are over, and drives the outputs.
+func (c *Controller) Run() error {
+	if err := c.catchup.Run(c.ctx, c.trip); err != nil {
+		return err
+	}
+	if err := c.escalations.Run(c.ctx, c.escalate); err != nil {
+		return err
+	}
+	want, err := c.update()
+	if err != nil {
+		return fmt.Errorf("output: %w", err)
+	}
+	if err := c.drive(want); err != nil {
+		return fmt.Errorf("output: %w", err)
+	}
+	return nil
+}
+
+type activation struct {
+	id      int64
+	output  string
+	pattern string
+	started time.Time
+	until   time.Time
+	stopped time.Time
+}
+
+func latest(conn *sqlite.Conn, output string) (*activation, error) {
+	stmt := fetch_output_activation_latest.Prep(conn)
+	defer stmt.Finalize()
+	stmt.SetText("@output", output)
+	hasRow, err := stmt.Step()
+	if err != nil {
+		return nil, fmt.Errorf("error fetching output activations: %w", err)
+	}
+	if !hasRow {
+		return nil, nil
+	}
+	a := &activation{
+		id:      stmt.GetInt64("id"),
+		output:  output,
+		pattern: stmt.GetText("pattern"),
+	}
+	if a.started, err = database.GetTime(stmt, "started"); err != nil {
+		return nil, err
+	}
+	if a.until, err = database.GetTime(stmt, "until"); err != nil {
+		return nil, err
+	}
+	if a.stopped, err = database.GetTime(stmt, "stopped"); err != nil {
+		return nil, err
+	}
+	if err := database.NoMoreRows(stmt); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+func stop(conn *sqlite.Conn, id int64, t time.Time, reason string) error {
+	stmt := update_output_activation_stopped.Prep(conn)
+	defer stmt.Finalize()
+	stmt.SetInt64("@id", id)
+	database.BindTime(stmt, "@stopped", t)
+	stmt.SetText("@reason", reason)
+	if _, err := stmt.Step(); err != nil {
+		return fmt.Errorf("stop output activation: %d: %w", id, err)
+	}
+	return nil
+}
+
+func (c *Controller) trip(conn *sqlite.Conn, stmt *sqlite.Stmt) error {
+	tripID := stmt.GetInt64("id")
+	var pattern string
+	switch stmt.GetText("action") {
+	case "alarm":
+		pattern = PatternAlarm
+	case "chime":
+		pattern = PatternChime
+	default:
+		return nil
+	}
+	t, err := database.GetTime(stmt, "time")
+	if err != nil {
+		return fmt.Errorf("bad trip time: %d: %w", tripID, err)
+	}
+	replayed, err := pipeline.Replayed(conn, "output", t)
+	if err != nil {
+		return err
+	}
+	if replayed {
+		c.log.Info("replayed", zap.Int64("trip", tripID))
+		return nil
+	}
+
+	for _, o := range c.outputs {
+		if !o.takes(pattern) {
+			continue
+		}
+		log := c.log.With(
+			zap.String("output", o.Name),
+			zap.String("pattern", pattern),
+			zap.Int64("trip", tripID),
+		)
+		if err := activate(conn, log, o, pattern, t, cause{trip: tripID}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *Controller) escalate(conn *sqlite.Conn, stmt *sqlite.Stmt) error {
+	id := stmt.GetInt64("id")
+	name := stmt.GetText("output")
+	t, err := database.GetTime(stmt, "time")
+	if err != nil {
+		return fmt.Errorf("bad escalation output time: %d: %w", id, err)
+	}
+	replayed, err := pipeline.Replayed(conn, "output.escalate", t)
+	if err != nil {
+		return err
+	}
+	if replayed {
+		c.log.Info("replayed", zap.Int64("escalation", id))
+		return nil
+	}
+	log := c.log.With(
+		zap.String("output", name),
+		zap.String("pattern", PatternAlarm),
+		zap.Int64("alert", stmt.GetInt64("alert")),
+	)
+	var o *Output
+	for _, candidate := range c.outputs {
+		if candidate.Name == name {
+			o = candidate
+			break
+		}
+	}
+	if o == nil {
+		// removed from the site configuration since
+		log.Warn("output.unknown")
+		return nil
+	}
+	return activate(conn, log, o, PatternAlarm, t, cause{escalation: id})
+}
+
+// cause is the trip or escalation step starting an activation.
+type cause struct {
+	trip       int64
+	escalation int64
+}
+
+// activate starts pattern on o at t, unless the output is already busy
+// with the same or more important, or cooling down.
+func activate(conn *sqlite.Conn, log *zap.Logger, o *Output, pattern string, t time.Time, why cause) error {
+	prev, err := latest(conn, o.Name)
+	if err != nil {
+		return err
+	}
+	if prev != nil && prev.stopped.IsZero() && !t.Before(prev.until) {
+		// over, but not yet stopped by update
+		if err := stop(conn, prev.id, prev.until, "finished"); err != nil {
+			return err
+		}
+		prev.stopped = prev.until
+	}
+	if prev != nil && prev.stopped.IsZero() {
+		if prev.pattern == PatternAlarm || prev.pattern == pattern {
+			// already busy with the same or more important
+			return nil
+		}
+		if err := stop(conn, prev.id, t, "replaced"); err != nil {
+			return err
+		}
+		prev = nil
+	}
+	if prev != nil && prev.pattern == pattern && t.Before(prev.stopped.Add(o.Cooldown)) {
+		log.Info("cooldown")
+		return nil
+	}
+
+	if err := start(conn, o, pattern, t, why); err != nil {
+		return err
+	}
+	log.Info("start")
+	return nil
+}
+
+func start(conn *sqlite.Conn, o *Output, pattern string, t time.Time, why cause) error {
+	stmt := insert_output_activation.Prep(conn)
+	defer stmt.Finalize()
+	stmt.SetText("@output", o.Name)
+	stmt.SetText("@pattern", pattern)
+	bindID(stmt, "@trip", why.trip)
+	bindID(stmt, "@escalation", why.escalation)
+	database.BindTime(stmt, "@started", t)
+	database.BindTime(stmt, "@until", t.Add(o.length(pattern)))
+	if _, err := stmt.Step(); err != nil {
+		return fmt.Errorf("add output activation: %s: %w", o.Name, err)
+	}
+	return nil
+}
+
+// bindID binds id, or NULL for 0.
+func bindID(stmt *sqlite.Stmt, param string, id int64) {
+	if id == 0 {
+		stmt.SetNull(param)
+		return
+	}
+	stmt.SetInt64(param, id)
+}
+
+// update stops the activations that are over, and returns which
+// outputs should be on.
+func (c *Controller) update() (want map[string]bool, err error) {
+	conn := c.db.Get(c.ctx)
+	if conn == nil {
+		return nil, context.Canceled
+	}
+	defer c.db.Put(conn)
+	defer sqlitex.Save(conn)(&err)
+
+	now := c.config.clock()
+
+	var disarmed time.Time
+	{
+		stmt := fetch_arming_change_latest.Prep(conn)
+		defer stmt.Finalize()
+		hasRow, err := stmt.Step()
+		if err != nil {
+			return nil, fmt.Errorf("error fetching arming mode: %w", err)
+		}
+		if hasRow && stmt.GetText("mode") == "disarmed" {
+			if disarmed, err = database.GetTime(stmt, "time"); err != nil {
+				return nil, err
+			}
+		}
+		if err := stmt.Reset(); err != nil {
+			return nil, err
+		}
+	}
+
+	type active struct {
+		*activation
+		// when the alert escalated to it was handled, and how
+		handled time.Time
+		reason  string
+	}
+	var actives []active
+	{
+		stmt := fetch_output_activations_active.Prep(conn)
+		defer stmt.Finalize()
+		for {
+			hasRow, err := stmt.Step()
+			if err != nil {
+				return nil, fmt.Errorf("error fetching output activations: %w", err)
+			}
+			if !hasRow {
+				break
+			}
+			a := &activation{
+				id:      stmt.GetInt64("id"),
+				output:  stmt.GetText("output"),
+				pattern: stmt.GetText("pattern"),
+			}
+			if a.started, err = database.GetTime(stmt, "started"); err != nil {
+				return nil, err
+			}
+			if a.until, err = database.GetTime(stmt, "until"); err != nil {
+				return nil, err
+			}
+			act := active{activation: a}
+			for _, reason := range []string{"acknowledged", "resolved"} {
+				t, err := database.GetTime(stmt, reason)
+				if err != nil {
+					return nil, err
+				}
+				if !t.IsZero() && (act.handled.IsZero() || t.Before(act.handled)) {
+					act.handled = t
+					act.reason = reason
+				}
+			}
+			actives = append(actives, act)
+		}
+	}
+
+	want = make(map[string]bool)
+	for _, a := range actives {
+		switch {
+		case !a.handled.IsZero():
+			t := a.handled
+			if t.Before(a.started) {
+				t = a.started
+			}
+			if err := stop(conn, a.id, t, a.reason); err != nil {
+				return nil, err
+			}
+			c.log.Info("stop", zap.String("output", a.output), zap.String("reason", a.reason))
+		case !disarmed.IsZero() && disarmed.After(a.started):
+			if err := stop(conn, a.id, disarmed, "disarmed"); err != nil {
+				return nil, err
+			}
+			c.log.Info("stop", zap.String("output", a.output), zap.String("reason", "disarmed"))
+		case !now.Before(a.until):
+			if err := stop(conn, a.id, a.until, "finished"); err != nil {
+				return nil, err
+			}
+			c.log.Info("stop", zap.String("output", a.output), zap.String("reason", "finished"))
+		default:
+			if now.Before(a.started) {
+				continue
+			}
+			want[a.output] = isOn(a.pattern, now.Sub(a.started))
+		}
+	}
+	return want, nil
+}
+
+// drive sets the outputs that are not known to be in the wanted state
+// already, concurrently. Failures are logged and recorded, and retried
+// after a backoff.
+func (c *Controller) drive(want map[string]bool) error {
+	type set struct {
+		output *Output
+		on     bool
+		err    error
+	}
+	now := c.config.clock()
+	var sets []*set
+	for _, o := range c.outputs {
+		on := want[o.Name]
+		if prev, ok := c.driven[o.Name]; ok && prev == on {
+			continue
+		}
+		if f, ok := c.failed[o.Name]; ok && now.Before(f.next) {
+			continue
+		}
+		sets = append(sets, &set{output: o, on: on})
+	}
+
+	var wg sync.WaitGroup
+	for _, s := range sets {
+		wg.Add(1)
+		go func(s *set) {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(c.ctx, driveTimeout)
+			defer cancel()
+			s.err = s.output.Driver.Set(ctx, s.on)
+		}(s)
+	}
+	wg.Wait()
+	if c.ctx.Err() != nil {
+		return c.ctx.Err()
+	}
+
+	now = c.config.clock()
+	for _, s := range sets {
+		name := s.output.Name
+		if s.err != nil {
+			delete(c.driven, name)
+			f, ok := c.failed[name]
+			if !ok {
+				f = &failure{}
+				c.failed[name] = f
+			}
+			f.count++
+			delay := c.backoff(f.count)
+			f.next = now.Add(delay)
+			c.log.Warn("drive.failed",
+				zap.String("output", name),
+				zap.Bool("on", s.on),
+				zap.Int("failures", f.count),
+				zap.Duration("retry", delay),
+				zap.Error(s.err),
+			)
+		} else {
+			c.driven[name] = s.on
+			delete(c.failed, name)
+			c.log.Info("drive", zap.String("output", name), zap.Bool("on", s.on))
+		}
+		if err := c.record(name, s.on, now, s.err); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// backoff returns how long to wait after the given number of failures
+// in a row.
+func (c *Controller) backoff(failures int) time.Duration {
+	delay := c.config.minBackoff
+	for i := 1; i < failures && delay < c.config.maxBackoff; i++ {
+		delay *= 2
+	}
+	if delay > c.config.maxBackoff {
+		delay = c.config.maxBackoff
+	}
+	return delay
+}
+
+func (c *Controller) record(output string, on bool, now time.Time, driveErr error) error {
+	conn := c.db.Get(c.ctx)
+	if conn == nil {
+		return context.Canceled
+	}
+	defer c.db.Put(conn)
+
+	var stmt *sqlite.Stmt
+	if driveErr != nil {
+		stmt = upsert_output_state_error.Prep(conn)
+		stmt.SetText("@error", driveErr.Error())
+	} else {
+		stmt = upsert_output_state.Prep(conn)
+		stmt.SetBool("@isOn", on)
+	}
+	defer stmt.Finalize()
+	stmt.SetText("@output", output)
+	database.BindTime(stmt, "@changed", now)
+	if _, err := stmt.Step(); err != nil {
+		return fmt.Errorf("record output state: %s: %w", output, err)
+	}
+	return nil
+}
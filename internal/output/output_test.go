@@ -0,0 +1,599 @@
+package output_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"crawshaw.io/sqlite"
+	"crawshaw.io/sqlite/sqlitex"
+	"eagain.net/go/securityblanket/internal/database"
+	"eagain.net/go/securityblanket/internal/mqtt/mqtttest"
+	"eagain.net/go/securityblanket/internal/output"
+	"github.com/google/go-cmp/cmp"
+	"go.uber.org/zap/zaptest"
+)
+
+func execScript(t testing.TB, db *database.DB, sql string) {
+	conn := db.Get(nil)
+	defer db.Put(conn)
+
+	if err := sqlitex.ExecScript(conn, sql); err != nil {
+		t.Fatalf("database error: %v", err)
+	}
+}
+
+var start = time.Date(2020, 2, 3, 4, 5, 6, 0, time.UTC)
+
+func at(d time.Duration) string {
+	return start.Add(d).Format(time.RFC3339Nano)
+}
+
+// trip adds a trip of the front door at start+d, classified as action.
+func trip(t testing.TB, db *database.DB, id int, d time.Duration, action string) {
+	execScript(t, db, fmt.Sprintf(`
+INSERT INTO honeywell5800_updates(id, time, channel, sensor, event)
+VALUES (%[1]d, '%[2]s', 8, 1, 0);
+
+INSERT INTO honeywell5800_trips(id, sensor, loop, trippedBy)
+VALUES (%[1]d, 1, 1, %[1]d);
+
+INSERT INTO arming_trips(trip, mode, action)
+VALUES (%[1]d, 'away', '%[3]s');
+`, id, at(d), action))
+}
+
+func setup(t testing.TB, db *database.DB) {
+	execScript(t, db, `
+INSERT INTO honeywell5800_sensors(id, model, description)
+VALUES (1, '5800MINI', 'front door');
+`)
+}
+
+// fake records the states it is driven to.
+type fake struct {
+	states []bool
+	err    error
+	calls  int
+}
+
+func (f *fake) Set(ctx context.Context, on bool) error {
+	f.calls++
+	if f.err != nil {
+		return f.err
+	}
+	f.states = append(f.states, on)
+	return nil
+}
+
+type activation struct {
+	Output  string
+	Pattern string
+	Started string
+	Stopped string
+	Reason  string
+}
+
+func activations(t testing.TB, db *database.DB) []activation {
+	conn := db.Get(nil)
+	defer db.Put(conn)
+	var got []activation
+	fn := func(stmt *sqlite.Stmt) error {
+		got = append(got, activation{
+			Output:  stmt.GetText("output"),
+			Pattern: stmt.GetText("pattern"),
+			Started: stmt.GetText("started"),
+			Stopped: stmt.GetText("stopped"),
+			Reason:  stmt.GetText("stopReason"),
+		})
+		return nil
+	}
+	const query = `SELECT output, pattern, started, stopped, stopReason FROM output_activations ORDER BY id`
+	if err := sqlitex.Exec(conn, query, fn); err != nil {
+		t.Fatalf("database error: %v", err)
+	}
+	return got
+}
+
+func TestAlarm(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	db := database.Scratch()
+	defer db.Close()
+	setup(t, db)
+
+	log := zaptest.NewLogger(t)
+	now := start
+	siren := &fake{}
+	outputs := []*output.Output{
+		{
+			Name:     "siren",
+			Driver:   siren,
+			Patterns: []string{output.PatternAlarm},
+			MaxOn:    2 * time.Minute,
+			Cooldown: time.Minute,
+		},
+	}
+	c := output.New(ctx, db, log, outputs,
+		output.Clock(func() time.Time { return now }),
+	)
+	run := func(d time.Duration) {
+		t.Helper()
+		now = start.Add(d)
+		if err := c.Run(); err != nil {
+			t.Fatalf("run: %v", err)
+		}
+	}
+
+	// the state is not known at startup
+	run(0)
+	// chimes do not sound the siren
+	trip(t, db, 1, time.Second, "chime")
+	run(time.Second)
+	trip(t, db, 2, 2*time.Second, "alarm")
+	run(2 * time.Second)
+	run(time.Minute)
+	// on for at most MaxOn
+	run(3 * time.Minute)
+	// cooldown
+	trip(t, db, 3, 2*time.Minute+30*time.Second, "alarm")
+	run(3*time.Minute + 30*time.Second)
+	trip(t, db, 4, 4*time.Minute, "alarm")
+	run(4 * time.Minute)
+	execScript(t, db, fmt.Sprintf(`
+INSERT INTO arming_changes(time, mode, changedBy)
+VALUES ('%s', 'disarmed', 'test');
+`, at(5*time.Minute)))
+	run(5 * time.Minute)
+
+	if diff := cmp.Diff([]bool{false, true, false, true, false}, siren.states); diff != "" {
+		t.Errorf("wrong states: -want +got\n%s", diff)
+	}
+	want := []activation{
+		{"siren", "alarm", at(2 * time.Second), at(2*time.Minute + 2*time.Second), "finished"},
+		{"siren", "alarm", at(4 * time.Minute), at(5 * time.Minute), "disarmed"},
+	}
+	if diff := cmp.Diff(want, activations(t, db)); diff != "" {
+		t.Errorf("wrong activations: -want +got\n%s", diff)
+	}
+}
+
+func TestChime(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	db := database.Scratch()
+	defer db.Close()
+	setup(t, db)
+
+	log := zaptest.NewLogger(t)
+	now := start
+	buzzer := &fake{}
+	outputs := []*output.Output{
+		{
+			Name:     "buzzer",
+			Driver:   buzzer,
+			Patterns: []string{output.PatternChime, output.PatternAlarm},
+		},
+	}
+	c := output.New(ctx, db, log, outputs,
+		output.Clock(func() time.Time { return now }),
+	)
+	run := func(d time.Duration) {
+		t.Helper()
+		now = start.Add(d)
+		if err := c.Run(); err != nil {
+			t.Fatalf("run: %v", err)
+		}
+	}
+
+	trip(t, db, 1, 0, "chime")
+	for d := time.Duration(0); d <= time.Second; d += 100 * time.Millisecond {
+		run(d)
+	}
+	// an alarm replaces a chime
+	trip(t, db, 2, 2*time.Second, "chime")
+	run(2 * time.Second)
+	trip(t, db, 3, 2*time.Second+100*time.Millisecond, "alarm")
+	run(2*time.Second + 600*time.Millisecond)
+	// a chime does not interrupt an alarm
+	trip(t, db, 4, 3*time.Second, "chime")
+	run(3*time.Second + 400*time.Millisecond)
+
+	if diff := cmp.Diff([]bool{true, false, true, false, true}, buzzer.states); diff != "" {
+		t.Errorf("wrong states: -want +got\n%s", diff)
+	}
+	want := []activation{
+		{"buzzer", "chime", at(0), at(800 * time.Millisecond), "finished"},
+		{"buzzer", "chime", at(2 * time.Second), at(2*time.Second + 100*time.Millisecond), "replaced"},
+		{"buzzer", "alarm", at(2*time.Second + 100*time.Millisecond), "", ""},
+	}
+	if diff := cmp.Diff(want, activations(t, db)); diff != "" {
+		t.Errorf("wrong activations: -want +got\n%s", diff)
+	}
+}
+
+func TestEscalation(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	db := database.Scratch()
+	defer db.Close()
+	setup(t, db)
+
+	log := zaptest.NewLogger(t)
+	now := start
+	siren := &fake{}
+	outputs := []*output.Output{
+		{
+			// trips only chime, but an escalation step names it
+			Name:     "siren",
+			Driver:   siren,
+			Patterns: []string{output.PatternChime},
+		},
+	}
+	c := output.New(ctx, db, log, outputs,
+		output.Clock(func() time.Time { return now }),
+	)
+	run := func(d time.Duration) {
+		t.Helper()
+		now = start.Add(d)
+		if err := c.Run(); err != nil {
+			t.Fatalf("run: %v", err)
+		}
+	}
+
+	// outputs removed from the configuration are ignored
+	execScript(t, db, fmt.Sprintf(`
+INSERT INTO alerts(id, source, sensor, loop, severity, summary, raised, lastSeen)
+VALUES (1, 'trip', 1, 1, 'alarm', 'test', '%[1]s', '%[1]s');
+
+INSERT INTO alert_escalations(alert, policy, step, due)
+VALUES (1, 'p', 1, '%[1]s');
+
+INSERT INTO alert_escalation_outputs(alert, step, output, time) VALUES
+	(1, 0, 'gone', '%[2]s'),
+	(1, 0, 'siren', '%[2]s');
+`, at(0), at(time.Minute)))
+	run(time.Minute)
+	execScript(t, db, fmt.Sprintf(`
+INSERT INTO arming_changes(time, mode, changedBy)
+VALUES ('%s', 'disarmed', 'test');
+`, at(2*time.Minute)))
+	run(2 * time.Minute)
+
+	if diff := cmp.Diff([]bool{true, false}, siren.states); diff != "" {
+		t.Errorf("wrong states: -want +got\n%s", diff)
+	}
+	want := []activation{
+		{"siren", "alarm", at(time.Minute), at(2 * time.Minute), "disarmed"},
+	}
+	if diff := cmp.Diff(want, activations(t, db)); diff != "" {
+		t.Errorf("wrong activations: -want +got\n%s", diff)
+	}
+}
+
+func TestEscalationHandled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	db := database.Scratch()
+	defer db.Close()
+	setup(t, db)
+
+	log := zaptest.NewLogger(t)
+	now := start
+	siren := &fake{}
+	strobe := &fake{}
+	outputs := []*output.Output{
+		{Name: "siren", Driver: siren},
+		{Name: "strobe", Driver: strobe},
+	}
+	c := output.New(ctx, db, log, outputs,
+		output.Clock(func() time.Time { return now }),
+	)
+	run := func(d time.Duration) {
+		t.Helper()
+		now = start.Add(d)
+		if err := c.Run(); err != nil {
+			t.Fatalf("run: %v", err)
+		}
+	}
+
+	execScript(t, db, fmt.Sprintf(`
+INSERT INTO alerts(id, source, sensor, loop, severity, summary, raised, lastSeen)
+VALUES
+	(1, 'trip', 1, 1, 'alarm', 'test', '%[1]s', '%[1]s'),
+	(2, 'trip', 1, 2, 'alarm', 'test', '%[1]s', '%[1]s');
+
+INSERT INTO alert_escalations(alert, policy, step, due)
+VALUES (1, 'p', 1, '%[1]s'), (2, 'p', 1, '%[1]s');
+
+INSERT INTO alert_escalation_outputs(alert, step, output, time) VALUES
+	(1, 0, 'siren', '%[2]s'),
+	(2, 0, 'strobe', '%[2]s');
+`, at(0), at(time.Minute)))
+	run(time.Minute)
+
+	// someone is on it, while the system is still armed
+	execScript(t, db, fmt.Sprintf(`
+UPDATE alerts SET acknowledged='%[1]s', acknowledgedBy='test' WHERE id=1;
+UPDATE alerts SET resolved='%[2]s' WHERE id=2;
+`, at(2*time.Minute), at(3*time.Minute)))
+	run(3 * time.Minute)
+
+	if diff := cmp.Diff([]bool{true, false}, siren.states); diff != "" {
+		t.Errorf("wrong siren states: -want +got\n%s", diff)
+	}
+	if diff := cmp.Diff([]bool{true, false}, strobe.states); diff != "" {
+		t.Errorf("wrong strobe states: -want +got\n%s", diff)
+	}
+	want := []activation{
+		{"siren", "alarm", at(time.Minute), at(2 * time.Minute), "acknowledged"},
+		{"strobe", "alarm", at(time.Minute), at(3 * time.Minute), "resolved"},
+	}
+	if diff := cmp.Diff(want, activations(t, db)); diff != "" {
+		t.Errorf("wrong activations: -want +got\n%s", diff)
+	}
+}
+
+func TestDriverFailure(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	db := database.Scratch()
+	defer db.Close()
+	setup(t, db)
+
+	log := zaptest.NewLogger(t)
+	now := start
+	siren := &fake{err: errors.New("unplugged")}
+	outputs := []*output.Output{
+		{Name: "siren", Driver: siren, Patterns: []string{output.PatternAlarm}},
+	}
+	c := output.New(ctx, db, log, outputs,
+		output.Clock(func() time.Time { return now }),
+	)
+	trip(t, db, 1, 0, "alarm")
+	if err := c.Run(); err != nil {
+		t.Fatalf("run: %v", err)
+	}
+	state := func() (isOn bool, lastError string) {
+		conn := db.Get(nil)
+		defer db.Put(conn)
+		fn := func(stmt *sqlite.Stmt) error {
+			isOn = stmt.GetInt64("isOn") != 0
+			lastError = stmt.GetText("lastError")
+			return nil
+		}
+		if err := sqlitex.Exec(conn, `SELECT isOn, lastError FROM output_states WHERE output='siren'`, fn); err != nil {
+			t.Fatalf("database error: %v", err)
+		}
+		return isOn, lastError
+	}
+	if isOn, lastError := state(); isOn || lastError != "unplugged" {
+		t.Errorf("wrong state after failure: %v %q", isOn, lastError)
+	}
+
+	siren.err = nil
+	now = start.Add(time.Second)
+	if err := c.Run(); err != nil {
+		t.Fatalf("run: %v", err)
+	}
+	if diff := cmp.Diff([]bool{true}, siren.states); diff != "" {
+		t.Errorf("wrong states: -want +got\n%s", diff)
+	}
+	if isOn, lastError := state(); !isOn || lastError != "" {
+		t.Errorf("wrong state after retry: %v %q", isOn, lastError)
+	}
+}
+
+func TestDriverBackoff(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	db := database.Scratch()
+	defer db.Close()
+	setup(t, db)
+
+	log := zaptest.NewLogger(t)
+	now := start
+	siren := &fake{err: errors.New("unplugged")}
+	strobe := &fake{}
+	outputs := []*output.Output{
+		{Name: "siren", Driver: siren, Patterns: []string{output.PatternAlarm}},
+		{Name: "strobe", Driver: strobe, Patterns: []string{output.PatternAlarm}},
+	}
+	c := output.New(ctx, db, log, outputs,
+		output.Clock(func() time.Time { return now }),
+		output.Backoff(time.Second, 10*time.Second),
+	)
+	trip(t, db, 1, 0, "alarm")
+	for _, step := range []struct {
+		d     time.Duration
+		calls int
+	}{
+		{0, 1},
+		{500 * time.Millisecond, 1},
+		{time.Second, 2},
+		// backoff doubled
+		{2 * time.Second, 2},
+		{3 * time.Second, 3},
+	} {
+		now = start.Add(step.d)
+		if err := c.Run(); err != nil {
+			t.Fatalf("run: %v", err)
+		}
+		if g, e := siren.calls, step.calls; g != e {
+			t.Errorf("wrong number of attempts at %v: %d != %d", step.d, g, e)
+		}
+	}
+	if diff := cmp.Diff([]bool{true}, strobe.states); diff != "" {
+		t.Errorf("failing siren held up the strobe: -want +got\n%s", diff)
+	}
+}
+
+// waiter is driven only once other is being driven too.
+type waiter struct {
+	other <-chan struct{}
+	err   error
+}
+
+func (w *waiter) Set(ctx context.Context, on bool) error {
+	select {
+	case <-ctx.Done():
+		w.err = ctx.Err()
+		return w.err
+	case <-w.other:
+		return nil
+	}
+}
+
+// signal closes ch when driven.
+type signal struct {
+	ch chan struct{}
+}
+
+func (s *signal) Set(ctx context.Context, on bool) error {
+	close(s.ch)
+	return nil
+}
+
+func TestDriveConcurrently(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	db := database.Scratch()
+	defer db.Close()
+	setup(t, db)
+
+	log := zaptest.NewLogger(t)
+	now := start
+	ch := make(chan struct{})
+	slow := &waiter{other: ch}
+	outputs := []*output.Output{
+		{Name: "slow", Driver: slow, Patterns: []string{output.PatternAlarm}},
+		{Name: "fast", Driver: &signal{ch: ch}, Patterns: []string{output.PatternAlarm}},
+	}
+	c := output.New(ctx, db, log, outputs,
+		output.Clock(func() time.Time { return now }),
+	)
+	trip(t, db, 1, 0, "alarm")
+	if err := c.Run(); err != nil {
+		t.Fatalf("run: %v", err)
+	}
+	if slow.err != nil {
+		t.Errorf("outputs were driven one at a time: %v", slow.err)
+	}
+}
+
+func TestHTTPRelay(t *testing.T) {
+	var mu sync.Mutex
+	var got []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		got = append(got, req.URL.RequestURI())
+		mu.Unlock()
+		if req.URL.Query().Get("fail") != "" {
+			http.Error(w, "nope", http.StatusInternalServerError)
+		}
+	}))
+	defer srv.Close()
+
+	ctx := context.Background()
+	r := &output.HTTPRelay{
+		OnURL:  srv.URL + "/relay?state=1",
+		OffURL: srv.URL + "/relay?state=0",
+	}
+	if err := r.Set(ctx, true); err != nil {
+		t.Fatalf("on: %v", err)
+	}
+	if err := r.Set(ctx, false); err != nil {
+		t.Fatalf("off: %v", err)
+	}
+	r.OnURL = srv.URL + "/relay?fail=1"
+	if err := r.Set(ctx, true); err == nil {
+		t.Error("expected an error from a failing relay")
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	want := []string{"/relay?state=1", "/relay?state=0", "/relay?fail=1"}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("wrong requests: -want +got\n%s", diff)
+	}
+}
+
+func TestMQTTRelay(t *testing.T) {
+	broker := mqtttest.NewBroker()
+	defer broker.Close()
+
+	ctx := context.Background()
+	r := &output.MQTTRelay{
+		Addr:  broker.Addr,
+		Topic: "cmnd/siren/POWER",
+		On:    []byte("ON"),
+		Off:   []byte("OFF"),
+	}
+	r.Config.ClientID = "test"
+	defer r.Close()
+	if err := r.Set(ctx, true); err != nil {
+		t.Fatalf("on: %v", err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for broker.Retained(r.Topic) == nil {
+		if time.Now().After(deadline) {
+			t.Fatal("on never arrived")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	// reconnects after losing the broker
+	broker.DisconnectAll()
+	deadline = time.Now().Add(5 * time.Second)
+	for {
+		err := r.Set(ctx, false)
+		if err == nil && broker.Retained(r.Topic) != nil && string(broker.Retained(r.Topic).Payload) == "OFF" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("off never arrived: %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	var payloads []string
+	for _, msg := range broker.Published() {
+		if msg.Topic != r.Topic || !msg.Retain {
+			t.Errorf("unexpected message: %+v", msg)
+		}
+		payloads = append(payloads, string(msg.Payload))
+	}
+	if len(payloads) == 0 || payloads[0] != "ON" {
+		t.Errorf("wrong messages: %q", payloads)
+	}
+}
+
+// TestGPIO drives a line of a simulated chip, as set up with the
+// gpio-sim kernel module. Set SECURITYBLANKET_TEST_GPIOCHIP to the
+// path of the chip to run it.
+func TestGPIO(t *testing.T) {
+	chip := os.Getenv("SECURITYBLANKET_TEST_GPIOCHIP")
+	if chip == "" {
+		t.Skip("SECURITYBLANKET_TEST_GPIOCHIP not set")
+	}
+	line := uint64(0)
+	if s := os.Getenv("SECURITYBLANKET_TEST_GPIOLINE"); s != "" {
+		var err error
+		line, err = strconv.ParseUint(s, 10, 32)
+		if err != nil {
+			t.Fatalf("bad SECURITYBLANKET_TEST_GPIOLINE: %v", err)
+		}
+	}
+	g := &output.GPIO{Chip: chip, Line: uint32(line)}
+	defer g.Close()
+	ctx := context.Background()
+	for _, on := range []bool{true, false, true} {
+		if err := g.Set(ctx, on); err != nil {
+			t.Fatalf("set %v: %v", on, err)
+		}
+	}
+}
@@ -0,0 +1,5 @@
+UPDATE output_activations
+	SET stopped=@stopped,
+		stopReason=@reason
+	WHERE id=@id
+		AND stopped IS NULL
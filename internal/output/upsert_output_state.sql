@@ -0,0 +1,6 @@
+INSERT INTO output_states(output, isOn, changed, lastError)
+	VALUES (@output, @isOn, @changed, NULL)
+	ON CONFLICT(output) DO UPDATE SET
+		isOn=excluded.isOn,
+		changed=excluded.changed,
+		lastError=NULL
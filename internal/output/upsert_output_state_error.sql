@@ -0,0 +1,4 @@
+INSERT INTO output_states(output, isOn, changed, lastError)
+	VALUES (@output, false, @changed, @error)
+	ON CONFLICT(output) DO UPDATE SET
+		lastError=excluded.lastError
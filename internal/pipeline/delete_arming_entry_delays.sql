@@ -0,0 +1,2 @@
+DELETE FROM arming_entry_delays
+	WHERE trip>@last
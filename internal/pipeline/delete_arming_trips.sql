@@ -0,0 +1,2 @@
+DELETE FROM arming_trips
+	WHERE trip>@last
@@ -0,0 +1,2 @@
+DELETE FROM honeywell5800_receptions
+	WHERE raw>@last
@@ -0,0 +1,2 @@
+DELETE FROM honeywell5800_supervision_losses
+	WHERE lastSeen>@last
@@ -0,0 +1,2 @@
+DELETE FROM honeywell5800_trips
+	WHERE trippedBy>@last
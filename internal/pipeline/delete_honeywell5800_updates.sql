@@ -0,0 +1,12 @@
+-- Updates only heard in the raw messages being processed again. An
+-- update also heard earlier by another receiver stays, and is found
+-- again as a duplicate.
+DELETE FROM honeywell5800_updates
+	WHERE id IN (
+		SELECT sensorUpdate FROM honeywell5800_receptions
+			WHERE raw>@last
+	)
+	AND id NOT IN (
+		SELECT sensorUpdate FROM honeywell5800_receptions
+			WHERE raw<=@last
+	)
@@ -0,0 +1,3 @@
+SELECT coalesce(max(id), 0) AS last
+	FROM alert_escalation_outputs
+	WHERE time<@time
@@ -0,0 +1,2 @@
+SELECT min(id) AS min
+	FROM alert_escalation_outputs
@@ -0,0 +1,3 @@
+SELECT coalesce(max(id), 0) AS last
+	FROM alerts
+	WHERE raised<@time
@@ -0,0 +1,7 @@
+SELECT coalesce(max(arming_trips.id), 0) AS last
+	FROM arming_trips
+	JOIN honeywell5800_trips
+	ON (honeywell5800_trips.id=arming_trips.trip)
+	JOIN honeywell5800_updates
+	ON (honeywell5800_updates.id=honeywell5800_trips.trippedBy)
+	WHERE honeywell5800_updates.time<@time
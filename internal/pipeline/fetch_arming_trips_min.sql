@@ -0,0 +1,2 @@
+SELECT min(id) AS min
+	FROM arming_trips
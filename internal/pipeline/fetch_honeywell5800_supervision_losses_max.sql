@@ -0,0 +1,2 @@
+SELECT max(id) AS max
+	FROM honeywell5800_supervision_losses
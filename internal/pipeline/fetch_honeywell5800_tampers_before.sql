@@ -0,0 +1,5 @@
+SELECT coalesce(max(honeywell5800_tampers.id), 0) AS last
+	FROM honeywell5800_tampers
+	JOIN honeywell5800_updates
+	ON (honeywell5800_updates.id=honeywell5800_tampers.openedBy)
+	WHERE honeywell5800_updates.time<@time
@@ -0,0 +1,3 @@
+SELECT coalesce(max(id), 0) AS last
+	FROM honeywell5800_updates
+	WHERE time<@time
@@ -0,0 +1,3 @@
+SELECT rewound
+	FROM pipeline_replays
+	WHERE consumer=@consumer
@@ -0,0 +1,3 @@
+SELECT coalesce(max(id), 0) AS last
+	FROM rfjam_conditions
+	WHERE time<@time
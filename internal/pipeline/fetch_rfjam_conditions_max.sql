@@ -0,0 +1,2 @@
+SELECT max(id) AS max
+	FROM rfjam_conditions
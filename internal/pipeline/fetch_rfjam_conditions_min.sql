@@ -0,0 +1,2 @@
+SELECT min(id) AS min
+	FROM rfjam_conditions
@@ -0,0 +1,3 @@
+SELECT coalesce(max(id), 0) AS last
+	FROM rtl433_raw
+	WHERE time<@time
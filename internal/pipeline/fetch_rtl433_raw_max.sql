@@ -0,0 +1,2 @@
+SELECT max(id) AS max
+	FROM rtl433_raw
@@ -0,0 +1,2 @@
+SELECT min(id) AS min
+	FROM rtl433_raw
@@ -0,0 +1,411 @@
+// Package pipeline describes how rows flow between catchup consumers:
+// the table each consumer reads, and the tables it adds rows to for
+// the consumers after it.
+//
+// A Registry uses that to wake up the readers of a table whenever rows
+// are added to it. Graph shows how far behind each consumer is.
+//
+// Rewind makes a consumer process rows again, for example after fixing
+// the model of a sensor in honeywell5800_site_loops. What the consumer
+// derived from those rows can be cleared first, and everyone
+// downstream is rewound to match. Consumers check Replayed, so events
+// from before the rewind do not notify people again.
+package pipeline
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"crawshaw.io/sqlite"
+	"crawshaw.io/sqlite/sqlitex"
+	"eagain.net/go/securityblanket/internal/catchup"
+	"eagain.net/go/securityblanket/internal/database"
+)
+
+// Stage is a catchup consumer, as a part of the pipeline.
+type Stage struct {
+	// Name is the name of the catchup consumer.
+	Name string
+	// Source is the table the consumer reads.
+	Source string
+	// Outputs are the tables the consumer adds rows to.
+	Outputs []string
+	// clear are run in order to undo what the consumer derived from
+	// source rows with id greater than @last. Stages without them keep
+	// only state that processing the rows again brings up to date, or
+	// history that is not thrown away.
+	clear []sqlAsset
+}
+
+// source is a table consumers read.
+type source struct {
+	// max returns the largest id in the table, as column max.
+	max sqlAsset
+	// min returns the smallest id in the table, as column min.
+	min sqlAsset
+	// before returns the id of the last row older than @time, or 0,
+	// as column last.
+	before sqlAsset
+}
+
+var sources = map[string]source{
+	"rtl433_raw": {
+		max:    fetch_rtl433_raw_max,
+		min:    fetch_rtl433_raw_min,
+		before: fetch_rtl433_raw_before,
+	},
+	"honeywell5800_updates": {
+		max:    fetch_honeywell5800_updates_max,
+		min:    fetch_honeywell5800_updates_min,
+		before: fetch_honeywell5800_updates_before,
+	},
+	"honeywell5800_trips": {
+		max:    fetch_honeywell5800_trips_max,
+		min:    fetch_honeywell5800_trips_min,
+		before: fetch_honeywell5800_trips_before,
+	},
+	"honeywell5800_supervision_losses": {
+		max:    fetch_honeywell5800_supervision_losses_max,
+		min:    fetch_honeywell5800_supervision_losses_min,
+		before: fetch_honeywell5800_supervision_losses_before,
+	},
+	"rfjam_conditions": {
+		max:    fetch_rfjam_conditions_max,
+		min:    fetch_rfjam_conditions_min,
+		before: fetch_rfjam_conditions_before,
+	},
+	"honeywell5800_tampers": {
+		max:    fetch_honeywell5800_tampers_max,
+		min:    fetch_honeywell5800_tampers_min,
+		before: fetch_honeywell5800_tampers_before,
+	},
+	"arming_trips": {
+		max:    fetch_arming_trips_max,
+		min:    fetch_arming_trips_min,
+		before: fetch_arming_trips_before,
+	},
+	"alerts": {
+		max:    fetch_alerts_max,
+		min:    fetch_alerts_min,
+		before: fetch_alerts_before,
+	},
+	"alert_escalation_outputs": {
+		max:    fetch_alert_escalation_outputs_max,
+		min:    fetch_alert_escalation_outputs_min,
+		before: fetch_alert_escalation_outputs_before,
+	},
+}
+
+// stages are in pipeline order: every stage comes after the stages
+// whose outputs it reads.
+var stages = []*Stage{
+	{
+		Name:    "honeywell5800.receive",
+		Source:  "rtl433_raw",
+		Outputs: []string{"honeywell5800_updates", "honeywell5800_receptions"},
+		// Deleting an update deletes whatever refers to it, so what
+		// it closed is reopened first.
+		clear: []sqlAsset{
+			update_honeywell5800_trips_reopened,
+			update_honeywell5800_supervision_losses_reopened,
+			update_honeywell5800_tampers_reopened,
+			delete_honeywell5800_updates,
+			delete_honeywell5800_receptions,
+		},
+	},
+	{
+		Name:    "rfjam.noise",
+		Source:  "rtl433_raw",
+		Outputs: []string{"rfjam_conditions"},
+	},
+	{
+		Name:    "honeywell5800.trip",
+		Source:  "honeywell5800_updates",
+		Outputs: []string{"honeywell5800_trips"},
+		clear: []sqlAsset{
+			delete_honeywell5800_trips,
+			update_honeywell5800_trips_cleared,
+		},
+	},
+	{
+		Name:    "honeywell5800.signal",
+		Source:  "honeywell5800_updates",
+		Outputs: []string{"honeywell5800_signal_stats"},
+	},
+	{
+		Name:    "honeywell5800.supervise",
+		Source:  "honeywell5800_updates",
+		Outputs: []string{"honeywell5800_supervision_losses"},
+		clear: []sqlAsset{
+			delete_honeywell5800_supervision_losses,
+			update_honeywell5800_supervision_losses_restored,
+		},
+	},
+	{
+		Name:    "honeywell5800.battery",
+		Source:  "honeywell5800_updates",
+		Outputs: []string{"honeywell5800_batteries", "honeywell5800_battery_replacements"},
+	},
+	{
+		Name:    "honeywell5800.tamper",
+		Source:  "honeywell5800_updates",
+		Outputs: []string{"honeywell5800_tampers"},
+		clear: []sqlAsset{
+			delete_honeywell5800_tampers,
+			update_honeywell5800_tampers_closed,
+		},
+	},
+	{
+		Name:    "arming.classify",
+		Source:  "honeywell5800_trips",
+		Outputs: []string{"arming_trips", "arming_entry_delays"},
+		clear: []sqlAsset{
+			delete_arming_trips,
+			delete_arming_entry_delays,
+		},
+	},
+	// Alerts, and what came of them, are history people have already
+	// seen.
+	{
+		Name:    "alert.trip",
+		Source:  "arming_trips",
+		Outputs: []string{"alerts", "notify_outbox"},
+	},
+	{
+		Name:    "alert.tamper",
+		Source:  "honeywell5800_tampers",
+		Outputs: []string{"alerts", "notify_outbox"},
+	},
+	{
+		Name:    "alert.supervision",
+		Source:  "honeywell5800_supervision_losses",
+		Outputs: []string{"alerts", "notify_outbox"},
+	},
+	{
+		Name:    "alert.jamming",
+		Source:  "rfjam_conditions",
+		Outputs: []string{"alerts", "notify_outbox"},
+	},
+	{
+		Name:    "output",
+		Source:  "arming_trips",
+		Outputs: []string{"output_activations"},
+	},
+	{
+		Name:    "escalate",
+		Source:  "alerts",
+		Outputs: []string{"alert_escalations", "alert_escalation_notices", "alert_escalation_outputs", "notify_outbox"},
+	},
+	{
+		Name:    "output.escalate",
+		Source:  "alert_escalation_outputs",
+		Outputs: []string{"output_activations"},
+	},
+}
+
+// Stages returns the stages, in pipeline order.
+func Stages() []*Stage {
+	list := make([]*Stage, len(stages))
+	copy(list, stages)
+	return list
+}
+
+func find(name string) (*Stage, error) {
+	for _, s := range stages {
+		if s.Name == name {
+			return s, nil
+		}
+	}
+	names := make([]string, len(stages))
+	for i, s := range stages {
+		names[i] = s.Name
+	}
+	return nil, fmt.Errorf("unknown consumer: %q, known: %s", name, strings.Join(names, ", "))
+}
+
+// downstream returns the stage and everyone reading what it, or
+// someone after it, outputs; in pipeline order.
+func downstream(stage *Stage) []*Stage {
+	tables := make(map[string]bool)
+	list := []*Stage{stage}
+	for _, s := range stages {
+		if s == stage {
+			for _, t := range s.Outputs {
+				tables[t] = true
+			}
+			continue
+		}
+		if !tables[s.Source] {
+			continue
+		}
+		list = append(list, s)
+		for _, t := range s.Outputs {
+			tables[t] = true
+		}
+	}
+	return list
+}
+
+// Seek returns the id of the last row the named consumer reads that
+// is older than t. Rewinding to it processes the rows from t on again.
+func Seek(ctx context.Context, db *database.DB, name string, t time.Time) (int64, error) {
+	stage, err := find(name)
+	if err != nil {
+		return 0, err
+	}
+	conn := db.Get(ctx)
+	if conn == nil {
+		return 0, context.Canceled
+	}
+	defer db.Put(conn)
+
+	stmt := sources[stage.Source].before.Prep(conn)
+	defer stmt.Finalize()
+	database.BindTime(stmt, "@time", t)
+	last, err := sqlitex.ResultInt64(stmt)
+	if err != nil {
+		return 0, fmt.Errorf("seeking %s: %w", stage.Source, err)
+	}
+	return last, nil
+}
+
+// Rewound is a consumer moved back by Rewind.
+type Rewound struct {
+	Name string
+	// From and To are the last processed ids before and after.
+	From int64
+	To   int64
+	// Cleared is how many derived rows were deleted or changed. Rows
+	// deleted by foreign key cascades are not counted.
+	Cleared int64
+}
+
+// Rewind moves the named consumer back to last, so the rows after it
+// are processed again when the consumer next runs. With clear, what
+// it derived from those rows is undone first.
+//
+// Consumers downstream are moved back to the last row of their source
+// that is left, and cleared likewise. Everything happens in one
+// savepoint. The daemon must not be running.
+//
+// Every consumer moved back remembers when, for Replayed.
+//
+// Clearing is refused if retention has already pruned some of the
+// rows after last: what was derived from them could not be rebuilt.
+func Rewind(ctx context.Context, db *database.DB, name string, last int64, clear bool) (rewound []*Rewound, err error) {
+	if last < 0 {
+		return nil, errors.New("cannot rewind to a negative id")
+	}
+	stage, err := find(name)
+	if err != nil {
+		return nil, err
+	}
+	if clear && len(stage.clear) == 0 {
+		return nil, fmt.Errorf("%s: does not support clearing, rewind without it", name)
+	}
+	conn := db.Get(ctx)
+	if conn == nil {
+		return nil, context.Canceled
+	}
+	defer db.Put(conn)
+	defer sqlitex.Save(conn)(&err)
+
+	if clear {
+		if err := checkPruned(conn, stage, last); err != nil {
+			return nil, err
+		}
+	}
+	now := time.Now()
+	for _, s := range downstream(stage) {
+		to := last
+		if s != stage {
+			// whatever upstream cleared is gone from the source
+			max, err := fetchMax(conn, sources[s.Source].max)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", s.Name, err)
+			}
+			to = max
+		}
+		r, err := rewind(conn, s, to, clear, now)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", s.Name, err)
+		}
+		if r != nil {
+			rewound = append(rewound, r)
+		}
+	}
+	return rewound, nil
+}
+
+// checkPruned returns an error if rows after last that stage has
+// processed are gone from its source.
+func checkPruned(conn *sqlite.Conn, stage *Stage, last int64) error {
+	prev, err := catchup.Last(conn, stage.Name)
+	if err != nil {
+		return fmt.Errorf("%s: %w", stage.Name, err)
+	}
+	if prev <= last {
+		return nil
+	}
+	stmt := sources[stage.Source].min.Prep(conn)
+	defer stmt.Finalize()
+	// NULL for an empty table reads as 0
+	min, err := sqlitex.ResultInt64(stmt)
+	if err != nil {
+		return fmt.Errorf("%s: fetching min id: %w", stage.Name, err)
+	}
+	if min == 0 {
+		return fmt.Errorf("%s: rows after %d have been pruned from %s, cannot clear", stage.Name, last, stage.Source)
+	}
+	if last < min-1 {
+		return fmt.Errorf("%s: rows after %d have been pruned from %s, cannot clear before %d", stage.Name, last, stage.Source, min-1)
+	}
+	return nil
+}
+
+func fetchMax(conn *sqlite.Conn, sql sqlAsset) (int64, error) {
+	stmt := sql.Prep(conn)
+	defer stmt.Finalize()
+	// NULL for an empty table reads as 0
+	max, err := sqlitex.ResultInt64(stmt)
+	if err != nil {
+		return 0, fmt.Errorf("fetching max id: %w", err)
+	}
+	return max, nil
+}
+
+// rewind moves one consumer back to last, if it is past that. It
+// returns nil if the consumer was left alone.
+func rewind(conn *sqlite.Conn, stage *Stage, last int64, clear bool, now time.Time) (*Rewound, error) {
+	prev, err := catchup.Rewind(conn, stage.Name, last)
+	if err != nil {
+		return nil, err
+	}
+	if prev <= last {
+		return nil, nil
+	}
+	if err := saveReplay(conn, stage.Name, now); err != nil {
+		return nil, err
+	}
+	r := &Rewound{
+		Name: stage.Name,
+		From: prev,
+		To:   last,
+	}
+	if !clear {
+		return r, nil
+	}
+	for _, sql := range stage.clear {
+		stmt := sql.Prep(conn)
+		defer stmt.Finalize()
+		stmt.SetInt64("@last", last)
+		if _, err := stmt.Step(); err != nil {
+			return nil, fmt.Errorf("clearing: %w", err)
+		}
+		r.Cleared += int64(conn.Changes())
+	}
+	return r, nil
+}
@@ -0,0 +1,455 @@
+package pipeline_test
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"crawshaw.io/sqlite/sqlitex"
+	"eagain.net/go/securityblanket/internal/alert"
+	"eagain.net/go/securityblanket/internal/arming"
+	"eagain.net/go/securityblanket/internal/database"
+	"eagain.net/go/securityblanket/internal/honeywell5800/hw58trip"
+	"eagain.net/go/securityblanket/internal/pipeline"
+	"eagain.net/go/securityblanket/internal/retention"
+	"github.com/google/go-cmp/cmp"
+	"go.uber.org/zap/zaptest"
+)
+
+func execScript(t testing.TB, db *database.DB, sql string) {
+	conn := db.Get(nil)
+	defer db.Put(conn)
+
+	if err := sqlitex.ExecScript(conn, sql); err != nil {
+		t.Fatalf("database error: %v", err)
+	}
+}
+
+func TestStagesOrder(t *testing.T) {
+	outputs := make(map[string]string)
+	for _, s := range pipeline.Stages() {
+		for _, table := range s.Outputs {
+			outputs[table] = s.Name
+		}
+	}
+	seen := make(map[string]bool)
+	for _, s := range pipeline.Stages() {
+		if seen[s.Name] {
+			t.Errorf("duplicate stage: %s", s.Name)
+		}
+		seen[s.Name] = true
+		if from, ok := outputs[s.Source]; ok && !seen[from] {
+			t.Errorf("stage %s comes before %s, which it reads from", s.Name, from)
+		}
+	}
+}
+
+func TestSeekEmpty(t *testing.T) {
+	db := database.Scratch()
+	for _, s := range pipeline.Stages() {
+		last, err := pipeline.Seek(context.Background(), db, s.Name, time.Now())
+		if err != nil {
+			t.Errorf("seek %s: %v", s.Name, err)
+			continue
+		}
+		if last != 0 {
+			t.Errorf("seek %s: found something in an empty database: %d", s.Name, last)
+		}
+	}
+}
+
+func TestRewindUnknown(t *testing.T) {
+	db := database.Scratch()
+	_, err := pipeline.Rewind(context.Background(), db, "xyzzy", 0, false)
+	if err == nil || !strings.Contains(err.Error(), "unknown consumer") {
+		t.Errorf("wrong error: %v", err)
+	}
+}
+
+func TestRewindClearUnsupported(t *testing.T) {
+	db := database.Scratch()
+	if _, err := pipeline.Rewind(context.Background(), db, "honeywell5800.signal", 0, true); err == nil {
+		t.Error("expected an error")
+	}
+}
+
+type trip struct {
+	ID        int64
+	TrippedBy int64
+	ClearedBy int64
+}
+
+func trips(t testing.TB, db *database.DB) []trip {
+	conn := db.Get(nil)
+	defer db.Put(conn)
+	stmt := conn.Prep(`SELECT id, trippedBy, coalesce(clearedBy, 0) AS clearedBy FROM honeywell5800_trips ORDER BY id`)
+	defer stmt.Finalize()
+	var list []trip
+	for {
+		hasRow, err := stmt.Step()
+		if err != nil {
+			t.Fatalf("database error: %v", err)
+		}
+		if !hasRow {
+			break
+		}
+		list = append(list, trip{
+			ID:        stmt.GetInt64("id"),
+			TrippedBy: stmt.GetInt64("trippedBy"),
+			ClearedBy: stmt.GetInt64("clearedBy"),
+		})
+	}
+	return list
+}
+
+func count(t testing.TB, db *database.DB, table string) int64 {
+	conn := db.Get(nil)
+	defer db.Put(conn)
+	stmt := conn.Prep(fmt.Sprintf(`SELECT count(*) AS count FROM %q`, table))
+	defer stmt.Finalize()
+	n, err := sqlitex.ResultInt64(stmt)
+	if err != nil {
+		t.Fatalf("database error: %v", err)
+	}
+	return n
+}
+
+func TestRewindClear(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	db := database.Scratch()
+	defer db.Close()
+
+	start := time.Date(2020, 2, 3, 4, 5, 6, 0, time.Local)
+	var sql strings.Builder
+	sql.WriteString(`
+INSERT INTO honeywell5800_sensors(id, model, description)
+VALUES (123456, '5853', 'west wing');
+`)
+	for i, event := range []int{128, 0, 128, 0} {
+		fmt.Fprintf(&sql, `
+INSERT INTO honeywell5800_updates(id, time, channel, sensor, event)
+VALUES (%d, '%s', 8, 123456, %d);
+`, i+1, start.Add(time.Duration(i)*time.Hour).Format(time.RFC3339Nano), event)
+	}
+	execScript(t, db, sql.String())
+
+	tripper := hw58trip.New(ctx, db, zaptest.NewLogger(t))
+	if err := tripper.Run(); err != nil {
+		t.Fatalf("run: %v", err)
+	}
+	want := []trip{
+		{ID: 1, TrippedBy: 1, ClearedBy: 2},
+		{ID: 2, TrippedBy: 3, ClearedBy: 4},
+	}
+	if diff := cmp.Diff(want, trips(t, db)); diff != "" {
+		t.Fatalf("wrong trips: -want +got\n%s", diff)
+	}
+	execScript(t, db, `
+INSERT INTO arming_trips(trip, mode, action)
+VALUES (1, 'away', 'alarm'), (2, 'away', 'alarm');
+INSERT INTO catchup(name, last)
+VALUES ('arming.classify', 2), ('alert.trip', 2), ('output', 1);
+`)
+
+	// the loop turns out to be wired the other way around, since
+	// the third update
+	execScript(t, db, `
+INSERT INTO honeywell5800_site_loops(sensor, loop, siteNormallyOpen)
+VALUES (123456, 1, true);
+`)
+	last, err := pipeline.Seek(ctx, db, "honeywell5800.trip", start.Add(2*time.Hour))
+	if err != nil {
+		t.Fatalf("seek: %v", err)
+	}
+	if last != 2 {
+		t.Errorf("wrong seek result: %d", last)
+	}
+	rewound, err := pipeline.Rewind(ctx, db, "honeywell5800.trip", last, true)
+	if err != nil {
+		t.Fatalf("rewind: %v", err)
+	}
+	wantRewound := []*pipeline.Rewound{
+		{Name: "honeywell5800.trip", From: 4, To: 2, Cleared: 1},
+		{Name: "arming.classify", From: 2, To: 1},
+		{Name: "alert.trip", From: 2, To: 1},
+	}
+	if diff := cmp.Diff(wantRewound, rewound); diff != "" {
+		t.Errorf("wrong rewound: -want +got\n%s", diff)
+	}
+	if g, e := count(t, db, "arming_trips"), int64(1); g != e {
+		t.Errorf("wrong number of arming trips: %d != %d", g, e)
+	}
+
+	if err := tripper.Run(); err != nil {
+		t.Fatalf("run again: %v", err)
+	}
+	want = []trip{
+		{ID: 1, TrippedBy: 1, ClearedBy: 2},
+		{ID: 3, TrippedBy: 4},
+	}
+	if diff := cmp.Diff(want, trips(t, db)); diff != "" {
+		t.Errorf("wrong trips after replay: -want +got\n%s", diff)
+	}
+}
+
+func TestRewindReplay(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	db := database.Scratch()
+	defer db.Close()
+	log := zaptest.NewLogger(t)
+
+	start := time.Date(2020, 2, 3, 4, 5, 6, 0, time.Local)
+	var sql strings.Builder
+	// smoke is an alarm even when disarmed
+	sql.WriteString(`
+INSERT INTO honeywell5800_sensors(id, model, description)
+VALUES (123456, '5808W3', 'kitchen');
+`)
+	for i, event := range []int{128, 0, 128, 0} {
+		fmt.Fprintf(&sql, `
+INSERT INTO honeywell5800_updates(id, time, channel, sensor, event)
+VALUES (%d, '%s', 8, 123456, %d);
+`, i+1, start.Add(time.Duration(i)*time.Hour).Format(time.RFC3339Nano), event)
+	}
+	execScript(t, db, sql.String())
+
+	tripper := hw58trip.New(ctx, db, log)
+	classifier := arming.New(ctx, db, log)
+	alerts := alert.New(ctx, db, log, alert.Channels("hook"))
+	run := func() {
+		t.Helper()
+		if err := tripper.Run(); err != nil {
+			t.Fatalf("trip: %v", err)
+		}
+		if err := classifier.Run(); err != nil {
+			t.Fatalf("classify: %v", err)
+		}
+		if err := alerts.Run(); err != nil {
+			t.Fatalf("alert: %v", err)
+		}
+	}
+	run()
+	if g, e := count(t, db, "arming_trips"), int64(2); g != e {
+		t.Fatalf("wrong number of arming trips: %d != %d", g, e)
+	}
+	queued := count(t, db, "notify_outbox")
+	if queued == 0 {
+		t.Fatal("nothing was queued")
+	}
+	raised := count(t, db, "alerts")
+
+	if _, err := pipeline.Rewind(ctx, db, "honeywell5800.trip", 0, true); err != nil {
+		t.Fatalf("rewind: %v", err)
+	}
+	run()
+	if g, e := count(t, db, "arming_trips"), int64(2); g != e {
+		t.Errorf("trips were not classified again: %d != %d", g, e)
+	}
+	if g, e := count(t, db, "notify_outbox"), queued; g != e {
+		t.Errorf("replay queued notifications: %d != %d", g, e)
+	}
+	if g, e := count(t, db, "alerts"), raised; g != e {
+		t.Errorf("replay raised alerts: %d != %d", g, e)
+	}
+
+	// what happens after the rewind is alerted about as usual
+	execScript(t, db, fmt.Sprintf(`
+INSERT INTO honeywell5800_updates(id, time, channel, sensor, event)
+VALUES (5, '%s', 8, 123456, 128);
+`, time.Now().Add(time.Minute).Format(time.RFC3339Nano)))
+	run()
+	if g, e := count(t, db, "notify_outbox"), queued+1; g != e {
+		t.Errorf("new trip was not notified: %d != %d", g, e)
+	}
+}
+
+func TestRewindNoClear(t *testing.T) {
+	db := database.Scratch()
+	execScript(t, db, `
+INSERT INTO rtl433_raw(time, freqMHz, model, data)
+VALUES ('2020-01-01T00:00:00Z', 345, 'x', '{}'), ('2020-01-01T00:00:01Z', 345, 'x', '{}');
+INSERT INTO honeywell5800_sensors(id) VALUES (1);
+INSERT INTO honeywell5800_updates(id, time, channel, sensor, event)
+VALUES (1, '2020-01-01T00:00:00Z', 8, 1, 0);
+INSERT INTO catchup(name, last)
+VALUES ('honeywell5800.receive', 2), ('rfjam.noise', 2), ('honeywell5800.trip', 1);
+`)
+	rewound, err := pipeline.Rewind(context.Background(), db, "honeywell5800.receive", 0, false)
+	if err != nil {
+		t.Fatalf("rewind: %v", err)
+	}
+	// nothing was cleared, so consumers reading from the same
+	// source, or downstream, are left alone
+	want := []*pipeline.Rewound{
+		{Name: "honeywell5800.receive", From: 2, To: 0},
+	}
+	if diff := cmp.Diff(want, rewound); diff != "" {
+		t.Errorf("wrong rewound: -want +got\n%s", diff)
+	}
+}
+
+func TestRewindReceive(t *testing.T) {
+	db := database.Scratch()
+	execScript(t, db, `
+INSERT INTO rtl433_raw(id, time, freqMHz, model, data)
+VALUES
+	(1, '2020-01-01T00:00:00Z', 345, 'x', '{}'),
+	(2, '2020-01-01T00:00:00Z', 345, 'x', '{}'),
+	(3, '2020-01-01T00:00:01Z', 345, 'x', '{}');
+INSERT INTO honeywell5800_sensors(id) VALUES (1);
+INSERT INTO honeywell5800_updates(id, time, channel, sensor, event)
+VALUES
+	(1, '2020-01-01T00:00:00Z', 8, 1, 128),
+	(2, '2020-01-01T00:00:01Z', 8, 1, 0);
+-- two receivers heard the first update
+INSERT INTO honeywell5800_receptions(sensorUpdate, receiver, raw, time)
+VALUES
+	(1, 'a', 1, '2020-01-01T00:00:00Z'),
+	(1, 'b', 2, '2020-01-01T00:00:00Z'),
+	(2, 'a', 3, '2020-01-01T00:00:01Z');
+INSERT INTO honeywell5800_trips(sensor, loop, trippedBy, clearedBy)
+VALUES (1, 1, 1, 2);
+INSERT INTO catchup(name, last)
+VALUES ('honeywell5800.receive', 3), ('honeywell5800.trip', 2), ('arming.classify', 1);
+`)
+	rewound, err := pipeline.Rewind(context.Background(), db, "honeywell5800.receive", 1, true)
+	if err != nil {
+		t.Fatalf("rewind: %v", err)
+	}
+	want := []*pipeline.Rewound{
+		{Name: "honeywell5800.receive", From: 3, To: 1, Cleared: 3},
+		{Name: "honeywell5800.trip", From: 2, To: 1},
+	}
+	if diff := cmp.Diff(want, rewound); diff != "" {
+		t.Errorf("wrong rewound: -want +got\n%s", diff)
+	}
+	if g, e := count(t, db, "honeywell5800_updates"), int64(1); g != e {
+		t.Errorf("wrong number of updates: %d != %d", g, e)
+	}
+	if g, e := count(t, db, "honeywell5800_receptions"), int64(1); g != e {
+		t.Errorf("wrong number of receptions: %d != %d", g, e)
+	}
+	// the trip is open again, waiting for the update to be received
+	// again
+	wantTrips := []trip{
+		{ID: 1, TrippedBy: 1},
+	}
+	if diff := cmp.Diff(wantTrips, trips(t, db)); diff != "" {
+		t.Errorf("wrong trips: -want +got\n%s", diff)
+	}
+}
+
+func TestRewindPruned(t *testing.T) {
+	db := database.Scratch()
+	execScript(t, db, `
+INSERT INTO rtl433_raw(id, time, freqMHz, model, data)
+VALUES
+	(1, '2020-01-01T00:00:00Z', 345, 'x', '{}'),
+	(2, '2020-01-02T00:00:00Z', 345, 'x', '{}'),
+	(3, '2020-01-03T00:00:00Z', 345, 'x', '{}');
+INSERT INTO honeywell5800_sensors(id) VALUES (1);
+INSERT INTO honeywell5800_updates(id, time, channel, sensor, event)
+VALUES
+	(1, '2020-01-01T00:00:00Z', 8, 1, 128),
+	(2, '2020-01-02T00:00:00Z', 8, 1, 0),
+	(3, '2020-01-03T00:00:00Z', 8, 1, 128);
+INSERT INTO honeywell5800_receptions(sensorUpdate, receiver, raw, time)
+VALUES
+	(1, 'a', 1, '2020-01-01T00:00:00Z'),
+	(2, 'a', 2, '2020-01-02T00:00:00Z'),
+	(3, 'a', 3, '2020-01-03T00:00:00Z');
+INSERT INTO honeywell5800_trips(sensor, loop, trippedBy, clearedBy)
+VALUES (1, 1, 1, 2);
+INSERT INTO catchup(name, last)
+VALUES ('honeywell5800.receive', 3), ('rfjam.noise', 3), ('honeywell5800.trip', 3);
+`)
+	policy, err := retention.For("rtl433_raw", 24*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2020, 1, 3, 12, 0, 0, 0, time.UTC)
+	p := retention.New(context.Background(), db, zaptest.NewLogger(t),
+		[]*retention.Policy{policy},
+		retention.Clock(func() time.Time { return now }),
+	)
+	if err := p.Run(); err != nil {
+		t.Fatalf("prune: %v", err)
+	}
+	if g, e := count(t, db, "rtl433_raw"), int64(1); g != e {
+		t.Fatalf("wrong number of raw rows: %d != %d", g, e)
+	}
+
+	_, err = pipeline.Rewind(context.Background(), db, "honeywell5800.receive", 0, true)
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	if g, e := err.Error(), "honeywell5800.receive: rows after 0 have been pruned from rtl433_raw, cannot clear before 2"; g != e {
+		t.Errorf("wrong error: %q != %q", g, e)
+	}
+	if g, e := count(t, db, "honeywell5800_updates"), int64(3); g != e {
+		t.Errorf("updates were cleared: %d != %d", g, e)
+	}
+	if g, e := count(t, db, "honeywell5800_trips"), int64(1); g != e {
+		t.Errorf("trips were cleared: %d != %d", g, e)
+	}
+
+	// what is left can still be cleared
+	rewound, err := pipeline.Rewind(context.Background(), db, "honeywell5800.receive", 2, true)
+	if err != nil {
+		t.Fatalf("rewind: %v", err)
+	}
+	want := []*pipeline.Rewound{
+		{Name: "honeywell5800.receive", From: 3, To: 2, Cleared: 1},
+		{Name: "honeywell5800.trip", From: 3, To: 2},
+	}
+	if diff := cmp.Diff(want, rewound); diff != "" {
+		t.Errorf("wrong rewound: -want +got\n%s", diff)
+	}
+	if g, e := count(t, db, "honeywell5800_trips"), int64(1); g != e {
+		t.Errorf("wrong number of trips: %d != %d", g, e)
+	}
+}
+
+func TestGraph(t *testing.T) {
+	db := database.Scratch()
+	execScript(t, db, `
+INSERT INTO rtl433_raw(time, freqMHz, model, data)
+VALUES ('2020-01-01T00:00:00Z', 345, 'x', '{}'), ('2020-01-01T00:00:01Z', 345, 'x', '{}');
+INSERT INTO catchup(name, last)
+VALUES ('honeywell5800.receive', 1), ('honeywell5800.trip', 3);
+`)
+	graph, err := pipeline.Graph(context.Background(), db)
+	if err != nil {
+		t.Fatalf("graph: %v", err)
+	}
+	if g, e := len(graph), len(pipeline.Stages()); g != e {
+		t.Fatalf("wrong number of stages: %d != %d", g, e)
+	}
+	for _, s := range graph {
+		switch s.Name {
+		case "honeywell5800.receive":
+			if s.Last != 1 || s.Max != 2 || s.Lag() != 1 {
+				t.Errorf("wrong status: %s: last %d max %d lag %d", s.Name, s.Last, s.Max, s.Lag())
+			}
+			want := []string{
+				"honeywell5800.trip",
+				"honeywell5800.signal",
+				"honeywell5800.supervise",
+				"honeywell5800.battery",
+				"honeywell5800.tamper",
+			}
+			if diff := cmp.Diff(want, s.Readers); diff != "" {
+				t.Errorf("wrong readers: -want +got\n%s", diff)
+			}
+		case "honeywell5800.trip":
+			// the updates it saw are gone
+			if s.Lag() != 0 {
+				t.Errorf("wrong lag: %s: %d", s.Name, s.Lag())
+			}
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package pipeline
+
+import (
+	"fmt"
+	"sync"
+)
+
+// Registry wakes up the runners of a live pipeline. Whoever adds rows
+// to a table wakes up everyone reading it, without knowing who they
+// are.
+type Registry struct {
+	mu   sync.Mutex
+	subs []*subscription
+}
+
+type subscription struct {
+	tables map[string]bool
+	wakeup func()
+}
+
+func NewRegistry() *Registry {
+	r := &Registry{}
+	return r
+}
+
+func mustFind(name string) *Stage {
+	s, err := find(name)
+	if err != nil {
+		panic(fmt.Errorf("pipeline: %w", err))
+	}
+	return s
+}
+
+// Subscribe calls wakeup whenever rows are added to any of tables. It
+// is for readers that are not stages of the pipeline; stages use
+// Register.
+func (r *Registry) Subscribe(wakeup func(), tables ...string) {
+	sub := &subscription{
+		tables: make(map[string]bool, len(tables)),
+		wakeup: wakeup,
+	}
+	for _, t := range tables {
+		sub.tables[t] = true
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.subs = append(r.subs, sub)
+}
+
+// Register calls wakeup whenever rows are added to the source of any
+// of the named stages. Several stages run by the same runner are
+// registered together, so the runner is woken up once.
+func (r *Registry) Register(wakeup func(), stages ...string) {
+	tables := make([]string, 0, len(stages))
+	for _, name := range stages {
+		tables = append(tables, mustFind(name).Source)
+	}
+	r.Subscribe(wakeup, tables...)
+}
+
+// Added returns a function to call after adding rows to tables. It is
+// for writers that are not stages of the pipeline; stages use Wakeup.
+func (r *Registry) Added(tables ...string) func() {
+	fn := func() {
+		r.mu.Lock()
+		var wakeups []func()
+		for _, sub := range r.subs {
+			for _, t := range tables {
+				if sub.tables[t] {
+					wakeups = append(wakeups, sub.wakeup)
+					break
+				}
+			}
+		}
+		r.mu.Unlock()
+		for _, wakeup := range wakeups {
+			wakeup()
+		}
+	}
+	return fn
+}
+
+// Wakeup returns a function for the named stages to call after adding
+// rows to their outputs.
+func (r *Registry) Wakeup(stages ...string) func() {
+	var tables []string
+	for _, name := range stages {
+		tables = append(tables, mustFind(name).Outputs...)
+	}
+	return r.Added(tables...)
+}
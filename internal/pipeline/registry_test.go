@@ -0,0 +1,65 @@
+package pipeline_test
+
+import (
+	"testing"
+
+	"eagain.net/go/securityblanket/internal/pipeline"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestRegistry(t *testing.T) {
+	woken := make(map[string]int)
+	counter := func(name string) func() {
+		return func() { woken[name]++ }
+	}
+	pipe := pipeline.NewRegistry()
+	pipe.Register(counter("receive"), "honeywell5800.receive")
+	pipe.Register(counter("rfjam"), "rfjam.noise")
+	pipe.Register(counter("trip"), "honeywell5800.trip")
+	pipe.Register(counter("alert"), "alert.trip", "alert.tamper", "alert.supervision", "alert.jamming")
+	pipe.Subscribe(counter("hass"), "honeywell5800_updates", "alerts")
+
+	pipe.Added("rtl433_raw")()
+	want := map[string]int{"receive": 1, "rfjam": 1}
+	if diff := cmp.Diff(want, woken); diff != "" {
+		t.Errorf("wrong wakeups from raw: -want +got\n%s", diff)
+	}
+
+	woken = make(map[string]int)
+	pipe.Wakeup("honeywell5800.receive")()
+	want = map[string]int{"trip": 1, "hass": 1}
+	if diff := cmp.Diff(want, woken); diff != "" {
+		t.Errorf("wrong wakeups from receive: -want +got\n%s", diff)
+	}
+
+	// one wakeup for stages run together
+	woken = make(map[string]int)
+	pipe.Wakeup("honeywell5800.tamper", "honeywell5800.supervise")()
+	want = map[string]int{"alert": 1}
+	if diff := cmp.Diff(want, woken); diff != "" {
+		t.Errorf("wrong wakeups from tamper and supervise: -want +got\n%s", diff)
+	}
+
+	woken = make(map[string]int)
+	pipe.Wakeup("rfjam.noise")()
+	want = map[string]int{"alert": 1}
+	if diff := cmp.Diff(want, woken); diff != "" {
+		t.Errorf("wrong wakeups from rfjam: -want +got\n%s", diff)
+	}
+
+	woken = make(map[string]int)
+	pipe.Wakeup("honeywell5800.signal")()
+	if len(woken) != 0 {
+		t.Errorf("nobody reads signal stats: %v", woken)
+	}
+}
+
+func TestRegistryUnknown(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("expected a panic")
+		}
+	}()
+	pipe := pipeline.NewRegistry()
+	pipe.Register(func() {}, "xyzzy")
+}
@@ -0,0 +1,46 @@
+package pipeline
+
+import (
+	"fmt"
+	"time"
+
+	"crawshaw.io/sqlite"
+	"eagain.net/go/securityblanket/internal/database"
+)
+
+// Replayed reports whether an event at t, processed by the named
+// consumer, happened before the consumer was last rewound. Such an
+// event was already dealt with when the consumer first got to it, so
+// consumers that tell people about events, or act on them, should
+// leave it be.
+func Replayed(conn *sqlite.Conn, name string, t time.Time) (bool, error) {
+	stmt := fetch_pipeline_replay.Prep(conn)
+	defer stmt.Finalize()
+	stmt.SetText("@consumer", name)
+	hasRow, err := stmt.Step()
+	if err != nil {
+		return false, fmt.Errorf("fetching replay: %w", err)
+	}
+	if !hasRow {
+		return false, nil
+	}
+	rewound, err := database.GetTime(stmt, "rewound")
+	if err != nil {
+		return false, fmt.Errorf("bad rewind time: %s: %w", name, err)
+	}
+	if err := database.NoMoreRows(stmt); err != nil {
+		return false, err
+	}
+	return t.Before(rewound), nil
+}
+
+func saveReplay(conn *sqlite.Conn, name string, now time.Time) error {
+	stmt := upsert_pipeline_replay.Prep(conn)
+	defer stmt.Finalize()
+	stmt.SetText("@consumer", name)
+	database.BindTime(stmt, "@rewound", now)
+	if _, err := stmt.Step(); err != nil {
+		return fmt.Errorf("saving replay: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,71 @@
+package pipeline
+
+import (
+	"context"
+	"fmt"
+
+	"eagain.net/go/securityblanket/internal/catchup"
+	"eagain.net/go/securityblanket/internal/database"
+)
+
+// Status is how far a stage has gotten.
+type Status struct {
+	*Stage
+	// Last is the last id processed, and Max the largest id in the
+	// source.
+	Last int64
+	Max  int64
+	// Readers are the stages reading the outputs of this one.
+	Readers []string
+}
+
+// Lag is how many ids the stage is behind its source.
+func (s *Status) Lag() int64 {
+	if s.Max < s.Last {
+		// rows at the end were deleted, by pruning or rewinding
+		return 0
+	}
+	return s.Max - s.Last
+}
+
+// readers returns the stages reading the outputs of stage.
+func readers(stage *Stage) []string {
+	var names []string
+	for _, s := range stages {
+		for _, t := range stage.Outputs {
+			if s.Source == t {
+				names = append(names, s.Name)
+				break
+			}
+		}
+	}
+	return names
+}
+
+// Graph returns the status of every stage, in pipeline order.
+func Graph(ctx context.Context, db *database.DB) ([]*Status, error) {
+	conn := db.Get(ctx)
+	if conn == nil {
+		return nil, context.Canceled
+	}
+	defer db.Put(conn)
+
+	list := make([]*Status, 0, len(stages))
+	for _, s := range stages {
+		last, err := catchup.Last(conn, s.Name)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", s.Name, err)
+		}
+		max, err := fetchMax(conn, sources[s.Source].max)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", s.Name, err)
+		}
+		list = append(list, &Status{
+			Stage:   s,
+			Last:    last,
+			Max:     max,
+			Readers: readers(s),
+		})
+	}
+	return list, nil
+}
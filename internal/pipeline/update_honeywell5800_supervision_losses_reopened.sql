@@ -0,0 +1,13 @@
+-- Supervision losses restored by an update only heard in the raw
+-- messages being processed again are open again, instead of going
+-- away with the update.
+UPDATE honeywell5800_supervision_losses
+	SET restoredBy=NULL
+	WHERE restoredBy IN (
+		SELECT sensorUpdate FROM honeywell5800_receptions
+			WHERE raw>@last
+	)
+	AND restoredBy NOT IN (
+		SELECT sensorUpdate FROM honeywell5800_receptions
+			WHERE raw<=@last
+	)
@@ -0,0 +1,3 @@
+UPDATE honeywell5800_supervision_losses
+	SET restoredBy=NULL
+	WHERE restoredBy>@last
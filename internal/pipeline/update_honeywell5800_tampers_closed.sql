@@ -0,0 +1,3 @@
+UPDATE honeywell5800_tampers
+	SET closedBy=NULL
+	WHERE closedBy>@last
@@ -0,0 +1,13 @@
+-- Tampers closed by an update only heard in the raw messages being
+-- processed again are open again, instead of going away with the
+-- update.
+UPDATE honeywell5800_tampers
+	SET closedBy=NULL
+	WHERE closedBy IN (
+		SELECT sensorUpdate FROM honeywell5800_receptions
+			WHERE raw>@last
+	)
+	AND closedBy NOT IN (
+		SELECT sensorUpdate FROM honeywell5800_receptions
+			WHERE raw<=@last
+	)
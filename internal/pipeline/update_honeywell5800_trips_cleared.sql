@@ -0,0 +1,3 @@
+UPDATE honeywell5800_trips
+	SET clearedBy=NULL
+	WHERE clearedBy>@last
@@ -0,0 +1,13 @@
+-- Trips cleared by an update only heard in the raw messages being
+-- processed again are open again, instead of going away with the
+-- update.
+UPDATE honeywell5800_trips
+	SET clearedBy=NULL
+	WHERE clearedBy IN (
+		SELECT sensorUpdate FROM honeywell5800_receptions
+			WHERE raw>@last
+	)
+	AND clearedBy NOT IN (
+		SELECT sensorUpdate FROM honeywell5800_receptions
+			WHERE raw<=@last
+	)
@@ -0,0 +1,3 @@
+INSERT INTO pipeline_replays(consumer, rewound)
+	VALUES (@consumer, @rewound)
+	ON CONFLICT(consumer) DO UPDATE SET rewound=excluded.rewound
@@ -0,0 +1,16 @@
+DELETE FROM honeywell5800_updates
+WHERE id IN (
+	SELECT id
+	FROM honeywell5800_updates AS u
+	WHERE id<=@upto
+		AND time<@before
+		AND NOT EXISTS (SELECT 1 FROM honeywell5800_trips WHERE trippedBy=u.id OR clearedBy=u.id)
+		AND NOT EXISTS (SELECT 1 FROM honeywell5800_supervision_losses WHERE lastSeen=u.id OR restoredBy=u.id)
+		AND NOT EXISTS (SELECT 1 FROM honeywell5800_tampers WHERE openedBy=u.id OR closedBy=u.id)
+		AND id<(SELECT max(id) FROM honeywell5800_updates WHERE sensor=u.sensor)
+		AND NOT EXISTS (
+			SELECT 1 FROM catchup_dead_letters
+			WHERE consumer IN (SELECT value FROM json_each(@consumers))
+				AND source=u.id
+		)
+)
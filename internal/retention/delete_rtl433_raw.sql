@@ -0,0 +1,8 @@
+DELETE FROM rtl433_raw AS r
+WHERE id<=@upto
+	AND time<@before
+	AND NOT EXISTS (
+		SELECT 1 FROM catchup_dead_letters
+		WHERE consumer IN (SELECT value FROM json_each(@consumers))
+			AND source=r.id
+	)
@@ -0,0 +1,22 @@
+SELECT max(id) AS upto
+FROM (
+	SELECT id
+	FROM honeywell5800_updates AS u
+	WHERE id<=@watermark
+		AND time<@before
+		-- the history of trips, supervision and tampers refers
+		-- to these
+		AND NOT EXISTS (SELECT 1 FROM honeywell5800_trips WHERE trippedBy=u.id OR clearedBy=u.id)
+		AND NOT EXISTS (SELECT 1 FROM honeywell5800_supervision_losses WHERE lastSeen=u.id OR restoredBy=u.id)
+		AND NOT EXISTS (SELECT 1 FROM honeywell5800_tampers WHERE openedBy=u.id OR closedBy=u.id)
+		-- the latest update is the current state of the sensor
+		AND id<(SELECT max(id) FROM honeywell5800_updates WHERE sensor=u.sensor)
+		-- skipped rows are kept for retrying
+		AND NOT EXISTS (
+			SELECT 1 FROM catchup_dead_letters
+			WHERE consumer IN (SELECT value FROM json_each(@consumers))
+				AND source=u.id
+		)
+	ORDER BY id
+	LIMIT @limit
+)
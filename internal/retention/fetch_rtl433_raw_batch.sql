@@ -0,0 +1,15 @@
+SELECT max(id) AS upto
+FROM (
+	SELECT id
+	FROM rtl433_raw AS r
+	WHERE id<=@watermark
+		AND time<@before
+		-- skipped rows are kept for retrying
+		AND NOT EXISTS (
+			SELECT 1 FROM catchup_dead_letters
+			WHERE consumer IN (SELECT value FROM json_each(@consumers))
+				AND source=r.id
+		)
+	ORDER BY id
+	LIMIT @limit
+)
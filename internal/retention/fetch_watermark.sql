@@ -0,0 +1,7 @@
+-- The last id processed by every consumer of a table. A consumer that
+-- has not processed anything yet has no row.
+SELECT
+	count(*) AS known,
+	coalesce(min(last), 0) AS watermark
+FROM catchup
+WHERE name IN (SELECT value FROM json_each(@consumers))
@@ -0,0 +1,404 @@
+// Package retention deletes old rows from append-only logs, so the
+// database does not grow forever.
+//
+// A row is deleted once it is older than the policy allows, and every
+// catchup consumer of the table has processed it. Rows are deleted in
+// small batches, each in its own savepoint, so writers are not blocked
+// for long. Afterwards, free pages are returned to the filesystem with
+// incremental vacuum, if the database has it enabled; see
+// EnableIncrementalVacuum.
+package retention
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	"crawshaw.io/sqlite"
+	"crawshaw.io/sqlite/sqlitex"
+	"eagain.net/go/securityblanket/internal/database"
+	"eagain.net/go/securityblanket/internal/metrics"
+	"eagain.net/go/securityblanket/internal/pipeline"
+	"go.uber.org/zap"
+)
+
+var deletedCounter = metrics.Default.Counter(
+	"securityblanket_retention_deleted_total",
+	"Rows deleted by retention policies.",
+	"table",
+)
+
+// Policy says how long rows of a table are kept.
+type Policy struct {
+	Table string
+	// Keep is how long rows are kept, by their time.
+	Keep time.Duration
+	// Consumers are the catchup consumers reading the table, the
+	// pipeline stages with it as their source. Rows they have not all
+	// processed are kept, as are rows any of them skipped into the
+	// dead letter queue.
+	Consumers []string
+	// BatchSQL finds the next batch of rows to delete, up to @limit
+	// rows with id at most @watermark and time before @before, and not
+	// dead letters of the consumers in the JSON array @consumers. The
+	// result must have a column named upto, the largest id in the
+	// batch, or NULL if there is nothing to delete.
+	BatchSQL string
+	// DeleteSQL deletes the batch: rows with id at most @upto and
+	// time before @before, again leaving out dead letters of
+	// @consumers.
+	DeleteSQL string
+	// SelectSQL returns the rows DeleteSQL would delete, ordered by
+	// id, with every column.
+	SelectSQL string
+	// Related are tables whose rows are deleted along with the batch,
+	// by foreign key cascade.
+	Related []Related
+	// Archive is called with the result of SelectSQL before deleting
+	// a batch, and then with the rows of each related table, in the
+	// same savepoint. If it fails, nothing is deleted.
+	Archive func(table string, rows *sqlite.Stmt) error
+}
+
+// Related is a table whose rows go with the rows a policy deletes.
+type Related struct {
+	Table string
+	// SelectSQL returns the rows that go with what DeleteSQL would
+	// delete, with every column. It takes the same parameters.
+	SelectSQL string
+}
+
+// tables are the tables retention policies can be set for.
+var tables = map[string]Policy{
+	"rtl433_raw": {
+		BatchSQL:  fetch_rtl433_raw_batch.Content,
+		DeleteSQL: delete_rtl433_raw.Content,
+		SelectSQL: select_rtl433_raw.Content,
+	},
+	// Updates referred to by trips, supervision losses and tampers
+	// are kept, as is the latest update of every sensor. Receptions
+	// go with their updates.
+	"honeywell5800_updates": {
+		Related: []Related{
+			{
+				Table:     "honeywell5800_receptions",
+				SelectSQL: select_honeywell5800_receptions.Content,
+			},
+		},
+		BatchSQL:  fetch_honeywell5800_updates_batch.Content,
+		DeleteSQL: delete_honeywell5800_updates.Content,
+		SelectSQL: select_honeywell5800_updates.Content,
+	},
+}
+
+// Tables lists the tables retention policies can be set for.
+func Tables() []string {
+	names := make([]string, 0, len(tables))
+	for name := range tables {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// ArchivedTables lists the tables whose rows can end up in an archive:
+// the tables of Tables, and the tables related to them.
+func ArchivedTables() []string {
+	names := Tables()
+	for _, p := range tables {
+		for _, r := range p.Related {
+			names = append(names, r.Table)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// For returns the policy keeping rows of table for keep.
+func For(table string, keep time.Duration) (*Policy, error) {
+	p, ok := tables[table]
+	if !ok {
+		return nil, fmt.Errorf("no retention policy for table: %q", table)
+	}
+	p.Table = table
+	p.Keep = keep
+	p.Consumers = consumers(table)
+	return &p, nil
+}
+
+// consumers returns the names of the pipeline stages reading table.
+func consumers(table string) []string {
+	var names []string
+	for _, s := range pipeline.Stages() {
+		if s.Source == table {
+			names = append(names, s.Name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+const (
+	defaultBatchSize = 1000
+	// vacuumPages is how many free pages are returned to the
+	// filesystem at a time.
+	vacuumPages = 1000
+)
+
+type config struct {
+	clock     func() time.Time
+	batchSize int
+}
+
+type Option option
+
+type option func(*config)
+
+// Clock overrides the source of time used for deciding what is old.
+func Clock(clock func() time.Time) Option {
+	fn := func(conf *config) {
+		conf.clock = clock
+	}
+	return fn
+}
+
+// BatchSize sets how many rows are deleted at a time.
+func BatchSize(n int) Option {
+	fn := func(conf *config) {
+		conf.batchSize = n
+	}
+	return fn
+}
+
+// Pruner applies retention policies. Run needs to be called
+// periodically.
+type Pruner struct {
+	ctx      context.Context
+	db       *database.DB
+	log      *zap.Logger
+	policies []*Policy
+	config   config
+}
+
+func New(ctx context.Context, db *database.DB, log *zap.Logger, policies []*Policy, opts ...Option) *Pruner {
+	p := &Pruner{
+		ctx:      ctx,
+		db:       db,
+		log:      log,
+		policies: policies,
+		config: config{
+			clock:     time.Now,
+			batchSize: defaultBatchSize,
+		},
+	}
+	for _, opt := range opts {
+		opt(&p.config)
+	}
+	return p
+}
+
+// Run deletes old rows, and returns the space they used to the
+// filesystem.
+func (p *Pruner) Run() error {
+	now := p.config.clock()
+	for _, policy := range p.policies {
+		if err := p.prune(policy, now.Add(-policy.Keep)); err != nil {
+			return fmt.Errorf("retention: %s: %w", policy.Table, err)
+		}
+	}
+	if err := p.vacuum(); err != nil {
+		return fmt.Errorf("retention: %w", err)
+	}
+	return nil
+}
+
+func (p *Pruner) prune(policy *Policy, before time.Time) error {
+	consumers, err := json.Marshal(policy.Consumers)
+	if err != nil {
+		return err
+	}
+	deleted := deletedCounter.With(policy.Table)
+	var total int64
+	for {
+		n, err := p.batch(policy, string(consumers), before)
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			break
+		}
+		total += n
+		deleted.Add(float64(n))
+	}
+	if total > 0 {
+		p.log.Info("pruned", zap.String("table", policy.Table), zap.Int64("rows", total))
+	}
+	return nil
+}
+
+// batch deletes one batch of rows, and returns how many.
+func (p *Pruner) batch(policy *Policy, consumers string, before time.Time) (deleted int64, err error) {
+	conn := p.db.Get(p.ctx)
+	if conn == nil {
+		return 0, context.Canceled
+	}
+	defer p.db.Put(conn)
+	defer sqlitex.Save(conn)(&err)
+
+	var watermark int64
+	{
+		stmt := fetch_watermark.Prep(conn)
+		defer stmt.Finalize()
+		stmt.SetText("@consumers", consumers)
+		if err := database.Row(stmt); err != nil {
+			return 0, fmt.Errorf("fetching watermark: %w", err)
+		}
+		if stmt.GetInt64("known") < int64(len(policy.Consumers)) {
+			// someone has not processed anything yet
+			return 0, nil
+		}
+		watermark = stmt.GetInt64("watermark")
+		if err := database.NoMoreRows(stmt); err != nil {
+			return 0, err
+		}
+	}
+
+	var upto int64
+	{
+		stmt := conn.Prep(policy.BatchSQL)
+		defer stmt.Finalize()
+		stmt.SetInt64("@watermark", watermark)
+		stmt.SetText("@consumers", consumers)
+		database.BindTime(stmt, "@before", before)
+		stmt.SetInt64("@limit", int64(p.config.batchSize))
+		if err := database.Row(stmt); err != nil {
+			return 0, fmt.Errorf("fetching batch: %w", err)
+		}
+		if stmt.ColumnType(stmt.ColumnIndex("upto")) == sqlite.SQLITE_NULL {
+			return 0, nil
+		}
+		upto = stmt.GetInt64("upto")
+		if err := database.NoMoreRows(stmt); err != nil {
+			return 0, err
+		}
+	}
+
+	if policy.Archive != nil {
+		if err := archive(conn, policy, consumers, upto, before); err != nil {
+			return 0, fmt.Errorf("archive: %w", err)
+		}
+	}
+
+	stmt := conn.Prep(policy.DeleteSQL)
+	defer stmt.Finalize()
+	stmt.SetText("@consumers", consumers)
+	stmt.SetInt64("@upto", upto)
+	database.BindTime(stmt, "@before", before)
+	if _, err := stmt.Step(); err != nil {
+		return 0, fmt.Errorf("deleting: %w", err)
+	}
+	return int64(conn.Changes()), nil
+}
+
+func archive(conn *sqlite.Conn, policy *Policy, consumers string, upto int64, before time.Time) error {
+	if err := archiveTable(conn, policy, policy.Table, policy.SelectSQL, consumers, upto, before); err != nil {
+		return err
+	}
+	for _, r := range policy.Related {
+		if err := archiveTable(conn, policy, r.Table, r.SelectSQL, consumers, upto, before); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func archiveTable(conn *sqlite.Conn, policy *Policy, table, query string, consumers string, upto int64, before time.Time) error {
+	stmt := conn.Prep(query)
+	defer stmt.Finalize()
+	stmt.SetText("@consumers", consumers)
+	stmt.SetInt64("@upto", upto)
+	database.BindTime(stmt, "@before", before)
+	return policy.Archive(table, stmt)
+}
+
+// vacuum returns free pages to the filesystem, a few at a time, if
+// the database uses incremental vacuum.
+func (p *Pruner) vacuum() error {
+	prev := int64(-1)
+	for {
+		free, err := p.vacuumStep()
+		if err != nil {
+			return err
+		}
+		if free == 0 || free == prev {
+			return nil
+		}
+		prev = free
+	}
+}
+
+// vacuumStep returns some free pages to the filesystem, and reports
+// how many there were before that.
+func (p *Pruner) vacuumStep() (free int64, err error) {
+	conn := p.db.Get(p.ctx)
+	if conn == nil {
+		return 0, context.Canceled
+	}
+	defer p.db.Put(conn)
+
+	mode, err := pragmaInt(conn, "PRAGMA auto_vacuum;")
+	if err != nil {
+		return 0, err
+	}
+	const incremental = 2
+	if mode != incremental {
+		return 0, nil
+	}
+	free, err = pragmaInt(conn, "PRAGMA freelist_count;")
+	if err != nil {
+		return 0, err
+	}
+	if free == 0 {
+		return 0, nil
+	}
+	query := fmt.Sprintf("PRAGMA incremental_vacuum(%d);", vacuumPages)
+	if err := sqlitex.ExecTransient(conn, query, nil); err != nil {
+		return 0, fmt.Errorf("incremental vacuum: %w", err)
+	}
+	return free, nil
+}
+
+func pragmaInt(conn *sqlite.Conn, query string) (int64, error) {
+	stmt, _, err := conn.PrepareTransient(query)
+	if err != nil {
+		return 0, err
+	}
+	defer stmt.Finalize()
+	n, err := sqlitex.ResultInt64(stmt)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", query, err)
+	}
+	return n, nil
+}
+
+// EnableIncrementalVacuum switches an existing database to incremental
+// vacuum, so space freed by retention policies can be returned to the
+// filesystem. This rewrites the whole database, and needs as much free
+// space as the database takes; run it while nothing else is using the
+// database. New databases use incremental vacuum from the start.
+func EnableIncrementalVacuum(ctx context.Context, db *database.DB) error {
+	conn := db.Get(ctx)
+	if conn == nil {
+		return context.Canceled
+	}
+	defer db.Put(conn)
+	if err := sqlitex.ExecTransient(conn, "PRAGMA auto_vacuum=INCREMENTAL;", nil); err != nil {
+		return err
+	}
+	if err := sqlitex.ExecTransient(conn, "VACUUM;", nil); err != nil {
+		return fmt.Errorf("vacuum: %w", err)
+	}
+	return nil
+}
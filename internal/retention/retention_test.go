@@ -0,0 +1,322 @@
+package retention_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"crawshaw.io/sqlite"
+	"crawshaw.io/sqlite/sqlitex"
+	"eagain.net/go/securityblanket/internal/database"
+	"eagain.net/go/securityblanket/internal/retention"
+	"github.com/google/go-cmp/cmp"
+	"go.uber.org/zap/zaptest"
+)
+
+func execScript(t testing.TB, db *database.DB, sql string) {
+	conn := db.Get(nil)
+	defer db.Put(conn)
+
+	if err := sqlitex.ExecScript(conn, sql); err != nil {
+		t.Fatalf("database error: %v", err)
+	}
+}
+
+var start = time.Date(2020, 2, 3, 4, 5, 6, 0, time.UTC)
+
+// addRaw adds n raw messages, one day apart starting at start.
+func addRaw(t testing.TB, db *database.DB, n int) {
+	var sql strings.Builder
+	ts := start
+	for i := 0; i < n; i++ {
+		fmt.Fprintf(&sql, `
+INSERT INTO rtl433_raw(time, freqMHz, model, data)
+VALUES ('%s', 345, 'Honeywell-Security', '{"padding": "%s"}');
+`, ts.Format(time.RFC3339Nano), strings.Repeat("x", 2000))
+		ts = ts.Add(24 * time.Hour)
+	}
+	execScript(t, db, sql.String())
+}
+
+func setLast(t testing.TB, db *database.DB, consumer string, last int64) {
+	execScript(t, db, fmt.Sprintf(`
+INSERT INTO catchup(name, last) VALUES ('%s', %d)
+	ON CONFLICT(name) DO UPDATE SET last=excluded.last;
+`, consumer, last))
+}
+
+func rawIDs(t testing.TB, db *database.DB) []int64 {
+	conn := db.Get(nil)
+	defer db.Put(conn)
+	stmt := conn.Prep(`SELECT id FROM rtl433_raw ORDER BY id`)
+	defer stmt.Finalize()
+	var ids []int64
+	for {
+		hasRow, err := stmt.Step()
+		if err != nil {
+			t.Fatalf("database error: %v", err)
+		}
+		if !hasRow {
+			break
+		}
+		ids = append(ids, stmt.GetInt64("id"))
+	}
+	return ids
+}
+
+func newPruner(t testing.TB, db *database.DB, now time.Time, policy *retention.Policy) *retention.Pruner {
+	return retention.New(context.Background(), db, zaptest.NewLogger(t),
+		[]*retention.Policy{policy},
+		retention.Clock(func() time.Time { return now }),
+		retention.BatchSize(2),
+	)
+}
+
+func rawPolicy(t testing.TB, keep time.Duration) *retention.Policy {
+	policy, err := retention.For("rtl433_raw", keep)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return policy
+}
+
+func TestConsumers(t *testing.T) {
+	for table, want := range map[string][]string{
+		"rtl433_raw": {
+			"honeywell5800.receive",
+			"rfjam.noise",
+		},
+		"honeywell5800_updates": {
+			"honeywell5800.battery",
+			"honeywell5800.signal",
+			"honeywell5800.supervise",
+			"honeywell5800.tamper",
+			"honeywell5800.trip",
+		},
+	} {
+		p, err := retention.For(table, time.Hour)
+		if err != nil {
+			t.Fatalf("policy: %v", err)
+		}
+		if diff := cmp.Diff(want, p.Consumers); diff != "" {
+			t.Errorf("wrong consumers of %s: -want +got\n%s", table, diff)
+		}
+	}
+}
+
+func TestPrune(t *testing.T) {
+	db := database.Scratch()
+	addRaw(t, db, 10)
+	setLast(t, db, "honeywell5800.receive", 10)
+	setLast(t, db, "rfjam.noise", 10)
+
+	// ten days in, keeping a week leaves days 3 to 9
+	now := start.Add(10 * 24 * time.Hour)
+	p := newPruner(t, db, now, rawPolicy(t, 7*24*time.Hour))
+	if err := p.Run(); err != nil {
+		t.Fatalf("run: %v", err)
+	}
+	want := []int64{4, 5, 6, 7, 8, 9, 10}
+	if diff := cmp.Diff(want, rawIDs(t, db)); diff != "" {
+		t.Errorf("wrong rows left: -want +got\n%s", diff)
+	}
+}
+
+func TestPruneWatermark(t *testing.T) {
+	db := database.Scratch()
+	addRaw(t, db, 10)
+	now := start.Add(100 * 24 * time.Hour)
+	p := newPruner(t, db, now, rawPolicy(t, 24*time.Hour))
+
+	// one consumer has not processed anything yet
+	setLast(t, db, "honeywell5800.receive", 10)
+	if err := p.Run(); err != nil {
+		t.Fatalf("run: %v", err)
+	}
+	if got := len(rawIDs(t, db)); got != 10 {
+		t.Errorf("rows pruned before every consumer saw them: %d left", got)
+	}
+
+	setLast(t, db, "rfjam.noise", 3)
+	if err := p.Run(); err != nil {
+		t.Fatalf("run: %v", err)
+	}
+	want := []int64{4, 5, 6, 7, 8, 9, 10}
+	if diff := cmp.Diff(want, rawIDs(t, db)); diff != "" {
+		t.Errorf("wrong rows left: -want +got\n%s", diff)
+	}
+}
+
+func TestPruneDeadLetters(t *testing.T) {
+	db := database.Scratch()
+	addRaw(t, db, 10)
+	setLast(t, db, "honeywell5800.receive", 10)
+	setLast(t, db, "rfjam.noise", 10)
+	// skipped by one consumer, and by someone not reading the table
+	execScript(t, db, fmt.Sprintf(`
+INSERT INTO catchup_dead_letters(consumer, source, attempts, error, firstFailed, lastFailed, skipped)
+VALUES
+	('rfjam.noise', 3, 3, 'bad', '%[1]s', '%[1]s', '%[1]s'),
+	('honeywell5800.trip', 5, 3, 'bad', '%[1]s', '%[1]s', '%[1]s');
+`, start.Format(time.RFC3339Nano)))
+
+	now := start.Add(100 * 24 * time.Hour)
+	p := newPruner(t, db, now, rawPolicy(t, 24*time.Hour))
+	if err := p.Run(); err != nil {
+		t.Fatalf("run: %v", err)
+	}
+	want := []int64{3}
+	if diff := cmp.Diff(want, rawIDs(t, db)); diff != "" {
+		t.Errorf("wrong rows left: -want +got\n%s", diff)
+	}
+}
+
+func TestArchive(t *testing.T) {
+	db := database.Scratch()
+	addRaw(t, db, 5)
+	setLast(t, db, "honeywell5800.receive", 5)
+	setLast(t, db, "rfjam.noise", 5)
+	now := start.Add(100 * 24 * time.Hour)
+
+	policy := rawPolicy(t, 24*time.Hour)
+	var archived []int64
+	policy.Archive = func(table string, rows *sqlite.Stmt) error {
+		if table != "rtl433_raw" {
+			t.Errorf("wrong table: %q", table)
+		}
+		var batch []int64
+		for {
+			hasRow, err := rows.Step()
+			if err != nil {
+				return err
+			}
+			if !hasRow {
+				break
+			}
+			batch = append(batch, rows.GetInt64("id"))
+		}
+		if len(archived)+len(batch) > 2 {
+			return errors.New("archive is full")
+		}
+		archived = append(archived, batch...)
+		return nil
+	}
+	p := newPruner(t, db, now, policy)
+	if err := p.Run(); err == nil {
+		t.Fatal("expected an error from archive")
+	}
+	if diff := cmp.Diff([]int64{1, 2}, archived); diff != "" {
+		t.Errorf("wrong archived batches: -want +got\n%s", diff)
+	}
+	// the failed batch was not deleted
+	want := []int64{3, 4, 5}
+	if diff := cmp.Diff(want, rawIDs(t, db)); diff != "" {
+		t.Errorf("wrong rows left: -want +got\n%s", diff)
+	}
+}
+
+func pragma(t testing.TB, db *database.DB, query string) int64 {
+	conn := db.Get(nil)
+	defer db.Put(conn)
+	stmt, _, err := conn.PrepareTransient(query)
+	if err != nil {
+		t.Fatalf("database error: %v", err)
+	}
+	defer stmt.Finalize()
+	n, err := sqlitex.ResultInt64(stmt)
+	if err != nil {
+		t.Fatalf("database error: %v", err)
+	}
+	return n
+}
+
+func TestVacuum(t *testing.T) {
+	db := database.Scratch()
+	if got := pragma(t, db, "PRAGMA auto_vacuum;"); got != 2 {
+		t.Fatalf("new database does not use incremental vacuum: %d", got)
+	}
+	addRaw(t, db, 50)
+	setLast(t, db, "honeywell5800.receive", 50)
+	setLast(t, db, "rfjam.noise", 50)
+	before := pragma(t, db, "PRAGMA page_count;")
+
+	now := start.Add(100 * 24 * time.Hour)
+	p := newPruner(t, db, now, rawPolicy(t, 24*time.Hour))
+	if err := p.Run(); err != nil {
+		t.Fatalf("run: %v", err)
+	}
+	if got := pragma(t, db, "PRAGMA freelist_count;"); got != 0 {
+		t.Errorf("free pages left: %d", got)
+	}
+	if after := pragma(t, db, "PRAGMA page_count;"); after >= before {
+		t.Errorf("database did not shrink: %d -> %d pages", before, after)
+	}
+}
+
+func TestPruneUpdates(t *testing.T) {
+	db := database.Scratch()
+	var sql strings.Builder
+	sql.WriteString(`
+INSERT INTO honeywell5800_sensors(id) VALUES (1), (2);
+`)
+	ts := start
+	for i := 1; i <= 6; i++ {
+		// sensor 2 is only heard from once
+		sensor := 1
+		if i == 3 {
+			sensor = 2
+		}
+		fmt.Fprintf(&sql, `
+INSERT INTO honeywell5800_updates(id, time, channel, sensor, event)
+VALUES (%d, '%s', 8, %d, 0);
+`, i, ts.Format(time.RFC3339Nano), sensor)
+		ts = ts.Add(time.Hour)
+	}
+	sql.WriteString(`
+INSERT INTO honeywell5800_trips(sensor, loop, trippedBy, clearedBy)
+VALUES (1, 1, 2, 4);
+`)
+	execScript(t, db, sql.String())
+	for _, name := range []string{
+		"honeywell5800.battery",
+		"honeywell5800.signal",
+		"honeywell5800.supervise",
+		"honeywell5800.tamper",
+		"honeywell5800.trip",
+	} {
+		setLast(t, db, name, 6)
+	}
+
+	policy, err := retention.For("honeywell5800_updates", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := newPruner(t, db, start.Add(100*24*time.Hour), policy)
+	if err := p.Run(); err != nil {
+		t.Fatalf("run: %v", err)
+	}
+
+	conn := db.Get(nil)
+	defer db.Put(conn)
+	stmt := conn.Prep(`SELECT id FROM honeywell5800_updates ORDER BY id`)
+	defer stmt.Finalize()
+	var got []int64
+	for {
+		hasRow, err := stmt.Step()
+		if err != nil {
+			t.Fatalf("database error: %v", err)
+		}
+		if !hasRow {
+			break
+		}
+		got = append(got, stmt.GetInt64("id"))
+	}
+	// trip, latest of sensor 2, trip, latest of sensor 1
+	want := []int64{2, 3, 4, 6}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("wrong updates left: -want +got\n%s", diff)
+	}
+}
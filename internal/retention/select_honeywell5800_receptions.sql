@@ -0,0 +1,18 @@
+-- Receptions of the updates select_honeywell5800_updates.sql returns,
+-- which go with them by cascade.
+SELECT r.*
+FROM honeywell5800_receptions AS r
+JOIN honeywell5800_updates AS u
+ON (u.id=r.sensorUpdate)
+WHERE u.id<=@upto
+	AND u.time<@before
+	AND NOT EXISTS (SELECT 1 FROM honeywell5800_trips WHERE trippedBy=u.id OR clearedBy=u.id)
+	AND NOT EXISTS (SELECT 1 FROM honeywell5800_supervision_losses WHERE lastSeen=u.id OR restoredBy=u.id)
+	AND NOT EXISTS (SELECT 1 FROM honeywell5800_tampers WHERE openedBy=u.id OR closedBy=u.id)
+	AND u.id<(SELECT max(id) FROM honeywell5800_updates WHERE sensor=u.sensor)
+	AND NOT EXISTS (
+		SELECT 1 FROM catchup_dead_letters
+		WHERE consumer IN (SELECT value FROM json_each(@consumers))
+			AND source=u.id
+	)
+ORDER BY r.sensorUpdate, r.receiver
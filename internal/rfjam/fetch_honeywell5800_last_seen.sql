@@ -0,0 +1,16 @@
+-- Sensors with a known heartbeat interval, and when they were last
+-- heard from.
+SELECT
+	honeywell5800_signal_stats.sensor AS sensor,
+	honeywell5800_signal_stats.heartbeatInterval AS heartbeatInterval,
+	last.id AS lastSeen,
+	last.time AS lastSeenTime
+FROM honeywell5800_signal_stats
+LEFT JOIN honeywell5800_updates AS last
+ON (last.id=(
+	SELECT max(id)
+	FROM honeywell5800_updates
+	WHERE sensor=honeywell5800_signal_stats.sensor
+))
+WHERE honeywell5800_signal_stats.heartbeatInterval IS NOT NULL
+ORDER BY honeywell5800_signal_stats.sensor
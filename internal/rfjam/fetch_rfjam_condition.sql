@@ -0,0 +1,6 @@
+SELECT active, baseline
+	FROM rfjam_conditions
+	WHERE kind=@kind
+	AND receiver=@receiver
+	ORDER BY id DESC
+	LIMIT 1
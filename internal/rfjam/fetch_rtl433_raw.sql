@@ -0,0 +1,11 @@
+SELECT
+	id,
+	time,
+	receiver,
+	noise
+FROM rtl433_raw
+WHERE id>@last
+	AND id<=@max
+	AND noise IS NOT NULL
+ORDER BY id ASC
+LIMIT 100
@@ -0,0 +1,7 @@
+SELECT id, time, noise
+	FROM rtl433_raw
+	WHERE receiver=@receiver
+	AND id<=@id
+	AND noise IS NOT NULL
+	ORDER BY id DESC
+	LIMIT @limit
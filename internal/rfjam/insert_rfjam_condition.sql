@@ -0,0 +1,20 @@
+INSERT INTO rfjam_conditions(
+	time,
+	kind,
+	receiver,
+	active,
+	noise,
+	baseline,
+	silentSensors,
+	sensors
+)
+	VALUES (
+		@time,
+		@kind,
+		@receiver,
+		@active,
+		@noise,
+		@baseline,
+		@silentSensors,
+		@sensors
+	)
@@ -0,0 +1,478 @@
+// Package rfjam detects signs of someone jamming the radio.
+//
+// Two independent signals are watched:
+//
+// A raised noise floor, as seen in the noise level rtl_433 "-M level"
+// reports with every transmission, compared to the recent normal
+// level of the same receiver. This catches jamming that still lets
+// some transmissions through. The noise level is only known when
+// something is decoded: the periodic "-M stats" reports are not
+// used, so both the baseline and the current level come from decoded
+// transmissions only, and a jammer that drowns out everything shows
+// up as silence instead.
+//
+// Many sensors going silent at the same time, as judged by their
+// usual heartbeat interval (see hw58signal). This catches jamming
+// strong enough that nothing gets decoded, and needs Run to be called
+// periodically even when no messages arrive. Sensors cannot be heard
+// while the daemon or their receiver is down, so that time does not
+// count as silence; see package downtime.
+//
+// Changes are recorded in the rfjam_conditions table.
+package rfjam
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"crawshaw.io/sqlite"
+	"crawshaw.io/sqlite/sqlitex"
+	"eagain.net/go/securityblanket/internal/catchup"
+	"eagain.net/go/securityblanket/internal/database"
+	"eagain.net/go/securityblanket/internal/downtime"
+	"eagain.net/go/securityblanket/internal/honeywell5800"
+	"go.uber.org/zap"
+)
+
+const (
+	kindNoise   = "noise"
+	kindSilence = "silence"
+)
+
+const (
+	// how many latest samples to use for the normal noise floor
+	baselineSamples = 500
+	// how many samples are needed before the noise floor is trusted
+	minBaselineSamples = 20
+	// sensors not heard from in this long are considered gone, not
+	// jammed
+	staleSensor = 7 * 24 * time.Hour
+)
+
+type config struct {
+	noiseMargin    float64
+	noiseSamples   int
+	baselineWindow time.Duration
+	silenceFactor  float64
+	silentSensors  int
+	silentFraction float64
+	started        time.Time
+	clock          func() time.Time
+	wakeup         func()
+}
+
+type Option option
+
+type option func(*config)
+
+// NoiseMargin sets how many dB above the normal noise floor counts as
+// jamming. The condition clears when the noise drops below half the
+// margin.
+func NoiseMargin(dB float64) Option {
+	fn := func(conf *config) {
+		conf.noiseMargin = dB
+	}
+	return fn
+}
+
+// NoiseSamples sets how many consecutive samples need to be above (or
+// below) the threshold to raise (or clear) the noise condition.
+func NoiseSamples(n int) Option {
+	fn := func(conf *config) {
+		conf.noiseSamples = n
+	}
+	return fn
+}
+
+// BaselineWindow sets how far back to look for the normal noise
+// floor.
+func BaselineWindow(d time.Duration) Option {
+	fn := func(conf *config) {
+		conf.baselineWindow = d
+	}
+	return fn
+}
+
+// SilenceFactor sets how many heartbeat intervals a sensor can go
+// unheard before it counts as silent.
+func SilenceFactor(f float64) Option {
+	fn := func(conf *config) {
+		conf.silenceFactor = f
+	}
+	return fn
+}
+
+// SilentSensors sets how many sensors need to go silent at the same
+// time to raise the silence condition. A single silent sensor is
+// more likely a dead battery than jamming.
+func SilentSensors(n int) Option {
+	fn := func(conf *config) {
+		conf.silentSensors = n
+	}
+	return fn
+}
+
+// SilentFraction sets what fraction of the sensors need to go silent
+// at the same time to raise the silence condition.
+func SilentFraction(f float64) Option {
+	fn := func(conf *config) {
+		conf.silentFraction = f
+	}
+	return fn
+}
+
+// Started sets when the process started listening to the sensors.
+// The default is the time New was called.
+func Started(t time.Time) Option {
+	fn := func(conf *config) {
+		conf.started = t
+	}
+	return fn
+}
+
+// Clock overrides the source of time used for detecting silence.
+func Clock(clock func() time.Time) Option {
+	fn := func(conf *config) {
+		conf.clock = clock
+	}
+	return fn
+}
+
+// Wakeup is called whenever a condition is raised or cleared.
+func Wakeup(wakeup func()) Option {
+	fn := func(conf *config) {
+		conf.wakeup = wakeup
+	}
+	return fn
+}
+
+type Detector struct {
+	ctx     context.Context
+	db      *database.DB
+	catchup *catchup.Catchup
+	log     *zap.Logger
+	config  config
+}
+
+func New(ctx context.Context, db *database.DB, log *zap.Logger, opts ...Option) *Detector {
+	d := &Detector{
+		ctx: ctx,
+		db:  db,
+		catchup: catchup.New(&catchup.Config{
+			DB:      db,
+			Log:     log.Named("catchup"),
+			Name:    "rfjam.noise",
+			MaxSQL:  fetch_rtl433_raw_max.Content,
+			NextSQL: fetch_rtl433_raw.Content,
+		}),
+		log: log,
+		config: config{
+			noiseMargin:    10,
+			noiseSamples:   3,
+			baselineWindow: 24 * time.Hour,
+			silenceFactor:  2.5,
+			silentSensors:  3,
+			silentFraction: 0.5,
+			clock:          time.Now,
+			wakeup:         func() {},
+		},
+	}
+	for _, opt := range opts {
+		opt(&d.config)
+	}
+	if d.config.started.IsZero() {
+		d.config.started = d.config.clock()
+	}
+	return d
+}
+
+// Run processes new noise samples, and checks for silent sensors.
+func (d *Detector) Run() error {
+	if err := d.catchup.Run(d.ctx, d.runNoise); err != nil {
+		return err
+	}
+	if err := d.checkSilence(); err != nil {
+		return fmt.Errorf("rfjam silence: %w", err)
+	}
+	return nil
+}
+
+func median(values []float64) float64 {
+	s := append([]float64(nil), values...)
+	sort.Float64s(s)
+	mid := len(s) / 2
+	if len(s)%2 == 0 {
+		return (s[mid-1] + s[mid]) / 2
+	}
+	return s[mid]
+}
+
+type condition struct {
+	active   bool
+	baseline float64
+}
+
+func fetchCondition(conn *sqlite.Conn, kind, receiver string) (condition, error) {
+	stmt := fetch_rfjam_condition.Prep(conn)
+	defer stmt.Finalize()
+	stmt.SetText("@kind", kind)
+	stmt.SetText("@receiver", receiver)
+	hasRow, err := stmt.Step()
+	if err != nil {
+		return condition{}, err
+	}
+	if !hasRow {
+		return condition{}, nil
+	}
+	c := condition{
+		active: stmt.GetInt64("active") != 0,
+	}
+	if f, ok, err := database.GetNullFloat(stmt, "baseline"); err != nil {
+		return condition{}, err
+	} else if ok {
+		c.baseline = f
+	}
+	return c, nil
+}
+
+type change struct {
+	time     time.Time
+	kind     string
+	receiver string
+	active   bool
+	// noise
+	noise    float64
+	baseline float64
+	// silence
+	silent  int
+	sensors int
+}
+
+func (d *Detector) addChange(conn *sqlite.Conn, c *change) error {
+	stmt := insert_rfjam_condition.Prep(conn)
+	defer stmt.Finalize()
+	database.BindTime(stmt, "@time", c.time)
+	stmt.SetText("@kind", c.kind)
+	stmt.SetText("@receiver", c.receiver)
+	stmt.SetBool("@active", c.active)
+	isNoise := c.kind == kindNoise
+	database.BindNullFloat(stmt, "@noise", c.noise, isNoise)
+	database.BindNullFloat(stmt, "@baseline", c.baseline, isNoise)
+	if isNoise {
+		stmt.SetNull("@silentSensors")
+		stmt.SetNull("@sensors")
+	} else {
+		stmt.SetInt64("@silentSensors", int64(c.silent))
+		stmt.SetInt64("@sensors", int64(c.sensors))
+	}
+	if _, err := stmt.Step(); err != nil {
+		return fmt.Errorf("cannot record jamming condition: %w", err)
+	}
+
+	if c.active {
+		d.log.Warn("jamming",
+			zap.String("kind", c.kind),
+			zap.String("receiver", c.receiver),
+			zap.Float64("noise", c.noise),
+			zap.Float64("baseline", c.baseline),
+			zap.Int("silent", c.silent),
+			zap.Int("sensors", c.sensors),
+		)
+	} else {
+		d.log.Info("jamming.cleared",
+			zap.String("kind", c.kind),
+			zap.String("receiver", c.receiver),
+		)
+	}
+	d.config.wakeup()
+	return nil
+}
+
+type noiseSample struct {
+	id    int64
+	time  time.Time
+	noise float64
+}
+
+// fetchNoise returns up to limit latest noise samples of receiver,
+// up to and including id, latest first.
+func fetchNoise(conn *sqlite.Conn, receiver string, id int64, limit int) ([]noiseSample, error) {
+	stmt := fetch_rtl433_raw_noise.Prep(conn)
+	defer stmt.Finalize()
+	stmt.SetText("@receiver", receiver)
+	stmt.SetInt64("@id", id)
+	stmt.SetInt64("@limit", int64(limit))
+	var samples []noiseSample
+	for {
+		hasRow, err := stmt.Step()
+		if err != nil {
+			return nil, err
+		}
+		if !hasRow {
+			break
+		}
+		ts, err := database.GetTime(stmt, "time")
+		if err != nil {
+			return nil, err
+		}
+		samples = append(samples, noiseSample{
+			id:    stmt.GetInt64("id"),
+			time:  ts,
+			noise: stmt.GetFloat("noise"),
+		})
+	}
+	return samples, nil
+}
+
+func (d *Detector) runNoise(conn *sqlite.Conn, stmt *sqlite.Stmt) error {
+	rawID := stmt.GetInt64("id")
+	receiver := stmt.GetText("receiver")
+	ts, err := database.GetTime(stmt, "time")
+	if err != nil {
+		return fmt.Errorf("bad raw message time: %w", err)
+	}
+
+	recent, err := fetchNoise(conn, receiver, rawID, d.config.noiseSamples)
+	if err != nil {
+		return fmt.Errorf("error fetching noise samples: %w", err)
+	}
+	if len(recent) < d.config.noiseSamples {
+		return nil
+	}
+
+	cond, err := fetchCondition(conn, kindNoise, receiver)
+	if err != nil {
+		return fmt.Errorf("error fetching jamming condition: %w", err)
+	}
+
+	baseline := cond.baseline
+	if !cond.active {
+		// While jamming, the noise floor is frozen at what it was
+		// before. Otherwise a long enough jam would become the new
+		// normal.
+		oldest := recent[len(recent)-1]
+		history, err := fetchNoise(conn, receiver, oldest.id-1, baselineSamples)
+		if err != nil {
+			return fmt.Errorf("error fetching noise floor: %w", err)
+		}
+		since := ts.Add(-d.config.baselineWindow)
+		var levels []float64
+		for _, s := range history {
+			if s.time.Before(since) {
+				break
+			}
+			levels = append(levels, s.noise)
+		}
+		if len(levels) < minBaselineSamples {
+			return nil
+		}
+		baseline = median(levels)
+	}
+
+	raiseAt := baseline + d.config.noiseMargin
+	clearAt := baseline + d.config.noiseMargin/2
+	above, below := 0, 0
+	for _, s := range recent {
+		if s.noise > raiseAt {
+			above++
+		}
+		if s.noise < clearAt {
+			below++
+		}
+	}
+
+	switch {
+	case !cond.active && above == len(recent):
+	case cond.active && below == len(recent):
+	default:
+		return nil
+	}
+	return d.addChange(conn, &change{
+		time:     ts,
+		kind:     kindNoise,
+		receiver: receiver,
+		active:   !cond.active,
+		noise:    recent[0].noise,
+		baseline: baseline,
+	})
+}
+
+// countSilent returns how many sensors are normally heard from, and
+// how many of them have gone silent.
+func (d *Detector) countSilent(conn *sqlite.Conn, now time.Time) (silent int, sensors int, err error) {
+	stmt := fetch_honeywell5800_last_seen.Prep(conn)
+	defer stmt.Finalize()
+	for {
+		hasRow, err := stmt.Step()
+		if err != nil {
+			return 0, 0, err
+		}
+		if !hasRow {
+			break
+		}
+		sensor := honeywell5800.SensorFromSQL(stmt, "sensor")
+		lastSeenTime, err := database.GetTime(stmt, "lastSeenTime")
+		if err != nil {
+			return 0, 0, fmt.Errorf("bad last seen time: %v: %w", sensor, err)
+		}
+		if lastSeenTime.IsZero() || now.Sub(lastSeenTime) > staleSensor {
+			continue
+		}
+		quiet, err := d.quiet(conn, stmt.GetInt64("lastSeen"), lastSeenTime, now)
+		if err != nil {
+			return 0, 0, fmt.Errorf("downtime: %v: %w", sensor, err)
+		}
+		sensors++
+		interval := time.Duration(stmt.GetFloat("heartbeatInterval") * float64(time.Second))
+		if float64(quiet) > d.config.silenceFactor*float64(interval) {
+			silent++
+		}
+	}
+	return silent, sensors, nil
+}
+
+// quiet returns for how long a sensor last heard at lastSeen, in
+// update, has been silent. It could not have been heard while the
+// daemon or the receiver was down.
+func (d *Detector) quiet(conn *sqlite.Conn, update int64, lastSeen, now time.Time) (time.Duration, error) {
+	down, err := downtime.Between(conn, update, d.config.started, lastSeen, now)
+	if err != nil {
+		return 0, err
+	}
+	return now.Sub(lastSeen) - down, nil
+}
+
+func (d *Detector) checkSilence() (err error) {
+	conn := d.db.Get(d.ctx)
+	if conn == nil {
+		return context.Canceled
+	}
+	defer d.db.Put(conn)
+	defer sqlitex.Save(conn)(&err)
+
+	now := d.config.clock()
+	silent, sensors, err := d.countSilent(conn, now)
+	if err != nil {
+		return fmt.Errorf("error fetching sensors: %w", err)
+	}
+	jammed := sensors > 0 &&
+		silent >= d.config.silentSensors &&
+		float64(silent) >= d.config.silentFraction*float64(sensors)
+
+	cond, err := fetchCondition(conn, kindSilence, "")
+	if err != nil {
+		return fmt.Errorf("error fetching jamming condition: %w", err)
+	}
+	if jammed == cond.active {
+		return nil
+	}
+	return d.addChange(conn, &change{
+		time:    now,
+		kind:    kindSilence,
+		active:  jammed,
+		silent:  silent,
+		sensors: sensors,
+	})
+}
@@ -0,0 +1,402 @@
+package rfjam_test
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"crawshaw.io/sqlite/sqlitex"
+	"eagain.net/go/securityblanket/internal/database"
+	"eagain.net/go/securityblanket/internal/rfjam"
+	"github.com/google/go-cmp/cmp"
+	"go.uber.org/zap/zaptest"
+)
+
+func execScript(t testing.TB, db *database.DB, sql string) {
+	conn := db.Get(nil)
+	defer db.Put(conn)
+
+	if err := sqlitex.ExecScript(conn, sql); err != nil {
+		t.Fatalf("database error: %v", err)
+	}
+}
+
+var start = time.Date(2020, 2, 3, 4, 5, 6, 0, time.UTC)
+
+// addNoise adds synthetic raw messages with the given noise levels,
+// one minute apart starting at ts.
+func addNoise(t testing.TB, db *database.DB, receiver string, ts time.Time, levels ...float64) time.Time {
+	var sql strings.Builder
+	for _, noise := range levels {
+		fmt.Fprintf(&sql, `
+INSERT INTO rtl433_raw(time, freqMHz, receiver, model, noise, data)
+VALUES ('%s', 345, '%s', 'Honeywell-Security', %g, '{}');
+`, ts.Format(time.RFC3339Nano), receiver, noise)
+		ts = ts.Add(time.Minute)
+	}
+	execScript(t, db, sql.String())
+	return ts
+}
+
+// steady returns n noise levels wobbling around level.
+func steady(level float64, n int) []float64 {
+	levels := make([]float64, n)
+	for i := range levels {
+		levels[i] = level + float64(i%3) - 1
+	}
+	return levels
+}
+
+type condition struct {
+	Time     string
+	Kind     string
+	Receiver string
+	Active   bool
+	Noise    float64
+	Baseline float64
+	Silent   int64
+	Sensors  int64
+}
+
+func conditions(t testing.TB, db *database.DB) []condition {
+	conn := db.Get(nil)
+	defer db.Put(conn)
+	stmt := conn.Prep(`
+SELECT time, kind, receiver, active, noise, baseline, silentSensors, sensors
+FROM rfjam_conditions
+ORDER BY id
+`)
+	defer stmt.Finalize()
+	var got []condition
+	for {
+		hasRow, err := stmt.Step()
+		if err != nil {
+			t.Fatalf("database error: %v", err)
+		}
+		if !hasRow {
+			break
+		}
+		got = append(got, condition{
+			Time:     stmt.GetText("time"),
+			Kind:     stmt.GetText("kind"),
+			Receiver: stmt.GetText("receiver"),
+			Active:   stmt.GetInt64("active") != 0,
+			Noise:    stmt.GetFloat("noise"),
+			Baseline: stmt.GetFloat("baseline"),
+			Silent:   stmt.GetInt64("silentSensors"),
+			Sensors:  stmt.GetInt64("sensors"),
+		})
+	}
+	return got
+}
+
+func TestNoise(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	db := database.Scratch()
+	defer db.Close()
+
+	log := zaptest.NewLogger(t)
+	wakeups := 0
+	detector := rfjam.New(ctx, db, log,
+		rfjam.Wakeup(func() { wakeups++ }),
+	)
+
+	ts := addNoise(t, db, "attic", start, steady(-30, 30)...)
+	// a short burst is not jamming
+	ts = addNoise(t, db, "attic", ts, -12, -12, -30)
+	// the other receiver is unaffected throughout
+	addNoise(t, db, "garage", start, steady(-35, 40)...)
+	jamStart := ts
+	ts = addNoise(t, db, "attic", ts, -15, -14, -13, -13)
+	// noise dropping a bit is not enough to clear
+	ts = addNoise(t, db, "attic", ts, -22, -22, -22, -22)
+	jamEnd := ts.Add(2 * time.Minute)
+	addNoise(t, db, "attic", ts, steady(-30, 5)...)
+
+	if err := detector.Run(); err != nil {
+		t.Fatalf("run: %v", err)
+	}
+
+	want := []condition{
+		{
+			Time:     jamStart.Add(2 * time.Minute).Format(time.RFC3339Nano),
+			Kind:     "noise",
+			Receiver: "attic",
+			Active:   true,
+			Noise:    -13,
+			Baseline: -30,
+		},
+		{
+			Time:     jamEnd.Format(time.RFC3339Nano),
+			Kind:     "noise",
+			Receiver: "attic",
+			Active:   false,
+			Noise:    -29,
+			Baseline: -30,
+		},
+	}
+	if diff := cmp.Diff(want, conditions(t, db)); diff != "" {
+		t.Errorf("wrong conditions (-want +got):\n%s", diff)
+	}
+	if g, e := wakeups, 2; g != e {
+		t.Errorf("wrong number of wakeups: %v != %v", g, e)
+	}
+}
+
+func TestNoiseNoBaseline(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	db := database.Scratch()
+	defer db.Close()
+
+	log := zaptest.NewLogger(t)
+	detector := rfjam.New(ctx, db, log)
+
+	// too little history to know what is normal
+	ts := addNoise(t, db, "attic", start, steady(-30, 5)...)
+	addNoise(t, db, "attic", ts, -10, -10, -10)
+
+	if err := detector.Run(); err != nil {
+		t.Fatalf("run: %v", err)
+	}
+	if diff := cmp.Diff([]condition(nil), conditions(t, db)); diff != "" {
+		t.Errorf("wrong conditions (-want +got):\n%s", diff)
+	}
+}
+
+// addSensors adds synthetic sensors with hourly heartbeats, last
+// heard at ts.
+func addSensors(t testing.TB, db *database.DB, ts time.Time, sensors ...int) {
+	var sql strings.Builder
+	for _, sensor := range sensors {
+		fmt.Fprintf(&sql, `
+INSERT INTO honeywell5800_sensors(id, description) VALUES (%d, 'test');
+INSERT INTO honeywell5800_signal_stats(sensor, updated, samples, heartbeats, heartbeatInterval)
+VALUES (%d, '%s', 0, 10, 3600);
+`, sensor, sensor, ts.Format(time.RFC3339Nano))
+	}
+	execScript(t, db, sql.String())
+	heard(t, db, ts, sensors...)
+}
+
+func heard(t testing.TB, db *database.DB, ts time.Time, sensors ...int) {
+	var sql strings.Builder
+	for _, sensor := range sensors {
+		fmt.Fprintf(&sql, `
+INSERT INTO honeywell5800_updates(time, channel, sensor, event)
+VALUES ('%s', 8, %d, 4);
+`, ts.Format(time.RFC3339Nano), sensor)
+	}
+	execScript(t, db, sql.String())
+}
+
+func TestSilence(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	db := database.Scratch()
+	defer db.Close()
+
+	log := zaptest.NewLogger(t)
+	now := start
+	detector := rfjam.New(ctx, db, log,
+		rfjam.Clock(func() time.Time { return now }),
+	)
+
+	addSensors(t, db, start, 1, 2, 3, 4)
+	// gone for long enough to not count
+	addSensors(t, db, start.Add(-30*24*time.Hour), 5)
+
+	run := func() {
+		t.Helper()
+		if err := detector.Run(); err != nil {
+			t.Fatalf("run: %v", err)
+		}
+	}
+
+	// a missed heartbeat or two is normal
+	now = start.Add(2 * time.Hour)
+	heard(t, db, now, 1)
+	run()
+	if diff := cmp.Diff([]condition(nil), conditions(t, db)); diff != "" {
+		t.Errorf("wrong conditions (-want +got):\n%s", diff)
+	}
+
+	// three out of four have been silent for too long
+	now = start.Add(3 * time.Hour)
+	run()
+	jammed := now
+	// no change
+	now = start.Add(4 * time.Hour)
+	run()
+
+	// enough sensors are heard again
+	now = start.Add(5 * time.Hour)
+	heard(t, db, now, 2, 3)
+	run()
+
+	want := []condition{
+		{
+			Time:    jammed.Format(time.RFC3339Nano),
+			Kind:    "silence",
+			Active:  true,
+			Silent:  3,
+			Sensors: 4,
+		},
+		{
+			Time:    now.Format(time.RFC3339Nano),
+			Kind:    "silence",
+			Active:  false,
+			Silent:  2,
+			Sensors: 4,
+		},
+	}
+	if diff := cmp.Diff(want, conditions(t, db)); diff != "" {
+		t.Errorf("wrong conditions (-want +got):\n%s", diff)
+	}
+}
+
+func TestSilenceFewSensors(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	db := database.Scratch()
+	defer db.Close()
+
+	log := zaptest.NewLogger(t)
+	detector := rfjam.New(ctx, db, log,
+		rfjam.Clock(func() time.Time { return start.Add(24 * time.Hour) }),
+	)
+	// two dead sensors are not enough to suspect jamming
+	addSensors(t, db, start, 1, 2)
+	if err := detector.Run(); err != nil {
+		t.Fatalf("run: %v", err)
+	}
+	if diff := cmp.Diff([]condition(nil), conditions(t, db)); diff != "" {
+		t.Errorf("wrong conditions (-want +got):\n%s", diff)
+	}
+}
+
+func TestSilenceAfterStart(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	db := database.Scratch()
+	defer db.Close()
+
+	log := zaptest.NewLogger(t)
+	// the daemon was down for a day, and nobody was listening
+	started := start.Add(24 * time.Hour)
+	now := started
+	detector := rfjam.New(ctx, db, log,
+		rfjam.Clock(func() time.Time { return now }),
+		rfjam.Started(started),
+	)
+	addSensors(t, db, start, 1, 2, 3, 4)
+	run := func() {
+		t.Helper()
+		if err := detector.Run(); err != nil {
+			t.Fatalf("run: %v", err)
+		}
+	}
+
+	now = started.Add(time.Minute)
+	run()
+	if diff := cmp.Diff([]condition(nil), conditions(t, db)); diff != "" {
+		t.Fatalf("silence right after start (-want +got):\n%s", diff)
+	}
+
+	// still not heard from long after the start
+	now = started.Add(3 * time.Hour)
+	run()
+	want := []condition{{
+		Time:    now.Format(time.RFC3339Nano),
+		Kind:    "silence",
+		Active:  true,
+		Silent:  4,
+		Sensors: 4,
+	}}
+	if diff := cmp.Diff(want, conditions(t, db)); diff != "" {
+		t.Errorf("wrong conditions (-want +got):\n%s", diff)
+	}
+}
+
+func TestSilenceAfterReceiverRestart(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	db := database.Scratch()
+	defer db.Close()
+
+	log := zaptest.NewLogger(t)
+	now := start
+	detector := rfjam.New(ctx, db, log,
+		rfjam.Clock(func() time.Time { return now }),
+	)
+	addSensors(t, db, start, 1, 2, 3, 4)
+	// sensors 1-3 were last heard by receiver a, which was then down
+	// for a while
+	stopped := start.Add(30 * time.Minute)
+	resumed := start.Add(4 * time.Hour)
+	execScript(t, db, fmt.Sprintf(`
+INSERT INTO honeywell5800_receptions(sensorUpdate, receiver, raw, time)
+SELECT id, 'a', id, time FROM honeywell5800_updates WHERE sensor IN (1, 2, 3);
+INSERT INTO rtl433_restarts(time, freqMHz, receiver, started, uptime, error, resumes)
+VALUES ('%s', 345, 'a', '%s', 1800, 'rtl_tcp: connection refused', '%s');
+`, stopped.Format(time.RFC3339Nano), start.Format(time.RFC3339Nano), resumed.Format(time.RFC3339Nano)))
+	heard(t, db, resumed, 4)
+
+	now = resumed.Add(time.Hour)
+	if err := detector.Run(); err != nil {
+		t.Fatalf("run: %v", err)
+	}
+	if diff := cmp.Diff([]condition(nil), conditions(t, db)); diff != "" {
+		t.Errorf("silence right after receiver restart (-want +got):\n%s", diff)
+	}
+}
+
+func TestSilenceReceiverRestartRepeatedly(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	db := database.Scratch()
+	defer db.Close()
+
+	log := zaptest.NewLogger(t)
+	now := start
+	detector := rfjam.New(ctx, db, log,
+		rfjam.Clock(func() time.Time { return now }),
+	)
+	addSensors(t, db, start, 1, 2, 3, 4)
+	// sensors 1-3 were last heard by receiver a, which crashes every
+	// half an hour and is back a minute later
+	execScript(t, db, `
+INSERT INTO honeywell5800_receptions(sensorUpdate, receiver, raw, time)
+SELECT id, 'a', id, time FROM honeywell5800_updates WHERE sensor IN (1, 2, 3);
+`)
+	for i := 1; i <= 6; i++ {
+		stopped := start.Add(time.Duration(i) * 30 * time.Minute)
+		execScript(t, db, fmt.Sprintf(`
+INSERT INTO rtl433_restarts(time, freqMHz, receiver, started, uptime, error, resumes)
+VALUES ('%s', 345, 'a', '%s', 1740, 'rtl_tcp: connection refused', '%s');
+`,
+			stopped.Format(time.RFC3339Nano),
+			stopped.Add(-29*time.Minute).Format(time.RFC3339Nano),
+			stopped.Add(time.Minute).Format(time.RFC3339Nano),
+		))
+	}
+
+	now = start.Add(3 * time.Hour)
+	heard(t, db, now, 4)
+	if err := detector.Run(); err != nil {
+		t.Fatalf("run: %v", err)
+	}
+	want := []condition{{
+		Time:    now.Format(time.RFC3339Nano),
+		Kind:    "silence",
+		Active:  true,
+		Silent:  3,
+		Sensors: 4,
+	}}
+	if diff := cmp.Diff(want, conditions(t, db)); diff != "" {
+		t.Errorf("wrong conditions (-want +got):\n%s", diff)
+	}
+}
@@ -0,0 +1,160 @@
+package rtl433receive
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+
+	"eagain.net/go/securityblanket/internal/honeywell5800/hw58demod"
+	"go.uber.org/zap"
+)
+
+// default sample rate for raw IQ input, same as rtl_433
+const defaultSampleRate = 250000
+
+// ReceiveIQ decodes Honeywell 5800 transmissions from raw IQ samples
+// with the built-in demodulator instead of rtl_433, and passes them to
+// store in the same format rtl_433 would. It returns nil at the end of
+// input.
+//
+// Zero sampleRate means the rtl_433 default of 250 kHz.
+func ReceiveIQ(ctx context.Context, log *zap.Logger, r io.Reader, format hw58demod.Format, sampleRate uint64, store Store) error {
+	if sampleRate == 0 {
+		sampleRate = defaultSampleRate
+	}
+	count := 0
+	fn := func(msg *hw58demod.Message) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		count++
+		if err := store.Store(ctx, msg.RTL433JSON()); err != nil {
+			return fmt.Errorf("rtl433 store error: %w", err)
+		}
+		return nil
+	}
+	if err := hw58demod.Demodulate(r, format, sampleRate, fn); err != nil {
+		return err
+	}
+	log.Info("iq.done", zap.Int("messages", count))
+	return nil
+}
+
+// rtl_tcp command codes
+const (
+	rtlTCPSetFrequency  = 0x01
+	rtlTCPSetSampleRate = 0x02
+	rtlTCPSetGainMode   = 0x03
+)
+
+var rtlTCPMagic = []byte("RTL0")
+
+func rtlTCPCommand(w io.Writer, cmd byte, param uint32) error {
+	var buf [5]byte
+	buf[0] = cmd
+	binary.BigEndian.PutUint32(buf[1:], param)
+	_, err := w.Write(buf[:])
+	return err
+}
+
+// ReceiveRTLTCP connects to an rtl_tcp server at addr, tunes it as
+// described by radio, and decodes Honeywell 5800 transmissions with
+// the built-in demodulator. Only frequency and sample rate of radio
+// are used.
+//
+// Lost connections are retried as specified by opts; see Supervise.
+func ReceiveRTLTCP(ctx context.Context, log *zap.Logger, addr string, radio *Radio, store Store, opts ...Option) error {
+	sampleRate := radio.SampleRate
+	if sampleRate == 0 {
+		sampleRate = defaultSampleRate
+	}
+	conf := newConfig(opts)
+	runOnce := func(ctx context.Context) (*Exit, error) {
+		exit := &Exit{
+			Device:    "rtl_tcp://" + addr,
+			Frequency: radio.Frequency,
+			Start:     conf.clock(),
+			ExitCode:  -1,
+		}
+		defer func() {
+			exit.Stop = conf.clock()
+		}()
+
+		ctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+		var dialer net.Dialer
+		conn, err := dialer.DialContext(ctx, "tcp", addr)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			exit.Err = err
+			return exit, nil
+		}
+		defer conn.Close()
+		go func() {
+			<-ctx.Done()
+			_ = conn.Close()
+		}()
+
+		br := bufio.NewReader(conn)
+		var header [12]byte
+		if _, err := io.ReadFull(br, header[:]); err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			exit.Err = fmt.Errorf("reading rtl_tcp header: %v", err)
+			return exit, nil
+		}
+		if !bytes.Equal(header[:4], rtlTCPMagic) {
+			exit.Err = errors.New("not an rtl_tcp server")
+			return exit, nil
+		}
+		for _, c := range []struct {
+			cmd   byte
+			param uint32
+		}{
+			{rtlTCPSetSampleRate, uint32(sampleRate)},
+			{rtlTCPSetFrequency, uint32(radio.Frequency)},
+			// automatic gain
+			{rtlTCPSetGainMode, 0},
+		} {
+			if err := rtlTCPCommand(conn, c.cmd, c.param); err != nil {
+				if ctx.Err() != nil {
+					return nil, ctx.Err()
+				}
+				exit.Err = fmt.Errorf("configuring rtl_tcp: %v", err)
+				return exit, nil
+			}
+		}
+		log.Info("rtl_tcp.connected", zap.String("addr", addr))
+
+		var storeErr error
+		fn := func(msg *hw58demod.Message) error {
+			if err := store.Store(ctx, msg.RTL433JSON()); err != nil {
+				storeErr = fmt.Errorf("rtl433 store error: %w", err)
+				return storeErr
+			}
+			return nil
+		}
+		err = hw58demod.Demodulate(br, hw58demod.CU8, sampleRate, fn)
+		if storeErr != nil {
+			return nil, storeErr
+		}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		if err != nil {
+			exit.Err = fmt.Errorf("reading from rtl_tcp: %v", err)
+			return exit, nil
+		}
+		exit.Err = errors.New("rtl_tcp closed the connection")
+		return exit, nil
+	}
+	return supervise(ctx, log, conf, runOnce)
+}
@@ -0,0 +1,136 @@
+package rtl433receive_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"eagain.net/go/securityblanket/internal/honeywell5800/hw58demod"
+	"eagain.net/go/securityblanket/internal/rtl433receive"
+	"github.com/google/go-cmp/cmp"
+	"go.uber.org/zap/zaptest"
+)
+
+// iqFixture is synthesized by the tests of hw58demod, not captured
+// off the air.
+const iqFixture = "../honeywell5800/hw58demod/testdata/synthetic_344.975M_250k.cu8"
+
+// model, id, channel and event of messages, ignoring signal level
+func summarize(t testing.TB, data []string) []string {
+	var got []string
+	for _, d := range data {
+		i := strings.Index(d, `,"rssi"`)
+		if i < 0 {
+			t.Fatalf("no signal level: %s", d)
+		}
+		got = append(got, d[:i]+"}")
+	}
+	return got
+}
+
+var iqFixtureMessages = []string{
+	`{"model":"Honeywell-Security","id":123456,"channel":8,"event":128}`,
+	`{"model":"Honeywell-Security","id":123456,"channel":8,"event":128}`,
+	`{"model":"Honeywell-Security","id":123456,"channel":8,"event":128}`,
+	`{"model":"Honeywell-Security","id":123456,"channel":8,"event":0}`,
+	`{"model":"Honeywell-Security","id":123456,"channel":8,"event":0}`,
+	`{"model":"Honeywell-Security","id":123456,"channel":8,"event":0}`,
+	`{"model":"Honeywell-Security","id":654321,"channel":2,"event":4}`,
+}
+
+func TestReceiveIQ(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	data, err := ioutil.ReadFile(iqFixture)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := &memStore{}
+	if err := rtl433receive.ReceiveIQ(ctx, zaptest.NewLogger(t), bytes.NewReader(data), hw58demod.CU8, 0, store); err != nil {
+		t.Fatalf("receive: %v", err)
+	}
+	if diff := cmp.Diff(iqFixtureMessages, summarize(t, store.data)); diff != "" {
+		t.Errorf("wrong messages (-want +got):\n%s", diff)
+	}
+}
+
+// fakeRTLTCP serves data to one client, like rtl_tcp would, and
+// returns the commands it received.
+func fakeRTLTCP(t testing.TB, l net.Listener, data []byte) <-chan []byte {
+	commands := make(chan []byte, 1)
+	go func() {
+		defer close(commands)
+		conn, err := l.Accept()
+		if err != nil {
+			t.Errorf("accept: %v", err)
+			return
+		}
+		defer conn.Close()
+		header := []byte("RTL0\x00\x00\x00\x05\x00\x00\x00\x1d")
+		if _, err := conn.Write(header); err != nil {
+			t.Errorf("write header: %v", err)
+			return
+		}
+		cmds := make([]byte, 15)
+		if _, err := io.ReadFull(conn, cmds); err != nil {
+			t.Errorf("read commands: %v", err)
+			return
+		}
+		commands <- cmds
+		if _, err := conn.Write(data); err != nil {
+			t.Errorf("write samples: %v", err)
+		}
+	}()
+	return commands
+}
+
+func TestReceiveRTLTCP(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	data, err := ioutil.ReadFile(iqFixture)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer l.Close()
+	commands := fakeRTLTCP(t, l, data)
+
+	store := &memStore{}
+	radio := &rtl433receive.Radio{Frequency: 344975000}
+	err = rtl433receive.ReceiveRTLTCP(ctx, zaptest.NewLogger(t), l.Addr().String(), radio, store,
+		rtl433receive.Restarts(store),
+		rtl433receive.Backoff(time.Millisecond, 2*time.Millisecond),
+		rtl433receive.FailureBudget(1),
+	)
+	if err == nil || !strings.Contains(err.Error(), "giving up") {
+		t.Fatalf("expected to give up: %v", err)
+	}
+
+	want := make([]byte, 15)
+	want[0] = 0x02
+	binary.BigEndian.PutUint32(want[1:], 250000)
+	want[5] = 0x01
+	binary.BigEndian.PutUint32(want[6:], 344975000)
+	want[10] = 0x03
+	if g, e := <-commands, want; !bytes.Equal(g, e) {
+		t.Errorf("wrong commands: %x != %x", g, e)
+	}
+	if diff := cmp.Diff(iqFixtureMessages, summarize(t, store.data)); diff != "" {
+		t.Errorf("wrong messages (-want +got):\n%s", diff)
+	}
+	if g, e := len(store.restarts), 1; g != e {
+		t.Fatalf("wrong number of restarts: %d != %d", g, e)
+	}
+	if g, e := store.restarts[0].Frequency, uint64(344975000); g != e {
+		t.Errorf("wrong frequency: %v != %v", g, e)
+	}
+}
@@ -0,0 +1,155 @@
+package rtl433receive_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"eagain.net/go/securityblanket/internal/mqtt"
+	"eagain.net/go/securityblanket/internal/mqtt/mqtttest"
+	"eagain.net/go/securityblanket/internal/rtl433receive"
+	"github.com/google/go-cmp/cmp"
+	"go.uber.org/zap/zaptest"
+)
+
+// chanStore passes messages to a channel.
+type chanStore chan string
+
+func (c chanStore) Store(ctx context.Context, data []byte) error {
+	c <- string(data)
+	return nil
+}
+
+func TestReceiveSyslog(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	store := make(chanStore, 10)
+	done := make(chan error, 1)
+	go func() {
+		done <- rtl433receive.ServeSyslog(ctx, zaptest.NewLogger(t), conn, store)
+	}()
+
+	client, err := net.Dial("udp", conn.LocalAddr().String())
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer client.Close()
+	for _, pkt := range []string{
+		`garbage`,
+		`<13>1 2020-02-12T12:32:23Z pi rtl_433 - - - {"time":"2020-02-12 12:32:23","src":"SDR","lvl":5,"msg":"status"}`,
+		`<13>1 2020-02-12T12:32:23Z pi rtl_433 - - - {"model":"Honeywell-Security","id":987654,"channel":8,"event":128}`,
+	} {
+		if _, err := client.Write([]byte(pkt)); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+	}
+	if g, e := <-store, `{"model":"Honeywell-Security","id":987654,"channel":8,"event":128}`; g != e {
+		t.Errorf("wrong message: %q != %q", g, e)
+	}
+	cancel()
+	if err := <-done; !errors.Is(err, context.Canceled) {
+		t.Errorf("expected cancellation: %v", err)
+	}
+}
+
+func TestReceiveMQTT(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	broker := mqtttest.NewBroker()
+	defer broker.Close()
+
+	store := make(chanStore, 10)
+	restarts := &memStore{}
+	done := make(chan error, 1)
+	go func() {
+		done <- rtl433receive.ReceiveMQTT(ctx, zaptest.NewLogger(t),
+			"mqtt://user:secret@"+broker.Addr, store,
+			rtl433receive.Restarts(restarts),
+			rtl433receive.Backoff(time.Millisecond, 2*time.Millisecond),
+		)
+	}()
+
+	broker.WaitSubscribers(1)
+	broker.Publish(&mqtt.Message{Topic: "rtl_433/pi/devices/x", Payload: []byte(`42`)})
+	broker.Publish(&mqtt.Message{Topic: "rtl_433/pi/events", Payload: []byte(`{"model":"a"}`)})
+	if g, e := <-store, `{"model":"a"}`; g != e {
+		t.Errorf("wrong message: %q != %q", g, e)
+	}
+
+	// reconnects after losing connection
+	broker.DisconnectAll()
+	broker.WaitSubscribers(2)
+	broker.Publish(&mqtt.Message{Topic: "rtl_433/pi/events", Payload: []byte(`{"model":"b"}`)})
+	if g, e := <-store, `{"model":"b"}`; g != e {
+		t.Errorf("wrong message: %q != %q", g, e)
+	}
+	cancel()
+	if err := <-done; !errors.Is(err, context.Canceled) {
+		t.Errorf("expected cancellation: %v", err)
+	}
+
+	restarts.mu.Lock()
+	defer restarts.mu.Unlock()
+	if g, e := len(restarts.restarts), 1; g != e {
+		t.Fatalf("wrong number of restarts: %d != %d", g, e)
+	}
+	if g, e := restarts.restarts[0].Device, "mqtt://user@"+broker.Addr; g != e {
+		t.Errorf("wrong device: %q != %q", g, e)
+	}
+	if g, e := broker.Connects()[0].Password, "secret"; g != e {
+		t.Errorf("wrong password: %q != %q", g, e)
+	}
+}
+
+func TestReceiveMQTTPasswordWithoutUsername(t *testing.T) {
+	err := rtl433receive.ReceiveMQTT(context.Background(), zaptest.NewLogger(t),
+		"mqtt://:secret@broker.invalid", make(chanStore),
+	)
+	if !errors.Is(err, mqtt.ErrPasswordWithoutUsername) {
+		t.Errorf("wrong error: %v", err)
+	}
+}
+
+func TestReceiveHTTP(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	handler := func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/events" {
+			http.NotFound(w, req)
+			return
+		}
+		fmt.Fprintln(w, `{"model":"a"}`)
+		fmt.Fprintln(w, `{"src":"SDR","msg":"not data"}`)
+		fmt.Fprintln(w)
+		fmt.Fprintln(w, `data: {"model":"b"}`)
+	}
+	srv := httptest.NewServer(http.HandlerFunc(handler))
+	defer srv.Close()
+
+	store := make(chanStore, 10)
+	err := rtl433receive.ReceiveHTTP(ctx, zaptest.NewLogger(t), srv.URL+"/events", store,
+		rtl433receive.FailureBudget(1),
+	)
+	if err == nil || !strings.Contains(err.Error(), "stream ended") {
+		t.Errorf("expected stream to end: %v", err)
+	}
+	close(store)
+	var got []string
+	for msg := range store {
+		got = append(got, msg)
+	}
+	want := []string{`{"model":"a"}`, `{"model":"b"}`}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("wrong messages: -want +got\n%s", diff)
+	}
+}
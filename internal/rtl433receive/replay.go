@@ -0,0 +1,185 @@
+package rtl433receive
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// TimeStore is a Store that can record messages with a reception
+// time other than the current time.
+type TimeStore interface {
+	Store
+	StoreTime(ctx context.Context, t time.Time, data []byte) error
+}
+
+type replayConfig struct {
+	realTime   bool
+	timestamps bool
+	location   *time.Location
+}
+
+type ReplayOption replayOption
+
+type replayOption func(*replayConfig)
+
+// RealTime paces the replay according to the timestamps in the
+// input, instead of going as fast as possible.
+func RealTime() ReplayOption {
+	fn := func(conf *replayConfig) {
+		conf.realTime = true
+	}
+	return fn
+}
+
+// Timestamps preserves the original reception times in the input.
+// The store passed to Replay must implement TimeStore. Timestamps
+// without a time zone are interpreted in loc.
+func Timestamps(loc *time.Location) ReplayOption {
+	fn := func(conf *replayConfig) {
+		conf.timestamps = true
+		conf.location = loc
+	}
+	return fn
+}
+
+// rtl_433 time formats, as selected by its "-M time:..." option.
+var timeLayouts = []string{
+	"2006-01-02 15:04:05.999999999Z07:00",
+	"2006-01-02T15:04:05.999999999Z07:00",
+	"2006-01-02 15:04:05.999999999",
+	"2006-01-02T15:04:05.999999999",
+}
+
+func parseUnixTime(s string) (time.Time, error) {
+	sec, frac := s, ""
+	if i := strings.IndexByte(s, '.'); i >= 0 {
+		sec, frac = s[:i], s[i+1:]
+	}
+	n, err := strconv.ParseInt(sec, 10, 64)
+	if err != nil {
+		return time.Time{}, err
+	}
+	var nsec int64
+	if frac != "" {
+		if len(frac) > 9 {
+			frac = frac[:9]
+		}
+		frac += strings.Repeat("0", 9-len(frac))
+		nsec, err = strconv.ParseInt(frac, 10, 64)
+		if err != nil {
+			return time.Time{}, err
+		}
+	}
+	return time.Unix(n, nsec), nil
+}
+
+// parseTime extracts the reception time from rtl_433 JSON output.
+// Messages without a time return zero time.
+func parseTime(data []byte, loc *time.Location) (time.Time, error) {
+	var msg struct {
+		Time json.RawMessage `json:"time"`
+	}
+	if err := json.Unmarshal(data, &msg); err != nil {
+		return time.Time{}, err
+	}
+	if msg.Time == nil {
+		return time.Time{}, nil
+	}
+	var s string
+	if err := json.Unmarshal(msg.Time, &s); err != nil {
+		// time:unix can be output as a bare number
+		s = string(msg.Time)
+	}
+	if t, err := parseUnixTime(s); err == nil {
+		return t, nil
+	}
+	for _, layout := range timeLayouts {
+		if t, err := time.ParseInLocation(layout, s, loc); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("unrecognized time: %q", s)
+}
+
+// Replay reads newline-delimited rtl_433 JSON output from r and
+// passes every message to store, as if it had been received from a
+// radio.
+func Replay(ctx context.Context, log *zap.Logger, r io.Reader, store Store, opts ...ReplayOption) error {
+	conf := replayConfig{
+		location: time.Local,
+	}
+	for _, opt := range opts {
+		opt(&conf)
+	}
+	timeStore, ok := store.(TimeStore)
+	if conf.timestamps && !ok {
+		return errors.New("replay with timestamps needs a store that supports them")
+	}
+
+	var first time.Time
+	var started time.Time
+	s := bufio.NewScanner(r)
+	lineNum := 0
+	count := 0
+	for s.Scan() {
+		lineNum++
+		line := bytes.TrimSpace(s.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		if !json.Valid(line) {
+			return fmt.Errorf("replay: line %d: not JSON", lineNum)
+		}
+		var t time.Time
+		if conf.timestamps || conf.realTime {
+			var err error
+			t, err = parseTime(line, conf.location)
+			if err != nil {
+				return fmt.Errorf("replay: line %d: %v", lineNum, err)
+			}
+		}
+
+		if conf.realTime && !t.IsZero() {
+			if first.IsZero() {
+				first = t
+				started = time.Now()
+			}
+			delay := time.Until(started.Add(t.Sub(first)))
+			if delay > 0 {
+				timer := time.NewTimer(delay)
+				select {
+				case <-ctx.Done():
+					timer.Stop()
+					return ctx.Err()
+				case <-timer.C:
+				}
+			}
+		}
+
+		var err error
+		if conf.timestamps && !t.IsZero() {
+			err = timeStore.StoreTime(ctx, t, line)
+		} else {
+			err = store.Store(ctx, line)
+		}
+		if err != nil {
+			return fmt.Errorf("rtl433 store error: %w", err)
+		}
+		count++
+	}
+	if err := s.Err(); err != nil {
+		return fmt.Errorf("reading replay input: %v", err)
+	}
+	log.Info("replay.done", zap.Int("messages", count))
+	return nil
+}
@@ -0,0 +1,99 @@
+package rtl433receive_test
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"eagain.net/go/securityblanket/internal/rtl433receive"
+	"github.com/google/go-cmp/cmp"
+	"go.uber.org/zap/zaptest"
+)
+
+type timeStore struct {
+	memStore
+	mu    sync.Mutex
+	times []time.Time
+}
+
+func (s *timeStore) StoreTime(ctx context.Context, t time.Time, data []byte) error {
+	s.mu.Lock()
+	s.times = append(s.times, t)
+	s.mu.Unlock()
+	return s.memStore.Store(ctx, data)
+}
+
+const replayInput = `{"time" : "2020-02-12 12:32:23", "model" : "Honeywell-Security", "id" : 987654, "channel" : 8, "event" : 128}
+
+{"time" : "2020-02-12T12:32:26.5", "model" : "Honeywell-Security", "id" : 987654, "channel" : 8, "event" : 0}
+{"time" : "1581536000.25", "model" : "xyzzy"}
+{"model" : "no time"}
+`
+
+func TestReplayTimestamps(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	store := &timeStore{}
+	loc := time.FixedZone("test", -7*60*60)
+	if err := rtl433receive.Replay(ctx, zaptest.NewLogger(t), strings.NewReader(replayInput), store,
+		rtl433receive.Timestamps(loc),
+	); err != nil {
+		t.Fatalf("replay: %v", err)
+	}
+	if g, e := len(store.data), 4; g != e {
+		t.Fatalf("wrong number of messages: %d != %d", g, e)
+	}
+	want := []time.Time{
+		time.Date(2020, 2, 12, 12, 32, 23, 0, loc),
+		time.Date(2020, 2, 12, 12, 32, 26, 500000000, loc),
+		time.Unix(1581536000, 250000000),
+	}
+	if diff := cmp.Diff(want, store.times); diff != "" {
+		t.Errorf("wrong times: -want +got\n%s", diff)
+	}
+}
+
+func TestReplayTimestampsNeedTimeStore(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	store := &memStore{}
+	err := rtl433receive.Replay(ctx, zaptest.NewLogger(t), strings.NewReader(replayInput), store,
+		rtl433receive.Timestamps(time.UTC),
+	)
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+}
+
+func TestReplayBadJSON(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	store := &memStore{}
+	err := rtl433receive.Replay(ctx, zaptest.NewLogger(t), strings.NewReader("{}\nrtl_433 version 19.08\n"), store)
+	if err == nil || !strings.Contains(err.Error(), "line 2") {
+		t.Fatalf("expected an error about line 2: %v", err)
+	}
+}
+
+func TestReplayRealTime(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	store := &memStore{}
+	const input = `{"time" : "1581536000.00", "model" : "a"}
+{"time" : "1581536000.05", "model" : "b"}
+`
+	start := time.Now()
+	if err := rtl433receive.Replay(ctx, zaptest.NewLogger(t), strings.NewReader(input), store,
+		rtl433receive.RealTime(),
+	); err != nil {
+		t.Fatalf("replay: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Errorf("replay was too fast: %v", elapsed)
+	}
+	if g, e := len(store.data), 2; g != e {
+		t.Errorf("wrong number of messages: %d != %d", g, e)
+	}
+}
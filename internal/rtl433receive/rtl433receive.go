@@ -3,12 +3,15 @@ package rtl433receive
 import (
 	"bufio"
 	"context"
+	"errors"
 	"fmt"
 	"os/exec"
 	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"go.uber.org/zap"
-	"golang.org/x/sync/errgroup"
 )
 
 // Store describes methods for receiving radio messages.
@@ -20,57 +23,157 @@ type Store interface {
 	Store(ctx context.Context, data []byte) error
 }
 
-func Receive(ctx context.Context, log *zap.Logger, device string, frequency uint64, store Store) error {
-	ctx, cancel := context.WithCancel(ctx)
-	defer cancel()
+// Radio describes how to run rtl_433 for one SDR.
+type Radio struct {
+	// Device is the SDR device to use, as a USB device index or a
+	// colon and serial number. Empty means the first device.
+	Device string
+	// Frequency is the center frequency, in Hz.
+	Frequency uint64
+	// SampleRate is in samples per second. Zero uses the rtl_433
+	// default.
+	SampleRate uint64
+	// Protocols lists the rtl_433 decoders to enable, by number. No
+	// protocols means the rtl_433 defaults.
+	Protocols []int
+}
 
+func command(ctx context.Context, radio *Radio) *exec.Cmd {
 	cmd := exec.CommandContext(ctx, "rtl_433",
 		"-M", "newmodel",
+		"-M", "level",
 		"-F", "json",
-		"-f", strconv.FormatUint(frequency, 10),
+		"-f", strconv.FormatUint(radio.Frequency, 10),
 	)
-	if device != "" {
+	if radio.Device != "" {
+		cmd.Args = append(cmd.Args,
+			"-d", radio.Device,
+		)
+	}
+	if radio.SampleRate != 0 {
 		cmd.Args = append(cmd.Args,
-			"-d", device,
+			"-s", strconv.FormatUint(radio.SampleRate, 10),
 		)
 	}
+	for _, p := range radio.Protocols {
+		cmd.Args = append(cmd.Args,
+			"-R", strconv.Itoa(p),
+		)
+	}
+	return cmd
+}
+
+// Receive runs rtl_433 once, passing everything it outputs to store.
+// It returns when the subprocess exits, which is always an error.
+//
+// See Supervise for restarting the subprocess on failures.
+func Receive(ctx context.Context, log *zap.Logger, radio *Radio, store Store) error {
+	exit, err := run(ctx, log, command(ctx, radio), store, time.Now)
+	if err != nil {
+		return err
+	}
+	return exit.Err
+}
+
+// how many lines of stderr to keep for Exit.Stderr
+const stderrTailLines = 20
+
+type tail struct {
+	mu    sync.Mutex
+	lines []string
+}
+
+func (t *tail) add(line string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(t.lines) >= stderrTailLines {
+		copy(t.lines, t.lines[1:])
+		t.lines = t.lines[:len(t.lines)-1]
+	}
+	t.lines = append(t.lines, line)
+}
+
+func (t *tail) String() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return strings.Join(t.lines, "\n")
+}
+
+// run runs cmd once. Failures of the subprocess are reported in Exit,
+// errors from store and context cancellation are returned as err.
+func run(ctx context.Context, log *zap.Logger, cmd *exec.Cmd, store Store, clock func() time.Time) (_ *Exit, err error) {
+	exit := &Exit{
+		Start:    clock(),
+		ExitCode: -1,
+	}
+	defer func() {
+		exit.Stop = clock()
+	}()
+
 	stdout, err := cmd.StdoutPipe()
 	if err != nil {
-		return fmt.Errorf("running rtl_433: cannot set up stdout: %v", err)
+		return nil, fmt.Errorf("running rtl_433: cannot set up stdout: %v", err)
 	}
 	stderr, err := cmd.StderrPipe()
 	if err != nil {
-		return fmt.Errorf("running rtl_433: cannot set up stderr: %v", err)
+		return nil, fmt.Errorf("running rtl_433: cannot set up stderr: %v", err)
 	}
 	if err := cmd.Start(); err != nil {
-		return fmt.Errorf("starting rtl_433: %v", err)
+		exit.Err = fmt.Errorf("starting rtl_433: %v", err)
+		return exit, nil
 	}
 
-	g, ctx := errgroup.WithContext(ctx)
-	g.Go(func() error {
+	var stderrTail tail
+	var storeErr error
+	var readErrs [2]error
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
 		s := bufio.NewScanner(stderr)
 		for s.Scan() {
 			log.Named("stderr").Info(s.Text())
+			stderrTail.add(s.Text())
 		}
 		if err := s.Err(); err != nil {
-			return fmt.Errorf("reading rtl_433 stderr: %v", err)
+			readErrs[0] = fmt.Errorf("reading rtl_433 stderr: %v", err)
 		}
-		return nil
-	})
-	g.Go(func() error {
+	}()
+	go func() {
+		defer wg.Done()
 		s := bufio.NewScanner(stdout)
 		for s.Scan() {
 			if err := store.Store(ctx, s.Bytes()); err != nil {
-				return fmt.Errorf("rtl433 store error: %w", err)
+				storeErr = fmt.Errorf("rtl433 store error: %w", err)
+				// stop the subprocess, the error is not its fault
+				_ = cmd.Process.Kill()
+				break
 			}
 		}
 		if err := s.Err(); err != nil {
-			return fmt.Errorf("reading from rtl_433: %v", err)
+			readErrs[1] = fmt.Errorf("reading from rtl_433: %v", err)
 		}
-		return nil
-	})
-	if err := g.Wait(); err != nil {
-		return err
+	}()
+	wg.Wait()
+	waitErr := cmd.Wait()
+
+	if storeErr != nil {
+		return nil, storeErr
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	exit.ExitCode = cmd.ProcessState.ExitCode()
+	exit.Stderr = stderrTail.String()
+	switch {
+	case readErrs[1] != nil:
+		exit.Err = readErrs[1]
+	case readErrs[0] != nil:
+		exit.Err = readErrs[0]
+	case waitErr != nil:
+		exit.Err = fmt.Errorf("rtl_433 failed: %v", waitErr)
+	default:
+		exit.Err = errors.New("rtl_433 exited unexpectedly")
 	}
-	return cmd.Wait()
+	return exit, nil
 }
@@ -0,0 +1,217 @@
+package rtl433receive
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"os/exec"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Exit describes one run of the rtl_433 subprocess, or a connection
+// to a networked rtl_433, that ended.
+type Exit struct {
+	// Device is the SDR device, or the address of a networked
+	// rtl_433.
+	Device    string
+	Frequency uint64
+	Start     time.Time
+	Stop      time.Time
+	// ExitCode is the exit status of the subprocess, or -1 if it
+	// did not start, was killed by a signal, or was not a
+	// subprocess at all.
+	ExitCode int
+	// Stderr contains the last lines the subprocess wrote to
+	// stderr.
+	Stderr string
+	// Err describes why the subprocess is considered to have
+	// failed. It is never nil.
+	Err error
+	// Resumes is when the receiver is started again, or zero if it
+	// is not.
+	Resumes time.Time
+}
+
+// Uptime returns how long the subprocess ran.
+func (e *Exit) Uptime() time.Duration {
+	return e.Stop.Sub(e.Start)
+}
+
+// RestartStore records subprocess failures that lead to a restart.
+//
+// If StoreRestart returns an error, Supervise will exit with that
+// error.
+type RestartStore interface {
+	StoreRestart(ctx context.Context, exit *Exit) error
+}
+
+type nopRestartStore struct{}
+
+func (nopRestartStore) StoreRestart(ctx context.Context, exit *Exit) error {
+	return nil
+}
+
+type config struct {
+	restarts      RestartStore
+	minBackoff    time.Duration
+	maxBackoff    time.Duration
+	stableUptime  time.Duration
+	failureBudget int
+	command       func(ctx context.Context) *exec.Cmd
+	clock         func() time.Time
+}
+
+type Option option
+
+type option func(*config)
+
+// Restarts records every failure of the subprocess in store.
+func Restarts(store RestartStore) Option {
+	fn := func(conf *config) {
+		conf.restarts = store
+	}
+	return fn
+}
+
+// Backoff sets the minimum and maximum delay before restarting the
+// subprocess. The delay doubles on every consecutive failure, and is
+// randomized by up to half to avoid synchronized retries.
+func Backoff(min, max time.Duration) Option {
+	fn := func(conf *config) {
+		conf.minBackoff = min
+		conf.maxBackoff = max
+	}
+	return fn
+}
+
+// StableUptime sets how long the subprocess needs to run for it to be
+// considered healthy. A healthy run resets the backoff delay and the
+// failure budget.
+func StableUptime(d time.Duration) Option {
+	fn := func(conf *config) {
+		conf.stableUptime = d
+	}
+	return fn
+}
+
+// FailureBudget sets how many consecutive failures are tolerated
+// before giving up. Zero means retry forever.
+func FailureBudget(n int) Option {
+	fn := func(conf *config) {
+		conf.failureBudget = n
+	}
+	return fn
+}
+
+// Command overrides the subprocess to run. This is mostly useful for
+// tests. It has no effect on network receivers.
+func Command(command func(ctx context.Context) *exec.Cmd) Option {
+	fn := func(conf *config) {
+		conf.command = command
+	}
+	return fn
+}
+
+// Clock overrides the source of time used for measuring uptime.
+func Clock(clock func() time.Time) Option {
+	fn := func(conf *config) {
+		conf.clock = clock
+	}
+	return fn
+}
+
+func backoff(conf *config, failures int) time.Duration {
+	d := conf.minBackoff
+	for i := 1; i < failures && d < conf.maxBackoff; i++ {
+		d *= 2
+	}
+	if d > conf.maxBackoff {
+		d = conf.maxBackoff
+	}
+	if half := int64(d / 2); half > 0 {
+		d = time.Duration(half + rand.Int63n(half+1))
+	}
+	return d
+}
+
+func newConfig(opts []Option) *config {
+	conf := &config{
+		restarts:      nopRestartStore{},
+		minBackoff:    1 * time.Second,
+		maxBackoff:    5 * time.Minute,
+		stableUptime:  10 * time.Minute,
+		failureBudget: 0,
+		clock:         time.Now,
+	}
+	for _, opt := range opts {
+		opt(conf)
+	}
+	return conf
+}
+
+// Supervise runs rtl_433, passing everything it outputs to store, and
+// restarts it whenever it exits. It returns on context cancellation,
+// errors from store, or when the failure budget is exhausted.
+func Supervise(ctx context.Context, log *zap.Logger, radio *Radio, store Store, opts ...Option) error {
+	conf := newConfig(opts)
+	if conf.command == nil {
+		conf.command = func(ctx context.Context) *exec.Cmd {
+			return command(ctx, radio)
+		}
+	}
+	runOnce := func(ctx context.Context) (*Exit, error) {
+		exit, err := run(ctx, log, conf.command(ctx), store, conf.clock)
+		if err != nil {
+			return nil, err
+		}
+		exit.Device = radio.Device
+		exit.Frequency = radio.Frequency
+		return exit, nil
+	}
+	return supervise(ctx, log, conf, runOnce)
+}
+
+// supervise calls runOnce until it returns an error, the context is
+// canceled, or the failure budget is exhausted.
+func supervise(ctx context.Context, log *zap.Logger, conf *config, runOnce func(ctx context.Context) (*Exit, error)) error {
+	failures := 0
+	for {
+		exit, err := runOnce(ctx)
+		if err != nil {
+			return err
+		}
+		if exit.Uptime() >= conf.stableUptime {
+			failures = 0
+		}
+		failures++
+
+		log.Warn("exit",
+			zap.Error(exit.Err),
+			zap.Int("exit_code", exit.ExitCode),
+			zap.Duration("uptime", exit.Uptime()),
+			zap.Int("failures", failures),
+		)
+		giveUp := conf.failureBudget > 0 && failures >= conf.failureBudget
+		delay := backoff(conf, failures)
+		if !giveUp {
+			exit.Resumes = exit.Stop.Add(delay)
+		}
+		if err := conf.restarts.StoreRestart(ctx, exit); err != nil {
+			return fmt.Errorf("recording rtl_433 restart: %w", err)
+		}
+		if giveUp {
+			return fmt.Errorf("rtl_433 failed %d times in a row, giving up: %w", failures, exit.Err)
+		}
+
+		log.Info("restart.wait", zap.Duration("delay", delay))
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
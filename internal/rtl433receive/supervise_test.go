@@ -0,0 +1,144 @@
+package rtl433receive_test
+
+import (
+	"context"
+	"errors"
+	"os/exec"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"eagain.net/go/securityblanket/internal/rtl433receive"
+	"go.uber.org/zap/zaptest"
+)
+
+type memStore struct {
+	mu       sync.Mutex
+	data     []string
+	restarts []*rtl433receive.Exit
+}
+
+func (s *memStore) Store(ctx context.Context, data []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.data = append(s.data, string(data))
+	return nil
+}
+
+func (s *memStore) StoreRestart(ctx context.Context, exit *rtl433receive.Exit) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.restarts = append(s.restarts, exit)
+	return nil
+}
+
+func fakeCommand(script string) func(ctx context.Context) *exec.Cmd {
+	return func(ctx context.Context) *exec.Cmd {
+		return exec.CommandContext(ctx, "sh", "-c", script)
+	}
+}
+
+func TestSuperviseFailureBudget(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	store := &memStore{}
+	err := rtl433receive.Supervise(ctx, zaptest.NewLogger(t), &rtl433receive.Radio{Frequency: 42}, store,
+		rtl433receive.Command(fakeCommand(`echo '{"model":"xyzzy"}'; echo oops >&2; exit 3`)),
+		rtl433receive.Restarts(store),
+		rtl433receive.Backoff(time.Millisecond, 2*time.Millisecond),
+		rtl433receive.FailureBudget(3),
+	)
+	if err == nil || !strings.Contains(err.Error(), "giving up") {
+		t.Fatalf("expected to give up: %v", err)
+	}
+	if g, e := len(store.data), 3; g != e {
+		t.Errorf("wrong number of messages: %d != %d", g, e)
+	}
+	if g, e := len(store.restarts), 3; g != e {
+		t.Fatalf("wrong number of restarts: %d != %d", g, e)
+	}
+	exit := store.restarts[0]
+	if g, e := exit.ExitCode, 3; g != e {
+		t.Errorf("wrong exit code: %d != %d", g, e)
+	}
+	if g, e := exit.Stderr, "oops"; g != e {
+		t.Errorf("wrong stderr: %q != %q", g, e)
+	}
+	if g, e := exit.Frequency, uint64(42); g != e {
+		t.Errorf("wrong frequency: %d != %d", g, e)
+	}
+	if wait := exit.Resumes.Sub(exit.Stop); wait <= 0 || wait > time.Millisecond {
+		t.Errorf("wrong resume time: %v after stop", wait)
+	}
+	if last := store.restarts[2]; !last.Resumes.IsZero() {
+		t.Errorf("resumes after giving up: %v", last.Resumes)
+	}
+}
+
+func TestSuperviseStableUptime(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	store := &memStore{}
+	// every run looks like it lasted half an hour, so the failure budget
+	// never runs out
+	var mu sync.Mutex
+	now := time.Date(2020, 1, 2, 3, 4, 5, 6, time.UTC)
+	clock := func() time.Time {
+		mu.Lock()
+		defer mu.Unlock()
+		now = now.Add(30 * time.Minute)
+		return now
+	}
+	restarts := &cancelAfter{memStore: store, n: 5, cancel: cancel}
+	err := rtl433receive.Supervise(ctx, zaptest.NewLogger(t), &rtl433receive.Radio{Frequency: 42}, store,
+		rtl433receive.Command(fakeCommand(`exit 1`)),
+		rtl433receive.Restarts(restarts),
+		rtl433receive.Backoff(time.Millisecond, 2*time.Millisecond),
+		rtl433receive.FailureBudget(2),
+		rtl433receive.Clock(clock),
+	)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected cancellation: %v", err)
+	}
+	if g, e := len(store.restarts), 5; g != e {
+		t.Errorf("wrong number of restarts: %d != %d", g, e)
+	}
+}
+
+type cancelAfter struct {
+	*memStore
+	n      int
+	cancel func()
+}
+
+func (c *cancelAfter) StoreRestart(ctx context.Context, exit *rtl433receive.Exit) error {
+	if err := c.memStore.StoreRestart(ctx, exit); err != nil {
+		return err
+	}
+	c.n--
+	if c.n == 0 {
+		c.cancel()
+	}
+	return nil
+}
+
+type failingStore struct{}
+
+var errStore = errors.New("store failed")
+
+func (failingStore) Store(ctx context.Context, data []byte) error {
+	return errStore
+}
+
+func TestSuperviseStoreError(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	err := rtl433receive.Supervise(ctx, zaptest.NewLogger(t), &rtl433receive.Radio{Frequency: 42}, failingStore{},
+		rtl433receive.Command(fakeCommand(`echo '{}'; exec sleep 10`)),
+		rtl433receive.Backoff(time.Millisecond, 2*time.Millisecond),
+	)
+	if !errors.Is(err, errStore) {
+		t.Fatalf("expected store error: %v", err)
+	}
+}
@@ -1,14 +1,26 @@
-INSERT INTO rtl433_raw(time, freqMHz, model, data)
+INSERT INTO rtl433_raw(time, freqMHz, receiver, model, rssi, snr, noise, data)
 	SELECT @time AS new_time,
 		@freqMHz AS new_freqMHz,
+		@receiver AS new_receiver,
 		json_extract(@data, '$.model') AS new_model,
+		json_extract(@data, '$.rssi') AS new_rssi,
+		json_extract(@data, '$.snr') AS new_snr,
+		json_extract(@data, '$.noise') AS new_noise,
 		-- remove inconvenient and redundant fields
 		json_remove(@data,
 			-- hard-to-parse format; use a clock in our
 			-- process instead
 			'$.time',
 			-- extracted to standalone columns
-			'$.model'
+			'$.model',
+			'$.rssi',
+			'$.snr',
+			'$.noise',
+			-- estimated from the signal, differs for
+			-- every repeat of a transmission
+			'$.freq',
+			'$.freq1',
+			'$.freq2'
 		) AS new_data
 		-- Deduplicate identical (after pruning) transmissions
 		-- within dedup window.
@@ -20,12 +32,16 @@ INSERT INTO rtl433_raw(time, freqMHz, model, data)
 		-- time. That should be rare enough to not matter, and
 		-- will be deduplicated by the protocol-specific
 		-- logic.
+		--
+		-- Each receiver is deduplicated separately, so we
+		-- know every receiver that heard a transmission.
 		WHERE new_data
 		NOT IN (
 			SELECT data
 			FROM rtl433_raw
 			WHERE time>=@dedupTime
 			AND freqMHz=new_freqMHz
+			AND receiver=new_receiver
 			AND model=new_model
 			ORDER BY id DESC
 			LIMIT 1
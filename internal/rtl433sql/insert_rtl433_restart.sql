@@ -0,0 +1,2 @@
+INSERT INTO rtl433_restarts(time, freqMHz, receiver, device, started, uptime, exitCode, stderr, error, resumes)
+	VALUES (@time, @freqMHz, @receiver, @device, @started, @uptime, @exitCode, @stderr, @error, @resumes)
@@ -2,16 +2,49 @@ package rtl433sql
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
+	"strconv"
 	"time"
 
 	"eagain.net/go/securityblanket/internal/database"
+	"eagain.net/go/securityblanket/internal/metrics"
 	"eagain.net/go/securityblanket/internal/rtl433receive"
 )
 
+var (
+	receivedTotal = metrics.Default.Counter(
+		"securityblanket_rtl433_received_total",
+		"Raw rtl_433 messages received, including duplicates.",
+		"model", "freq_mhz",
+	)
+	duplicatesTotal = metrics.Default.Counter(
+		"securityblanket_rtl433_duplicates_total",
+		"Raw rtl_433 messages dropped as repeats of a recent message.",
+		"model", "freq_mhz",
+	)
+	restartsTotal = metrics.Default.Counter(
+		"securityblanket_rtl433_restarts_total",
+		"Times rtl_433, or the connection to it, had to be restarted.",
+		"receiver", "freq_mhz",
+	)
+)
+
+// model returns the rtl_433 decoder a message is from, or the empty
+// string if it cannot tell.
+func model(data []byte) string {
+	var msg struct {
+		Model string `json:"model"`
+	}
+	// the database does the real parsing
+	_ = json.Unmarshal(data, &msg)
+	return msg.Model
+}
+
 type config struct {
-	wakeup func()
-	clock  func() time.Time
+	wakeup   func()
+	clock    func() time.Time
+	receiver string
 }
 
 type SQLStore struct {
@@ -31,6 +64,14 @@ func Clock(clock func() time.Time) Option {
 	return fn
 }
 
+// Receiver sets the label of the receiver the messages come from.
+func Receiver(label string) Option {
+	fn := func(conf *config) {
+		conf.receiver = label
+	}
+	return fn
+}
+
 func Wakeup(wakeup func()) Option {
 	fn := func(conf *config) {
 		conf.wakeup = wakeup
@@ -53,29 +94,44 @@ func New(db *database.DB, freqMHz int64, opts ...Option) *SQLStore {
 	return h
 }
 
-var _ rtl433receive.Store = (*SQLStore)(nil)
+var _ rtl433receive.TimeStore = (*SQLStore)(nil)
 
 func (s *SQLStore) Store(ctx context.Context, data []byte) error {
-	now := s.config.clock()
+	return s.StoreTime(ctx, s.config.clock(), data)
+}
 
+// StoreTime stores a message received at time now.
+//
+// Multiple SQLStores may share a database. Every insert is a single
+// autocommit statement, so SQLite assigns ids in commit order, as
+// required by the catchup package.
+func (s *SQLStore) StoreTime(ctx context.Context, now time.Time, data []byte) error {
 	conn := s.db.Get(ctx)
 	if conn == nil {
 		return context.Canceled
 	}
 	defer s.db.Put(conn)
 
+	// rtl_433 repeats transmissions within a fraction of a second
+	const dedupWindow = 5 * time.Second
 	stmt := insert_rtl433_raw.Prep(conn)
 	defer stmt.Finalize()
 	stmt.SetText("@time", now.Format(time.RFC3339Nano))
+	database.BindTime(stmt, "@dedupTime", now.Add(-dedupWindow))
 	stmt.SetInt64("@freqMHz", s.freqMHz)
+	stmt.SetText("@receiver", s.config.receiver)
 	stmt.SetBytes("@data", data)
 	if _, err := stmt.Step(); err != nil {
-		return fmt.Errorf("cannot insert rtl_433 345MHz raw data: %w", err)
+		return fmt.Errorf("cannot insert rtl_433 %dMHz raw data: %w", s.freqMHz, err)
 	}
 
+	freq := strconv.FormatInt(s.freqMHz, 10)
+	m := model(data)
+	receivedTotal.With(m, freq).Inc()
 	switch affected := conn.Changes(); affected {
 	case 0:
 		// deduplicated; do nothing
+		duplicatesTotal.With(m, freq).Inc()
 	case 1:
 		s.config.wakeup()
 	default:
@@ -83,3 +139,35 @@ func (s *SQLStore) Store(ctx context.Context, data []byte) error {
 	}
 	return nil
 }
+
+var _ rtl433receive.RestartStore = (*SQLStore)(nil)
+
+func (s *SQLStore) StoreRestart(ctx context.Context, exit *rtl433receive.Exit) error {
+	conn := s.db.Get(ctx)
+	if conn == nil {
+		return context.Canceled
+	}
+	defer s.db.Put(conn)
+
+	stmt := insert_rtl433_restart.Prep(conn)
+	defer stmt.Finalize()
+	database.BindTime(stmt, "@time", exit.Stop)
+	stmt.SetInt64("@freqMHz", s.freqMHz)
+	stmt.SetText("@receiver", s.config.receiver)
+	stmt.SetText("@device", exit.Device)
+	database.BindTime(stmt, "@started", exit.Start)
+	stmt.SetFloat("@uptime", exit.Uptime().Seconds())
+	if exit.ExitCode < 0 {
+		stmt.SetNull("@exitCode")
+	} else {
+		stmt.SetInt64("@exitCode", int64(exit.ExitCode))
+	}
+	stmt.SetText("@stderr", exit.Stderr)
+	stmt.SetText("@error", exit.Err.Error())
+	database.BindTime(stmt, "@resumes", exit.Resumes)
+	if _, err := stmt.Step(); err != nil {
+		return fmt.Errorf("cannot insert rtl_433 restart: %w", err)
+	}
+	restartsTotal.With(s.config.receiver, strconv.FormatInt(s.freqMHz, 10)).Inc()
+	return nil
+}
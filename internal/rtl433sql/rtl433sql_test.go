@@ -2,12 +2,17 @@ package rtl433sql_test
 
 import (
 	"context"
+	"errors"
 	"sync/atomic"
 	"testing"
 	"time"
 
+	"crawshaw.io/sqlite"
 	"eagain.net/go/securityblanket/internal/database"
+	"eagain.net/go/securityblanket/internal/metrics"
+	"eagain.net/go/securityblanket/internal/rtl433receive"
 	"eagain.net/go/securityblanket/internal/rtl433sql"
+	"github.com/google/go-cmp/cmp"
 )
 
 func TestSimple(t *testing.T) {
@@ -26,6 +31,7 @@ func TestSimple(t *testing.T) {
 	s := rtl433sql.New(db, freq,
 		rtl433sql.Wakeup(wakeup),
 		rtl433sql.Clock(clock),
+		rtl433sql.Receiver("attic"),
 	)
 	const input = `{"model": "xyzzy", "foo": 42}`
 	if err := s.Store(ctx, []byte(input)); err != nil {
@@ -45,7 +51,7 @@ func TestSimple(t *testing.T) {
 	if !hasRow {
 		t.Fatal("expected 1 row, got none")
 	}
-	if g, e := stmt.ColumnCount(), 5; g != e {
+	if g, e := stmt.ColumnCount(), 9; g != e {
 		t.Errorf("wrong number of columns: %d != %d", g, e)
 	}
 	// don't care about id
@@ -55,6 +61,9 @@ func TestSimple(t *testing.T) {
 	if g, e := stmt.GetInt64("freqMHz"), int64(freq); g != e {
 		t.Errorf("wrong freqMHz: %v != %v", g, e)
 	}
+	if g, e := stmt.GetText("receiver"), "attic"; g != e {
+		t.Errorf("wrong receiver: %v != %v", g, e)
+	}
 	if g, e := stmt.GetText("model"), "xyzzy"; g != e {
 		t.Errorf("wrong model: %v != %v", g, e)
 	}
@@ -62,3 +71,164 @@ func TestSimple(t *testing.T) {
 		t.Errorf("wrong data: %v != %v", g, e)
 	}
 }
+
+func TestLevel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	db := database.Scratch()
+	defer db.Close()
+
+	s := rtl433sql.New(db, 345)
+	const input = `{"model": "xyzzy", "foo": 42, "mod": "ASK", "freq": 344.975, "rssi": -0.1, "snr": 30.5, "noise": -31.2}`
+	if err := s.Store(ctx, []byte(input)); err != nil {
+		t.Fatalf("Store: %v", err)
+	}
+	conn := db.Get(nil)
+	defer db.Put(conn)
+	stmt := conn.Prep(`SELECT rssi, snr, noise, data FROM rtl433_raw`)
+	defer stmt.Finalize()
+	if err := database.Row(stmt); err != nil {
+		t.Fatalf("database error: %v", err)
+	}
+	if g, e := stmt.GetFloat("rssi"), -0.1; g != e {
+		t.Errorf("wrong rssi: %v != %v", g, e)
+	}
+	if g, e := stmt.GetFloat("snr"), 30.5; g != e {
+		t.Errorf("wrong snr: %v != %v", g, e)
+	}
+	if g, e := stmt.GetFloat("noise"), -31.2; g != e {
+		t.Errorf("wrong noise: %v != %v", g, e)
+	}
+	if g, e := stmt.GetText("data"), `{"foo":42,"mod":"ASK"}`; g != e {
+		t.Errorf("wrong data: %v != %v", g, e)
+	}
+}
+
+func countRaw(t testing.TB, db *database.DB) int64 {
+	conn := db.Get(nil)
+	defer db.Put(conn)
+	stmt := conn.Prep(`SELECT count(*) AS count FROM rtl433_raw`)
+	defer stmt.Finalize()
+	if err := database.Row(stmt); err != nil {
+		t.Fatalf("database error when counting: %v", err)
+	}
+	return stmt.GetInt64("count")
+}
+
+func TestDedupPerReceiver(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	db := database.Scratch()
+	defer db.Close()
+
+	now := time.Date(2020, 1, 2, 3, 4, 5, 6, time.Local)
+	clock := func() time.Time { return now }
+	attic := rtl433sql.New(db, 345, rtl433sql.Clock(clock), rtl433sql.Receiver("attic"))
+	garage := rtl433sql.New(db, 345, rtl433sql.Clock(clock), rtl433sql.Receiver("garage"))
+	const input = `{"model": "xyzzy", "foo": 42}`
+	for _, s := range []*rtl433sql.SQLStore{attic, attic, garage, garage} {
+		if err := s.Store(ctx, []byte(input)); err != nil {
+			t.Fatalf("Store: %v", err)
+		}
+	}
+	if g, e := countRaw(t, db), int64(2); g != e {
+		t.Errorf("wrong number of rows: %d != %d", g, e)
+	}
+
+	// outside the dedup window
+	now = now.Add(time.Minute)
+	if err := attic.Store(ctx, []byte(input)); err != nil {
+		t.Fatalf("Store: %v", err)
+	}
+	if g, e := countRaw(t, db), int64(3); g != e {
+		t.Errorf("wrong number of rows: %d != %d", g, e)
+	}
+}
+
+func TestStoreRestart(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	db := database.Scratch()
+	defer db.Close()
+
+	s := rtl433sql.New(db, 345)
+	start := time.Date(2020, 1, 2, 3, 4, 5, 6, time.UTC)
+	exit := &rtl433receive.Exit{
+		Device:   ":123",
+		Start:    start,
+		Stop:     start.Add(90 * time.Second),
+		ExitCode: -1,
+		Stderr:   "usb_claim_interface error -6",
+		Err:      errors.New("rtl_433 failed: signal: killed"),
+		Resumes:  start.Add(95 * time.Second),
+	}
+	if err := s.StoreRestart(ctx, exit); err != nil {
+		t.Fatalf("StoreRestart: %v", err)
+	}
+	conn := db.Get(nil)
+	defer db.Put(conn)
+	stmt := conn.Prep(`SELECT * FROM rtl433_restarts`)
+	defer stmt.Finalize()
+	if err := database.Row(stmt); err != nil {
+		t.Fatalf("database error: %v", err)
+	}
+	if g, e := stmt.GetInt64("freqMHz"), int64(345); g != e {
+		t.Errorf("wrong freqMHz: %v != %v", g, e)
+	}
+	if g, e := stmt.GetText("device"), ":123"; g != e {
+		t.Errorf("wrong device: %v != %v", g, e)
+	}
+	if g, e := stmt.GetFloat("uptime"), 90.0; g != e {
+		t.Errorf("wrong uptime: %v != %v", g, e)
+	}
+	if stmt.ColumnType(stmt.ColumnIndex("exitCode")) != sqlite.SQLITE_NULL {
+		t.Errorf("not NULL exitCode: %v", stmt.GetText("exitCode"))
+	}
+	if g, e := stmt.GetText("stderr"), exit.Stderr; g != e {
+		t.Errorf("wrong stderr: %v != %v", g, e)
+	}
+	if g, e := stmt.GetText("error"), exit.Err.Error(); g != e {
+		t.Errorf("wrong error: %v != %v", g, e)
+	}
+	if g, e := stmt.GetText("resumes"), exit.Resumes.Format(time.RFC3339Nano); g != e {
+		t.Errorf("wrong resumes: %v != %v", g, e)
+	}
+	if err := database.NoMoreRows(stmt); err != nil {
+		t.Fatalf("database error: %v", err)
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	db := database.Scratch()
+	defer db.Close()
+
+	s := rtl433sql.New(db, 999)
+	const input = `{"model": "metrics-test", "foo": 42}`
+	for i := 0; i < 2; i++ {
+		if err := s.Store(ctx, []byte(input)); err != nil {
+			t.Fatalf("Store: %v", err)
+		}
+	}
+
+	families, err := metrics.Default.Gather(ctx)
+	if err != nil {
+		t.Fatalf("gather: %v", err)
+	}
+	got := make(map[string]float64)
+	for _, f := range families {
+		for _, s := range f.Samples {
+			if len(s.Values) == 2 && s.Values[0] == "metrics-test" && s.Values[1] == "999" {
+				got[f.Name] = s.Value
+			}
+		}
+	}
+	want := map[string]float64{
+		"securityblanket_rtl433_received_total":   2,
+		"securityblanket_rtl433_duplicates_total": 1,
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("wrong metrics: -want +got\n%s", diff)
+	}
+}
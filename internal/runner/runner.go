@@ -2,10 +2,41 @@ package runner
 
 import (
 	"context"
+	"time"
 
+	"eagain.net/go/securityblanket/internal/metrics"
 	"go.uber.org/zap"
 )
 
+var (
+	wakeupsTotal = metrics.Default.Counter(
+		"securityblanket_runner_wakeups_total",
+		"Wakeups of a runner, including slow ones.",
+		"runner",
+	)
+	slowWakeupsTotal = metrics.Default.Counter(
+		"securityblanket_runner_slow_wakeups_total",
+		"Wakeups of a runner that was already due to run.",
+		"runner",
+	)
+)
+
+type config struct {
+	name string
+}
+
+type Option option
+
+type option func(*config)
+
+// Name identifies the runner in metrics.
+func Name(name string) Option {
+	fn := func(conf *config) {
+		conf.name = name
+	}
+	return fn
+}
+
 // Runner is a helper that makes it easy to write a loop that only
 // wakes up when it's signaled, and terminates on context
 // cancellation.
@@ -14,17 +45,26 @@ type Runner struct {
 	run    func() error
 	log    *zap.Logger
 	wakeup chan struct{}
+
+	wakeups     *metrics.Counter
+	slowWakeups *metrics.Counter
 }
 
-func New(ctx context.Context, fn func() error, log *zap.Logger) *Runner {
+func New(ctx context.Context, fn func() error, log *zap.Logger, opts ...Option) *Runner {
 	if log == nil {
 		log = zap.NewNop()
 	}
+	var conf config
+	for _, opt := range opts {
+		opt(&conf)
+	}
 	r := &Runner{
-		ctx:    ctx,
-		run:    fn,
-		log:    log,
-		wakeup: make(chan struct{}, 1),
+		ctx:         ctx,
+		run:         fn,
+		log:         log,
+		wakeup:      make(chan struct{}, 1),
+		wakeups:     wakeupsTotal.With(conf.name),
+		slowWakeups: slowWakeupsTotal.With(conf.name),
 	}
 	// process any leftovers
 	r.wakeup <- struct{}{}
@@ -50,10 +90,28 @@ func (r *Runner) Loop() error {
 }
 
 func (r *Runner) Wakeup() {
+	r.wakeups.Inc()
 	select {
 	case r.wakeup <- struct{}{}:
 		r.log.Debug("wakeup")
 	default:
+		r.slowWakeups.Inc()
 		r.log.Debug("wakeup.slow")
 	}
 }
+
+// Tick wakes up the runner every interval, for work that depends on
+// the passing of time rather than new input. It terminates on context
+// cancellation.
+func (r *Runner) Tick(interval time.Duration) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.ctx.Done():
+			return r.ctx.Err()
+		case <-ticker.C:
+			r.Wakeup()
+		}
+	}
+}
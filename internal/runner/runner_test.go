@@ -3,8 +3,12 @@ package runner_test
 import (
 	"context"
 	"fmt"
+	"testing"
+	"time"
 
+	"eagain.net/go/securityblanket/internal/metrics"
 	"eagain.net/go/securityblanket/internal/runner"
+	"github.com/google/go-cmp/cmp"
 	"golang.org/x/sync/errgroup"
 )
 
@@ -38,3 +42,58 @@ func Example() {
 	// run
 	// after
 }
+
+func TestTick(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	runs := 0
+	fn := func() error {
+		runs++
+		if runs == 3 {
+			cancel()
+		}
+		return nil
+	}
+	r := runner.New(ctx, fn, nil)
+	var g errgroup.Group
+	g.Go(r.Loop)
+	g.Go(func() error { return r.Tick(time.Millisecond) })
+	if err := g.Wait(); err != context.Canceled {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if runs < 3 {
+		t.Errorf("too few runs: %d", runs)
+	}
+}
+
+func TestWakeupMetrics(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	fn := func() error { return nil }
+	// not looping, so the initial wakeup is still pending
+	r := runner.New(ctx, fn, nil, runner.Name("test.wakeup"))
+	r.Wakeup()
+	r.Wakeup()
+
+	families, err := metrics.Default.Gather(ctx)
+	if err != nil {
+		t.Fatalf("gather: %v", err)
+	}
+	got := make(map[string]float64)
+	for _, f := range families {
+		for _, s := range f.Samples {
+			if len(s.Values) == 1 && s.Values[0] == "test.wakeup" {
+				got[f.Name] = s.Value
+			}
+		}
+	}
+	want := map[string]float64{
+		"securityblanket_runner_wakeups_total":      2,
+		"securityblanket_runner_slow_wakeups_total": 2,
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("wrong metrics: -want +got\n%s", diff)
+	}
+}
@@ -0,0 +1,20 @@
+-- Every time the rtl_433 subprocess exits and gets restarted.
+CREATE TABLE rtl433_restarts (
+	id INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+	time TEXT NOT NULL
+		DEFAULT (strftime('%Y-%m-%dT%H:%M:%f', 'now')),
+	freqMHz INTEGER NOT NULL
+		CONSTRAINT 'freqMHz is positive' CHECK (freqMhz>0),
+	device TEXT NOT NULL
+		DEFAULT '',
+	started TEXT NOT NULL,
+	-- seconds
+	uptime REAL NOT NULL
+		CONSTRAINT 'uptime is not negative' CHECK (uptime>=0),
+	-- NULL if the process did not exit normally
+	exitCode INTEGER,
+	stderr TEXT NOT NULL
+		DEFAULT '',
+	error TEXT NOT NULL
+		CONSTRAINT 'error is not empty' CHECK (error<>'')
+);
@@ -0,0 +1,41 @@
+-- Which receiver heard each raw message. Rows from before receivers
+-- were tracked have an empty label.
+ALTER TABLE rtl433_raw
+	ADD COLUMN receiver TEXT NOT NULL
+		DEFAULT '';
+
+ALTER TABLE rtl433_restarts
+	ADD COLUMN receiver TEXT NOT NULL
+		DEFAULT '';
+
+-- Every receiver that heard a sensor update. The same transmission
+-- heard by several receivers is stored only once in
+-- honeywell5800_updates.
+CREATE TABLE honeywell5800_receptions (
+	sensorUpdate INTEGER NOT NULL
+		REFERENCES honeywell5800_updates(id)
+		ON DELETE CASCADE,
+	receiver TEXT NOT NULL,
+	-- rtl433_raw(id), but not a foreign key as the raw log gets
+	-- pruned
+	raw INTEGER NOT NULL,
+	time TEXT NOT NULL,
+	-- signal level, when rtl_433 reports it
+	rssi REAL,
+	snr REAL,
+	noise REAL,
+	PRIMARY KEY (sensorUpdate, receiver)
+)
+	WITHOUT ROWID;
+
+-- How well each receiver hears each sensor.
+CREATE VIEW honeywell5800_sensor_receivers AS
+	SELECT honeywell5800_updates.sensor AS sensor,
+		honeywell5800_receptions.receiver AS receiver,
+		count(*) AS heard,
+		max(honeywell5800_receptions.time) AS lastHeard,
+		avg(honeywell5800_receptions.rssi) AS avgRSSI
+	FROM honeywell5800_receptions
+	JOIN honeywell5800_updates
+	ON (honeywell5800_updates.id=honeywell5800_receptions.sensorUpdate)
+	GROUP BY honeywell5800_updates.sensor, honeywell5800_receptions.receiver;
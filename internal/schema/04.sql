@@ -0,0 +1,41 @@
+-- Signal level, as reported by rtl_433 "-M level". NULL when not
+-- reported.
+ALTER TABLE rtl433_raw
+	ADD COLUMN rssi REAL;
+ALTER TABLE rtl433_raw
+	ADD COLUMN snr REAL;
+ALTER TABLE rtl433_raw
+	ADD COLUMN noise REAL;
+
+-- Best signal level any receiver heard the update with. Updated as
+-- more receptions come in.
+ALTER TABLE honeywell5800_updates
+	ADD COLUMN rssi REAL;
+ALTER TABLE honeywell5800_updates
+	ADD COLUMN snr REAL;
+ALTER TABLE honeywell5800_updates
+	ADD COLUMN noise REAL;
+
+-- Rolling statistics about how well each sensor is heard.
+CREATE TABLE honeywell5800_signal_stats (
+	sensor INTEGER NOT NULL PRIMARY KEY
+		REFERENCES honeywell5800_sensors(id)
+		ON DELETE CASCADE,
+	-- time of the latest update included
+	updated TEXT NOT NULL,
+	-- number of updates with signal level in the window
+	samples INTEGER NOT NULL
+		CONSTRAINT 'samples is not negative' CHECK (samples>=0),
+	medianRSSI REAL,
+	medianSNR REAL,
+	-- number of heartbeats in the window
+	heartbeats INTEGER NOT NULL
+		CONSTRAINT 'heartbeats is not negative' CHECK (heartbeats>=0),
+	-- estimated from the heartbeats seen, in seconds
+	heartbeatInterval REAL,
+	missedHeartbeats INTEGER
+		CONSTRAINT 'missedHeartbeats is not negative' CHECK (missedHeartbeats>=0),
+	-- estimated fraction of transmissions lost
+	loss REAL
+		CONSTRAINT 'loss is a fraction' CHECK (loss>=0 AND loss<=1)
+);
@@ -0,0 +1,37 @@
+-- Signs of someone jamming the radio. Every row is a change of state;
+-- the latest row for each kind and receiver is the current state.
+--
+-- Jamming defeats every sensor at once, so active conditions are
+-- meant to be treated as high priority by anything downstream.
+CREATE TABLE rfjam_conditions (
+	id INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+	time TEXT NOT NULL,
+	kind TEXT NOT NULL
+		CONSTRAINT 'kind is known' CHECK (kind IN ('noise', 'silence')),
+	-- receiver the condition was detected on, or empty when it
+	-- concerns the whole site
+	receiver TEXT NOT NULL
+		DEFAULT '',
+	active BOOLEAN NOT NULL,
+	-- for kind noise: the noise level that triggered the change,
+	-- and the normal noise floor it was compared against, in dB
+	noise REAL,
+	baseline REAL,
+	-- for kind silence: how many of the sensors that are normally
+	-- heard have gone silent
+	silentSensors INTEGER,
+	sensors INTEGER
+);
+
+CREATE INDEX rfjam_conditions_kind_receiver
+	ON rfjam_conditions(kind, receiver, id);
+
+CREATE VIEW rfjam_active AS
+	SELECT *
+	FROM rfjam_conditions
+	WHERE id IN (
+		SELECT max(id)
+		FROM rfjam_conditions
+		GROUP BY kind, receiver
+	)
+	AND active;
@@ -0,0 +1,50 @@
+-- How often sensors of a model check in, in seconds. NULL if the
+-- model does not send heartbeats, and is thus not supervised.
+ALTER TABLE honeywell5800_models
+	ADD COLUMN heartbeatInterval REAL
+		CONSTRAINT 'heartbeatInterval is positive' CHECK (
+			heartbeatInterval IS NULL
+			OR heartbeatInterval>0
+		);
+
+-- Honeywell documents supervised 5800 series transmitters as checking
+-- in every 70 to 90 minutes.
+UPDATE honeywell5800_models
+	SET heartbeatInterval=90*60
+	WHERE id IN (
+		'5800MINI',
+		'5800PIR-RES',
+		'5802MN',
+		'5808W3',
+		'5816',
+		'5818MNL',
+		'5822T',
+		'5853'
+	);
+
+CREATE INDEX honeywell5800_updates_sensor
+	ON honeywell5800_updates(sensor, id);
+
+-- A sensor that has not been heard from within its heartbeat
+-- interval, plus some slack.
+CREATE TABLE honeywell5800_supervision_losses (
+	id INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+	sensor INTEGER NOT NULL
+		REFERENCES honeywell5800_sensors(id)
+		ON DELETE CASCADE,
+	-- the last update heard before the loss
+	lastSeen INTEGER NOT NULL
+		REFERENCES honeywell5800_updates(id)
+		ON DELETE CASCADE,
+	-- when the sensor was due to be heard from
+	lost TEXT NOT NULL,
+	-- the first update heard after the loss
+	restoredBy INTEGER
+		REFERENCES honeywell5800_updates(id)
+		ON DELETE CASCADE
+);
+
+-- at most one ongoing loss per sensor
+CREATE UNIQUE INDEX honeywell5800_supervision_losses_ongoing
+	ON honeywell5800_supervision_losses(sensor)
+	WHERE restoredBy IS NULL;
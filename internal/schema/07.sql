@@ -0,0 +1,38 @@
+-- Battery state of each sensor, as reported in updates. A single
+-- report is not trusted; the state only changes after several
+-- reports in a row agree.
+CREATE TABLE honeywell5800_batteries (
+	sensor INTEGER NOT NULL PRIMARY KEY
+		REFERENCES honeywell5800_sensors(id)
+		ON DELETE CASCADE,
+	low BOOLEAN NOT NULL
+		DEFAULT false,
+	-- consecutive reports disagreeing with low, and the time of
+	-- the first of them
+	pending INTEGER NOT NULL
+		DEFAULT 0
+		CONSTRAINT 'pending is not negative' CHECK (pending>=0),
+	pendingSince TEXT,
+	-- for the current or latest low battery
+	firstSeenLow TEXT,
+	lastSeenLow TEXT,
+	cleared TEXT
+);
+
+-- Battery replacements, either noticed by a low battery turning back
+-- to normal, or recorded by hand.
+CREATE TABLE honeywell5800_battery_replacements (
+	id INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+	sensor INTEGER NOT NULL
+		REFERENCES honeywell5800_sensors(id)
+		ON DELETE CASCADE,
+	time TEXT NOT NULL,
+	-- when the old battery was first reported low, if it was
+	lowSince TEXT,
+	automatic BOOLEAN NOT NULL,
+	note TEXT NOT NULL
+		DEFAULT ''
+);
+
+CREATE INDEX honeywell5800_battery_replacements_sensor
+	ON honeywell5800_battery_replacements(sensor, id);
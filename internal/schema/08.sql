@@ -0,0 +1,38 @@
+-- A tamper loop opening, such as a sensor case being opened or pried
+-- off the wall. Tampers are security events on their own, regardless
+-- of arming, and are recorded even when the loop is disabled.
+CREATE TABLE honeywell5800_tampers (
+	id INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+	sensor INTEGER NOT NULL
+		REFERENCES honeywell5800_sensors(id)
+		ON DELETE CASCADE,
+	loop INTEGER NOT NULL
+		CONSTRAINT 'loop value in range' CHECK (
+			loop >= 1
+			AND loop <= 4
+		),
+	-- whether the loop was disabled in site configuration at the
+	-- time
+	disabled BOOLEAN NOT NULL,
+	openedBy INTEGER NOT NULL
+		REFERENCES honeywell5800_updates(id)
+		ON DELETE CASCADE,
+	closedBy INTEGER
+		REFERENCES honeywell5800_updates(id)
+		ON DELETE CASCADE,
+	acknowledged TEXT,
+	-- who acknowledged the tamper, free-form
+	acknowledgedBy TEXT,
+	CONSTRAINT 'acknowledged by someone' CHECK (
+		(acknowledged IS NULL) = (acknowledgedBy IS NULL)
+	)
+);
+
+-- at most one open tamper per loop
+CREATE UNIQUE INDEX honeywell5800_tampers_open
+	ON honeywell5800_tampers(sensor, loop)
+	WHERE closedBy IS NULL;
+
+CREATE VIEW honeywell5800_tampers_unacknowledged AS
+	SELECT * FROM honeywell5800_tampers
+	WHERE acknowledged IS NULL;
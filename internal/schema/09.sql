@@ -0,0 +1,134 @@
+-- What to do about a trip.
+CREATE TABLE arming_actions (
+	id TEXT NOT NULL PRIMARY KEY
+		CONSTRAINT 'id is not empty' CHECK (id<>'')
+)
+	WITHOUT ROWID;
+
+-- Arming modes. A trip on a loop that is not otherwise covered by
+-- arming_kind_rules or arming_loop_rules gets the default action of
+-- the mode.
+CREATE TABLE arming_modes (
+	id TEXT NOT NULL PRIMARY KEY
+		CONSTRAINT 'id is not empty' CHECK (id<>''),
+	defaultAction TEXT NOT NULL
+		REFERENCES arming_actions(id)
+)
+	WITHOUT ROWID;
+
+INSERT INTO arming_actions(id)
+	VALUES
+		('ignored'),
+		('chime'),
+		('alarm');
+
+INSERT INTO arming_modes(id, defaultAction)
+	VALUES
+		('disarmed', 'ignored'),
+		('home', 'alarm'),
+		('away', 'alarm'),
+		('night', 'alarm');
+
+-- History of arming mode changes. The latest one is the current mode;
+-- with no changes at all, the system is disarmed.
+CREATE TABLE arming_changes (
+	id INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+	time TEXT NOT NULL,
+	mode TEXT NOT NULL
+		REFERENCES arming_modes(id),
+	-- who changed the mode, free-form
+	changedBy TEXT NOT NULL
+		CONSTRAINT 'changedBy is not empty' CHECK (changedBy<>''),
+	-- what they used to change it, such as "cli" or a key fob
+	via TEXT NOT NULL
+		DEFAULT ''
+);
+
+-- Action for trips of a loop kind in a mode.
+CREATE TABLE arming_kind_rules (
+	mode TEXT NOT NULL
+		REFERENCES arming_modes(id)
+		ON DELETE CASCADE,
+	kind TEXT NOT NULL
+		REFERENCES honeywell5800_loop_kinds(id)
+		ON DELETE CASCADE,
+	action TEXT NOT NULL
+		REFERENCES arming_actions(id),
+	PRIMARY KEY (mode, kind)
+)
+	WITHOUT ROWID;
+
+-- Life safety is never ignored.
+WITH kinds (kind) AS (
+	VALUES
+		('heat detector'),
+		('medical alert'),
+		('panic button'),
+		('smoke detector')
+)
+INSERT INTO arming_kind_rules(mode, kind, action)
+	SELECT arming_modes.id, kinds.kind, 'alarm'
+		FROM arming_modes
+		JOIN kinds;
+
+-- Not intrusions, but worth knowing about.
+WITH kinds (kind) AS (
+	VALUES
+		('low temperature'),
+		('maintenance needed')
+)
+INSERT INTO arming_kind_rules(mode, kind, action)
+	SELECT arming_modes.id, kinds.kind, 'chime'
+		FROM arming_modes
+		JOIN kinds;
+
+-- Key fobs are for people who are supposed to be there.
+INSERT INTO arming_kind_rules(mode, kind, action)
+	SELECT arming_modes.id, 'key fob button', 'ignored'
+		FROM arming_modes;
+
+-- Chime on the perimeter while disarmed.
+INSERT INTO arming_kind_rules(mode, kind, action)
+	VALUES
+		('disarmed', 'door open', 'chime'),
+		('disarmed', 'door or window open', 'chime'),
+		('disarmed', 'tilt switch', 'chime'),
+		('disarmed', 'window open', 'chime');
+
+-- People move around inside when home, or at night.
+INSERT INTO arming_kind_rules(mode, kind, action)
+	VALUES
+		('home', 'motion detector', 'ignored'),
+		('night', 'motion detector', 'ignored');
+
+-- Action for trips of a single loop in a mode, overriding
+-- arming_kind_rules.
+CREATE TABLE arming_loop_rules (
+	mode TEXT NOT NULL
+		REFERENCES arming_modes(id)
+		ON DELETE CASCADE,
+	sensor INTEGER NOT NULL
+		REFERENCES honeywell5800_sensors(id)
+		ON DELETE CASCADE,
+	loop INTEGER NOT NULL
+		CONSTRAINT 'loop value in range' CHECK (
+			loop >= 1
+			AND loop <= 4
+		),
+	action TEXT NOT NULL
+		REFERENCES arming_actions(id),
+	PRIMARY KEY (mode, sensor, loop)
+)
+	WITHOUT ROWID;
+
+-- Trips classified according to the arming mode at the time of the
+-- trip.
+CREATE TABLE arming_trips (
+	trip INTEGER NOT NULL PRIMARY KEY
+		REFERENCES honeywell5800_trips(id)
+		ON DELETE CASCADE,
+	mode TEXT NOT NULL
+		REFERENCES arming_modes(id),
+	action TEXT NOT NULL
+		REFERENCES arming_actions(id)
+);
@@ -0,0 +1,53 @@
+-- Entry and exit delays of arming modes, in seconds. NULL means no
+-- delay.
+--
+-- During the exit delay after arming, trips on entry/exit loops and
+-- motion detectors are ignored, to let people leave. A trip on an
+-- entry/exit loop starts the entry delay, which gives time to disarm
+-- before the trip becomes an alarm. Motion detectors tripping during
+-- an entry delay follow the same countdown.
+ALTER TABLE arming_modes
+	ADD COLUMN exitDelay REAL
+		CONSTRAINT 'exitDelay is positive' CHECK (
+			exitDelay IS NULL
+			OR exitDelay>0
+		);
+
+ALTER TABLE arming_modes
+	ADD COLUMN entryDelay REAL
+		CONSTRAINT 'entryDelay is positive' CHECK (
+			entryDelay IS NULL
+			OR entryDelay>0
+		);
+
+UPDATE arming_modes
+	SET exitDelay=60
+	WHERE id='away';
+
+UPDATE arming_modes
+	SET entryDelay=30
+	WHERE id IN ('home', 'away', 'night');
+
+-- Loops people use to come and go, typically the front door.
+ALTER TABLE honeywell5800_site_loops
+	ADD COLUMN entryExit BOOLEAN NOT NULL
+		DEFAULT false;
+
+-- Trips waiting for their entry delay to run out. The countdown
+-- survives restarts; outcome is NULL until it is over, and then tells
+-- whether the trip became an alarm or was ignored due to disarming.
+CREATE TABLE arming_entry_delays (
+	trip INTEGER NOT NULL PRIMARY KEY
+		REFERENCES honeywell5800_trips(id)
+		ON DELETE CASCADE,
+	mode TEXT NOT NULL
+		REFERENCES arming_modes(id),
+	started TEXT NOT NULL,
+	deadline TEXT NOT NULL,
+	outcome TEXT
+		REFERENCES arming_actions(id)
+);
+
+CREATE INDEX arming_entry_delays_pending
+	ON arming_entry_delays(trip)
+	WHERE outcome IS NULL;
@@ -0,0 +1,99 @@
+-- Give trip classifications an order of their own, so they can be
+-- consumed with catchup. Trips waiting for an entry delay are
+-- classified out of order.
+CREATE TABLE arming_trips_new (
+	id INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+	trip INTEGER NOT NULL UNIQUE
+		REFERENCES honeywell5800_trips(id)
+		ON DELETE CASCADE,
+	mode TEXT NOT NULL
+		REFERENCES arming_modes(id),
+	action TEXT NOT NULL
+		REFERENCES arming_actions(id)
+);
+
+INSERT INTO arming_trips_new(trip, mode, action)
+	SELECT trip, mode, action
+	FROM arming_trips
+	ORDER BY trip;
+
+DROP TABLE arming_trips;
+
+ALTER TABLE arming_trips_new
+	RENAME TO arming_trips;
+
+-- What raised an alert.
+CREATE TABLE alert_sources (
+	id TEXT NOT NULL PRIMARY KEY
+		CONSTRAINT 'id is not empty' CHECK (id<>'')
+)
+	WITHOUT ROWID;
+
+INSERT INTO alert_sources(id)
+	VALUES
+		('trip'),
+		('tamper'),
+		('supervision'),
+		('battery');
+
+CREATE TABLE alert_severities (
+	id TEXT NOT NULL PRIMARY KEY
+		CONSTRAINT 'id is not empty' CHECK (id<>'')
+)
+	WITHOUT ROWID;
+
+INSERT INTO alert_severities(id)
+	VALUES
+		('alarm'),
+		('warning'),
+		('info');
+
+-- Alerts are raised from trips classified as alarms, tampers,
+-- supervision losses and low batteries. While an alert is open, the
+-- same condition happening again only bumps count. An alert is
+-- resolved once the condition has cleared.
+--
+-- All times come from the source tables, so alerts can be rebuilt
+-- from them.
+CREATE TABLE alerts (
+	id INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+	source TEXT NOT NULL
+		REFERENCES alert_sources(id),
+	sensor INTEGER NOT NULL
+		REFERENCES honeywell5800_sensors(id)
+		ON DELETE CASCADE,
+	-- 0 for alerts about the whole sensor
+	loop INTEGER NOT NULL
+		CONSTRAINT 'loop value in range' CHECK (
+			loop >= 0
+			AND loop <= 4
+		),
+	severity TEXT NOT NULL
+		REFERENCES alert_severities(id),
+	summary TEXT NOT NULL,
+	raised TEXT NOT NULL,
+	lastSeen TEXT NOT NULL,
+	count INTEGER NOT NULL
+		DEFAULT 1
+		CONSTRAINT 'count is positive' CHECK (count>0),
+	-- set once someone has been told
+	notified TEXT,
+	acknowledged TEXT,
+	-- who acknowledged the alert, free-form
+	acknowledgedBy TEXT,
+	note TEXT NOT NULL
+		DEFAULT '',
+	resolved TEXT,
+	CONSTRAINT 'acknowledged by someone' CHECK (
+		(acknowledged IS NULL) = (acknowledgedBy IS NULL)
+	)
+);
+
+-- at most one open alert per condition
+CREATE UNIQUE INDEX alerts_open_condition
+	ON alerts(source, sensor, loop)
+	WHERE resolved IS NULL;
+
+CREATE VIEW alerts_open AS
+	SELECT * FROM alerts
+	WHERE resolved IS NULL;
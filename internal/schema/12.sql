@@ -0,0 +1,30 @@
+-- Notifications waiting to be delivered, or already delivered. Rows
+-- are added in the same savepoint as the alert change they are about,
+-- one per notification channel, and delivered asynchronously.
+CREATE TABLE notify_outbox (
+	id INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+	alert INTEGER NOT NULL
+		REFERENCES alerts(id)
+		ON DELETE CASCADE,
+	-- name of the channel in the site configuration
+	channel TEXT NOT NULL
+		CONSTRAINT 'channel is not empty' CHECK (channel<>''),
+	event TEXT NOT NULL
+		CONSTRAINT 'event is known' CHECK (
+			event IN ('raised', 'resolved')
+		),
+	created TEXT NOT NULL,
+	attempts INTEGER NOT NULL
+		DEFAULT 0
+		CONSTRAINT 'attempts is not negative' CHECK (attempts>=0),
+	nextAttempt TEXT NOT NULL,
+	lastError TEXT,
+	delivered TEXT,
+	-- delivery was given up on
+	failed TEXT
+);
+
+CREATE INDEX notify_outbox_pending
+	ON notify_outbox(id)
+	WHERE delivered IS NULL
+		AND failed IS NULL;
@@ -0,0 +1,24 @@
+-- The VAPID key pair identifying this site to push services. There
+-- is only ever one; it is generated on first use.
+CREATE TABLE webpush_vapid (
+	id INTEGER NOT NULL PRIMARY KEY
+		CONSTRAINT 'only one key' CHECK (id=1),
+	-- ASN.1 DER, as SEC 1 EC private key
+	privateKey BLOB NOT NULL,
+	created TEXT NOT NULL
+);
+
+-- Browsers and phones subscribed to push notifications. Subscriptions
+-- the push service reports as gone are deleted.
+CREATE TABLE webpush_subscriptions (
+	id INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+	endpoint TEXT NOT NULL UNIQUE
+		CONSTRAINT 'endpoint is https' CHECK (endpoint LIKE 'https://%'),
+	-- uncompressed P-256 public key of the user agent
+	p256dh BLOB NOT NULL
+		CONSTRAINT 'p256dh is a P-256 point' CHECK (length(p256dh)=65),
+	auth BLOB NOT NULL
+		CONSTRAINT 'auth is 16 bytes' CHECK (length(auth)=16),
+	created TEXT NOT NULL,
+	lastDelivered TEXT
+);
@@ -0,0 +1,52 @@
+-- Escalation of alerts through the policies in the site
+-- configuration. The next step and when it is due are kept here, so
+-- escalation continues across restarts.
+CREATE TABLE alert_escalations (
+	alert INTEGER NOT NULL PRIMARY KEY
+		REFERENCES alerts(id)
+		ON DELETE CASCADE,
+	-- name of the policy in the site configuration
+	policy TEXT NOT NULL,
+	-- index of the next step to take
+	step INTEGER NOT NULL
+		DEFAULT 0
+		CONSTRAINT 'step is not negative' CHECK (step>=0),
+	due TEXT,
+	finished TEXT,
+	outcome TEXT
+		CONSTRAINT 'outcome is known' CHECK (
+			outcome IN (
+				'acknowledged',
+				'resolved',
+				'exhausted',
+				'unknown policy'
+			)
+		),
+	-- recipients have been told about the resolution
+	resolvedQueued BOOLEAN NOT NULL
+		DEFAULT false,
+	CONSTRAINT 'pending or finished' CHECK (
+		(due IS NULL) = (finished IS NOT NULL)
+		AND (finished IS NULL) = (outcome IS NULL)
+	)
+);
+
+CREATE INDEX alert_escalations_pending
+	ON alert_escalations(due)
+	WHERE finished IS NULL;
+
+-- Recipients reached, or left alone because of quiet hours, by each
+-- escalation step.
+CREATE TABLE alert_escalation_notices (
+	id INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+	alert INTEGER NOT NULL
+		REFERENCES alert_escalations(alert)
+		ON DELETE CASCADE,
+	step INTEGER NOT NULL,
+	recipient TEXT NOT NULL,
+	time TEXT NOT NULL,
+	quiet BOOLEAN NOT NULL
+);
+
+CREATE INDEX alert_escalation_notices_alert
+	ON alert_escalation_notices(alert);
@@ -0,0 +1,42 @@
+-- Sirens, strobes and chimes being driven. An activation lasts from
+-- the trip that started it until it is stopped; times come from the
+-- trip, so trips processed late do not sound long after the fact.
+CREATE TABLE output_activations (
+	id INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+	-- name of the output in the site configuration
+	output TEXT NOT NULL,
+	pattern TEXT NOT NULL
+		CONSTRAINT 'pattern is known' CHECK (
+			pattern IN ('chime', 'alarm')
+		),
+	trip INTEGER
+		REFERENCES arming_trips(id)
+		ON DELETE SET NULL,
+	started TEXT NOT NULL,
+	-- when the pattern ends on its own, or the output has been on
+	-- for as long as allowed
+	until TEXT NOT NULL,
+	stopped TEXT,
+	stopReason TEXT
+		CONSTRAINT 'stopReason is known' CHECK (
+			stopReason IN ('finished', 'disarmed', 'replaced')
+		),
+	CONSTRAINT 'stopped for a reason' CHECK (
+		(stopped IS NULL) = (stopReason IS NULL)
+	)
+);
+
+-- at most one activation per output at a time
+CREATE UNIQUE INDEX output_activations_active
+	ON output_activations(output)
+	WHERE stopped IS NULL;
+
+-- The state each output was last driven to.
+CREATE TABLE output_states (
+	output TEXT NOT NULL PRIMARY KEY,
+	isOn BOOLEAN NOT NULL,
+	changed TEXT NOT NULL,
+	-- the latest failure to drive the output, cleared on success
+	lastError TEXT
+)
+	WITHOUT ROWID;
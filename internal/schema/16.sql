@@ -0,0 +1,25 @@
+-- Source rows a catchup consumer failed to process. A row is tried
+-- again until it has failed too many times, and is then skipped and
+-- left here for someone to look at.
+CREATE TABLE catchup_dead_letters (
+	id INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+	consumer TEXT NOT NULL
+		CONSTRAINT 'consumer is not empty' CHECK (consumer<>''),
+	-- id of the row in the source table of the consumer
+	source INTEGER NOT NULL,
+	attempts INTEGER NOT NULL
+		CONSTRAINT 'attempts is positive' CHECK (attempts>0),
+	-- the latest failure
+	error TEXT NOT NULL,
+	firstFailed TEXT NOT NULL,
+	lastFailed TEXT NOT NULL,
+	-- when the consumer gave up and moved past the row
+	skipped TEXT,
+	-- try a skipped row again, on the next run of the consumer
+	retry BOOLEAN NOT NULL
+		DEFAULT false,
+	CONSTRAINT 'only skipped rows are retried' CHECK (
+		NOT retry OR skipped IS NOT NULL
+	),
+	UNIQUE (consumer, source)
+);
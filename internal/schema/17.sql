@@ -0,0 +1,19 @@
+-- Retention keeps the updates other tables refer to. These make
+-- checking for, and cascading to, the references cheap.
+CREATE INDEX honeywell5800_trips_trippedBy
+	ON honeywell5800_trips(trippedBy);
+
+CREATE INDEX honeywell5800_trips_clearedBy
+	ON honeywell5800_trips(clearedBy);
+
+CREATE INDEX honeywell5800_supervision_losses_lastSeen
+	ON honeywell5800_supervision_losses(lastSeen);
+
+CREATE INDEX honeywell5800_supervision_losses_restoredBy
+	ON honeywell5800_supervision_losses(restoredBy);
+
+CREATE INDEX honeywell5800_tampers_openedBy
+	ON honeywell5800_tampers(openedBy);
+
+CREATE INDEX honeywell5800_tampers_closedBy
+	ON honeywell5800_tampers(closedBy);
@@ -0,0 +1,11 @@
+-- Rows processed again after a rewind are about events that happened
+-- before it. Consumers that tell people about events, or act on them,
+-- look here so they do not do it twice.
+CREATE TABLE pipeline_replays (
+	consumer TEXT NOT NULL PRIMARY KEY
+		CONSTRAINT 'consumer is not empty' CHECK (consumer<>''),
+	-- when the consumer was last rewound; events before this are
+	-- replays
+	rewound TEXT NOT NULL
+)
+	WITHOUT ROWID;
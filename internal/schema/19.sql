@@ -0,0 +1,17 @@
+-- Subscriptions a notification from the outbox has been pushed to. A
+-- notification that failed for some subscriptions is retried only for
+-- the rest.
+CREATE TABLE webpush_deliveries (
+	notification INTEGER NOT NULL
+		REFERENCES notify_outbox(id)
+		ON DELETE CASCADE,
+	subscription INTEGER NOT NULL
+		REFERENCES webpush_subscriptions(id)
+		ON DELETE CASCADE,
+	time TEXT NOT NULL,
+	PRIMARY KEY (notification, subscription)
+)
+	WITHOUT ROWID;
+
+CREATE INDEX webpush_deliveries_subscription
+	ON webpush_deliveries(subscription);
@@ -0,0 +1,85 @@
+-- Jamming raises alerts about the whole site, which have no sensor.
+INSERT INTO alert_sources(id)
+	VALUES ('jamming');
+
+CREATE TABLE alerts_new (
+	id INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+	source TEXT NOT NULL
+		REFERENCES alert_sources(id),
+	-- NULL for alerts about the whole site
+	sensor INTEGER
+		REFERENCES honeywell5800_sensors(id)
+		ON DELETE CASCADE,
+	-- 0 for alerts about the whole sensor
+	loop INTEGER NOT NULL
+		CONSTRAINT 'loop value in range' CHECK (
+			loop >= 0
+			AND loop <= 4
+		),
+	severity TEXT NOT NULL
+		REFERENCES alert_severities(id),
+	summary TEXT NOT NULL,
+	raised TEXT NOT NULL,
+	lastSeen TEXT NOT NULL,
+	count INTEGER NOT NULL
+		DEFAULT 1
+		CONSTRAINT 'count is positive' CHECK (count>0),
+	-- set once someone has been told
+	notified TEXT,
+	acknowledged TEXT,
+	-- who acknowledged the alert, free-form
+	acknowledgedBy TEXT,
+	note TEXT NOT NULL
+		DEFAULT '',
+	resolved TEXT,
+	CONSTRAINT 'acknowledged by someone' CHECK (
+		(acknowledged IS NULL) = (acknowledgedBy IS NULL)
+	),
+	CONSTRAINT 'only jamming is about the whole site' CHECK (
+		(sensor IS NULL) = (source='jamming')
+	),
+	CONSTRAINT 'site alerts have no loop' CHECK (
+		sensor IS NOT NULL
+		OR loop=0
+	)
+);
+
+INSERT INTO alerts_new(
+	id, source, sensor, loop, severity, summary, raised, lastSeen,
+	count, notified, acknowledged, acknowledgedBy, note, resolved
+)
+	SELECT
+		id, source, sensor, loop, severity, summary, raised, lastSeen,
+		count, notified, acknowledged, acknowledgedBy, note, resolved
+	FROM alerts
+	ORDER BY id;
+
+-- keep ids of deleted alerts from being reused
+UPDATE sqlite_sequence
+	SET seq=(SELECT seq FROM sqlite_sequence WHERE name='alerts')
+	WHERE name='alerts_new';
+
+-- Migrations run without foreign key enforcement, so dropping the
+-- table leaves the notifications and escalations referring to it
+-- alone.
+DROP VIEW alerts_open;
+
+DROP TABLE alerts;
+
+ALTER TABLE alerts_new
+	RENAME TO alerts;
+
+-- at most one open alert per condition
+CREATE UNIQUE INDEX alerts_open_condition
+	ON alerts(source, sensor, loop)
+	WHERE resolved IS NULL;
+
+-- NULLs are distinct in the index above
+CREATE UNIQUE INDEX alerts_open_site
+	ON alerts(source)
+	WHERE resolved IS NULL
+	AND sensor IS NULL;
+
+CREATE VIEW alerts_open AS
+	SELECT * FROM alerts
+	WHERE resolved IS NULL;
@@ -0,0 +1,21 @@
+-- Outputs sounded by escalation steps. The output controller reads
+-- these like it reads trips, and starts the alarm pattern on each.
+CREATE TABLE alert_escalation_outputs (
+	id INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+	alert INTEGER NOT NULL
+		REFERENCES alert_escalations(alert)
+		ON DELETE CASCADE,
+	step INTEGER NOT NULL,
+	-- name of the output in the site configuration
+	output TEXT NOT NULL,
+	time TEXT NOT NULL
+);
+
+CREATE INDEX alert_escalation_outputs_alert
+	ON alert_escalation_outputs(alert);
+
+-- An activation comes from either a trip or an escalation step.
+ALTER TABLE output_activations
+	ADD COLUMN escalation INTEGER
+		REFERENCES alert_escalation_outputs(id)
+		ON DELETE SET NULL;
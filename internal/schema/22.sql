@@ -0,0 +1,16 @@
+-- Runs of the daemon. Nobody was listening between the last time a
+-- run was known to be alive and the start of the next one.
+CREATE TABLE daemon_runs (
+	id INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+	started TEXT NOT NULL,
+	alive TEXT NOT NULL,
+	CONSTRAINT 'alive after start' CHECK (alive>=started)
+);
+
+CREATE INDEX daemon_runs_started
+	ON daemon_runs(started);
+
+-- When the receiver was started again after the exit; NULL if it was
+-- not, because the daemon gave up or stopped.
+ALTER TABLE rtl433_restarts
+	ADD COLUMN resumes TEXT;
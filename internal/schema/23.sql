@@ -0,0 +1,60 @@
+-- Activations started by escalation steps also stop once the alert
+-- has been acknowledged or resolved.
+CREATE TABLE output_activations_new (
+	id INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+	-- name of the output in the site configuration
+	output TEXT NOT NULL,
+	pattern TEXT NOT NULL
+		CONSTRAINT 'pattern is known' CHECK (
+			pattern IN ('chime', 'alarm')
+		),
+	trip INTEGER
+		REFERENCES arming_trips(id)
+		ON DELETE SET NULL,
+	started TEXT NOT NULL,
+	-- when the pattern ends on its own, or the output has been on
+	-- for as long as allowed
+	until TEXT NOT NULL,
+	stopped TEXT,
+	stopReason TEXT
+		CONSTRAINT 'stopReason is known' CHECK (
+			stopReason IN (
+				'finished',
+				'disarmed',
+				'replaced',
+				'acknowledged',
+				'resolved'
+			)
+		),
+	escalation INTEGER
+		REFERENCES alert_escalation_outputs(id)
+		ON DELETE SET NULL,
+	CONSTRAINT 'stopped for a reason' CHECK (
+		(stopped IS NULL) = (stopReason IS NULL)
+	)
+);
+
+INSERT INTO output_activations_new(
+	id, output, pattern, trip, started, until, stopped, stopReason,
+	escalation
+)
+	SELECT
+		id, output, pattern, trip, started, until, stopped, stopReason,
+		escalation
+	FROM output_activations
+	ORDER BY id;
+
+-- keep ids of deleted activations from being reused
+UPDATE sqlite_sequence
+	SET seq=(SELECT seq FROM sqlite_sequence WHERE name='output_activations')
+	WHERE name='output_activations_new';
+
+DROP TABLE output_activations;
+
+ALTER TABLE output_activations_new
+	RENAME TO output_activations;
+
+-- at most one activation per output at a time
+CREATE UNIQUE INDEX output_activations_active
+	ON output_activations(output)
+	WHERE stopped IS NULL;
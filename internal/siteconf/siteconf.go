@@ -0,0 +1,961 @@
+// Package siteconf loads the daemon configuration file.
+//
+// The configuration is JSON. Unknown fields are rejected, to catch
+// typos.
+package siteconf
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/smtp"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"eagain.net/go/securityblanket/internal/archive"
+	"eagain.net/go/securityblanket/internal/database"
+	"eagain.net/go/securityblanket/internal/escalate"
+	"eagain.net/go/securityblanket/internal/homeassistant"
+	"eagain.net/go/securityblanket/internal/jsonx"
+	"eagain.net/go/securityblanket/internal/mqtt"
+	"eagain.net/go/securityblanket/internal/notify"
+	"eagain.net/go/securityblanket/internal/output"
+	"eagain.net/go/securityblanket/internal/retention"
+	"eagain.net/go/securityblanket/internal/rfjam"
+	"eagain.net/go/securityblanket/internal/rtl433receive"
+	"eagain.net/go/securityblanket/internal/webpush"
+	"go.uber.org/zap"
+)
+
+type Config struct {
+	Receivers []Receiver `json:"receivers"`
+	Jamming   Jamming    `json:"jamming"`
+	Notify    []Channel  `json:"notify"`
+	// Recipients and Escalation route alerts to people. Channels not
+	// belonging to any recipient get every alert.
+	Recipients []Recipient `json:"recipients"`
+	Rotations  []Rotation  `json:"rotations"`
+	Escalation []Policy    `json:"escalation"`
+	Outputs    []Output    `json:"outputs"`
+	// HomeAssistant publishes sensors and the arming mode to Home
+	// Assistant, if set.
+	HomeAssistant *HomeAssistant `json:"homeAssistant"`
+	// Retention deletes old rows, by table. Tables not listed are
+	// kept forever.
+	Retention map[string]Retention `json:"retention"`
+	// Subscriptions lets browsers and phones subscribe to the webPush
+	// channels over HTTP. Without it, they cannot.
+	Subscriptions *Subscriptions `json:"subscriptions"`
+}
+
+// Receiver describes one source of rtl_433 output.
+type Receiver struct {
+	// Label identifies the receiver in logs and the database.
+	Label string `json:"label"`
+	// Source is empty for running rtl_433 as a subprocess, or a URL
+	// for receiving from a networked rtl_433: syslog://[HOST]:PORT,
+	// mqtt://[USER:PASS@]HOST[:PORT][/TOPIC] or
+	// http://HOST:PORT/events.
+	//
+	// Raw IQ samples can be decoded with the built-in Honeywell 5800
+	// demodulator instead of rtl_433, from rtl_tcp://HOST:PORT or
+	// file:///PATH.cu8 (or .cs16).
+	Source string `json:"source"`
+	// Device is the SDR device to use with a subprocess, as a USB
+	// device index or a colon and serial number.
+	Device string `json:"device"`
+	// Frequency is the center frequency, in Hz. Networked receivers
+	// need it too, to tag the messages they receive.
+	Frequency uint64 `json:"frequency"`
+	// SampleRate is in samples per second. Zero uses the rtl_433
+	// default. Only applies to a local rtl_433 and raw IQ sources.
+	SampleRate uint64 `json:"sampleRate"`
+	// Protocols lists the rtl_433 decoders to enable, by number.
+	Protocols []int `json:"protocols"`
+}
+
+// FreqMHz returns the center frequency rounded to megahertz, as used
+// for tagging received messages.
+func (r *Receiver) FreqMHz() int64 {
+	return int64((r.Frequency + 500000) / 1000000)
+}
+
+// IsIQ reports whether the receiver decodes raw IQ samples itself.
+func (r *Receiver) IsIQ() bool {
+	return strings.HasPrefix(r.Source, "rtl_tcp:") || strings.HasPrefix(r.Source, "file:")
+}
+
+// Radio returns the rtl_433 subprocess settings.
+func (r *Receiver) Radio() *rtl433receive.Radio {
+	return &rtl433receive.Radio{
+		Device:     r.Device,
+		Frequency:  r.Frequency,
+		SampleRate: r.SampleRate,
+		Protocols:  r.Protocols,
+	}
+}
+
+// Jamming tunes the jamming detector. Zero values use the defaults;
+// see package rfjam.
+type Jamming struct {
+	// NoiseMargin is how many dB above the normal noise floor counts
+	// as jamming.
+	NoiseMargin float64 `json:"noiseMargin"`
+	// NoiseSamples is how many consecutive noisy transmissions it
+	// takes.
+	NoiseSamples int `json:"noiseSamples"`
+	// SilenceFactor is how many heartbeat intervals a sensor can go
+	// unheard before it counts as silent.
+	SilenceFactor float64 `json:"silenceFactor"`
+	// SilentSensors and SilentFraction are how many, and what
+	// fraction of, the sensors need to go silent at the same time.
+	SilentSensors  int     `json:"silentSensors"`
+	SilentFraction float64 `json:"silentFraction"`
+}
+
+// Options returns the jamming detector settings.
+func (j *Jamming) Options() []rfjam.Option {
+	var opts []rfjam.Option
+	if j.NoiseMargin != 0 {
+		opts = append(opts, rfjam.NoiseMargin(j.NoiseMargin))
+	}
+	if j.NoiseSamples != 0 {
+		opts = append(opts, rfjam.NoiseSamples(j.NoiseSamples))
+	}
+	if j.SilenceFactor != 0 {
+		opts = append(opts, rfjam.SilenceFactor(j.SilenceFactor))
+	}
+	if j.SilentSensors != 0 {
+		opts = append(opts, rfjam.SilentSensors(j.SilentSensors))
+	}
+	if j.SilentFraction != 0 {
+		opts = append(opts, rfjam.SilentFraction(j.SilentFraction))
+	}
+	return opts
+}
+
+func (j *Jamming) validate() error {
+	if j.NoiseMargin < 0 {
+		return errors.New("noiseMargin cannot be negative")
+	}
+	if j.NoiseSamples < 0 {
+		return errors.New("noiseSamples cannot be negative")
+	}
+	if j.SilenceFactor < 0 {
+		return errors.New("silenceFactor cannot be negative")
+	}
+	if j.SilentSensors < 0 {
+		return errors.New("silentSensors cannot be negative")
+	}
+	if j.SilentFraction < 0 || j.SilentFraction > 1 {
+		return errors.New("silentFraction must be between 0 and 1")
+	}
+	return nil
+}
+
+// Channel is a destination for alert notifications. Exactly one of
+// Webhook, SMTP and WebPush is set.
+type Channel struct {
+	// Name identifies the channel in logs and the database. Renaming
+	// a channel abandons notifications still queued for it.
+	Name string `json:"name"`
+	// Webhook is a URL to POST notifications to, as JSON.
+	Webhook string   `json:"webhook"`
+	SMTP    *SMTP    `json:"smtp"`
+	WebPush *WebPush `json:"webPush"`
+	// MinInterval is the minimum number of seconds between
+	// notifications.
+	MinInterval float64 `json:"minInterval"`
+}
+
+// SMTP describes a mail server to send notifications through.
+type SMTP struct {
+	// Addr is HOST:PORT.
+	Addr string   `json:"addr"`
+	From string   `json:"from"`
+	To   []string `json:"to"`
+	// Username and Password are used for PLAIN authentication, which
+	// needs TLS unless the server is on localhost.
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+// WebPush sends notifications to every browser and phone subscribed
+// through the HTTP server.
+type WebPush struct {
+	// Subject is a mailto: or https: URL the push services can use
+	// to contact the operator of the site.
+	Subject string `json:"subject"`
+	// TTL is how many seconds push services keep trying to deliver.
+	// Zero uses the default of package webpush.
+	TTL float64 `json:"ttl"`
+}
+
+// Subscriptions protects the Web Push subscription API.
+type Subscriptions struct {
+	// Token must be sent as "Authorization: Bearer TOKEN" to
+	// subscribe or unsubscribe.
+	Token string `json:"token"`
+	// PushHosts are the push services endpoints may be on, including
+	// their subdomains. Empty uses the browsers' defaults, see
+	// webpush.DefaultHosts.
+	PushHosts []string `json:"pushHosts"`
+}
+
+// minTokenLength is the shortest subscription token accepted, in
+// bytes.
+const minTokenLength = 16
+
+func (s *Subscriptions) validate() error {
+	if len(s.Token) < minTokenLength {
+		return fmt.Errorf("token must be at least %d characters", minTokenLength)
+	}
+	for _, h := range s.PushHosts {
+		if h == "" || strings.ContainsAny(h, "/:@") {
+			return fmt.Errorf("pushHosts must be host names: %q", h)
+		}
+	}
+	return nil
+}
+
+// Options returns the options for webpush.Handler.
+func (s *Subscriptions) Options() []webpush.HandlerOption {
+	opts := []webpush.HandlerOption{webpush.Token(s.Token)}
+	if len(s.PushHosts) > 0 {
+		opts = append(opts, webpush.Hosts(s.PushHosts...))
+	}
+	return opts
+}
+
+// Channel returns the notification channel. Web Push keeps its
+// subscriptions in db.
+func (c *Channel) Channel(db *database.DB, log *zap.Logger) *notify.Channel {
+	ch := &notify.Channel{
+		MinInterval: time.Duration(c.MinInterval * float64(time.Second)),
+	}
+	switch {
+	case c.Webhook != "":
+		ch.Notifier = &notify.Webhook{URL: c.Webhook}
+	case c.SMTP != nil:
+		s := &notify.SMTP{
+			Addr: c.SMTP.Addr,
+			From: c.SMTP.From,
+			To:   c.SMTP.To,
+		}
+		if c.SMTP.Username != "" {
+			host, _, _ := net.SplitHostPort(c.SMTP.Addr)
+			s.Auth = smtp.PlainAuth("", c.SMTP.Username, c.SMTP.Password, host)
+		}
+		ch.Notifier = s
+	case c.WebPush != nil:
+		ch.Notifier = &webpush.Push{
+			DB:      db,
+			Log:     log.Named(c.Name),
+			Subject: c.WebPush.Subject,
+			TTL:     time.Duration(c.WebPush.TTL * float64(time.Second)),
+		}
+	}
+	return ch
+}
+
+func (c *Channel) validate() error {
+	n := 0
+	if c.Webhook != "" {
+		n++
+	}
+	if c.SMTP != nil {
+		n++
+	}
+	if c.WebPush != nil {
+		n++
+	}
+	if n != 1 {
+		return errors.New("exactly one of webhook, smtp and webPush is required")
+	}
+	if c.Webhook != "" {
+		u, err := url.Parse(c.Webhook)
+		if err != nil {
+			return fmt.Errorf("webhook: %w", err)
+		}
+		if u.Scheme != "http" && u.Scheme != "https" {
+			return fmt.Errorf("webhook must be http or https: %q", c.Webhook)
+		}
+	}
+	if c.SMTP != nil {
+		if _, _, err := net.SplitHostPort(c.SMTP.Addr); err != nil {
+			return fmt.Errorf("smtp addr: %w", err)
+		}
+		if c.SMTP.From == "" {
+			return errors.New("smtp from is required")
+		}
+		if len(c.SMTP.To) == 0 {
+			return errors.New("smtp to is required")
+		}
+	}
+	if c.WebPush != nil {
+		if !strings.HasPrefix(c.WebPush.Subject, "mailto:") && !strings.HasPrefix(c.WebPush.Subject, "https:") {
+			return errors.New("webPush subject must be a mailto: or https: URL")
+		}
+		if c.WebPush.TTL < 0 {
+			return errors.New("webPush ttl cannot be negative")
+		}
+	}
+	if c.MinInterval < 0 {
+		return errors.New("minInterval cannot be negative")
+	}
+	return nil
+}
+
+// Channels returns the notification channels by name.
+func (c *Config) Channels(db *database.DB, log *zap.Logger) map[string]*notify.Channel {
+	channels := make(map[string]*notify.Channel, len(c.Notify))
+	for i := range c.Notify {
+		channels[c.Notify[i].Name] = c.Notify[i].Channel(db, log)
+	}
+	return channels
+}
+
+// BroadcastChannels returns the names of the notification channels
+// that do not belong to any recipient.
+func (c *Config) BroadcastChannels() []string {
+	owned := make(map[string]struct{})
+	for i := range c.Recipients {
+		for _, ch := range c.Recipients[i].Channels {
+			owned[ch] = struct{}{}
+		}
+	}
+	var names []string
+	for i := range c.Notify {
+		if _, ok := owned[c.Notify[i].Name]; ok {
+			continue
+		}
+		names = append(names, c.Notify[i].Name)
+	}
+	return names
+}
+
+// Recipient is a person alerts are escalated to.
+type Recipient struct {
+	Name string `json:"name"`
+	// Channels are names of notification channels.
+	Channels   []string    `json:"channels"`
+	QuietHours *QuietHours `json:"quietHours"`
+}
+
+// QuietHours is a daily time range when the recipient is only told
+// about life safety alerts. Times are HH:MM in local time; the range
+// wraps around midnight if start is after end.
+type QuietHours struct {
+	Start string `json:"start"`
+	End   string `json:"end"`
+}
+
+// parseClock parses HH:MM as an offset from midnight.
+func parseClock(s string) (time.Duration, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("bad time of day, want HH:MM: %q", s)
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+// Rotation is an on-call schedule, handing the duty to each of the
+// recipients in turn.
+type Rotation struct {
+	Name string `json:"name"`
+	// Recipients are names of recipients, in order of their shifts.
+	Recipients []string `json:"recipients"`
+	// Start is when the shift of the first recipient starts, in
+	// RFC 3339 format.
+	Start string `json:"start"`
+	// Shift is the number of seconds each recipient is on call.
+	Shift float64 `json:"shift"`
+}
+
+// Policy is an escalation policy. The first policy matching an alert
+// applies.
+type Policy struct {
+	Name string `json:"name"`
+	// Sources and Severities limit the alerts the policy applies to.
+	// Empty matches all.
+	Sources    []string `json:"sources"`
+	Severities []string `json:"severities"`
+	Steps      []Step   `json:"steps"`
+}
+
+// Step is one escalation step. It is skipped if the alert has been
+// acknowledged.
+type Step struct {
+	// After is the number of seconds since the alert was raised.
+	After      float64  `json:"after"`
+	Recipients []string `json:"recipients"`
+	// Everyone sends to all recipients.
+	Everyone bool `json:"everyone"`
+	// OnCall are names of rotations, whose recipient on call is
+	// notified.
+	OnCall []string `json:"onCall"`
+	// Outputs are names of outputs to sound the alarm on.
+	Outputs []string `json:"outputs"`
+}
+
+// EscalationRecipients returns the escalation recipients.
+func (c *Config) EscalationRecipients() []*escalate.Recipient {
+	recipients := make([]*escalate.Recipient, 0, len(c.Recipients))
+	for i := range c.Recipients {
+		r := &c.Recipients[i]
+		er := &escalate.Recipient{
+			Name:     r.Name,
+			Channels: r.Channels,
+		}
+		if r.QuietHours != nil {
+			// validated already
+			start, _ := parseClock(r.QuietHours.Start)
+			end, _ := parseClock(r.QuietHours.End)
+			er.Quiet = &escalate.QuietHours{Start: start, End: end}
+		}
+		recipients = append(recipients, er)
+	}
+	return recipients
+}
+
+// EscalationRotations returns the on-call rotations.
+func (c *Config) EscalationRotations() []*escalate.Rotation {
+	rotations := make([]*escalate.Rotation, 0, len(c.Rotations))
+	for i := range c.Rotations {
+		r := &c.Rotations[i]
+		// validated already
+		start, _ := time.Parse(time.RFC3339, r.Start)
+		rotations = append(rotations, &escalate.Rotation{
+			Name:       r.Name,
+			Recipients: r.Recipients,
+			Start:      start,
+			Shift:      time.Duration(r.Shift * float64(time.Second)),
+		})
+	}
+	return rotations
+}
+
+// EscalationPolicies returns the escalation policies.
+func (c *Config) EscalationPolicies() []*escalate.Policy {
+	policies := make([]*escalate.Policy, 0, len(c.Escalation))
+	for i := range c.Escalation {
+		p := &c.Escalation[i]
+		ep := &escalate.Policy{
+			Name:       p.Name,
+			Sources:    p.Sources,
+			Severities: p.Severities,
+		}
+		for _, step := range p.Steps {
+			ep.Steps = append(ep.Steps, escalate.Step{
+				After:      time.Duration(step.After * float64(time.Second)),
+				Recipients: step.Recipients,
+				Everyone:   step.Everyone,
+				OnCall:     step.OnCall,
+				Outputs:    step.Outputs,
+			})
+		}
+		policies = append(policies, ep)
+	}
+	return policies
+}
+
+var (
+	alertSources    = []string{"trip", "tamper", "supervision", "battery", "jamming"}
+	alertSeverities = []string{"alarm", "warning", "info"}
+)
+
+func oneOf(s string, list []string) bool {
+	for _, item := range list {
+		if s == item {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *Config) validateEscalation() error {
+	channels := make(map[string]struct{}, len(c.Notify))
+	for i := range c.Notify {
+		channels[c.Notify[i].Name] = struct{}{}
+	}
+	outputs := make(map[string]struct{}, len(c.Outputs))
+	for i := range c.Outputs {
+		outputs[c.Outputs[i].Name] = struct{}{}
+	}
+	recipients := make(map[string]struct{}, len(c.Recipients))
+	for i := range c.Recipients {
+		r := &c.Recipients[i]
+		if r.Name == "" {
+			return fmt.Errorf("recipient #%d: name is required", i+1)
+		}
+		if _, dup := recipients[r.Name]; dup {
+			return fmt.Errorf("recipient %q: duplicate name", r.Name)
+		}
+		recipients[r.Name] = struct{}{}
+		if len(r.Channels) == 0 {
+			return fmt.Errorf("recipient %q: channels are required", r.Name)
+		}
+		for _, ch := range r.Channels {
+			if _, ok := channels[ch]; !ok {
+				return fmt.Errorf("recipient %q: unknown channel: %q", r.Name, ch)
+			}
+		}
+		if q := r.QuietHours; q != nil {
+			if _, err := parseClock(q.Start); err != nil {
+				return fmt.Errorf("recipient %q: quietHours start: %w", r.Name, err)
+			}
+			if _, err := parseClock(q.End); err != nil {
+				return fmt.Errorf("recipient %q: quietHours end: %w", r.Name, err)
+			}
+		}
+	}
+
+	rotations := make(map[string]struct{}, len(c.Rotations))
+	for i := range c.Rotations {
+		r := &c.Rotations[i]
+		if r.Name == "" {
+			return fmt.Errorf("rotation #%d: name is required", i+1)
+		}
+		if _, dup := rotations[r.Name]; dup {
+			return fmt.Errorf("rotation %q: duplicate name", r.Name)
+		}
+		rotations[r.Name] = struct{}{}
+		if len(r.Recipients) == 0 {
+			return fmt.Errorf("rotation %q: recipients are required", r.Name)
+		}
+		for _, name := range r.Recipients {
+			if _, ok := recipients[name]; !ok {
+				return fmt.Errorf("rotation %q: unknown recipient: %q", r.Name, name)
+			}
+		}
+		if _, err := time.Parse(time.RFC3339, r.Start); err != nil {
+			return fmt.Errorf("rotation %q: bad start, want RFC 3339: %q", r.Name, r.Start)
+		}
+		// a shift too short to measure would never end
+		if time.Duration(r.Shift*float64(time.Second)) <= 0 {
+			return fmt.Errorf("rotation %q: shift must be positive", r.Name)
+		}
+	}
+
+	names := make(map[string]struct{}, len(c.Escalation))
+	for i := range c.Escalation {
+		p := &c.Escalation[i]
+		if p.Name == "" {
+			return fmt.Errorf("escalation #%d: name is required", i+1)
+		}
+		if _, dup := names[p.Name]; dup {
+			return fmt.Errorf("escalation %q: duplicate name", p.Name)
+		}
+		names[p.Name] = struct{}{}
+		for _, source := range p.Sources {
+			if !oneOf(source, alertSources) {
+				return fmt.Errorf("escalation %q: unknown source: %q", p.Name, source)
+			}
+		}
+		for _, severity := range p.Severities {
+			if !oneOf(severity, alertSeverities) {
+				return fmt.Errorf("escalation %q: unknown severity: %q", p.Name, severity)
+			}
+		}
+		if len(p.Steps) == 0 {
+			return fmt.Errorf("escalation %q: steps are required", p.Name)
+		}
+		prev := 0.0
+		for j, step := range p.Steps {
+			if step.After < prev {
+				return fmt.Errorf("escalation %q: step #%d: after must not decrease", p.Name, j+1)
+			}
+			prev = step.After
+			if step.Everyone && len(step.Recipients) > 0 {
+				return fmt.Errorf("escalation %q: step #%d: recipients and everyone are mutually exclusive", p.Name, j+1)
+			}
+			if !step.Everyone && len(step.Recipients) == 0 && len(step.OnCall) == 0 && len(step.Outputs) == 0 {
+				return fmt.Errorf("escalation %q: step #%d: one of recipients, everyone, onCall and outputs is required", p.Name, j+1)
+			}
+			for _, name := range step.Recipients {
+				if _, ok := recipients[name]; !ok {
+					return fmt.Errorf("escalation %q: step #%d: unknown recipient: %q", p.Name, j+1, name)
+				}
+			}
+			for _, name := range step.OnCall {
+				if _, ok := rotations[name]; !ok {
+					return fmt.Errorf("escalation %q: step #%d: unknown rotation: %q", p.Name, j+1, name)
+				}
+			}
+			for _, name := range step.Outputs {
+				if _, ok := outputs[name]; !ok {
+					return fmt.Errorf("escalation %q: step #%d: unknown output: %q", p.Name, j+1, name)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// Output is a siren, strobe or chime. Exactly one of HTTP, MQTT and
+// GPIO is set.
+type Output struct {
+	// Name identifies the output in logs and the database.
+	Name string      `json:"name"`
+	HTTP *HTTPRelay  `json:"http"`
+	MQTT *MQTTRelay  `json:"mqtt"`
+	GPIO *GPIOOutput `json:"gpio"`
+	// Patterns lists what the output is used for, "alarm" and
+	// "chime".
+	Patterns []string `json:"patterns"`
+	// MaxOn is how many seconds an alarm can keep the output on.
+	// Zero uses the default of package output.
+	MaxOn float64 `json:"maxOn"`
+	// Cooldown is the minimum number of seconds between the end of
+	// an activation and the start of another.
+	Cooldown float64 `json:"cooldown"`
+}
+
+// HTTPRelay is a relay board switched by requesting URLs.
+type HTTPRelay struct {
+	On  string `json:"on"`
+	Off string `json:"off"`
+}
+
+// MQTTRelay is a device switched by publishing to a command topic.
+type MQTTRelay struct {
+	// Server is mqtt://[USER:PASS@]HOST[:PORT]/TOPIC.
+	Server string `json:"server"`
+	On     string `json:"on"`
+	Off    string `json:"off"`
+}
+
+// GPIOOutput is a line of a Linux GPIO character device.
+type GPIOOutput struct {
+	// Chip is the path of the device, such as /dev/gpiochip0.
+	Chip      string `json:"chip"`
+	Line      uint32 `json:"line"`
+	ActiveLow bool   `json:"activeLow"`
+}
+
+func parseMQTTServer(server string) (addr, topic string, u *url.URL, err error) {
+	u, err = url.Parse(server)
+	if err != nil {
+		return "", "", nil, err
+	}
+	if u.Scheme != "mqtt" {
+		return "", "", nil, fmt.Errorf("unsupported scheme: %q", u.Scheme)
+	}
+	if _, hasPassword := u.User.Password(); hasPassword && u.User.Username() == "" {
+		return "", "", nil, mqtt.ErrPasswordWithoutUsername
+	}
+	addr = u.Host
+	if u.Port() == "" {
+		addr = net.JoinHostPort(u.Hostname(), "1883")
+	}
+	topic = strings.TrimPrefix(u.Path, "/")
+	return addr, topic, u, nil
+}
+
+// Output returns the output, with its driver.
+func (o *Output) Output() *output.Output {
+	out := &output.Output{
+		Name:     o.Name,
+		Patterns: o.Patterns,
+		MaxOn:    time.Duration(o.MaxOn * float64(time.Second)),
+		Cooldown: time.Duration(o.Cooldown * float64(time.Second)),
+	}
+	switch {
+	case o.HTTP != nil:
+		out.Driver = &output.HTTPRelay{OnURL: o.HTTP.On, OffURL: o.HTTP.Off}
+	case o.MQTT != nil:
+		// validated already
+		addr, topic, u, _ := parseMQTTServer(o.MQTT.Server)
+		r := &output.MQTTRelay{
+			Addr:  addr,
+			Topic: topic,
+			On:    []byte(o.MQTT.On),
+			Off:   []byte(o.MQTT.Off),
+			Config: mqtt.Config{
+				ClientID: fmt.Sprintf("securityblanket-%d-%s", os.Getpid(), o.Name),
+			},
+		}
+		if u.User != nil {
+			r.Config.Username = u.User.Username()
+			r.Config.Password, _ = u.User.Password()
+		}
+		out.Driver = r
+	case o.GPIO != nil:
+		out.Driver = &output.GPIO{
+			Chip:      o.GPIO.Chip,
+			Line:      o.GPIO.Line,
+			ActiveLow: o.GPIO.ActiveLow,
+		}
+	}
+	return out
+}
+
+func (o *Output) validate() error {
+	n := 0
+	if o.HTTP != nil {
+		n++
+	}
+	if o.MQTT != nil {
+		n++
+	}
+	if o.GPIO != nil {
+		n++
+	}
+	if n != 1 {
+		return errors.New("exactly one of http, mqtt and gpio is required")
+	}
+	if o.HTTP != nil {
+		for _, s := range []string{o.HTTP.On, o.HTTP.Off} {
+			u, err := url.Parse(s)
+			if err != nil {
+				return fmt.Errorf("http: %w", err)
+			}
+			if u.Scheme != "http" && u.Scheme != "https" {
+				return fmt.Errorf("http on and off must be http or https URLs: %q", s)
+			}
+		}
+	}
+	if o.MQTT != nil {
+		_, topic, _, err := parseMQTTServer(o.MQTT.Server)
+		if err != nil {
+			return fmt.Errorf("bad mqtt server: %w", err)
+		}
+		if topic == "" {
+			return errors.New("mqtt server needs a topic")
+		}
+		if o.MQTT.On == o.MQTT.Off {
+			return errors.New("mqtt on and off must differ")
+		}
+	}
+	if o.GPIO != nil && o.GPIO.Chip == "" {
+		return errors.New("gpio chip is required")
+	}
+	if len(o.Patterns) == 0 {
+		return errors.New("patterns are required")
+	}
+	for _, p := range o.Patterns {
+		if p != output.PatternAlarm && p != output.PatternChime {
+			return fmt.Errorf("unknown pattern: %q", p)
+		}
+	}
+	if o.MaxOn < 0 {
+		return errors.New("maxOn cannot be negative")
+	}
+	if o.Cooldown < 0 {
+		return errors.New("cooldown cannot be negative")
+	}
+	return nil
+}
+
+// OutputDevices returns the sirens, strobes and chimes.
+func (c *Config) OutputDevices() []*output.Output {
+	outputs := make([]*output.Output, 0, len(c.Outputs))
+	for i := range c.Outputs {
+		outputs = append(outputs, c.Outputs[i].Output())
+	}
+	return outputs
+}
+
+// HomeAssistant describes the MQTT broker Home Assistant uses.
+type HomeAssistant struct {
+	// Server is mqtt://[USER:PASS@]HOST[:PORT].
+	Server string `json:"server"`
+	// DiscoveryPrefix defaults to "homeassistant".
+	DiscoveryPrefix string `json:"discoveryPrefix"`
+	// Topic prefixes the state topics. Defaults to
+	// "securityblanket".
+	Topic string `json:"topic"`
+	// Commands lets Home Assistant arm and disarm. Anyone who can
+	// publish on the broker can then do so.
+	Commands bool `json:"commands"`
+}
+
+// Config returns the Home Assistant settings.
+func (h *HomeAssistant) Config() *homeassistant.Config {
+	// validated already
+	addr, _, u, _ := parseMQTTServer(h.Server)
+	conf := &homeassistant.Config{
+		Addr:            addr,
+		DiscoveryPrefix: h.DiscoveryPrefix,
+		Topic:           h.Topic,
+		Commands:        h.Commands,
+		MQTT: mqtt.Config{
+			ClientID: fmt.Sprintf("securityblanket-%d-homeassistant", os.Getpid()),
+		},
+	}
+	if u.User != nil {
+		conf.MQTT.Username = u.User.Username()
+		conf.MQTT.Password, _ = u.User.Password()
+	}
+	return conf
+}
+
+func (h *HomeAssistant) validate() error {
+	_, topic, _, err := parseMQTTServer(h.Server)
+	if err != nil {
+		return fmt.Errorf("bad server: %w", err)
+	}
+	if topic != "" {
+		return errors.New("server cannot have a topic; use topic and discoveryPrefix")
+	}
+	for _, t := range []string{h.DiscoveryPrefix, h.Topic} {
+		if strings.ContainsAny(t, "+#") {
+			return fmt.Errorf("topic cannot contain wildcards: %q", t)
+		}
+	}
+	return nil
+}
+
+func (c *Config) validate() error {
+	if len(c.Receivers) == 0 {
+		return errors.New("no receivers")
+	}
+	labels := make(map[string]struct{}, len(c.Receivers))
+	for i := range c.Receivers {
+		r := &c.Receivers[i]
+		if r.Label == "" {
+			return fmt.Errorf("receiver #%d: label is required", i+1)
+		}
+		if _, dup := labels[r.Label]; dup {
+			return fmt.Errorf("receiver %q: duplicate label", r.Label)
+		}
+		labels[r.Label] = struct{}{}
+		if r.FreqMHz() <= 0 {
+			return fmt.Errorf("receiver %q: frequency is required", r.Label)
+		}
+		if r.Source != "" && (r.Device != "" || len(r.Protocols) > 0) {
+			return fmt.Errorf("receiver %q: device and protocols only apply to a local rtl_433", r.Label)
+		}
+		if r.Source != "" && !r.IsIQ() && r.SampleRate != 0 {
+			return fmt.Errorf("receiver %q: sampleRate only applies to a local rtl_433 or raw IQ samples", r.Label)
+		}
+	}
+	if err := c.Jamming.validate(); err != nil {
+		return fmt.Errorf("jamming: %w", err)
+	}
+	names := make(map[string]struct{}, len(c.Notify))
+	for i := range c.Notify {
+		ch := &c.Notify[i]
+		if ch.Name == "" {
+			return fmt.Errorf("notify #%d: name is required", i+1)
+		}
+		if _, dup := names[ch.Name]; dup {
+			return fmt.Errorf("notify %q: duplicate name", ch.Name)
+		}
+		names[ch.Name] = struct{}{}
+		if err := ch.validate(); err != nil {
+			return fmt.Errorf("notify %q: %w", ch.Name, err)
+		}
+	}
+	if err := c.validateEscalation(); err != nil {
+		return err
+	}
+	outputs := make(map[string]struct{}, len(c.Outputs))
+	for i := range c.Outputs {
+		o := &c.Outputs[i]
+		if o.Name == "" {
+			return fmt.Errorf("output #%d: name is required", i+1)
+		}
+		if _, dup := outputs[o.Name]; dup {
+			return fmt.Errorf("output %q: duplicate name", o.Name)
+		}
+		outputs[o.Name] = struct{}{}
+		if err := o.validate(); err != nil {
+			return fmt.Errorf("output %q: %w", o.Name, err)
+		}
+	}
+	if c.HomeAssistant != nil {
+		if err := c.HomeAssistant.validate(); err != nil {
+			return fmt.Errorf("homeAssistant: %w", err)
+		}
+	}
+	if c.Subscriptions != nil {
+		if err := c.Subscriptions.validate(); err != nil {
+			return fmt.Errorf("subscriptions: %w", err)
+		}
+	}
+	for table, r := range c.Retention {
+		if _, err := retention.For(table, 0); err != nil {
+			return fmt.Errorf("retention: %w; supported: %s", err, strings.Join(retention.Tables(), ", "))
+		}
+		if err := r.validate(); err != nil {
+			return fmt.Errorf("retention %q: %w", table, err)
+		}
+	}
+	return nil
+}
+
+// Retention is how long rows of a table are kept.
+type Retention struct {
+	KeepDays float64 `json:"keepDays"`
+	// Archive is a directory to keep deleted rows in, as compressed
+	// files. Empty means rows are deleted for good.
+	Archive string `json:"archive"`
+}
+
+func (r *Retention) validate() error {
+	if r.KeepDays <= 0 {
+		return errors.New("keepDays must be positive")
+	}
+	return nil
+}
+
+// RetentionPolicies returns the retention policies, ordered by table.
+func (c *Config) RetentionPolicies() []*retention.Policy {
+	tables := make([]string, 0, len(c.Retention))
+	for table := range c.Retention {
+		tables = append(tables, table)
+	}
+	sort.Strings(tables)
+	policies := make([]*retention.Policy, 0, len(tables))
+	// tables archived in the same directory share the manifest
+	archivers := make(map[string]*archive.Archiver)
+	for _, table := range tables {
+		r := c.Retention[table]
+		keep := time.Duration(r.KeepDays * float64(24*time.Hour))
+		// validated already
+		policy, _ := retention.For(table, keep)
+		if r.Archive != "" {
+			a, ok := archivers[r.Archive]
+			if !ok {
+				a = archive.New(r.Archive)
+				archivers[r.Archive] = a
+			}
+			policy.Archive = a.Archive
+		}
+		policies = append(policies, policy)
+	}
+	return policies
+}
+
+// Parse parses and validates a configuration.
+func Parse(data []byte) (*Config, error) {
+	var conf Config
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&conf); err != nil {
+		return nil, fmt.Errorf("cannot parse config: %w", err)
+	}
+	if err := jsonx.MustEOF(dec); err != nil {
+		return nil, fmt.Errorf("trailing junk in config: %w", err)
+	}
+	if err := conf.validate(); err != nil {
+		return nil, fmt.Errorf("invalid config: %w", err)
+	}
+	return &conf, nil
+}
+
+// Load reads and parses the configuration file at path.
+func Load(path string) (*Config, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return Parse(data)
+}
@@ -0,0 +1 @@
+DELETE FROM webpush_subscriptions WHERE endpoint=@endpoint
@@ -0,0 +1,86 @@
+package webpush
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// recordSize is the aes128gcm record size. Messages are sent as a
+// single record.
+const recordSize = 4096
+
+// hkdf is HKDF-SHA-256 for outputs of at most one hash length, which
+// is all RFC 8291 needs.
+func hkdf(salt, secret, info []byte, length int) []byte {
+	mac := hmac.New(sha256.New, salt)
+	_, _ = mac.Write(secret)
+	prk := mac.Sum(nil)
+	mac = hmac.New(sha256.New, prk)
+	_, _ = mac.Write(info)
+	_, _ = mac.Write([]byte{1})
+	return mac.Sum(nil)[:length]
+}
+
+// encrypt encrypts plaintext for the subscriber, as in RFC 8291, with
+// the aes128gcm content coding of RFC 8188.
+func encrypt(sub *subscriber, plaintext []byte) ([]byte, error) {
+	// delimiter and tag
+	if len(plaintext)+1+16 > recordSize {
+		return nil, fmt.Errorf("push message too large: %d bytes", len(plaintext))
+	}
+	curve := elliptic.P256()
+	uaX, uaY := elliptic.Unmarshal(curve, sub.p256dh)
+	if uaX == nil {
+		return nil, errors.New("p256dh is not a P-256 point")
+	}
+	local, err := ecdsa.GenerateKey(curve, rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	asPublic := elliptic.Marshal(curve, local.X, local.Y)
+	sharedX, _ := curve.ScalarMult(uaX, uaY, local.D.Bytes())
+	ecdhSecret := make([]byte, 32)
+	x := sharedX.Bytes()
+	copy(ecdhSecret[len(ecdhSecret)-len(x):], x)
+
+	salt := make([]byte, 16)
+	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+		return nil, err
+	}
+
+	keyInfo := append([]byte("WebPush: info\x00"), sub.p256dh...)
+	keyInfo = append(keyInfo, asPublic...)
+	ikm := hkdf(sub.auth, ecdhSecret, keyInfo, 32)
+	cek := hkdf(salt, ikm, []byte("Content-Encoding: aes128gcm\x00"), 16)
+	nonce := hkdf(salt, ikm, []byte("Content-Encoding: nonce\x00"), 12)
+
+	block, err := aes.NewCipher(cek)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	header := make([]byte, 0, 16+4+1+len(asPublic))
+	header = append(header, salt...)
+	var rs [4]byte
+	binary.BigEndian.PutUint32(rs[:], recordSize)
+	header = append(header, rs[:]...)
+	header = append(header, byte(len(asPublic)))
+	header = append(header, asPublic...)
+
+	// the last and only record is delimited by 0x02, with no padding
+	record := append(append([]byte(nil), plaintext...), 2)
+	return gcm.Seal(header, nonce, record, nil), nil
+}
@@ -0,0 +1,11 @@
+SELECT
+	id,
+	endpoint,
+	p256dh,
+	auth
+FROM webpush_subscriptions s
+WHERE NOT EXISTS (
+	SELECT 1 FROM webpush_deliveries d
+	WHERE d.notification=@notification AND d.subscription=s.id
+)
+ORDER BY id
@@ -0,0 +1 @@
+SELECT privateKey FROM webpush_vapid WHERE id=1
@@ -0,0 +1,184 @@
+package webpush
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"eagain.net/go/securityblanket/internal/database"
+	"go.uber.org/zap"
+)
+
+// maxSubscriptionSize limits the size of subscription requests.
+const maxSubscriptionSize = 16 * 1024
+
+// DefaultHosts are the push services of the major browsers. A host
+// matches itself and its subdomains.
+var DefaultHosts = []string{
+	"fcm.googleapis.com",
+	"push.services.mozilla.com",
+	"push.apple.com",
+	"notify.windows.com",
+}
+
+type handlerConfig struct {
+	token string
+	hosts []string
+}
+
+type HandlerOption handlerOption
+
+type handlerOption func(*handlerConfig)
+
+// Token enables registering subscriptions, for requests that carry it
+// as "Authorization: Bearer TOKEN". Without a token, subscriptions
+// cannot be added or removed over HTTP.
+func Token(token string) HandlerOption {
+	fn := func(conf *handlerConfig) {
+		conf.token = token
+	}
+	return fn
+}
+
+// Hosts replaces DefaultHosts as the push services subscriptions are
+// accepted for.
+func Hosts(hosts ...string) HandlerOption {
+	fn := func(conf *handlerConfig) {
+		conf.hosts = hosts
+	}
+	return fn
+}
+
+// Handler serves the subscription API:
+//
+//	GET key             the VAPID public key, as text
+//	POST subscription   add a PushSubscription, as JSON
+//	DELETE subscription remove a PushSubscription, as JSON
+//
+// Paths are relative; use http.StripPrefix to mount it.
+//
+// Changing subscriptions needs the Token option, and the endpoint must
+// be on one of the push service hosts. Otherwise anyone who can reach
+// the server could read the alerts, or make the daemon send requests
+// anywhere.
+func Handler(db *database.DB, log *zap.Logger, opts ...HandlerOption) http.Handler {
+	h := &handler{
+		db:  db,
+		log: log,
+		config: handlerConfig{
+			hosts: DefaultHosts,
+		},
+	}
+	for _, opt := range opts {
+		opt(&h.config)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/key", h.key)
+	mux.HandleFunc("/subscription", h.subscription)
+	return mux
+}
+
+type handler struct {
+	db     *database.DB
+	log    *zap.Logger
+	config handlerConfig
+}
+
+// authorized reports whether req carries the token.
+func (h *handler) authorized(req *http.Request) bool {
+	if h.config.token == "" {
+		return false
+	}
+	const prefix = "Bearer "
+	auth := req.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, prefix) {
+		return false
+	}
+	got := []byte(strings.TrimPrefix(auth, prefix))
+	return subtle.ConstantTimeCompare(got, []byte(h.config.token)) == 1
+}
+
+// allowedHost reports whether endpoint is on one of the push service
+// hosts.
+func (h *handler) allowedHost(endpoint string) bool {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return false
+	}
+	host := strings.ToLower(u.Hostname())
+	for _, allowed := range h.config.hosts {
+		allowed = strings.ToLower(allowed)
+		if host == allowed || strings.HasSuffix(host, "."+allowed) {
+			return true
+		}
+	}
+	return false
+}
+
+func (h *handler) key(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	key, err := VAPIDKey(req.Context(), h.db)
+	if err != nil {
+		h.log.Error("vapid.key", zap.Error(err))
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	_, _ = io.WriteString(w, PublicKey(key))
+}
+
+func (h *handler) subscription(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost && req.Method != http.MethodDelete {
+		w.Header().Set("Allow", "POST, DELETE")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if h.config.token == "" {
+		http.Error(w, "subscription registration is disabled", http.StatusForbidden)
+		return
+	}
+	if !h.authorized(req) {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="webpush"`)
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	var sub Subscription
+	dec := json.NewDecoder(http.MaxBytesReader(w, req.Body, maxSubscriptionSize))
+	if err := dec.Decode(&sub); err != nil {
+		http.Error(w, "bad subscription: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.Method == http.MethodDelete {
+		if err := Unsubscribe(req.Context(), h.db, sub.Endpoint); err != nil {
+			h.log.Error("unsubscribe", zap.Error(err))
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+		h.log.Info("unsubscribed", zap.String("endpoint", sub.Endpoint))
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if _, err := sub.decode(); err != nil {
+		http.Error(w, "bad subscription: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !h.allowedHost(sub.Endpoint) {
+		http.Error(w, "bad subscription: unknown push service: "+sub.Endpoint, http.StatusBadRequest)
+		return
+	}
+	if err := Subscribe(req.Context(), h.db, &sub, time.Now()); err != nil {
+		h.log.Error("subscribe", zap.Error(err))
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	h.log.Info("subscribed", zap.String("endpoint", sub.Endpoint))
+	w.WriteHeader(http.StatusCreated)
+}
@@ -0,0 +1,3 @@
+INSERT INTO webpush_deliveries(notification, subscription, time)
+	VALUES (@notification, @subscription, @time)
+	ON CONFLICT(notification, subscription) DO NOTHING
@@ -0,0 +1,3 @@
+-- SetBytes binds text; cast to keep it a blob
+INSERT INTO webpush_vapid(id, privateKey, created)
+	VALUES (1, CAST(@privateKey AS BLOB), @created)
@@ -0,0 +1,217 @@
+package webpush
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+
+	"crawshaw.io/sqlite/sqlitex"
+	"eagain.net/go/securityblanket/internal/database"
+	"eagain.net/go/securityblanket/internal/notify"
+	"go.uber.org/zap"
+)
+
+// DefaultTTL is how long push services keep undelivered messages,
+// unless Push.TTL says otherwise.
+const DefaultTTL = 24 * time.Hour
+
+// Push sends notifications to every subscription in the database.
+//
+// The subscriptions a notification from the outbox reached are
+// remembered, so when it fails for some subscriptions, retrying it
+// only pushes to the rest. Delivery is still at least once, for a
+// crash between pushing and remembering. Subscriptions the push
+// service reports as gone are removed.
+type Push struct {
+	DB  *database.DB
+	Log *zap.Logger
+	// Subject is a mailto: or https: URL push services can use to
+	// contact the operator of the site.
+	Subject string
+	// TTL is how long the push service should keep trying to deliver
+	// a message. Zero means DefaultTTL.
+	TTL time.Duration
+	// Client is used for the requests, or http.DefaultClient if nil.
+	Client *http.Client
+}
+
+var _ notify.Notifier = (*Push)(nil)
+
+// urgency returns the RFC 8030 urgency of the notification, which
+// phones use to decide whether to wake up for it.
+func urgency(n *notify.Notification) string {
+	if n.Event != "raised" {
+		return "normal"
+	}
+	switch n.Severity {
+	case "alarm":
+		return "high"
+	case "warning":
+		return "normal"
+	default:
+		return "low"
+	}
+}
+
+// subscribers returns the subscriptions that do not have the
+// notification yet.
+func (p *Push) subscribers(ctx context.Context, n *notify.Notification) ([]*subscriber, error) {
+	conn := p.DB.Get(ctx)
+	if conn == nil {
+		return nil, context.Canceled
+	}
+	defer p.DB.Put(conn)
+
+	stmt := fetch_webpush_subscriptions.Prep(conn)
+	defer stmt.Finalize()
+	stmt.SetInt64("@notification", n.ID)
+	var subs []*subscriber
+	for {
+		hasRow, err := stmt.Step()
+		if err != nil {
+			return nil, fmt.Errorf("error fetching push subscriptions: %w", err)
+		}
+		if !hasRow {
+			break
+		}
+		subs = append(subs, &subscriber{
+			id:       stmt.GetInt64("id"),
+			endpoint: stmt.GetText("endpoint"),
+			p256dh:   getBytes(stmt, "p256dh"),
+			auth:     getBytes(stmt, "auth"),
+		})
+	}
+	return subs, nil
+}
+
+// errGone is returned when the push service no longer knows the
+// subscription.
+type errGone struct {
+	status string
+}
+
+func (e errGone) Error() string {
+	return "push subscription gone: " + e.status
+}
+
+func (p *Push) send(ctx context.Context, sub *subscriber, auth string, payload []byte, n *notify.Notification) error {
+	body, err := encrypt(sub, payload)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, sub.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	ttl := p.TTL
+	if ttl == 0 {
+		ttl = DefaultTTL
+	}
+	req.Header.Set("Authorization", auth)
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set("Content-Encoding", "aes128gcm")
+	req.Header.Set("TTL", strconv.FormatInt(int64(ttl/time.Second), 10))
+	req.Header.Set("Urgency", urgency(n))
+	client := p.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	// drain, to allow connection reuse
+	_, _ = io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 64*1024))
+	switch {
+	case resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusGone:
+		return errGone{status: resp.Status}
+	case resp.StatusCode < 200 || resp.StatusCode > 299:
+		return fmt.Errorf("push service: %s", resp.Status)
+	}
+	return nil
+}
+
+func (p *Push) Notify(ctx context.Context, n *notify.Notification) error {
+	subs, err := p.subscribers(ctx, n)
+	if err != nil {
+		return fmt.Errorf("webpush: %w", err)
+	}
+	if len(subs) == 0 {
+		return nil
+	}
+	key, err := VAPIDKey(ctx, p.DB)
+	if err != nil {
+		return fmt.Errorf("webpush: %w", err)
+	}
+	payload, err := json.Marshal(n)
+	if err != nil {
+		return fmt.Errorf("webpush: %w", err)
+	}
+	now := time.Now()
+
+	var failed error
+	for _, sub := range subs {
+		auth, err := vapidAuthorization(key, sub.endpoint, p.Subject, now)
+		if err != nil {
+			return fmt.Errorf("webpush: %w", err)
+		}
+		err = p.send(ctx, sub, auth, payload, n)
+		switch err.(type) {
+		case nil:
+			if err := p.delivered(ctx, n, sub); err != nil {
+				return fmt.Errorf("webpush: %w", err)
+			}
+		case errGone:
+			p.Log.Info("subscription.gone", zap.String("endpoint", sub.endpoint), zap.Error(err))
+			if err := Unsubscribe(ctx, p.DB, sub.endpoint); err != nil {
+				return fmt.Errorf("webpush: %w", err)
+			}
+		default:
+			p.Log.Warn("push.failed", zap.String("endpoint", sub.endpoint), zap.Error(err))
+			failed = err
+		}
+	}
+	if failed != nil {
+		return fmt.Errorf("webpush: %w", failed)
+	}
+	return nil
+}
+
+// delivered remembers that sub has the notification.
+func (p *Push) delivered(ctx context.Context, n *notify.Notification, sub *subscriber) (err error) {
+	conn := p.DB.Get(ctx)
+	if conn == nil {
+		return context.Canceled
+	}
+	defer p.DB.Put(conn)
+	defer sqlitex.Save(conn)(&err)
+
+	now := time.Now()
+	stmt := update_webpush_subscription_delivered.Prep(conn)
+	defer stmt.Finalize()
+	stmt.SetText("@endpoint", sub.endpoint)
+	database.BindTime(stmt, "@time", now)
+	if _, err := stmt.Step(); err != nil {
+		return fmt.Errorf("mark subscription delivered: %w", err)
+	}
+	if n.ID == 0 {
+		return nil
+	}
+	ins := insert_webpush_delivery.Prep(conn)
+	defer ins.Finalize()
+	ins.SetInt64("@notification", n.ID)
+	ins.SetInt64("@subscription", sub.id)
+	database.BindTime(ins, "@time", now)
+	if _, err := ins.Step(); err != nil {
+		return fmt.Errorf("remember delivery: %w", err)
+	}
+	return nil
+}
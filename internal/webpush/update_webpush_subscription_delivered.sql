@@ -0,0 +1,3 @@
+UPDATE webpush_subscriptions
+	SET lastDelivered=@time
+	WHERE endpoint=@endpoint
@@ -0,0 +1,6 @@
+-- SetBytes binds text; cast to keep them blobs
+INSERT INTO webpush_subscriptions(endpoint, p256dh, auth, created)
+	VALUES (@endpoint, CAST(@p256dh AS BLOB), CAST(@auth AS BLOB), @created)
+	ON CONFLICT(endpoint) DO UPDATE SET
+		p256dh=excluded.p256dh,
+		auth=excluded.auth
@@ -0,0 +1,56 @@
+package webpush
+
+import (
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"time"
+)
+
+// vapidLifetime is how long the authorization tokens are valid. RFC
+// 8292 allows at most 24 hours.
+const vapidLifetime = 12 * time.Hour
+
+// vapidAuthorization returns the Authorization header value for
+// sending to endpoint, as in RFC 8292.
+func vapidAuthorization(key *ecdsa.PrivateKey, endpoint string, subject string, now time.Time) (string, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return "", err
+	}
+	header, err := json.Marshal(struct {
+		Typ string `json:"typ"`
+		Alg string `json:"alg"`
+	}{"JWT", "ES256"})
+	if err != nil {
+		return "", err
+	}
+	claims, err := json.Marshal(struct {
+		Aud string `json:"aud"`
+		Exp int64  `json:"exp"`
+		Sub string `json:"sub,omitempty"`
+	}{
+		Aud: u.Scheme + "://" + u.Host,
+		Exp: now.Add(vapidLifetime).Unix(),
+		Sub: subject,
+	})
+	if err != nil {
+		return "", err
+	}
+	signed := b64.EncodeToString(header) + "." + b64.EncodeToString(claims)
+	digest := sha256.Sum256([]byte(signed))
+	r, s, err := ecdsa.Sign(rand.Reader, key, digest[:])
+	if err != nil {
+		return "", fmt.Errorf("VAPID signature: %w", err)
+	}
+	// JWS wants the fixed-size concatenation of r and s
+	sig := make([]byte, 64)
+	rb, sb := r.Bytes(), s.Bytes()
+	copy(sig[32-len(rb):32], rb)
+	copy(sig[64-len(sb):], sb)
+	token := signed + "." + b64.EncodeToString(sig)
+	return "vapid t=" + token + ", k=" + PublicKey(key), nil
+}
@@ -0,0 +1,195 @@
+// Package webpush sends notifications to browsers and phones with Web
+// Push.
+//
+// Subscriptions are registered over HTTP, see Handler, and stored in
+// the database. Messages are encrypted for each subscription as in
+// RFC 8291, and the site identifies itself to the push services with
+// a VAPID key pair, as in RFC 8292, generated on first use and kept in
+// the database.
+package webpush
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/url"
+	"time"
+
+	"crawshaw.io/sqlite"
+	"crawshaw.io/sqlite/sqlitex"
+	"eagain.net/go/securityblanket/internal/database"
+)
+
+var b64 = base64.RawURLEncoding
+
+// decodeBase64 decodes base64url, with or without padding, as browsers
+// are not consistent about it.
+func decodeBase64(s string) ([]byte, error) {
+	for len(s)%4 != 0 {
+		s += "="
+	}
+	return base64.URLEncoding.DecodeString(s)
+}
+
+func getBytes(stmt *sqlite.Stmt, col string) []byte {
+	buf := make([]byte, stmt.GetLen(col))
+	stmt.GetBytes(col, buf)
+	return buf
+}
+
+func vapidKey(conn *sqlite.Conn, now time.Time) (key *ecdsa.PrivateKey, err error) {
+	defer sqlitex.Save(conn)(&err)
+
+	stmt := fetch_webpush_vapid.Prep(conn)
+	defer stmt.Finalize()
+	hasRow, err := stmt.Step()
+	if err != nil {
+		return nil, fmt.Errorf("error fetching VAPID key: %w", err)
+	}
+	if hasRow {
+		der := getBytes(stmt, "privateKey")
+		if err := database.NoMoreRows(stmt); err != nil {
+			return nil, err
+		}
+		key, err := x509.ParseECPrivateKey(der)
+		if err != nil {
+			return nil, fmt.Errorf("bad VAPID key in database: %w", err)
+		}
+		return key, nil
+	}
+
+	key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("generate VAPID key: %w", err)
+	}
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, fmt.Errorf("generate VAPID key: %w", err)
+	}
+	ins := insert_webpush_vapid.Prep(conn)
+	defer ins.Finalize()
+	ins.SetBytes("@privateKey", der)
+	database.BindTime(ins, "@created", now)
+	if _, err := ins.Step(); err != nil {
+		return nil, fmt.Errorf("add VAPID key: %w", err)
+	}
+	return key, nil
+}
+
+// VAPIDKey returns the key pair of the site, generating it if needed.
+func VAPIDKey(ctx context.Context, db *database.DB) (*ecdsa.PrivateKey, error) {
+	conn := db.Get(ctx)
+	if conn == nil {
+		return nil, context.Canceled
+	}
+	defer db.Put(conn)
+	return vapidKey(conn, time.Now())
+}
+
+// PublicKey returns the public key in the form browsers expect as
+// applicationServerKey: an uncompressed point, in base64url.
+func PublicKey(key *ecdsa.PrivateKey) string {
+	return b64.EncodeToString(elliptic.Marshal(key.Curve, key.X, key.Y))
+}
+
+// Subscription is a push subscription, as serialized by
+// PushSubscription.toJSON in browsers.
+type Subscription struct {
+	Endpoint string `json:"endpoint"`
+	Keys     struct {
+		// P256dh is the public key of the user agent, in base64url.
+		P256dh string `json:"p256dh"`
+		// Auth is the authentication secret, in base64url.
+		Auth string `json:"auth"`
+	} `json:"keys"`
+}
+
+// subscriber is a decoded subscription.
+type subscriber struct {
+	// id is 0 for subscriptions not yet in the database
+	id       int64
+	endpoint string
+	p256dh   []byte
+	auth     []byte
+}
+
+func (s *Subscription) decode() (*subscriber, error) {
+	u, err := url.Parse(s.Endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("bad endpoint: %w", err)
+	}
+	if u.Scheme != "https" || u.Host == "" {
+		return nil, fmt.Errorf("endpoint must be an https URL: %q", s.Endpoint)
+	}
+	p256dh, err := decodeBase64(s.Keys.P256dh)
+	if err != nil {
+		return nil, fmt.Errorf("bad p256dh: %w", err)
+	}
+	if x, _ := elliptic.Unmarshal(elliptic.P256(), p256dh); x == nil {
+		return nil, errors.New("p256dh is not a P-256 point")
+	}
+	auth, err := decodeBase64(s.Keys.Auth)
+	if err != nil {
+		return nil, fmt.Errorf("bad auth: %w", err)
+	}
+	if len(auth) != 16 {
+		return nil, fmt.Errorf("auth must be 16 bytes: %d", len(auth))
+	}
+	sub := &subscriber{
+		endpoint: s.Endpoint,
+		p256dh:   p256dh,
+		auth:     auth,
+	}
+	return sub, nil
+}
+
+// Subscribe adds a subscription, or updates the keys of an existing
+// one.
+func Subscribe(ctx context.Context, db *database.DB, s *Subscription, ts time.Time) (err error) {
+	sub, err := s.decode()
+	if err != nil {
+		return err
+	}
+	conn := db.Get(ctx)
+	if conn == nil {
+		return context.Canceled
+	}
+	defer db.Put(conn)
+	defer sqlitex.Save(conn)(&err)
+
+	stmt := upsert_webpush_subscription.Prep(conn)
+	defer stmt.Finalize()
+	stmt.SetText("@endpoint", sub.endpoint)
+	stmt.SetBytes("@p256dh", sub.p256dh)
+	stmt.SetBytes("@auth", sub.auth)
+	database.BindTime(stmt, "@created", ts)
+	if _, err := stmt.Step(); err != nil {
+		return fmt.Errorf("add subscription: %w", err)
+	}
+	return nil
+}
+
+// Unsubscribe removes the subscription with the given endpoint.
+func Unsubscribe(ctx context.Context, db *database.DB, endpoint string) error {
+	conn := db.Get(ctx)
+	if conn == nil {
+		return context.Canceled
+	}
+	defer db.Put(conn)
+	return unsubscribe(conn, endpoint)
+}
+
+func unsubscribe(conn *sqlite.Conn, endpoint string) error {
+	stmt := delete_webpush_subscription.Prep(conn)
+	defer stmt.Finalize()
+	stmt.SetText("@endpoint", endpoint)
+	if _, err := stmt.Step(); err != nil {
+		return fmt.Errorf("remove subscription: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,537 @@
+package webpush_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"crawshaw.io/sqlite"
+	"crawshaw.io/sqlite/sqlitex"
+	"eagain.net/go/securityblanket/internal/database"
+	"eagain.net/go/securityblanket/internal/notify"
+	"eagain.net/go/securityblanket/internal/webpush"
+	"github.com/google/go-cmp/cmp"
+	"go.uber.org/zap/zaptest"
+)
+
+var b64 = base64.RawURLEncoding
+
+// userAgent is the browser side of a subscription.
+type userAgent struct {
+	key  *ecdsa.PrivateKey
+	auth []byte
+}
+
+func newUserAgent(t testing.TB) *userAgent {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	auth := make([]byte, 16)
+	if _, err := rand.Read(auth); err != nil {
+		t.Fatal(err)
+	}
+	return &userAgent{key: key, auth: auth}
+}
+
+func (ua *userAgent) public() []byte {
+	return elliptic.Marshal(elliptic.P256(), ua.key.X, ua.key.Y)
+}
+
+func (ua *userAgent) subscription(endpoint string) *webpush.Subscription {
+	var s webpush.Subscription
+	s.Endpoint = endpoint
+	s.Keys.P256dh = b64.EncodeToString(ua.public())
+	s.Keys.Auth = b64.EncodeToString(ua.auth)
+	return &s
+}
+
+func hkdf(salt, secret, info []byte, length int) []byte {
+	mac := hmac.New(sha256.New, salt)
+	mac.Write(secret)
+	prk := mac.Sum(nil)
+	mac = hmac.New(sha256.New, prk)
+	mac.Write(info)
+	mac.Write([]byte{1})
+	return mac.Sum(nil)[:length]
+}
+
+// decrypt decrypts an aes128gcm message, as in RFC 8291.
+func (ua *userAgent) decrypt(t testing.TB, body []byte) []byte {
+	t.Helper()
+	if len(body) < 21 {
+		t.Fatalf("message too short: %d", len(body))
+	}
+	salt := body[:16]
+	if g, e := binary.BigEndian.Uint32(body[16:20]), uint32(4096); g != e {
+		t.Errorf("wrong record size: %d != %d", g, e)
+	}
+	idlen := int(body[20])
+	asPublic := body[21 : 21+idlen]
+	ciphertext := body[21+idlen:]
+
+	curve := elliptic.P256()
+	x, y := elliptic.Unmarshal(curve, asPublic)
+	if x == nil {
+		t.Fatalf("bad server public key: %x", asPublic)
+	}
+	sx, _ := curve.ScalarMult(x, y, ua.key.D.Bytes())
+	secret := make([]byte, 32)
+	sb := sx.Bytes()
+	copy(secret[32-len(sb):], sb)
+
+	info := append([]byte("WebPush: info\x00"), ua.public()...)
+	info = append(info, asPublic...)
+	ikm := hkdf(ua.auth, secret, info, 32)
+	cek := hkdf(salt, ikm, []byte("Content-Encoding: aes128gcm\x00"), 16)
+	nonce := hkdf(salt, ikm, []byte("Content-Encoding: nonce\x00"), 12)
+	block, err := aes.NewCipher(cek)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain, err := gcm.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		t.Fatalf("decrypt: %v", err)
+	}
+	if len(plain) == 0 || plain[len(plain)-1] != 2 {
+		t.Fatalf("bad record delimiter: %x", plain)
+	}
+	return plain[:len(plain)-1]
+}
+
+// verifyVAPID checks the Authorization header, and returns the
+// claims.
+func verifyVAPID(t testing.TB, header string, wantKey string) map[string]interface{} {
+	t.Helper()
+	if !strings.HasPrefix(header, "vapid ") {
+		t.Fatalf("not vapid: %q", header)
+	}
+	var token, k string
+	for _, part := range strings.Split(strings.TrimPrefix(header, "vapid "), ",") {
+		part = strings.TrimSpace(part)
+		switch {
+		case strings.HasPrefix(part, "t="):
+			token = part[2:]
+		case strings.HasPrefix(part, "k="):
+			k = part[2:]
+		}
+	}
+	if k != wantKey {
+		t.Errorf("wrong vapid key: %q != %q", k, wantKey)
+	}
+	pub, err := b64.DecodeString(k)
+	if err != nil {
+		t.Fatal(err)
+	}
+	x, y := elliptic.Unmarshal(elliptic.P256(), pub)
+	if x == nil {
+		t.Fatalf("bad vapid key: %q", k)
+	}
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		t.Fatalf("bad jwt: %q", token)
+	}
+	sig, err := b64.DecodeString(parts[2])
+	if err != nil || len(sig) != 64 {
+		t.Fatalf("bad jwt signature: %q", parts[2])
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	r := new(big.Int).SetBytes(sig[:32])
+	s := new(big.Int).SetBytes(sig[32:])
+	if !ecdsa.Verify(&ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}, digest[:], r, s) {
+		t.Fatalf("jwt signature does not verify")
+	}
+	claimsJSON, err := b64.DecodeString(parts[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	var claims map[string]interface{}
+	if err := json.Unmarshal(claimsJSON, &claims); err != nil {
+		t.Fatal(err)
+	}
+	return claims
+}
+
+type pushed struct {
+	Path    string
+	TTL     string
+	Urgency string
+	Body    []byte
+}
+
+// pushService is a fake push service. Paths starting with /gone/ are
+// unknown subscriptions, and ones starting with /flaky/ fail while
+// down is set.
+type pushService struct {
+	t    testing.TB
+	key  string
+	mu   sync.Mutex
+	got  []pushed
+	aud  string
+	down bool
+}
+
+func (p *pushService) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if strings.HasPrefix(req.URL.Path, "/gone/") {
+		http.Error(w, "gone", http.StatusGone)
+		return
+	}
+	p.mu.Lock()
+	down := p.down
+	p.mu.Unlock()
+	if down && strings.HasPrefix(req.URL.Path, "/flaky/") {
+		http.Error(w, "down", http.StatusServiceUnavailable)
+		return
+	}
+	if g, e := req.Header.Get("Content-Encoding"), "aes128gcm"; g != e {
+		http.Error(w, "wrong encoding: "+g, http.StatusBadRequest)
+		return
+	}
+	claims := verifyVAPID(p.t, req.Header.Get("Authorization"), p.key)
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.aud, _ = claims["aud"].(string)
+	p.got = append(p.got, pushed{
+		Path:    req.URL.Path,
+		TTL:     req.Header.Get("TTL"),
+		Urgency: req.Header.Get("Urgency"),
+		Body:    body,
+	})
+	w.WriteHeader(http.StatusCreated)
+}
+
+func endpoints(t testing.TB, db *database.DB) []string {
+	conn := db.Get(nil)
+	defer db.Put(conn)
+	var got []string
+	fn := func(stmt *sqlite.Stmt) error {
+		got = append(got, stmt.GetText("endpoint"))
+		return nil
+	}
+	if err := sqlitex.Exec(conn, `SELECT endpoint FROM webpush_subscriptions ORDER BY id`, fn); err != nil {
+		t.Fatalf("database error: %v", err)
+	}
+	return got
+}
+
+func TestPush(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	db := database.Scratch()
+	defer db.Close()
+	log := zaptest.NewLogger(t)
+
+	key, err := webpush.VAPIDKey(ctx, db)
+	if err != nil {
+		t.Fatalf("vapid key: %v", err)
+	}
+	again, err := webpush.VAPIDKey(ctx, db)
+	if err != nil {
+		t.Fatalf("vapid key: %v", err)
+	}
+	if g, e := webpush.PublicKey(again), webpush.PublicKey(key); g != e {
+		t.Fatalf("VAPID key changed: %q != %q", g, e)
+	}
+
+	svc := &pushService{t: t, key: webpush.PublicKey(key)}
+	srv := httptest.NewTLSServer(svc)
+	defer srv.Close()
+
+	phone := newUserAgent(t)
+	laptop := newUserAgent(t)
+	now := time.Date(2020, 2, 3, 4, 5, 6, 0, time.UTC)
+	for _, sub := range []*webpush.Subscription{
+		phone.subscription(srv.URL + "/push/phone"),
+		laptop.subscription(srv.URL + "/gone/laptop"),
+	} {
+		if err := webpush.Subscribe(ctx, db, sub, now); err != nil {
+			t.Fatalf("subscribe: %v", err)
+		}
+	}
+
+	p := &webpush.Push{
+		DB:      db,
+		Log:     log,
+		Subject: "mailto:alarm@example.com",
+		TTL:     time.Hour,
+		Client:  srv.Client(),
+	}
+	n := &notify.Notification{
+		Alert:    3,
+		Event:    "raised",
+		Time:     now,
+		Source:   "trip",
+		Sensor:   1,
+		Loop:     1,
+		Severity: "alarm",
+		Summary:  "front door: door or window open",
+	}
+	if err := p.Notify(ctx, n); err != nil {
+		t.Fatalf("notify: %v", err)
+	}
+
+	if g, e := len(svc.got), 1; g != e {
+		t.Fatalf("wrong number of pushes: %d != %d", g, e)
+	}
+	got := svc.got[0]
+	if g, e := got.Path, "/push/phone"; g != e {
+		t.Errorf("wrong path: %q != %q", g, e)
+	}
+	if g, e := got.TTL, "3600"; g != e {
+		t.Errorf("wrong TTL: %q != %q", g, e)
+	}
+	if g, e := got.Urgency, "high"; g != e {
+		t.Errorf("wrong urgency: %q != %q", g, e)
+	}
+	if g, e := svc.aud, srv.URL; g != e {
+		t.Errorf("wrong audience: %q != %q", g, e)
+	}
+	var decoded notify.Notification
+	if err := json.Unmarshal(phone.decrypt(t, got.Body), &decoded); err != nil {
+		t.Fatalf("bad payload: %v", err)
+	}
+	if diff := cmp.Diff(n, &decoded); diff != "" {
+		t.Errorf("wrong payload: -want +got\n%s", diff)
+	}
+
+	// the gone subscription was removed
+	if diff := cmp.Diff([]string{srv.URL + "/push/phone"}, endpoints(t, db)); diff != "" {
+		t.Errorf("wrong subscriptions: -want +got\n%s", diff)
+	}
+}
+
+// paths returns the paths pushed to, and forgets them.
+func (p *pushService) paths() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var paths []string
+	for _, got := range p.got {
+		paths = append(paths, got.Path)
+	}
+	p.got = nil
+	return paths
+}
+
+func TestRetryFailed(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	db := database.Scratch()
+	defer db.Close()
+	log := zaptest.NewLogger(t)
+
+	key, err := webpush.VAPIDKey(ctx, db)
+	if err != nil {
+		t.Fatalf("vapid key: %v", err)
+	}
+	svc := &pushService{t: t, key: webpush.PublicKey(key), down: true}
+	srv := httptest.NewTLSServer(svc)
+	defer srv.Close()
+
+	now := time.Date(2020, 2, 3, 4, 5, 6, 0, time.UTC)
+	for _, endpoint := range []string{
+		srv.URL + "/push/phone",
+		srv.URL + "/flaky/laptop",
+	} {
+		if err := webpush.Subscribe(ctx, db, newUserAgent(t).subscription(endpoint), now); err != nil {
+			t.Fatalf("subscribe: %v", err)
+		}
+	}
+	conn := db.Get(nil)
+	err = sqlitex.ExecScript(conn, `
+INSERT INTO honeywell5800_sensors(id, model, description)
+VALUES (1, '5800MINI', 'front door');
+
+INSERT INTO alerts(id, source, sensor, loop, severity, summary, raised, lastSeen)
+VALUES (3, 'trip', 1, 1, 'alarm', 'front door: door or window open', '2020-02-03T04:05:06Z', '2020-02-03T04:05:06Z');
+
+INSERT INTO notify_outbox(id, alert, channel, event, created, nextAttempt)
+VALUES (5, 3, 'push', 'raised', '2020-02-03T04:05:06Z', '2020-02-03T04:05:06Z');
+`)
+	db.Put(conn)
+	if err != nil {
+		t.Fatalf("database error: %v", err)
+	}
+
+	p := &webpush.Push{
+		DB:      db,
+		Log:     log,
+		Subject: "mailto:alarm@example.com",
+		Client:  srv.Client(),
+	}
+	n := &notify.Notification{
+		ID:       5,
+		Alert:    3,
+		Event:    "raised",
+		Time:     now,
+		Source:   "trip",
+		Sensor:   1,
+		Loop:     1,
+		Severity: "alarm",
+		Summary:  "front door: door or window open",
+	}
+	if err := p.Notify(ctx, n); err == nil {
+		t.Fatal("expected an error while the laptop's push service is down")
+	}
+	if diff := cmp.Diff([]string{"/push/phone"}, svc.paths()); diff != "" {
+		t.Errorf("wrong pushes: -want +got\n%s", diff)
+	}
+
+	// the retry only goes to the subscription that failed
+	svc.mu.Lock()
+	svc.down = false
+	svc.mu.Unlock()
+	if err := p.Notify(ctx, n); err != nil {
+		t.Fatalf("notify: %v", err)
+	}
+	if diff := cmp.Diff([]string{"/flaky/laptop"}, svc.paths()); diff != "" {
+		t.Errorf("wrong pushes on retry: -want +got\n%s", diff)
+	}
+	if err := p.Notify(ctx, n); err != nil {
+		t.Fatalf("notify: %v", err)
+	}
+	if g := svc.paths(); len(g) != 0 {
+		t.Errorf("pushed again after everyone had it: %v", g)
+	}
+
+	// other notifications go to everyone
+	n.ID = 0
+	if err := p.Notify(ctx, n); err != nil {
+		t.Fatalf("notify: %v", err)
+	}
+	if diff := cmp.Diff([]string{"/push/phone", "/flaky/laptop"}, svc.paths()); diff != "" {
+		t.Errorf("wrong pushes without outbox id: -want +got\n%s", diff)
+	}
+}
+
+func TestHandler(t *testing.T) {
+	db := database.Scratch()
+	defer db.Close()
+	log := zaptest.NewLogger(t)
+
+	const token = "correct horse battery staple"
+	mux := http.NewServeMux()
+	mux.Handle("/webpush/", http.StripPrefix("/webpush", webpush.Handler(db, log,
+		webpush.Token(token),
+		webpush.Hosts("push.example.com"),
+	)))
+	mux.Handle("/closed/", http.StripPrefix("/closed", webpush.Handler(db, log)))
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "/webpush/key")
+	if err != nil {
+		t.Fatalf("get key: %v", err)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := webpush.VAPIDKey(context.Background(), db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if g, e := string(body), webpush.PublicKey(key); g != e {
+		t.Errorf("wrong key: %q != %q", g, e)
+	}
+
+	send := func(path, auth, method string, sub interface{}) int {
+		t.Helper()
+		buf, err := json.Marshal(sub)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req, err := http.NewRequest(method, srv.URL+path, bytes.NewReader(buf))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if auth != "" {
+			req.Header.Set("Authorization", auth)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("%s subscription: %v", method, err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	request := func(method string, sub interface{}) int {
+		t.Helper()
+		return send("/webpush/subscription", "Bearer "+token, method, sub)
+	}
+	ua := newUserAgent(t)
+	sub := ua.subscription("https://push.example.com/abc")
+
+	if g, e := send("/webpush/subscription", "", http.MethodPost, sub), http.StatusUnauthorized; g != e {
+		t.Errorf("wrong status without token: %d != %d", g, e)
+	}
+	if g, e := send("/webpush/subscription", "Bearer wrong", http.MethodPost, sub), http.StatusUnauthorized; g != e {
+		t.Errorf("wrong status with wrong token: %d != %d", g, e)
+	}
+	if g, e := send("/closed/subscription", "Bearer "+token, http.MethodPost, sub), http.StatusForbidden; g != e {
+		t.Errorf("wrong status when registration is disabled: %d != %d", g, e)
+	}
+	if g := endpoints(t, db); len(g) != 0 {
+		t.Fatalf("unauthorized subscription added: %v", g)
+	}
+
+	if g, e := request(http.MethodPost, sub), http.StatusCreated; g != e {
+		t.Errorf("wrong status: %d != %d", g, e)
+	}
+	if diff := cmp.Diff([]string{"https://push.example.com/abc"}, endpoints(t, db)); diff != "" {
+		t.Errorf("wrong subscriptions: -want +got\n%s", diff)
+	}
+
+	bad := ua.subscription("http://push.example.com/insecure")
+	if g, e := request(http.MethodPost, bad), http.StatusBadRequest; g != e {
+		t.Errorf("wrong status for http endpoint: %d != %d", g, e)
+	}
+	for _, endpoint := range []string{
+		"https://169.254.169.254/latest",
+		"https://push.example.com.evil.example/abc",
+		"https://evilpush.example.com/abc",
+	} {
+		if g, e := request(http.MethodPost, ua.subscription(endpoint)), http.StatusBadRequest; g != e {
+			t.Errorf("wrong status for %q: %d != %d", endpoint, g, e)
+		}
+	}
+	if g, e := request(http.MethodPost, ua.subscription("https://eu.push.example.com/def")), http.StatusCreated; g != e {
+		t.Errorf("wrong status for subdomain: %d != %d", g, e)
+	}
+	if g, e := request(http.MethodDelete, ua.subscription("https://eu.push.example.com/def")), http.StatusNoContent; g != e {
+		t.Errorf("wrong status: %d != %d", g, e)
+	}
+
+	if g, e := request(http.MethodDelete, sub), http.StatusNoContent; g != e {
+		t.Errorf("wrong status: %d != %d", g, e)
+	}
+	if g := endpoints(t, db); len(g) != 0 {
+		t.Errorf("subscription not removed: %v", g)
+	}
+}